@@ -0,0 +1,81 @@
+package httpd
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 访问日志采用Apache的Combined Log Format，并在末尾追加请求的处理耗时(毫秒)，一行代表一个请求：
+// 127.0.0.1 - - [14/Oct/2026:19:30:00 +0800] "GET /index.html HTTP/1.1" 200 1024 "http://example.com/" "curl/7.68.0" 0.215ms
+// 不需要referer、user-agent以及耗时的话，截取每行的前7个字段即为Common Log Format。
+// 使用了RequestIDHandler时，行尾再追加用双引号包裹的请求ID。
+
+// accessLogger 保证多个连接并发写入时每一行的完整
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *accessLogger) log(req *Request, status int, written int64, start time.Time) {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	buf := make([]byte, 0, 256)
+	buf = append(buf, host...)
+	buf = append(buf, " - - ["...)
+	buf = start.AppendFormat(buf, "02/Jan/2006:15:04:05 -0700")
+	buf = append(buf, "] "...)
+	buf = appendQuoted(buf, req.Method+" "+req.RequestURI+" "+req.Proto)
+	buf = append(buf, ' ')
+	if status == 0 {
+		buf = append(buf, '-') // 连接被接管时状态码未知
+	} else {
+		buf = strconv.AppendInt(buf, int64(status), 10)
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, written, 10)
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, req.Header.Get("Referer"))
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, req.Header.Get("User-Agent"))
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, float64(time.Since(start))/float64(time.Millisecond), 'f', 3, 64)
+	buf = append(buf, "ms"...)
+	if req.requestID != "" {
+		buf = append(buf, ' ')
+		buf = appendQuoted(buf, req.requestID)
+	}
+	buf = append(buf, '\n')
+
+	l.mu.Lock()
+	l.w.Write(buf)
+	l.mu.Unlock()
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendQuoted 将s用双引号包裹后追加到buf，空字符串记为"-"。
+// s中的双引号、反斜杠以及控制字符会被转义，防止客户端伪造日志行。
+func appendQuoted(buf []byte, s string) []byte {
+	if s == "" {
+		return append(buf, `"-"`...)
+	}
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,786 @@
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acme.go实现了ACME协议(RFC 8555)的客户端，自动从Let's Encrypt等CA申请、续期证书：
+//  1. 用账户私钥注册账户(同一个私钥重复注册会返回已有的账户)；
+//  2. 为域名创建订单，CA为每个域名返回一个授权，授权中列出了可选的验证方式；
+//  3. 完成其中一种验证，证明我们控制着这个域名：
+//     - http-01：在 http://域名/.well-known/acme-challenge/<token> 上返回keyAuthorization；
+//     - tls-alpn-01：在443端口上，对ALPN为acme-tls/1的握手返回一个包含keyAuthorization摘要的自签名证书；
+//  4. 提交证书签名请求(CSR)，等待订单完成后下载证书链。
+//
+// 所有发往CA的请求都是JWS签名的POST请求，每个请求都要携带CA上一次返回的一次性nonce。
+
+// LetsEncryptURL Let's Encrypt生产环境的ACME目录地址
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	acmeALPNProto     = "acme-tls/1"
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	// acmeAccountFile 账户私钥在CacheDir中的文件名，证书以域名为文件名，不会与它冲突
+	acmeAccountFile = "acme_account.key"
+)
+
+// idPeAcmeIdentifier tls-alpn-01验证证书中携带keyAuthorization摘要的扩展
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// CertManager 通过ACME协议自动为Domains中的域名申请证书，并在过期前续期。
+// 把它设置为Server.AutoCert后，ListenAndServeTLS不再需要证书文件；
+// 使用http-01验证时，还需要在80端口上使用HTTPHandler
+type CertManager struct {
+	// Domains 允许申请证书的域名，客户端的SNI不在其中时握手失败。不能为空，否则任何人都可以让服务器为任意域名申请证书
+	Domains []string
+	// Email 注册账户时提供的联系邮箱，CA会在证书即将过期而没有续期时发送提醒，可以为空
+	Email string
+	// CacheDir 保存账户私钥以及证书的目录，为空时只保存在内存中，每次重启都要重新申请，很快就会触发CA的频率限制
+	CacheDir string
+	// DirectoryURL ACME服务的目录地址，为空时使用LetsEncryptURL。测试时可以使用Let's Encrypt的staging环境
+	DirectoryURL string
+	// RenewBefore 证书到期前多久开始续期，为0时为30天
+	RenewBefore time.Duration
+	// Client 访问ACME服务使用的Client，为nil时使用超时为1分钟的Client
+	Client *Client
+	// ErrorLog 记录续期失败等错误，为nil时使用log包
+	ErrorLog Logger
+	// Prompt 注册账户之前以CA的服务条款(Terms of Service)地址调用，返回true代表同意了条款。
+	// 是否接受条款由使用者决定，为nil或者返回false时不会注册账户，证书申请失败。已经阅读并接受了条款的话可以设置为AcceptTOS
+	Prompt func(tosURL string) bool
+
+	mu    sync.Mutex
+	certs map[string]*acmeCert
+	// 正在进行中的验证，http-01以token为键，tls-alpn-01以域名为键
+	httpTokens map[string]string
+	alpnCerts  map[string]*tls.Certificate
+
+	// acctMu 串行化所有发往CA的请求，nonce以及账户状态都不需要额外的保护
+	acctMu sync.Mutex
+	acct   *acmeClient
+}
+
+// AcceptTOS 总是同意CA的服务条款，设置为CertManager.Prompt即表示使用者接受了条款
+func AcceptTOS(tosURL string) bool {
+	return true
+}
+
+// acmeCert 一个域名的证书，done在第一次获取(读取缓存或者申请)结束后关闭
+type acmeCert struct {
+	done     chan struct{}
+	cert     *tls.Certificate
+	err      error
+	renewing bool
+	retryAt  time.Time // 续期失败后，下一次重试的时间
+}
+
+func (m *CertManager) logf(format string, v ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (m *CertManager) renewBefore() time.Duration {
+	if m.RenewBefore > 0 {
+		return m.RenewBefore
+	}
+	return 30 * 24 * time.Hour
+}
+
+func (m *CertManager) allowed(name string) bool {
+	for _, d := range m.Domains {
+		if strings.EqualFold(d, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate 可以直接作为tls.Config.GetCertificate使用。
+// 证书不存在时在握手过程中申请，客户端需要等待几秒；即将过期时在后台续期，续期完成前继续使用旧证书
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, errors.New("acme: missing server name")
+	}
+	for _, proto := range hello.SupportedProtos {
+		if proto == acmeALPNProto {
+			m.mu.Lock()
+			cert := m.alpnCerts[name]
+			m.mu.Unlock()
+			if cert == nil {
+				return nil, errors.New("acme: no tls-alpn-01 challenge for " + name)
+			}
+			return cert, nil
+		}
+	}
+	if !m.allowed(name) {
+		return nil, errors.New("acme: host " + strconv.Quote(name) + " not configured")
+	}
+
+	m.mu.Lock()
+	if m.certs == nil {
+		m.certs = make(map[string]*acmeCert)
+	}
+	st, ok := m.certs[name]
+	if !ok {
+		st = &acmeCert{done: make(chan struct{})}
+		m.certs[name] = st
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		// 申请证书与握手解耦，客户端放弃握手不会中断申请，其他等待的握手仍然可以用上
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		st.cert, st.err = m.loadOrObtain(ctx, name)
+		cancel()
+		if st.err != nil {
+			m.mu.Lock()
+			delete(m.certs, name)
+			m.mu.Unlock()
+		}
+		close(st.done)
+	}
+	<-st.done
+	if st.err != nil {
+		return nil, st.err
+	}
+
+	m.mu.Lock()
+	cert := st.cert
+	now := time.Now()
+	if !st.renewing && now.After(st.retryAt) && now.Add(m.renewBefore()).After(cert.Leaf.NotAfter) {
+		st.renewing = true
+		go m.renew(name, st)
+	}
+	m.mu.Unlock()
+	return cert, nil
+}
+
+func (m *CertManager) renew(name string, st *acmeCert) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	cert, err := m.obtain(ctx, name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st.renewing = false
+	if err != nil {
+		st.retryAt = time.Now().Add(time.Hour)
+		m.logf("httpd: acme: renewing certificate for %s: %v", name, err)
+		return
+	}
+	st.cert = cert
+}
+
+func (m *CertManager) loadOrObtain(ctx context.Context, name string) (*tls.Certificate, error) {
+	if cert, err := m.loadCert(name); err == nil {
+		return cert, nil
+	}
+	return m.obtain(ctx, name)
+}
+
+// loadCert 从CacheDir读取证书，已经过期的视为不存在
+func (m *CertManager) loadCert(name string) (*tls.Certificate, error) {
+	if m.CacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(m.CacheDir, name))
+	if err != nil {
+		return nil, err
+	}
+	var keyPEM, certPEM []byte
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		if strings.HasSuffix(b.Type, "PRIVATE KEY") {
+			keyPEM = pem.EncodeToMemory(b)
+		} else {
+			certPEM = append(certPEM, pem.EncodeToMemory(b)...)
+		}
+	}
+	return parseCertPEM(certPEM, keyPEM)
+}
+
+func parseCertPEM(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, errors.New("acme: certificate expired")
+	}
+	return &cert, nil
+}
+
+// writeCache 原子地写入CacheDir，写到一半进程退出也不会留下损坏的文件
+func (m *CertManager) writeCache(name string, data []byte) error {
+	if m.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.CacheDir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.CacheDir, name))
+}
+
+// obtain 向CA申请证书。先尝试tls-alpn-01，失败后再尝试http-01，每种验证方式都使用新的订单
+func (m *CertManager) obtain(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.acctMu.Lock()
+	defer m.acctMu.Unlock()
+	a, err := m.account(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, typ := range []string{"tls-alpn-01", "http-01"} {
+		var cert *tls.Certificate
+		if cert, err = m.tryObtain(ctx, a, name, typ); err == nil {
+			return cert, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// account 读取或生成账户私钥并注册账户，调用方持有acctMu
+func (m *CertManager) account(ctx context.Context) (*acmeClient, error) {
+	if m.acct != nil {
+		return m.acct, nil
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	c := m.Client
+	if c == nil {
+		c = &Client{Timeout: time.Minute}
+	}
+	dirURL := m.DirectoryURL
+	if dirURL == "" {
+		dirURL = LetsEncryptURL
+	}
+	if m.Prompt == nil {
+		return nil, errors.New("acme: terms of service not accepted, set CertManager.Prompt")
+	}
+	a := &acmeClient{c: c, key: key}
+	if err = a.get(ctx, dirURL, &a.dir); err != nil {
+		return nil, err
+	}
+	if !m.Prompt(a.dir.Meta.TermsOfService) {
+		return nil, errors.New("acme: terms of service " + a.dir.Meta.TermsOfService + " not accepted")
+	}
+	reg := map[string]interface{}{"termsOfServiceAgreed": true}
+	if m.Email != "" {
+		reg["contact"] = []string{"mailto:" + m.Email}
+	}
+	h, err := a.post(ctx, a.dir.NewAccount, reg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.kid = h.Get("Location"); a.kid == "" {
+		return nil, errors.New("acme: missing account location")
+	}
+	m.acct = a
+	return a, nil
+}
+
+func (m *CertManager) accountKey() (*ecdsa.PrivateKey, error) {
+	if m.CacheDir != "" {
+		if data, err := ioutil.ReadFile(filepath.Join(m.CacheDir, acmeAccountFile)); err == nil {
+			if b, _ := pem.Decode(data); b != nil {
+				return x509.ParseECPrivateKey(b.Bytes)
+			}
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.writeCache(acmeAccountFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+func (m *CertManager) tryObtain(ctx context.Context, a *acmeClient, name, typ string) (*tls.Certificate, error) {
+	var order acmeOrder
+	req := map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": name}},
+	}
+	h, err := a.post(ctx, a.dir.NewOrder, req, &order)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := h.Get("Location")
+
+	for _, authzURL := range order.Authorizations {
+		if err = m.authorize(ctx, a, authzURL, name, typ); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = a.post(ctx, order.Finalize, map[string]string{"csr": acmeBase64(csr)}, &order); err != nil {
+		return nil, err
+	}
+	// 签发可能是异步的，订单状态为processing时需要轮询
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			return nil, order.Error.orElse("acme: order for " + name + " is invalid")
+		}
+		if err = acmeSleep(ctx, h); err != nil {
+			return nil, err
+		}
+		if h, err = a.post(ctx, orderURL, nil, &order); err != nil {
+			return nil, err
+		}
+	}
+
+	a.accept = "application/pem-certificate-chain"
+	certPEM, err := a.postRaw(ctx, order.Certificate, nil)
+	a.accept = ""
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := parseCertPEM(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.writeCache(name, append(keyPEM, certPEM...)); err != nil {
+		m.logf("httpd: acme: caching certificate for %s: %v", name, err)
+	}
+	return cert, nil
+}
+
+// authorize 完成一个授权的验证，授权已经有效(如最近为同一个域名验证过)时直接返回
+func (m *CertManager) authorize(ctx context.Context, a *acmeClient, authzURL, name, typ string) error {
+	var authz acmeAuthorization
+	h, err := a.post(ctx, authzURL, nil, &authz)
+	if err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	var ch *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == typ {
+			ch = &authz.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return errors.New("acme: no " + typ + " challenge for " + name)
+	}
+	keyAuth := ch.Token + "." + a.thumbprint()
+	if typ == "http-01" {
+		m.setHTTPToken(ch.Token, keyAuth)
+		defer m.setHTTPToken(ch.Token, "")
+	} else {
+		cert, err := acmeALPNCert(name, keyAuth)
+		if err != nil {
+			return err
+		}
+		m.setALPNCert(name, cert)
+		defer m.setALPNCert(name, nil)
+	}
+
+	// 通知CA验证已经就绪，然后轮询授权的状态
+	if _, err = a.post(ctx, ch.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	for {
+		if err = acmeSleep(ctx, h); err != nil {
+			return err
+		}
+		if h, err = a.post(ctx, authzURL, nil, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, c := range authz.Challenges {
+			if c.Type == typ && c.Error != nil {
+				return c.Error
+			}
+		}
+		return errors.New("acme: authorization for " + name + " is " + authz.Status)
+	}
+}
+
+func (m *CertManager) setHTTPToken(token, keyAuth string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if keyAuth == "" {
+		delete(m.httpTokens, token)
+		return
+	}
+	if m.httpTokens == nil {
+		m.httpTokens = make(map[string]string)
+	}
+	m.httpTokens[token] = keyAuth
+}
+
+func (m *CertManager) setALPNCert(name string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cert == nil {
+		delete(m.alpnCerts, name)
+		return
+	}
+	if m.alpnCerts == nil {
+		m.alpnCerts = make(map[string]*tls.Certificate)
+	}
+	m.alpnCerts[name] = cert
+}
+
+// acmeALPNCert 生成tls-alpn-01验证使用的自签名证书，keyAuthorization的摘要放在关键扩展id-pe-acmeIdentifier中
+func acmeALPNCert(name, keyAuth string) (*tls.Certificate, error) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:       now.Add(-time.Hour),
+		NotAfter:        now.Add(24 * time.Hour),
+		DNSNames:        []string{name},
+		ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// HTTPHandler 返回一个回应http-01验证的Handler，应当在80端口上使用。
+// 其他请求交给fallback处理，fallback为nil时重定向到https
+func (m *CertManager) HTTPHandler(fallback Handler) Handler {
+	return &acmeHTTPHandler{m: m, fallback: fallback}
+}
+
+type acmeHTTPHandler struct {
+	m        *CertManager
+	fallback Handler
+}
+
+func (h *acmeHTTPHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		fallback := h.fallback
+		if fallback == nil {
+			fallback = RedirectToHTTPSHandler("")
+		}
+		fallback.ServeHTTP(w, r)
+		return
+	}
+	h.m.mu.Lock()
+	keyAuth, ok := h.m.httpTokens[r.URL.Path[len(acmeChallengePath):]]
+	h.m.mu.Unlock()
+	if !ok {
+		NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
+
+// acmeProblem 是CA返回的错误(RFC 7807 problem document)
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return "acme: " + p.Detail + " (" + p.Type + ")"
+}
+
+func (p *acmeProblem) orElse(msg string) error {
+	if p != nil {
+		return p
+	}
+	return errors.New(msg)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	Meta       struct {
+		TermsOfService string `json:"termsOfService"`
+	} `json:"meta"`
+}
+
+// acmeClient 以一个账户的身份向CA发送签名的请求
+type acmeClient struct {
+	c      *Client
+	key    *ecdsa.PrivateKey
+	kid    string // 账户的url，注册之前为空，此时请求中携带公钥本身
+	dir    acmeDirectory
+	nonce  string
+	accept string // 下一个请求的Accept首部
+}
+
+func (a *acmeClient) get(ctx context.Context, url string, out interface{}) error {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	_, body, err := a.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// post 发送签名的请求，payload为nil时是POST-as-GET，用于读取订单、授权等资源。
+// 响应的报文主体解析到out中，返回响应首部
+func (a *acmeClient) post(ctx context.Context, url string, payload, out interface{}) (Header, error) {
+	var p []byte
+	if payload != nil {
+		var err error
+		if p, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	h, body, err := a.postWithRetry(ctx, url, p)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		if err = json.Unmarshal(body, out); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (a *acmeClient) postRaw(ctx context.Context, url string, payload []byte) ([]byte, error) {
+	_, body, err := a.postWithRetry(ctx, url, payload)
+	return body, err
+}
+
+// postWithRetry CA认为nonce无效时会返回badNonce，同时在响应中附带一个新的nonce，这时重试一次即可
+func (a *acmeClient) postWithRetry(ctx context.Context, url string, payload []byte) (Header, []byte, error) {
+	for retry := 0; ; retry++ {
+		if a.nonce == "" {
+			if err := a.fetchNonce(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		jws, err := a.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := NewRequest("POST", url, bytes.NewReader(jws))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		if a.accept != "" {
+			req.Header.Set("Accept", a.accept)
+		}
+		h, body, err := a.do(req.WithContext(ctx))
+		if p, ok := err.(*acmeProblem); ok && p.Type == "urn:ietf:params:acme:error:badNonce" && retry == 0 {
+			continue
+		}
+		return h, body, err
+	}
+}
+
+func (a *acmeClient) fetchNonce(ctx context.Context) error {
+	req, err := NewRequest("HEAD", a.dir.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	if _, _, err = a.do(req.WithContext(ctx)); err != nil {
+		return err
+	}
+	if a.nonce == "" {
+		return errors.New("acme: missing Replay-Nonce")
+	}
+	return nil
+}
+
+// do 发送请求并读取整个响应，保存响应中的nonce供下一个请求使用，4xx、5xx响应转换为acmeProblem
+func (a *acmeClient) do(req *Request) (Header, []byte, error) {
+	resp, err := a.c.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		a.nonce = n
+	}
+	if resp.StatusCode >= 400 {
+		p := &acmeProblem{Status: resp.StatusCode}
+		if json.Unmarshal(body, p) != nil || p.Detail == "" {
+			p.Detail = resp.Status
+		}
+		return nil, nil, p
+	}
+	return resp.Header, body, nil
+}
+
+// acmeJWK 账户公钥的JWK表示，字段按字典序排列，json.Marshal的结果就是计算指纹所需的规范形式
+type acmeJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *acmeClient) jwk() acmeJWK {
+	var x, y [32]byte
+	a.key.X.FillBytes(x[:])
+	a.key.Y.FillBytes(y[:])
+	return acmeJWK{Crv: "P-256", Kty: "EC", X: acmeBase64(x[:]), Y: acmeBase64(y[:])}
+}
+
+// thumbprint 账户公钥的指纹(RFC 7638)，keyAuthorization由token与它拼接而成
+func (a *acmeClient) thumbprint() string {
+	b, _ := json.Marshal(a.jwk())
+	sum := sha256.Sum256(b)
+	return acmeBase64(sum[:])
+}
+
+// sign 生成flattened JSON形式的JWS，使用ES256签名，签名为r与s各32字节的拼接
+func (a *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	protected := map[string]interface{}{"alg": "ES256", "nonce": a.nonce, "url": url}
+	if a.kid != "" {
+		protected["kid"] = a.kid
+	} else {
+		protected["jwk"] = a.jwk()
+	}
+	a.nonce = "" // nonce只能使用一次
+	pb, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	p64, pl64 := acmeBase64(pb), acmeBase64(payload)
+	digest := sha256.Sum256([]byte(p64 + "." + pl64))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	var sig [64]byte
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{"protected": p64, "payload": pl64, "signature": acmeBase64(sig[:])})
+}
+
+func acmeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// acmeSleep 按照Retry-After等待下一次轮询，没有时等待1秒
+func acmeSleep(ctx context.Context, h Header) error {
+	d := time.Second
+	if n, err := strconv.Atoi(h.Get("Retry-After")); err == nil && n > 0 {
+		d = time.Duration(n) * time.Second
+		if d > time.Minute {
+			d = time.Minute
+		}
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,55 @@
+package httpd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strconv"
+)
+
+// basicauth.go实现了Basic认证(RFC 7617)：客户端在Authorization首部中携带 Basic base64(username:password)，
+// 没有携带或者凭证错误时服务器回复401，并通过WWW-Authenticate首部要求浏览器弹出登录框。
+// Basic认证以明文传输密码，应当只在https上使用。
+
+// BasicAuth 解析Authorization首部中的Basic认证，格式错误或者不是Basic认证时ok为false
+func (r *Request) BasicAuth() (username, password string, ok bool) {
+	return parseBasicAuth(r.Header.Get("Authorization"))
+}
+
+// BasicAuth 返回一个要求Basic认证的中间件，validate校验用户名与密码，
+// 没有凭证或者validate返回false时回复401。realm为空时使用"Restricted"。
+// 固定的账号可以使用BasicAuthUsers构造validate：
+//
+//	admin := httpd.BasicAuth("admin", httpd.BasicAuthUsers(map[string]string{"root": "secret"}))
+//	mux.Handle("/admin/", admin(adminHandler))
+func BasicAuth(realm string, validate func(username, password string) bool) Middleware {
+	if realm == "" {
+		realm = "Restricted"
+	}
+	challenge := "Basic realm=" + strconv.Quote(realm) + `, charset="UTF-8"`
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if user, pass, ok := r.BasicAuth(); ok && validate(user, pass) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			Error(w, "401 Unauthorized", StatusUnauthorized)
+		})
+	}
+}
+
+// BasicAuthUsers 返回一个按照users(用户名到密码)校验凭证的函数。
+// 比较的是用户名与密码的sha256摘要，耗时与输入无关，不会通过响应时间泄露正确的用户名或者密码
+func BasicAuthUsers(users map[string]string) func(username, password string) bool {
+	type digest [sha256.Size]byte
+	accounts := make(map[digest]digest, len(users))
+	for user, pass := range users {
+		accounts[sha256.Sum256([]byte(user))] = sha256.Sum256([]byte(pass))
+	}
+	return func(username, password string) bool {
+		want, ok := accounts[sha256.Sum256([]byte(username))]
+		got := sha256.Sum256([]byte(password))
+		// 用户名不存在时同样进行一次比较，保持耗时一致
+		return subtle.ConstantTimeCompare(got[:], want[:]) == 1 && ok
+	}
+}
@@ -0,0 +1,56 @@
+package httpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// 服务端请求的Body只能读取一次，反向代理在复用的上游连接失效时需要重新发送报文主体，
+// 多个中间件也可能都要读取报文主体(如签名校验之后再解析json)。
+// BufferBody把报文主体读入内存并设置GetBody，之后的读取者都可以通过GetBody重新得到完整的报文主体：
+//
+//	mux.Handle("/api/", httpd.BufferRequestBody(1<<20)(proxy))
+
+// BufferBody 把报文主体全部读入内存，Body替换为读取内存副本的Reader，并设置GetBody。
+// 报文主体超过maxBytes(不大于0时使用DefaultMaxDecodeBytes)时返回ErrBodyTooLarge，此时Body已经不完整了。
+// GetBody不为nil时认为报文主体已经可以重新读取，直接返回
+func (r *Request) BufferBody(maxBytes int64) error {
+	if r.GetBody != nil {
+		return nil
+	}
+	if !requestHasBody(r) {
+		r.GetBody = func() (io.Reader, error) { return &eofReader{}, nil }
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxDecodeBytes
+	}
+	data, err := ioutil.ReadAll(&maxBytesReader{r: r.Body, n: maxBytes})
+	if err != nil {
+		return err
+	}
+	r.Body = bytes.NewReader(data)
+	r.GetBody = func() (io.Reader, error) {
+		return bytes.NewReader(data), nil
+	}
+	return nil
+}
+
+// BufferRequestBody 返回一个在调用下游handler之前执行BufferBody的中间件，
+// 报文主体超过maxBytes时回复413，读取出错时回复400
+func BufferRequestBody(maxBytes int64) Middleware {
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if err := r.BufferBody(maxBytes); err != nil {
+				if err == ErrBodyTooLarge {
+					Error(w, "413 request entity too large", StatusRequestEntityTooLarge)
+				} else {
+					Error(w, "400 bad request", StatusBadRequest)
+				}
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certreload.go负责在不重启服务器的情况下更换证书文件：cert-manager、certbot这类工具定期把续期后的证书写到同一个路径，
+// 设置了Server.CertReloadInterval时定期检查证书与私钥文件是否被修改，修改了就重新加载；
+// 也可以在收到信号时调用Server.ReloadCertificates：
+//
+//	ch := make(chan os.Signal, 1)
+//	signal.Notify(ch, syscall.SIGHUP)
+//	for range ch {
+//		if err := srv.ReloadCertificates(); err != nil {
+//			log.Println("reloading certificates:", err)
+//		}
+//	}
+//
+// 新证书只用于之后的握手，已经建立的连接不受影响。新的文件无法加载(如证书与私钥只更新了一个)时继续使用旧证书。
+
+// certStore 持有从文件加载的证书以及TLSConfig中静态配置的证书，重新加载时整体替换
+type certStore struct {
+	certFile, keyFile string
+	static            []tls.Certificate // TLSConfig.Certificates，排在文件中的证书之前
+
+	mu      sync.Mutex // 串行化加载
+	certMod fileStamp
+	keyMod  fileStamp
+	index   atomic.Value // *certIndex
+}
+
+type certIndex struct {
+	sni *sniCertificates
+	def *tls.Certificate // 客户端没有发送SNI或者没有匹配的证书时使用，与crypto/tls一样取第一个证书
+}
+
+// fileStamp 文件的修改时间以及大小，任何一个变化都认为文件被修改了
+type fileStamp struct {
+	modtime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStamp, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+func newCertStore(certFile, keyFile string, static []tls.Certificate) (*certStore, error) {
+	cs := &certStore{certFile: certFile, keyFile: keyFile, static: static}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// load 读取证书文件并替换当前的证书，失败时保留原来的证书
+func (cs *certStore) load() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// 先记录文件的状态再读取，读取期间文件又被修改的话，下一次检查还能发现
+	// 加载失败时同样记录，文件没有再次变化之前watchCertificates不会反复重试
+	cs.certMod, _ = statFile(cs.certFile)
+	cs.keyMod, _ = statFile(cs.keyFile)
+	cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return err
+	}
+	certs := make([]tls.Certificate, 0, len(cs.static)+1)
+	certs = append(append(certs, cs.static...), cert)
+	sni, err := newSNICertificates(certs)
+	if err != nil {
+		return err
+	}
+	cs.index.Store(&certIndex{sni: sni, def: &certs[0]})
+	return nil
+}
+
+// modified 证书或者私钥文件是否在上一次加载之后被修改过
+func (cs *certStore) modified() bool {
+	certMod, err := statFile(cs.certFile)
+	if err != nil {
+		return false
+	}
+	keyMod, err := statFile(cs.keyFile)
+	if err != nil {
+		return false
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return certMod != cs.certMod || keyMod != cs.keyMod
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	idx := cs.index.Load().(*certIndex)
+	if cert := idx.sni.get(hello); cert != nil {
+		return cert, nil
+	}
+	return idx.def, nil
+}
+
+// watchCertificates 每隔interval检查一次文件，修改了就重新加载，服务器关闭或者开始Shutdown时退出
+func (s *Server) watchCertificates(cs *certStore, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	done, shutdown := s.baseContext().Done(), s.shutdownChan()
+	for {
+		select {
+		case <-t.C:
+		case <-done:
+			return
+		case <-shutdown:
+			return
+		}
+		if !cs.modified() {
+			continue
+		}
+		if err := cs.load(); err != nil {
+			s.logf("httpd: reloading certificate %s: %v", cs.certFile, err)
+		}
+	}
+}
+
+// ReloadCertificates 重新加载ListenAndServeTLS以及ServeTLS的certFile与keyFile，
+// 返回遇到的第一个错误，加载失败的证书保持不变
+func (s *Server) ReloadCertificates() error {
+	s.mu.Lock()
+	stores := s.certStores
+	s.mu.Unlock()
+	var err error
+	for _, cs := range stores {
+		if e := cs.load(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -2,7 +2,7 @@ package httpd
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
 	"io"
 	"strconv"
 )
@@ -41,15 +41,46 @@ import (
 
 // 所以我们的chunkReader还需要具有解码chunk的功能，保证用户调用到的Read方法只读到有效载荷(chunk data)：hello, this is chunked data sent by client!。
 
+// chunk size后面还可以跟随chunk扩展，如 1a;name=value\r\n，我们不关心扩展的内容，直接丢弃即可。
+// 最后一个chunk(chunk size为0)之后，在结束的\r\n之前还可以携带trailer，格式与首部字段一致：
+// 0\r\n
+// Checksum: 8f2e...\r\n
+// \r\n
+// trailer会被解析到Request.Trailer中，读取完trailer之后Body才会返回io.EOF。
+
 type chunkReader struct {
 	n    int // 当前处理的块中还有多少字节未读
 	bufr *bufio.Reader
 
-	done bool    // 是否读取完成
-	crlf [2]byte // 读取\r\n
+	done    bool    // 是否读取完成
+	crlf    [2]byte // 读取\r\n
+	trailer Header  // 用于存放trailer，为nil时丢弃trailer
+
+	// 服务端读取请求时的限制，取自Server的同名配置，为0时不限制
+	maxChunkSize int
+	maxBytes     int64
+	maxChunks    int
+	maxLineBytes int   // chunk大小所在的行(包括chunk扩展)以及全部trailer的最大字节数
+	total        int64 // 目前为止所有chunk声明的字节数
+	chunks       int   // 目前为止读到的chunk数
+	// err 解码过程中遇到的第一个错误，之后的读取都返回它。格式错误之后读到的内容已经不可信了，
+	// 如果继续解析，错误的CRLF之后的内容会被当作下一个chunk，错误的trailer之后会返回io.EOF，
+	// 报文主体剩下的部分就会被当成同一个连接上的下一个请求(请求走私)
+	err error
 }
 
 func (cr *chunkReader) Read(p []byte) (n int, err error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err = cr.read(p)
+	if err != nil && err != io.EOF {
+		cr.err = err
+	}
+	return
+}
+
+func (cr *chunkReader) read(p []byte) (n int, err error) {
 	// 报文主体读取完后，不允许再读
 	if cr.done {
 		return 0, io.EOF
@@ -61,36 +92,77 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 		if err != nil {
 			return
 		}
+		if cr.n > 0 {
+			if err = cr.checkLimits(cr.n); err != nil {
+				cr.n = 0
+				return 0, err
+			}
+		}
+		if cr.n == 0 { // 获取到的chunkSize为0，说明读到了chunk报文结尾
+			cr.done = true
+			// 将trailer以及最后的CRLF消费掉，防止影响下一个http报文的解析
+			if err = cr.readTrailer(); err != nil {
+				return
+			}
+			return 0, io.EOF
+		}
 	}
 
-	if cr.n == 0 { // 获取到的chunkSize为0，说明读到了chunk报文结尾
-		cr.done = true
-		err = cr.discardCRLF() //将最后的CRLF消费掉，防止影响下一个http报文的解析
-		return
+	if len(p) > cr.n {
+		p = p[:cr.n]
 	}
-	//如果当前块剩余的数据大于欲读取的长度
-	if len(p) <= cr.n {
-		n, err = cr.bufr.Read(p)
-		cr.n -= n
-		return n, err
+	n, err = cr.bufr.Read(p)
+	cr.n -= n
+	if err == io.EOF {
+		// chunk data还没读完，连接就断开了
+		return n, io.ErrUnexpectedEOF
 	}
-
-	//如果当前块剩余的数据不够欲读取的长度，将剩余的数据全部取出返回
-	n, _ = io.ReadFull(cr.bufr, p[:cr.n])
-	cr.n = 0
-	//记得把每个chunkData后的\r\n消费掉
-	if err = cr.discardCRLF(); err != nil {
-		return
+	if err == nil && cr.n == 0 {
+		//记得把每个chunkData后的\r\n消费掉
+		err = cr.discardCRLF()
 	}
 	return
 }
 
+// checkLimits 在读取chunk data之前根据声明的大小检查限制，客户端不需要真的发送这么多数据就能被拒绝。
+// 超出chunk数的上限是在滥用编码格式，回复400；其余的回复413
+func (cr *chunkReader) checkLimits(size int) error {
+	cr.chunks++
+	cr.total += int64(size)
+	if cr.maxChunks > 0 && cr.chunks > cr.maxChunks {
+		return badRequestError("too many chunks in request body")
+	}
+	if cr.maxChunkSize > 0 && size > cr.maxChunkSize {
+		return ErrBodyTooLarge
+	}
+	if cr.maxBytes > 0 && cr.total > cr.maxBytes {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
 func (cr *chunkReader) getChunkSize() (chunkSize int, err error) {
-	line, err := readLine(cr.bufr)
+	line, err := readLineLimit(cr.bufr, cr.maxLineBytes)
+	if err == errLineTooLong {
+		// 不加限制的话，客户端可以在chunk扩展中塞入任意多的数据，它们在checkLimits之前就被读入了内存
+		return 0, badRequestError("chunk size line too long")
+	}
 	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return
 	}
 
+	// 去掉chunk扩展
+	if index := bytes.IndexByte(line, ';'); index != -1 {
+		line = line[:index]
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return 0, badRequestError("empty chunk size")
+	}
+
 	//将16进制换算成10进制
 	// for i := 0; i < len(line); i++ {
 	// 	switch {
@@ -104,19 +176,42 @@ func (cr *chunkReader) getChunkSize() (chunkSize int, err error) {
 	// 		return 0, errors.New("illegal hex number")
 	// 	}
 	// }
-	chunkSizeInt64, err := strconv.ParseInt(string(line), 16, 64)
+	// ParseUint不接受正负号，同时限制在int能够表示的范围内
+	chunkSizeUint, err := strconv.ParseUint(string(line), 16, 31)
 	if err != nil {
-		return 0, err
+		return 0, badRequestError("illegal chunk size " + strconv.Quote(string(line)))
 	}
 
-	return int(chunkSizeInt64), nil
+	return int(chunkSizeUint), nil
+}
+
+// readTrailer 读取最后一个chunk之后的trailer，直到遇到空行
+func (cr *chunkReader) readTrailer() error {
+	trailer, err := readHeaderLimit(cr.bufr, cr.maxLineBytes)
+	if err == errLineTooLong {
+		return ErrHeaderTooLarge
+	}
+	if err != nil {
+		return err
+	}
+	if cr.trailer == nil {
+		return nil
+	}
+	for k, vs := range trailer {
+		cr.trailer[k] = append(cr.trailer[k], vs...)
+	}
+	return nil
 }
 
 func (cr *chunkReader) discardCRLF() (err error) {
 	if _, err = io.ReadFull(cr.bufr, cr.crlf[:]); err == nil {
 		if cr.crlf[0] != '\r' || cr.crlf[1] != '\n' {
-			return errors.New("unsupported encoding format of chunk")
+			return badRequestError("missing CRLF after chunk data")
 		}
 	}
+	if err == io.EOF {
+		// 连接在chunk data之后断开了，不能当作报文主体正常结束
+		err = io.ErrUnexpectedEOF
+	}
 	return
 }
@@ -0,0 +1,56 @@
+package httpd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// 格式错误之后，chunkReader的每一次读取都要返回同一个错误，不能在之后返回io.EOF，
+// 否则报文主体剩下的部分会被当成下一个请求
+func TestChunkReaderStickyError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"folded trailer", "0\r\n\tfold\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+		{"bad CRLF after chunk data", "3\r\nabcXX3\r\ndef\r\n0\r\n\r\nGET /next HTTP/1.1\r\nHost: x\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &chunkReader{bufr: bufio.NewReader(strings.NewReader(tt.body))}
+			_, err := ioutil.ReadAll(cr)
+			if _, ok := err.(badRequestError); !ok {
+				t.Fatalf("ReadAll error = %v, want badRequestError", err)
+			}
+			for i := 0; i < 3; i++ {
+				if n, err2 := cr.Read(make([]byte, 16)); n != 0 || err2 != err {
+					t.Fatalf("Read after error = %d, %v; want 0, %v", n, err2, err)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	trailer := make(Header)
+	cr := &chunkReader{
+		bufr:    bufio.NewReader(strings.NewReader("5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: 1\r\n\r\nnext")),
+		trailer: trailer,
+	}
+	b, err := ioutil.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("body = %q", b)
+	}
+	if got := trailer.Get("X-Sum"); got != "1" {
+		t.Errorf("trailer X-Sum = %q", got)
+	}
+	rest, _ := ioutil.ReadAll(cr.bufr)
+	if string(rest) != "next" {
+		t.Errorf("left over = %q, want %q", rest, "next")
+	}
+}
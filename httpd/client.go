@@ -0,0 +1,290 @@
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client.go是http客户端的实现：把Request序列化后写入tcp连接，再用ReadResponse解析出响应。
+// 连接的建立与复用由Transport负责。
+
+// Client 发送http请求，零值即可直接使用，多个goroutine可以并发使用同一个Client
+type Client struct {
+	// Timeout 整个请求的超时时间，包括建立连接、发送请求、读取响应的首部以及报文主体，为0时不限制
+	Timeout time.Duration
+
+	// Transport 负责建立连接以及发送请求，为nil时使用DefaultTransport
+	Transport RoundTripper
+
+	// Jar 保存响应中的Set-Cookie，并为之后的请求添加匹配的cookie，为nil时忽略所有cookie
+	Jar CookieJar
+
+	// CheckRedirect 在跟随每一次重定向之前调用，req为即将发送的请求，via为之前已经发送的请求，最早的在前。
+	// 返回错误时停止跟随，Do返回这个错误；返回ErrUseLastResponse时Do返回最后一个响应，且其Body未被读取。
+	// 为nil时最多跟随10次重定向
+	CheckRedirect func(req *Request, via []*Request) error
+}
+
+// ErrUseLastResponse CheckRedirect返回它时，Client不再跟随重定向，而是直接返回最后收到的3xx响应
+var ErrUseLastResponse = errors.New("httpd: use last response")
+
+// maxRedirects 没有设置CheckRedirect时最多跟随的重定向次数
+const maxRedirects = 10
+
+// DefaultClient Get、Post等包级函数使用的Client
+var DefaultClient = &Client{}
+
+// NewRequest 构造一个客户端请求，url必须是http或https的绝对地址。
+// body为*bytes.Buffer、*bytes.Reader或*strings.Reader时会自动设置ContentLength，
+// 其他类型的body长度未知，发送时使用chunk编码。
+func NewRequest(method, rawurl string, body io.Reader) (*Request, error) {
+	if method == "" {
+		method = "GET"
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		Method: method,
+		URL:    u,
+		Proto:  "HTTP/1.1",
+		Header: make(Header),
+		Host:   u.Host,
+		Body:   body,
+	}
+	switch v := body.(type) {
+	case nil:
+	case *bytes.Buffer:
+		req.ContentLength = int64(v.Len())
+		buf := v.Bytes()
+		req.GetBody = func() (io.Reader, error) {
+			return bytes.NewReader(buf), nil
+		}
+	case *bytes.Reader:
+		req.ContentLength = int64(v.Len())
+		snapshot := *v
+		req.GetBody = func() (io.Reader, error) {
+			r := snapshot
+			return &r, nil
+		}
+	case *strings.Reader:
+		req.ContentLength = int64(v.Len())
+		snapshot := *v
+		req.GetBody = func() (io.Reader, error) {
+			r := snapshot
+			return &r, nil
+		}
+	default:
+		req.ContentLength = -1
+	}
+	return req, nil
+}
+
+// Get 使用DefaultClient发送GET请求
+func Get(url string) (*Response, error) {
+	return DefaultClient.Get(url)
+}
+
+// Post 使用DefaultClient发送POST请求
+func Post(url, contentType string, body io.Reader) (*Response, error) {
+	return DefaultClient.Post(url, contentType, body)
+}
+
+func (c *Client) Get(url string) (*Response, error) {
+	req, err := NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *Client) Post(url, contentType string, body io.Reader) (*Response, error) {
+	req, err := NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do 发送请求并返回响应。只要err为nil，调用方读取完毕后都必须关闭resp.Body，连接才能被复用。
+// 非2xx的状态码不会被当作错误。请求的Context被取消或者超过Timeout时，正在进行的请求会被中断，
+// Timeout覆盖跟随重定向的全过程。
+//
+// 301、302、303、307、308响应会按照CheckRedirect的策略自动跟随：
+// 303以及对非GET、HEAD请求的301、302改为不带报文主体的GET请求；
+// 307、308保持原来的方法以及报文主体，请求带有报文主体却没有GetBody时直接返回重定向响应。
+func (c *Client) Do(req *Request) (*Response, error) {
+	if c.Timeout <= 0 {
+		return c.do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), c.Timeout)
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{rc: resp.Body, ctx: ctx, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) do(req *Request) (*Response, error) {
+	var via []*Request
+	for {
+		resp, err := c.send(req)
+		if err != nil {
+			return nil, err
+		}
+		next, err := c.redirectRequest(req, resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if next == nil {
+			return resp, nil
+		}
+		via = append(via, req)
+		if err = c.checkRedirect(next, via); err != nil {
+			if err == ErrUseLastResponse {
+				return resp, nil
+			}
+			resp.Body.Close()
+			return nil, err
+		}
+		// 读完剩余的报文主体，连接才能回到空闲池被下一个请求复用；太长的话不如直接关闭连接
+		io.CopyN(io.Discard, resp.Body, 2<<10)
+		resp.Body.Close()
+		req = next
+	}
+}
+
+func (c *Client) checkRedirect(req *Request, via []*Request) error {
+	if c.CheckRedirect != nil {
+		return c.CheckRedirect(req, via)
+	}
+	if len(via) >= maxRedirects {
+		return errors.New("httpd: stopped after " + strconv.Itoa(maxRedirects) + " redirects")
+	}
+	return nil
+}
+
+// redirectRequest 根据重定向响应构造下一个请求，不需要或者无法跟随时返回nil
+func (c *Client) redirectRequest(req *Request, resp *Response) (*Request, error) {
+	method, body, getBody, contentLength := req.Method, req.Body, req.GetBody, req.ContentLength
+	switch resp.StatusCode {
+	case StatusMovedPermanently, StatusFound, StatusSeeOther:
+		// 浏览器一直以来都把301、302的POST改成GET，RFC 7231也承认了这种做法
+		if method != "GET" && method != "HEAD" {
+			method = "GET"
+		}
+		body, getBody, contentLength = nil, nil, 0
+	case StatusTemporaryRedirect, StatusPermanentRedirect:
+		if body != nil && contentLength != 0 {
+			if getBody == nil {
+				return nil, nil
+			}
+			var err error
+			if body, err = getBody(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, nil
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, nil
+	}
+	u, err := req.URL.Parse(loc)
+	if err != nil {
+		return nil, errors.New("httpd: failed to parse Location header " + strconv.Quote(loc) + ": " + err.Error())
+	}
+
+	next := &Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		Header:        req.Header.Clone(),
+		Host:          u.Host,
+		Body:          body,
+		GetBody:       getBody,
+		ContentLength: contentLength,
+		ctx:           req.ctx,
+	}
+	if next.Header == nil {
+		next.Header = make(Header)
+	}
+	if body == nil {
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	// 凭证不能泄露给其他主机，cookie交给Jar按照新的地址重新匹配
+	if !strings.EqualFold(u.Hostname(), req.URL.Hostname()) {
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next, nil
+}
+
+// send 通过Transport发送一个请求，并在前后与Jar交换cookie
+func (c *Client) send(req *Request) (*Response, error) {
+	if c.Jar != nil {
+		if cookies := c.Jar.Cookies(req.URL); len(cookies) > 0 {
+			// 不修改调用方的Header
+			r2 := *req
+			r2.Header = req.Header.Clone()
+			if r2.Header == nil {
+				r2.Header = make(Header)
+			}
+			for _, cookie := range cookies {
+				r2.AddCookie(cookie)
+			}
+			req = &r2
+		}
+	}
+	resp, err := c.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			c.Jar.SetCookies(req.URL, cookies)
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) transport() RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	return DefaultTransport
+}
+
+// cancelBody 在报文主体关闭时释放Timeout对应的Context，超时导致的读取错误替换为context.DeadlineExceeded
+type cancelBody struct {
+	rc     io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (n int, err error) {
+	n, err = b.rc.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = b.ctx.Err()
+	}
+	return
+}
+
+func (b *cancelBody) Close() error {
+	err := b.rc.Close()
+	b.cancel()
+	return err
+}
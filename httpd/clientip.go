@@ -0,0 +1,89 @@
+package httpd
+
+import (
+	"net"
+	"strings"
+)
+
+// clientip.go负责在反向代理之后获取真实的客户端地址。
+// 代理会把它看到的对端地址追加到X-Forwarded-For的末尾，所以越靠右的地址越可信，
+// 但这些首部任何客户端都可以随意填写，只有当连接的对端是我们信任的代理时才能采信。
+
+// ClientIP 返回发起请求的客户端ip。
+// 连接的对端在Server.TrustedProxies之中时，从右往左遍历X-Forwarded-For，跳过受信任的代理，
+// 第一个不受信任的地址即为客户端；没有X-Forwarded-For时采用X-Real-IP。
+// 其他情况下，或者请求不是由Server读取的，直接返回RemoteAddr中的ip。
+func (r *Request) ClientIP() string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if r.conn == nil || !r.conn.svr.isTrustedProxy(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(ip))
+		}
+	}
+	if len(hops) == 0 {
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+		return peer
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// 格式错误的地址之前的内容都不可信，到此为止
+			return peer
+		}
+		if i == 0 || !r.conn.svr.isTrustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return peer
+}
+
+// isTrustedProxy 判断ip是否属于TrustedProxies
+func (s *Server) isTrustedProxy(ip string) bool {
+	if len(s.TrustedProxies) == 0 {
+		return false
+	}
+	s.trustedOnce.Do(s.parseTrustedProxies)
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range s.trustedNets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies 把TrustedProxies解析为网段，单独的ip视为只包含它自己的网段，无法解析的配置记录到ErrorLog后忽略
+func (s *Server) parseTrustedProxies() {
+	for _, v := range s.TrustedProxies {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				s.logf("httpd: invalid trusted proxy %q", v)
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			s.trustedNets = append(s.trustedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			s.logf("httpd: invalid trusted proxy %q: %v", v, err)
+			continue
+		}
+		s.trustedNets = append(s.trustedNets, n)
+	}
+}
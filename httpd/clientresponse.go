@@ -0,0 +1,182 @@
+package httpd
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// clientresponse.go负责客户端一侧响应报文的解析，与服务端解析请求报文共用readLine、readHeader以及chunkReader。
+// 一段响应报文：
+//
+//	HTTP/1.1 200 OK\r\n						#状态行
+//	Content-Type: text/plain\r\n			#首部字段
+//	Content-Length: 12\r\n
+//	\r\n
+//	hello,client							#报文主体
+
+// Response 代表客户端收到的响应
+type Response struct {
+	Status     string // 状态码以及状态文本，如 "200 OK"
+	StatusCode int
+	Proto      string // 如 "HTTP/1.1"
+
+	Header Header
+
+	// Body 用于读取报文主体，读取完毕后必须调用Close，否则连接无法释放。
+	// 没有报文主体时Body也不为nil，读取会立即返回io.EOF
+	Body io.ReadCloser
+
+	// ContentLength 为报文主体的长度，-1代表长度未知(chunk编码或者以关闭连接标记结束)
+	ContentLength int64
+	// TransferEncoding 为报文主体使用的传输编码，目前只可能是nil或者[chunked]
+	TransferEncoding []string
+	// Close 代表服务端是否会在响应之后关闭连接
+	Close bool
+
+	// Trailer 存放chunk编码的报文主体之后携带的trailer，Body读取到io.EOF之后才是完整的
+	Trailer Header
+
+	// Request 产生这个响应的请求
+	Request *Request
+}
+
+// responseError 代表响应报文的格式错误
+type responseError string
+
+func (e responseError) Error() string {
+	return "httpd: malformed response: " + string(e)
+}
+
+// ReadResponse 从b中解析出一个响应，req为对应的请求，可以为nil。
+// 对HEAD请求的响应以及1xx、204、304响应没有报文主体，所以需要通过req判断请求方法。
+// 返回的Body直接从b中读取报文主体。
+func ReadResponse(b *bufio.Reader, req *Request) (*Response, error) {
+	resp := &Response{Request: req}
+
+	line, err := readLine(b)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// 状态行为 HTTP/1.1 200 OK，状态文本中可能含有空格，也可能为空
+	proto, status, ok := cutString(string(line), " ")
+	if !ok {
+		return nil, responseError("malformed status line " + strconv.Quote(string(line)))
+	}
+	resp.Proto = proto
+	resp.Status = strings.TrimLeft(status, " ")
+	code, _, _ := cutString(resp.Status, " ")
+	if len(code) != 3 {
+		return nil, responseError("malformed status code " + strconv.Quote(code))
+	}
+	if resp.StatusCode, err = strconv.Atoi(code); err != nil || resp.StatusCode < 100 {
+		return nil, responseError("malformed status code " + strconv.Quote(code))
+	}
+	if resp.Proto != "HTTP/1.1" && resp.Proto != "HTTP/1.0" {
+		return nil, responseError("unsupported protocol " + strconv.Quote(resp.Proto))
+	}
+
+	if resp.Header, err = readHeader(b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	conn := strings.ToLower(resp.Header.Get("Connection"))
+	if resp.Proto == "HTTP/1.0" {
+		resp.Close = conn != "keep-alive"
+	} else {
+		resp.Close = conn == "close"
+	}
+
+	if err = resp.setupBody(b); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// setupBody 根据状态码、请求方法以及首部确定报文主体的边界
+func (resp *Response) setupBody(b *bufio.Reader) error {
+	if !resp.bodyAllowed() {
+		resp.Body = noBody{}
+		return nil
+	}
+	te, hasTE := resp.Header["Transfer-Encoding"]
+	cl, err := parseContentLength(resp.Header)
+	if err != nil {
+		return responseError(err.Error())
+	}
+	switch {
+	case hasTE:
+		if len(te) != 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return responseError("unsupported Transfer-Encoding " + strconv.Quote(strings.Join(te, ",")))
+		}
+		// 同时出现时以Transfer-Encoding为准，Content-Length被忽略
+		resp.Header.Del("Content-Length")
+		resp.TransferEncoding = []string{"chunked"}
+		resp.ContentLength = -1
+		resp.Trailer = declaredTrailer(resp.Header)
+		resp.Body = readCloser{&chunkReader{bufr: b, trailer: resp.Trailer}}
+	case cl != "":
+		resp.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
+		if resp.ContentLength == 0 {
+			resp.Body = noBody{}
+		} else {
+			resp.Body = readCloser{&unexpectedEOFReader{io.LimitReader(b, resp.ContentLength), resp.ContentLength}}
+		}
+	default:
+		// 既没有Content-Length也没有chunk编码，报文主体一直持续到服务端关闭连接
+		resp.ContentLength = -1
+		resp.Close = true
+		resp.Body = readCloser{b}
+	}
+	return nil
+}
+
+func (resp *Response) bodyAllowed() bool {
+	if resp.Request != nil && resp.Request.Method == "HEAD" {
+		return false
+	}
+	return bodyAllowedForStatus(resp.StatusCode)
+}
+
+// unexpectedEOFReader 报文主体还没有读够Content-Length就遇到了EOF时返回io.ErrUnexpectedEOF，
+// 避免把被截断的报文主体当成完整的
+type unexpectedEOFReader struct {
+	r      io.Reader
+	remain int64
+}
+
+func (u *unexpectedEOFReader) Read(p []byte) (n int, err error) {
+	n, err = u.r.Read(p)
+	u.remain -= int64(n)
+	if err == io.EOF && u.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// readCloser 为没有Close方法的Reader补上一个空的Close
+type readCloser struct {
+	io.Reader
+}
+
+func (readCloser) Close() error { return nil }
+
+// noBody 是没有报文主体的响应的Body
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+// cutString 在s中第一次出现sep的地方将其一分为二
+func cutString(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -2,11 +2,15 @@ package httpd
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 // 负责http协议的解析
@@ -14,6 +18,8 @@ import (
 type conn struct {
 	svr *Server  // 引用服务器对象
 	rwc net.Conn // 底层tcp连接
+	// 客户端地址，一般就是rwc的对端地址，开启了PROXY protocol时取自PROXY首部
+	remoteAddr net.Addr
 	// 每一次写入都会进行一次系统调用、一次IO操作，势必会极大降低应用程序的性能。
 	// 可以对用户写入数据进行缓存，缓存不下时再发送就能较少IO次数，从而提升效率。
 	// bufio.Writer的底层会分配一个缓存切片，我们对bufio.Writer写入时会优先往这个切片中写入，
@@ -42,43 +48,123 @@ type conn struct {
 	// 首部字段的每个key-value都占用一行(\r\n是换行符)，为了方便解析，我们的reader应该有ReadLine方法。这是第二个改进，改进用到了标准库的bufio.Reader。
 
 	lr   *io.LimitedReader
-	bufw *bufio.Writer // 是对lr 的封装 写数据时直接操作bufw，bufw进而写入到tcp连接。
+	bufw *bufio.Writer   // 是对lr 的封装 写数据时直接操作bufw，bufw进而写入到tcp连接。
+	w    *countingWriter // bufw底层的writer，写入rwc的同时统计字节数
+
+	bgReadDone chan struct{} // 后台预读goroutine退出时关闭，为nil代表没有后台预读
+	hijacked   bool          // 连接是否已经被handler接管
+	requests   int           // 连接上已经读取的请求数
+	state      int32         // 连接当前的ConnState，Shutdown会在其他goroutine中读取，通过atomic访问
+	// tls连接完成握手后的状态，每个请求的Request.TLS都指向它，明文连接为nil
+	tlsState *tls.ConnectionState
+	// 开启了MaxConns时，连接结束后调用它归还占用的名额
+	releaseSlot func()
 }
 
 func newConn(rwc net.Conn, svr *Server) *conn {
-	lr := &io.LimitedReader{R: rwc, N: 1 << 20}
+	m := svr.serverMetrics()
+	lr := &io.LimitedReader{R: &countingReader{rwc, &m.bytesIn}, N: svr.maxHeaderBytes()}
+	w := &countingWriter{rwc, &m.bytesOut}
 	return &conn{
-		svr:  svr,
-		rwc:  rwc,
-		bufw: bufio.NewWriterSize(rwc, 4<<10), // 缓存大小4KB
-		lr:   lr,                              // 为conn增加了lr字段，它是一个io.LimitedReader，它包含一个属性N代表能够在这个reader上读取的最多字节数，如果在此reader上读取的总字节数超过了上限，则接下来对这个reader的读取都会返回io.EOF，从而有效终止读取过程，避免首部字段的无限读。
-		bufr: bufio.NewReaderSize(lr, 4<<10),  // 它是一个bufio.Reader，其底层的reader为上述的LimitedReader。对于一个io.Reader接口而言，它是无法提供ReadLine方法的，而将其封装程bufio.Reader后，就可以使用这个方法。
+		svr:        svr,
+		rwc:        rwc,
+		w:          w,
+		remoteAddr: rwc.RemoteAddr(),
+		bufw:       newBufioWriterSize(w, svr.writeBufferSize()), // 缓存大小默认4KB，从池中复用
+		lr:         lr,                                           // 为conn增加了lr字段，它是一个io.LimitedReader，它包含一个属性N代表能够在这个reader上读取的最多字节数，如果在此reader上读取的总字节数超过了上限，则接下来对这个reader的读取都会返回io.EOF，从而有效终止读取过程，避免首部字段的无限读。
+		bufr:       newBufioReaderSize(lr, svr.readBufferSize()), // 它是一个bufio.Reader，其底层的reader为上述的LimitedReader。对于一个io.Reader接口而言，它是无法提供ReadLine方法的，而将其封装程bufio.Reader后，就可以使用这个方法。
 	}
 }
 
 func (c *conn) serve() {
+	var (
+		res    *response // 正在处理的请求对应的响应，handler发生panic时用于回复500
+		start  time.Time
+		hstart time.Time // handler开始运行的时间
+		parked bool      // 连接交给了poller托管，goroutine退出后连接仍然存活
+	)
 	defer func() {
 		if err := recover(); err != nil {
-			log.Printf("panic recovered,err: %v\n", err)
-			var trace [4096]byte
-			n := runtime.Stack(trace[:], false)
-			fmt.Printf("panic stack is %s:\n", string(trace[:n]))
+			handlerTime := time.Since(hstart)
+			// ErrAbortHandler是handler有意中断响应，不是程序错误
+			if err != ErrAbortHandler {
+				var trace [4096]byte
+				n := runtime.Stack(trace[:], false)
+				if res != nil && c.svr.PanicHandler != nil {
+					c.svr.PanicHandler(res.req, err, trace[:n])
+				} else {
+					var id string
+					if res != nil {
+						id = res.req.logID()
+					}
+					c.svr.logf("httpd: panic serving %s%s: %v\n%s", c.remoteAddr, id, err, trace[:n])
+				}
+			}
+			if res != nil {
+				if !c.hijacked {
+					c.abortBackgroundRead()
+					// 响应的首部还没有发送时，客户端还能收到一个完整的500响应；
+					// 否则响应已经发送了一半，只能直接关闭连接，让客户端感知到错误
+					if !res.cw.wroteHeader {
+						res.status = StatusInternalServerError
+						res.written = int64(len(StatusText(StatusInternalServerError)))
+						c.writeErrorResponse(StatusInternalServerError)
+					}
+				}
+				c.endRequest(res, start, handlerTime, err)
+			}
+		}
+		// handler发生panic、连接被接管或者写出响应失败时没有经过finishRequest，同样要删除表单的临时文件
+		if res != nil {
+			res.req.removeMultipartFiles()
+		}
+		if parked {
+			return
+		}
+		// 被接管的连接由handler负责关闭
+		if !c.hijacked {
+			c.close()
+		} else if c.releaseSlot != nil {
+			c.releaseSlot()
 		}
-		c.close()
 	}()
 
+	// 从poller中唤醒的连接已经读取过PROXY首部了。
+	// tls连接的PROXY首部在握手时由proxyConn解析，见tlsListener
+	_, isTLS := c.rwc.(*tls.Conn)
+	if c.svr.ProxyProtocol && c.requests == 0 && !isTLS {
+		if err := c.readProxyHeader(); err != nil {
+			c.logError("reading PROXY header", err)
+			return
+		}
+	}
+	if c.requests == 0 {
+		proto, err := c.handshake()
+		if err != nil {
+			c.logError("handshake", err)
+			return
+		}
+		if c.svr.ProxyProtocol && isTLS {
+			c.remoteAddr = c.rwc.RemoteAddr()
+		}
+		if fn := c.svr.TLSNextProto[proto]; fn != nil && c.tlsState != nil {
+			// 连接交给fn处理，fn返回后连接被关闭
+			c.setState(StateActive)
+			fn(c.svr, c.rwc.(*tls.Conn), c.svr.Handler)
+			return
+		}
+		if proto == "h2" {
+			c.serveHTTP2(nil, nil)
+			return
+		}
+	}
+
 	for { //http1.1支持keep-alive长连接，所以一个连接中可能读出个请求，因此实用for循环读取
 		// 对于HTTP 1.0来说，客户端为了获取服务端的每一个资源，都需要为每一个请求进行TCP连接的建立，
 		// 因此每一个请求都需要等待2个RTT(三次握手+服务端的返回)的延时。而往往一个html网页中往往引用了多个css或者js文件，每一个请求都要经历TCP的三次握手，其带来的代价无疑是昂贵的。
 		// 因此在HTTP 1.1中进行了巨大的改进，即如果将要请求的资源在同一台服务器上，则我只需要建立一个TCP连接，所有的HTTP请求都通过这个连接传输，平均下来可以减少一半的传播时延。
 		//如果客户端的请求头中包含connection: keep-alive字段，则我们的服务器应该有义务保证长连接的维持，并持续从中读取HTTP请求，因此这里我们使用for循环。
 
-		var err error
-		defer func() {
-			if err != nil {
-				fmt.Println(err)
-			}
-		}()
 		req, err := c.readRequest() //解析出Request
 		if err != nil {
 			handleError(err, c) // 将错误单独交给handleErr处理
@@ -87,14 +173,59 @@ func (c *conn) serve() {
 			// 但对于一些错误如使用了不支持的http版本，我们应该返回505状态码；
 			// 对于请求报文过大的错误，我们应该返回413状态码。因此在handleErr中，我们应该对err进行分类处理。
 			// 我们这里只进行对err的打印
+			c.logError("reading request", err)
+			return
+		}
+
+		if c.svr.H2C && c.requests == 0 && isH2CUpgrade(req) {
+			c.serveH2CUpgrade(req)
 			return
 		}
 
-		res := c.setupResponse() // //设置response
+		start = time.Now()
+		res = c.setupResponse(req) // //设置response
+		// 达到单个连接的请求数上限后，在这次的响应中告知客户端关闭连接
+		c.requests++
+		if max := c.svr.MaxRequestsPerConn; max > 0 && c.requests >= max {
+			res.closeAfterReply = true
+		}
+
+		ctx, cancel := context.WithCancel(c.svr.baseContext())
+		req.ctx = ctx
+		c.svr.startRequest(req)
+		// 没有报文主体的请求，handler不会再读取连接，这时可以在后台监听连接是否断开
+		if _, ok := req.Body.(*eofReader); ok {
+			c.startBackgroundRead(cancel)
+		}
 
 		// 有了用户关心的Request和response之后，传入用户提供的回调函数即可
-		c.svr.Handler.ServeHTTP(res, req)
+		hstart = time.Now()
+		c.serveHandler(res, req)
+		handlerTime := time.Since(hstart)
+		c.abortBackgroundRead()
+		cancel()
+		if c.hijacked {
+			c.endRequest(res, start, handlerTime, nil)
+			return // 连接已经交给了handler，serve循环不能再读写这个连接
+		}
+		err = res.finishResponse()
+		c.endRequest(res, start, handlerTime, nil)
+		if err != nil {
+			c.logError("writing response", err)
+			return
+		}
 		if err = req.finishRequest(); err != nil {
+			c.logError("finishing request", err)
+			return
+		}
+		if res.closeAfterReply {
+			return
+		}
+		res = nil
+		c.setState(StateIdle)
+		// 客户端没有紧接着发来下一个请求时，把连接交给poller托管，释放goroutine以及缓存
+		if p := c.svr.idlePoller(); p != nil && c.bufr.Buffered() == 0 && p.park(c) {
+			parked = true
 			return
 		}
 
@@ -107,18 +238,138 @@ func (c *conn) serve() {
 
 }
 
+// aLongTimeAgo 用于设置一个已经过期的deadline，从而让阻塞的Read立即返回
+var aLongTimeAgo = time.Unix(1, 0)
+
+// startBackgroundRead 在handler运行期间从连接上预读一个字节，
+// 如果读到了错误(对端关闭了连接)，说明客户端已经不再关心这个请求了，调用onClose取消请求的Context。
+// 预读到的数据仍然保存在bufr中，不会影响下一个请求的解析。
+func (c *conn) startBackgroundRead(onClose func()) {
+	done := make(chan struct{})
+	c.bgReadDone = done
+	go func() {
+		defer close(done)
+		if _, err := c.bufr.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return // 被abortBackgroundRead打断
+			}
+			onClose()
+		}
+	}()
+}
+
+// abortBackgroundRead 打断后台的预读，并等待其退出，之后连接的读取权交还给serve循环
+func (c *conn) abortBackgroundRead() {
+	if c.bgReadDone == nil {
+		return
+	}
+	c.rwc.SetReadDeadline(aLongTimeAgo)
+	<-c.bgReadDone
+	c.rwc.SetReadDeadline(time.Time{})
+	c.bgReadDone = nil
+}
+
+// endRequest 记录访问日志并通知Tracer，p为handler发生panic时recover得到的值
+func (c *conn) endRequest(res *response, start time.Time, handlerTime time.Duration, p interface{}) {
+	c.svr.endRequest(res.req, RequestInfo{
+		Start:           start,
+		HandlerDuration: handlerTime,
+		Status:          res.status,
+		Written:         res.written,
+		Hijacked:        c.hijacked,
+		Panic:           p,
+	})
+}
+
+// logError 记录连接上发生的错误，客户端正常关闭连接(io.EOF)以及读写超时属于连接的正常结束，不予记录
+func (c *conn) logError(op string, err error) {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+	c.svr.logf("httpd: %s from %s: %v", op, c.remoteAddr, err)
+}
+
 func (c *conn) readRequest() (*Request, error) {
 	return readRequest(c)
 }
 
-func (c *conn) setupResponse() *response {
-	return setupResponse(c)
+func (c *conn) setupResponse(req *Request) *response {
+	return setupResponse(c, req)
 }
 
 func (c *conn) close() {
 	c.rwc.Close()
+	c.setState(StateClosed)
+	// 托管在poller中的连接已经归还了缓存
+	if c.bufr != nil {
+		putBufioReader(c.bufr)
+		putBufioWriter(c.bufw)
+		c.bufr, c.bufw = nil, nil
+	}
+	if c.releaseSlot != nil {
+		c.releaseSlot()
+	}
+}
+
+func (c *conn) setState(state ConnState) {
+	old := ConnState(atomic.SwapInt32(&c.state, int32(state)))
+	c.svr.serverMetrics().connStateChanged(old, state)
+	switch state {
+	case StateNew:
+		c.svr.trackConn(c, true)
+	case StateClosed, StateHijacked:
+		c.svr.trackConn(c, false)
+	}
+	if hook := c.svr.ConnState; hook != nil {
+		hook(c.rwc, state)
+	}
 }
 
+// 读取首部时如果LimitedReader的额度已经耗尽，说明首部超过了最大限制，
+// 此时bufr返回的io.EOF并不是因为客户端关闭了连接
+func (c *conn) fixHeaderErr(err error) error {
+	if err == io.EOF && c.lr.N <= 0 {
+		return ErrHeaderTooLarge
+	}
+	return err
+}
+
+// handleError对readRequest返回的错误分类处理：
+// 对于客户端断开连接这类错误，直接关闭连接即可，不需要回复；
+// 对于报文格式错误、首部过大、不支持的http版本等错误，回复对应状态码的响应报文后再关闭连接。
 func handleError(err error, c *conn) {
-	fmt.Println(err)
+	var code int
+	switch err.(type) {
+	case badRequestError:
+		code = StatusBadRequest
+	case expectationFailedError:
+		code = StatusExpectationFailed
+	default:
+		switch err {
+		case ErrHeaderTooLarge:
+			code = StatusRequestHeaderFieldsTooLarge
+		case ErrBodyTooLarge:
+			code = StatusRequestEntityTooLarge
+		case ErrUnsupportedProto:
+			code = StatusHTTPVersionNotSupported
+		default:
+			return // 连接断开或者网络错误，没有必要再回复
+		}
+	}
+	c.writeErrorResponse(code)
+}
+
+// writeErrorResponse 绕过response直接往连接中写入一个以状态文本为报文主体的响应，写完之后连接需要关闭
+func (c *conn) writeErrorResponse(code int) {
+	text := StatusText(code)
+	fmt.Fprintf(c.bufw, "HTTP/1.1 %d %s\r\n", code, text)
+	fmt.Fprintf(c.bufw, "Date: %s\r\nServer: %s\r\n", httpDate(time.Now()), c.svr.serverHeader())
+	io.WriteString(c.bufw, "Content-Type: text/plain; charset=utf-8\r\n")
+	io.WriteString(c.bufw, "Connection: close\r\n")
+	fmt.Fprintf(c.bufw, "Content-Length: %d\r\n\r\n", len(text))
+	io.WriteString(c.bufw, text)
+	c.bufw.Flush()
 }
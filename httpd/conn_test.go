@@ -0,0 +1,81 @@
+package httpd
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunk编码的报文主体格式错误时，连接上剩余的数据不能被当作下一个请求处理
+func TestChunkedFramingErrorClosesConn(t *testing.T) {
+	bodies := []struct {
+		name string
+		body string
+	}{
+		{"folded trailer", "0\r\n\tfold\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+		{"bad CRLF after chunk data", "3\r\nabcXX3\r\ndef\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"},
+	}
+	for _, readBody := range []bool{true, false} {
+		for _, tt := range bodies {
+			name := tt.name
+			if !readBody {
+				name += " unread"
+			}
+			t.Run(name, func(t *testing.T) {
+				var mu sync.Mutex
+				var paths []string
+				addr := startTestServer(t, HandlerFunc(func(w ResponseWriter, r *Request) {
+					mu.Lock()
+					paths = append(paths, r.URL.Path)
+					mu.Unlock()
+					if readBody {
+						if _, err := ioutil.ReadAll(r.Body); err != nil {
+							return // 由框架回复400
+						}
+					}
+					io.WriteString(w, "ok")
+				}))
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				io.WriteString(c, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n"+tt.body)
+
+				br := bufio.NewReader(c)
+				resp, err := ReadResponse(br, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				if readBody && resp.StatusCode != StatusBadRequest {
+					t.Errorf("status = %d, want 400", resp.StatusCode)
+				}
+				if _, err := ReadResponse(br, nil); err == nil {
+					t.Error("got a second response, want connection closed")
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if len(paths) != 1 || paths[0] != "/" {
+					t.Errorf("served paths = %q, want only /", paths)
+				}
+			})
+		}
+	}
+}
+
+func startTestServer(t *testing.T, h Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := &Server{Handler: h}
+	go svr.Serve(l)
+	t.Cleanup(func() { svr.Close() })
+	return l.Addr().String()
+}
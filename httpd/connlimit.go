@@ -0,0 +1,139 @@
+package httpd
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connlimit.go负责限制同时处理的连接数。
+// 每个连接都占用一个文件描述符、一个goroutine以及读写缓存，流量突增时如果不加限制地接受连接，
+// 最终会耗尽文件描述符或者内存，连已经在处理的请求也无法完成。
+
+// ConnLimitPolicy 决定同时处理的连接数达到Server.MaxConns之后如何对待新连接
+type ConnLimitPolicy int
+
+const (
+	// ConnLimitWait 暂停接受新连接，直到有连接关闭。新连接停留在内核的accept队列中，队列满后由内核拒绝
+	ConnLimitWait ConnLimitPolicy = iota
+	// ConnLimitReject 继续接受新连接，最多AcceptQueue个连接排队等待空位，超出的连接立即收到503 Service Unavailable后被关闭
+	ConnLimitReject
+)
+
+// rejectTimeout 回复503时的超时，避免不读数据的客户端拖住goroutine
+const rejectTimeout = time.Second
+
+// connLimiter 用带缓冲的channel作为信号量，缓冲区的大小即为最大连接数。
+// MaxHandlerGoroutines同样用它来限制同时运行的handler数
+type connLimiter struct {
+	sem    chan struct{}
+	queued int32 // 正在排队等待空位的连接数
+}
+
+func (s *Server) limiter() *connLimiter {
+	if s.MaxConns <= 0 {
+		return nil
+	}
+	s.limiterOnce.Do(func() {
+		s.connLimiter = &connLimiter{sem: make(chan struct{}, s.MaxConns)}
+	})
+	return s.connLimiter
+}
+
+func (s *Server) handlerLimiter() *connLimiter {
+	if s.MaxHandlerGoroutines <= 0 {
+		return nil
+	}
+	s.handlerLimiterOnce.Do(func() {
+		s.handlerLimit = &connLimiter{sem: make(chan struct{}, s.MaxHandlerGoroutines)}
+	})
+	return s.handlerLimit
+}
+
+// acquire 阻塞直到有空位，服务器关闭时返回false
+func (l *connLimiter) acquire(done <-chan struct{}) bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *connLimiter) tryAcquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquireQueued 有空位时直接占用，否则在排队的数量没有超过max时等待空位，done关闭时放弃等待
+func (l *connLimiter) acquireQueued(max int, done <-chan struct{}) bool {
+	if l.tryAcquire() {
+		return true
+	}
+	if atomic.AddInt32(&l.queued, 1) > int32(max) {
+		atomic.AddInt32(&l.queued, -1)
+		return false
+	}
+	defer atomic.AddInt32(&l.queued, -1)
+	return l.acquire(done)
+}
+
+func (l *connLimiter) release() {
+	<-l.sem
+}
+
+// serveLimited 在ConnLimitReject模式下处理新接受的连接：有空位时直接处理，
+// 否则在排队的连接数没有超过AcceptQueue时等待空位，再否则回复503
+func (s *Server) serveLimited(l *connLimiter, c *conn) {
+	if l.tryAcquire() {
+		go c.serveLimited(l)
+		return
+	}
+	if atomic.AddInt32(&l.queued, 1) > int32(s.AcceptQueue) {
+		atomic.AddInt32(&l.queued, -1)
+		go c.reject()
+		return
+	}
+	go func() {
+		ok := l.acquire(s.baseContext().Done())
+		atomic.AddInt32(&l.queued, -1)
+		if !ok {
+			c.close()
+			return
+		}
+		c.serveLimited(l)
+	}()
+}
+
+// serveLimited 处理连接，连接结束后释放其占用的空位。
+// 连接被poller托管期间仍然占用着空位，所以不能在serve返回时释放
+func (c *conn) serveLimited(l *connLimiter) {
+	c.releaseSlot = l.release
+	c.serve()
+}
+
+// reject 回复503并关闭连接。
+// tls连接写入之前要先握手，握手需要读取ClientHello，所以读写都要设置超时
+func (c *conn) reject() {
+	c.rwc.SetDeadline(time.Now().Add(rejectTimeout))
+	c.writeErrorResponse(StatusServiceUnavailable)
+	c.close()
+}
+
+// serveHandler 在MaxHandlerGoroutines的限制下运行handler，
+// 没有空位并且排队的请求已满，或者排队期间客户端断开了连接时回复503
+func (c *conn) serveHandler(w ResponseWriter, r *Request) {
+	if l := c.svr.handlerLimiter(); l != nil {
+		if !l.acquireQueued(c.svr.HandlerQueue, r.Context().Done()) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(StatusServiceUnavailable)
+			w.Write([]byte(StatusText(StatusServiceUnavailable)))
+			return
+		}
+		defer l.release()
+	}
+	c.svr.Handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,253 @@
+package httpd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cookie 代表请求首部Cookie中的一个键值对，或者响应首部Set-Cookie中的一个cookie。
+// 对于请求中的cookie，只有Name以及Value有效。
+// Set-Cookie: uuid=12314753; Path=/; Domain=example.com; Max-Age=3600; HttpOnly; Secure; SameSite=Lax
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string    // 可选
+	Domain  string    // 可选
+	Expires time.Time // 可选，零值代表不设置
+
+	// MaxAge=0 代表不设置Max-Age属性
+	// MaxAge<0 代表立即删除cookie，等价于Max-Age: 0
+	// MaxAge>0 代表cookie的有效秒数
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// SameSite 控制浏览器在跨站请求中是否携带cookie
+type SameSite int
+
+const (
+	SameSiteDefaultMode SameSite = iota + 1
+	SameSiteLaxMode
+	SameSiteStrictMode
+	SameSiteNoneMode
+)
+
+// String 将cookie序列化为Set-Cookie首部的值，如果Name不合法则返回空字符串
+func (c *Cookie) String() string {
+	if c == nil || !isCookieNameValid(c.Name) {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteByte('=')
+	b.WriteString(sanitizeCookieValue(c.Value))
+
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(sanitizeCookiePath(c.Path))
+	}
+	if c.Domain != "" {
+		// 开头的.可以省略，浏览器都会忽略它
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() >= 1601 {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLaxMode:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrictMode:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNoneMode:
+		b.WriteString("; SameSite=None")
+	}
+	return b.String()
+}
+
+// TimeFormat 是http首部中时间的格式，时区只能是GMT
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// SetCookie 往响应首部中添加一个Set-Cookie，需要在写入报文主体之前调用
+func SetCookie(w ResponseWriter, cookie *Cookie) {
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v)
+	}
+}
+
+// Cookies 解析请求首部中所有的cookie
+func (r *Request) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, line := range r.Header["Cookie"] {
+		//example(line): uuid=12314753; tid=1BDB9E9; HOME=1
+		for _, kv := range strings.Split(strings.TrimSpace(line), ";") {
+			kv = strings.TrimSpace(kv)
+			index := strings.IndexByte(kv, '=')
+			if index == -1 {
+				continue
+			}
+			name, value := kv[:index], kv[index+1:]
+			if !isCookieNameValid(name) {
+				continue
+			}
+			// 值可以被双引号包裹
+			if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			cookies = append(cookies, &Cookie{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// AddCookie 往客户端请求中添加一个cookie，多个cookie合并在同一个Cookie首部中
+func (r *Request) AddCookie(c *Cookie) {
+	if !isCookieNameValid(c.Name) {
+		return
+	}
+	s := c.Name + "=" + sanitizeCookieValue(c.Value)
+	if v := r.Header.Get("Cookie"); v != "" {
+		r.Header.Set("Cookie", v+"; "+s)
+	} else {
+		r.Header.Set("Cookie", s)
+	}
+}
+
+// Cookies 解析响应首部中所有的Set-Cookie，格式不合法的会被忽略
+func (resp *Response) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, line := range resp.Header["Set-Cookie"] {
+		if c := readSetCookie(line); c != nil {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// readSetCookie 解析一个Set-Cookie首部的值，不认识的属性直接忽略
+// example(line): uuid=12314753; Path=/; Domain=example.com; Max-Age=3600; HttpOnly
+func readSetCookie(line string) *Cookie {
+	parts := strings.Split(strings.TrimSpace(line), ";")
+	name, value, ok := cutString(parts[0], "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || !isCookieNameValid(name) {
+		return nil
+	}
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	c := &Cookie{Name: name, Value: value}
+	for _, attr := range parts[1:] {
+		key, val, _ := cutString(strings.TrimSpace(attr), "=")
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "path":
+			c.Path = val
+		case "domain":
+			c.Domain = val
+		case "expires":
+			t, err := time.Parse(TimeFormat, val)
+			if err != nil {
+				// 老旧的服务端可能使用"-"分隔日期
+				if t, err = time.Parse("Mon, 02-Jan-2006 15:04:05 MST", val); err != nil {
+					continue
+				}
+			}
+			c.Expires = t.UTC()
+		case "max-age":
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs != 0 && val[0] == '0' {
+				continue
+			}
+			if secs <= 0 {
+				secs = -1
+			}
+			c.MaxAge = secs
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(val) {
+			case "lax":
+				c.SameSite = SameSiteLaxMode
+			case "strict":
+				c.SameSite = SameSiteStrictMode
+			case "none":
+				c.SameSite = SameSiteNoneMode
+			default:
+				c.SameSite = SameSiteDefaultMode
+			}
+		}
+	}
+	return c
+}
+
+// cookie的名称必须是http token：不能包含控制字符、空白字符以及分隔符
+func isCookieNameValid(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// cookie的值只允许出现RFC 6265中规定的字符，不合法的字符直接丢弃。
+// 值中包含空格或者逗号时，用双引号包裹起来。
+func sanitizeCookieValue(v string) string {
+	v = sanitize(v, func(b byte) bool {
+		return 0x20 <= b && b < 0x7f && b != '"' && b != ';' && b != '\\'
+	})
+	if strings.ContainsAny(v, " ,") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+func sanitizeCookiePath(v string) string {
+	return sanitize(v, func(b byte) bool {
+		return 0x20 <= b && b < 0x7f && b != ';'
+	})
+}
+
+func sanitize(v string, valid func(byte) bool) string {
+	ok := true
+	for i := 0; i < len(v); i++ {
+		if !valid(v[i]) {
+			ok = false
+			break
+		}
+	}
+	if ok {
+		return v
+	}
+	buf := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if valid(v[i]) {
+			buf = append(buf, v[i])
+		}
+	}
+	return string(buf)
+}
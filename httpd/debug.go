@@ -0,0 +1,260 @@
+package httpd
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debug.go提供运行时的调试接口：pprof性能分析以及expvar变量，功能与标准库的net/http/pprof、expvar相同，
+// 后者只能注册到net/http的ServeMux上，这里重新实现为本包的Handler：
+//
+//	mux.Handle("/debug/", httpd.BasicAuth("debug", check)(httpd.DebugHandler()))
+//
+// 之后可以用 go tool pprof http://host/debug/pprof/profile?seconds=30 采集cpu profile。
+// 这些接口会暴露程序的内部信息，采集profile也有一定的开销，不应该不加认证地开放到公网上。
+
+// DebugHandler 返回一个处理/debug/pprof/下的pprof接口以及/debug/vars的Handler，其他路径回复404
+func DebugHandler() Handler {
+	pprofHandler, vars := PprofHandler(), ExpvarHandler()
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch p := r.URL.Path; {
+		case p == "/debug/vars":
+			vars.ServeHTTP(w, r)
+		case strings.HasPrefix(p, "/debug/pprof/"):
+			pprofHandler.ServeHTTP(w, r)
+		default:
+			NotFound(w, r)
+		}
+	})
+}
+
+// PprofHandler 返回pprof接口的Handler，以请求路径的最后一段决定回复的内容，因此可以挂载在任意的前缀下：
+//
+//   - 最后一段为空时回复所有profile的索引页
+//   - profile：采集seconds参数指定的秒数(默认30秒)的cpu profile
+//   - trace：采集seconds参数指定的秒数(默认1秒)的执行追踪，用go tool trace查看
+//   - cmdline：程序的命令行参数，以NUL分隔
+//   - symbol：把地址转换为函数名，供go tool pprof使用
+//   - 其他：runtime/pprof中同名的profile，如heap、goroutine、allocs、block、mutex、threadcreate，
+//     debug参数大于0时输出文本格式，heap的gc参数大于0时先进行一次垃圾回收
+func PprofHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch name := path.Base(r.URL.Path); {
+		case strings.HasSuffix(r.URL.Path, "/"):
+			pprofIndex(w, r)
+		case name == "profile":
+			pprofCPU(w, r)
+		case name == "trace":
+			pprofTrace(w, r)
+		case name == "cmdline":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			io.WriteString(w, strings.Join(os.Args, "\x00"))
+		case name == "symbol":
+			pprofSymbol(w, r)
+		default:
+			pprofLookup(w, r, name)
+		}
+	})
+}
+
+// pprofSeconds 读取seconds参数，缺省或者不合法时返回def
+func pprofSeconds(r *Request, def int) time.Duration {
+	secs, err := strconv.Atoi(r.Query("seconds"))
+	if err != nil || secs <= 0 {
+		secs = def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// sleepRequest 等待d，期间客户端断开或者服务器关闭时提前返回false
+func sleepRequest(r *Request, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func setAttachment(w ResponseWriter, filename string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+}
+
+// pprofError 在profile开始写出之前报告错误，清除已经为profile设置的首部
+func pprofError(w ResponseWriter, msg string, code int) {
+	w.Header().Del("Content-Disposition")
+	Error(w, msg, code)
+}
+
+func pprofCPU(w ResponseWriter, r *Request) {
+	d := pprofSeconds(r, 30)
+	// profile在采集结束后才一次性写出，所以出错时还能回复错误
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		pprofError(w, "Could not enable CPU profiling: "+err.Error(), StatusInternalServerError)
+		return
+	}
+	ok := sleepRequest(r, d)
+	pprof.StopCPUProfile()
+	if !ok {
+		return
+	}
+	setAttachment(w, "profile")
+	w.Write(buf.Bytes())
+}
+
+func pprofTrace(w ResponseWriter, r *Request) {
+	d := pprofSeconds(r, 1)
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		pprofError(w, "Could not enable tracing: "+err.Error(), StatusInternalServerError)
+		return
+	}
+	ok := sleepRequest(r, d)
+	trace.Stop()
+	if !ok {
+		return
+	}
+	setAttachment(w, "trace")
+	w.Write(buf.Bytes())
+}
+
+func pprofLookup(w ResponseWriter, r *Request, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		NotFound(w, r)
+		return
+	}
+	if name == "heap" && r.Query("gc") != "" && r.Query("gc") != "0" {
+		runtime.GC()
+	}
+	debug, _ := strconv.Atoi(r.Query("debug"))
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf, debug); err != nil {
+		pprofError(w, "Could not write profile: "+err.Error(), StatusInternalServerError)
+		return
+	}
+	if debug > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else {
+		setAttachment(w, name)
+	}
+	w.Write(buf.Bytes())
+}
+
+// pprofSymbol 实现go tool pprof使用的符号查询协议：GET时回复num_symbols表示支持查询，
+// POST的报文主体(或者GET的查询字符串)是以+分隔的十六进制地址，每个能够解析的地址回复一行 地址 函数名
+func pprofSymbol(w ResponseWriter, r *Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var buf bytes.Buffer
+	buf.WriteString("num_symbols: 1\n")
+
+	var br *bufio.Reader
+	if r.Method == "POST" {
+		br = bufio.NewReader(r.Body)
+	} else {
+		br = bufio.NewReader(strings.NewReader(r.URL.RawQuery))
+	}
+	for {
+		word, err := br.ReadSlice('+')
+		if err == nil {
+			word = word[:len(word)-1]
+		}
+		pc, _ := strconv.ParseUint(string(word), 0, 64)
+		if pc != 0 {
+			if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+				fmt.Fprintf(&buf, "%#x %s\n", pc, f.Name())
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	w.Write(buf.Bytes())
+}
+
+// pprofDescriptions 索引页中各个profile的说明
+var pprofDescriptions = map[string]string{
+	"allocs":       "A sampling of all past memory allocations",
+	"block":        "Stack traces that led to blocking on synchronization primitives",
+	"cmdline":      "The command line invocation of the current program",
+	"goroutine":    "Stack traces of all current goroutines",
+	"heap":         "A sampling of memory allocations of live objects. You can specify the gc GET parameter to run GC before taking the heap sample.",
+	"mutex":        "Stack traces of holders of contended mutexes",
+	"profile":      "CPU profile. You can specify the duration in the seconds GET parameter. After you get the profile file, use the go tool pprof command to investigate the profile.",
+	"threadcreate": "Stack traces that led to the creation of new OS threads",
+	"trace":        "A trace of execution of the current program. You can specify the duration in the seconds GET parameter. After you get the trace file, use the go tool trace command to investigate the trace.",
+}
+
+func pprofIndex(w ResponseWriter, r *Request) {
+	type entry struct {
+		name, href string
+		count      int
+	}
+	var entries []entry
+	for _, p := range pprof.Profiles() {
+		entries = append(entries, entry{p.Name(), p.Name() + "?debug=1", p.Count()})
+	}
+	for _, name := range []string{"cmdline", "profile", "trace"} {
+		entries = append(entries, entry{name, name, -1})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>/debug/pprof/</title>\n</head>\n<body>\n")
+	b.WriteString("<p>Set debug=1 as a query parameter to export in legacy text format</p>\n<table>\n<tr><th>Count</th><th>Profile</th></tr>\n")
+	for _, e := range entries {
+		count := ""
+		if e.count >= 0 {
+			count = strconv.Itoa(e.count)
+		}
+		fmt.Fprintf(&b, "<tr><td>%s</td><td><a href=\"%s\">%s</a></td></tr>\n", count, html.EscapeString(e.href), html.EscapeString(e.name))
+	}
+	b.WriteString("</table>\n<p><a href=\"goroutine?debug=2\">full goroutine stack dump</a></p>\n<dl>\n")
+	for _, e := range entries {
+		if desc, ok := pprofDescriptions[e.name]; ok {
+			fmt.Fprintf(&b, "<dt>%s</dt><dd>%s</dd>\n", html.EscapeString(e.name), html.EscapeString(desc))
+		}
+	}
+	b.WriteString("</dl>\n</body>\n</html>\n")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// ExpvarHandler 返回以JSON对象输出expvar中发布的所有变量的Handler，与标准库expvar包注册的/debug/vars相同，
+// 默认包含cmdline以及memstats
+func ExpvarHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		var b strings.Builder
+		b.WriteString("{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if !first {
+				b.WriteString(",\n")
+			}
+			first = false
+			fmt.Fprintf(&b, "%q: %s", kv.Key, kv.Value)
+		})
+		b.WriteString("\n}\n")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, b.String())
+	})
+}
@@ -0,0 +1,191 @@
+package httpd
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content-Disposition的参数有三种写法：
+//
+//	filename=report.pdf                          token
+//	filename="a; b=\"c\".txt"                    quoted-string，其中可以出现;、=以及转义的引号
+//	filename*=UTF-8''%E2%82%AC%20rates.txt       RFC 5987的扩展值，字符集'语言'百分号编码的字节
+//
+// 较长的值还可以按照RFC 2231拆成多段：filename*0*=UTF-8''%E2%82%AC;filename*1=.txt，按编号拼接。
+// 浏览器上传非ASCII文件名时一般同时发送filename以及filename*，后者优先。
+
+// ParseContentDisposition 解析Content-Disposition首部，返回小写的类型(如form-data、attachment)以及参数，
+// 参数名为小写，filename*等扩展参数解码后以去掉*的名字存放，并覆盖同名的普通参数。
+// 格式错误的参数会被跳过而不是让整个首部解析失败，客户端的实现五花八门，尽量取出能用的部分
+func ParseContentDisposition(v string) (disposition string, params map[string]string) {
+	disposition, rest, _ := cutString(v, ";")
+	disposition = strings.ToLower(strings.TrimSpace(disposition))
+	params = make(map[string]string)
+
+	ext := make(map[string]bool)                // 已经由扩展值设置的参数
+	sections := make(map[string][]paramSection) // RFC 2231中分段的参数
+	for rest != "" {
+		var key, value string
+		var quoted, ok bool
+		key, value, quoted, rest, ok = consumeParam(rest)
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(key)
+		star := strings.IndexByte(key, '*')
+		switch {
+		case star < 0:
+			if !ext[key] {
+				if _, dup := params[key]; !dup {
+					params[key] = value
+				}
+			}
+		case star == len(key)-1 && !quoted:
+			// name*=charset'lang'value
+			if decoded, ok := decodeExtValue(value); ok {
+				params[key[:star]] = decoded
+				ext[key[:star]] = true
+			}
+		default:
+			// name*N或者name*N*
+			name, index := key[:star], key[star+1:]
+			encoded := strings.HasSuffix(index, "*")
+			index = strings.TrimSuffix(index, "*")
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 || index != strconv.Itoa(n) || encoded && quoted {
+				continue
+			}
+			sections[name] = append(sections[name], paramSection{n, value, encoded})
+		}
+	}
+
+	for name, secs := range sections {
+		if value, ok := joinSections(secs); ok {
+			params[name] = value
+			ext[name] = true
+		}
+	}
+	return disposition, params
+}
+
+// paramSection RFC 2231中分段参数的一段
+type paramSection struct {
+	index   int
+	value   string
+	encoded bool // 以*结尾，值为百分号编码，第0段还带有字符集以及语言
+}
+
+// joinSections 按编号拼接各段，编号必须从0开始连续
+func joinSections(secs []paramSection) (string, bool) {
+	sort.Slice(secs, func(i, j int) bool { return secs[i].index < secs[j].index })
+	charset := "us-ascii"
+	var buf []byte
+	for i, sec := range secs {
+		if sec.index != i {
+			return "", false
+		}
+		if !sec.encoded {
+			buf = append(buf, sec.value...)
+			continue
+		}
+		v := sec.value
+		if i == 0 {
+			var lang string
+			var ok bool
+			charset, lang, ok = cutString(v, "'")
+			if _, v, ok = cutString(lang, "'"); !ok {
+				return "", false
+			}
+		}
+		b, err := url.PathUnescape(v)
+		if err != nil {
+			return "", false
+		}
+		buf = append(buf, b...)
+	}
+	return decodeCharset(charset, buf)
+}
+
+// decodeExtValue 解码RFC 5987的扩展值 charset'language'value-chars
+func decodeExtValue(v string) (string, bool) {
+	charset, rest, ok := cutString(v, "'")
+	if !ok {
+		return "", false
+	}
+	if _, rest, ok = cutString(rest, "'"); !ok {
+		return "", false
+	}
+	b, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", false
+	}
+	return decodeCharset(charset, []byte(b))
+}
+
+// decodeCharset RFC 5987要求至少支持UTF-8以及ISO-8859-1
+func decodeCharset(charset string, b []byte) (string, bool) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "us-ascii", "":
+		if !utf8.Valid(b) {
+			return "", false
+		}
+		return string(b), true
+	case "iso-8859-1":
+		// ISO-8859-1的每个字节与unicode中前256个码位一一对应
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), true
+	}
+	return "", false
+}
+
+// consumeParam 从s中取出第一个 key=value 形式的参数，rest为下一个;之后的内容。
+// 没有=的参数返回ok为false，quoted表示值是否为quoted-string
+func consumeParam(s string) (key, value string, quoted bool, rest string, ok bool) {
+	s = strings.TrimLeft(s, " \t;")
+	i := strings.IndexAny(s, "=;")
+	if i < 0 {
+		return "", "", false, "", false
+	}
+	if s[i] == ';' {
+		return "", "", false, s[i+1:], false
+	}
+	key = strings.TrimSpace(s[:i])
+	s = strings.TrimLeft(s[i+1:], " \t")
+
+	if strings.HasPrefix(s, `"`) {
+		quoted = true
+		var b strings.Builder
+		j := 1
+		for ; j < len(s); j++ {
+			c := s[j]
+			if c == '"' {
+				break
+			}
+			// quoted-pair，\后面的字符按字面处理
+			if c == '\\' && j+1 < len(s) {
+				j++
+				c = s[j]
+			}
+			b.WriteByte(c)
+		}
+		value = b.String()
+		// 引号没有闭合时把剩下的内容都当作值
+		if j >= len(s) {
+			return key, value, quoted, "", key != ""
+		}
+		s = s[j+1:]
+		if k := strings.IndexByte(s, ';'); k >= 0 {
+			rest = s[k+1:]
+		}
+		return key, value, quoted, rest, key != ""
+	}
+
+	value, rest, _ = cutString(s, ";")
+	return key, strings.TrimSpace(value), false, rest, key != ""
+}
@@ -0,0 +1,129 @@
+package httpd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// dump.go把请求与响应还原成报文的格式，用于记录日志以及调试，与标准库net/http/httputil中的同名函数相同：
+//
+//	b, err := httpd.DumpRequest(r, true)
+//	log.Printf("%q", b)
+//
+// 需要包含报文主体时会把它全部读入内存，再替换为读取同样内容的Body，调用之后handler仍然可以正常读取，
+// 因此只应用于报文主体较小的场景。
+
+// DumpRequest 返回r的报文格式，请求行使用RequestURI以及Proto，首部按照字典序输出。
+// body为true时同时输出报文主体，原本使用chunk编码的报文主体会重新以chunk编码输出；
+// r.Body会被替换为内容相同的副本，读取出错时返回错误，此时r.Body中已经读出的数据会丢失
+func DumpRequest(r *Request, body bool) ([]byte, error) {
+	var data []byte
+	if body && requestHasBody(r) {
+		var err error
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body = bytes.NewReader(data)
+	}
+
+	uri := r.RequestURI
+	if uri == "" && r.URL != nil {
+		uri = r.URL.RequestURI()
+		if r.Method == "CONNECT" && r.URL.Path == "" {
+			uri = r.Host
+		}
+	}
+	method, proto := r.Method, r.Proto
+	if method == "" {
+		method = "GET"
+	}
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s %s\r\n", method, uri, proto)
+	// http/2的请求以及客户端请求中Host不在Header里
+	if _, ok := r.Header["Host"]; !ok && r.Host != "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", headerValueReplacer.Replace(r.Host))
+	}
+	// 客户端请求的Content-Length由Write根据ContentLength补充
+	if _, ok := r.Header["Content-Length"]; !ok && r.ContentLength > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", r.ContentLength)
+	}
+	if err := r.Header.Write(&b); err != nil {
+		return nil, err
+	}
+	b.WriteString("\r\n")
+	if body {
+		dumpBody(&b, data, isChunked(r.TransferEncoding), r.Trailer)
+	}
+	return b.Bytes(), nil
+}
+
+// requestHasBody 服务端没有报文主体的请求Body为eofReader，客户端请求则为nil
+func requestHasBody(r *Request) bool {
+	if r.Body == nil || r.ContentLength == 0 {
+		return false
+	}
+	_, ok := r.Body.(*eofReader)
+	return !ok
+}
+
+// DumpResponse 返回resp的报文格式，body为true时同时输出报文主体，
+// resp.Body读取完毕后被关闭并替换为内容相同的副本，含义同DumpRequest
+func DumpResponse(resp *Response, body bool) ([]byte, error) {
+	var data []byte
+	if body && resp.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+
+	proto, status := resp.Proto, resp.Status
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + StatusText(resp.StatusCode)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\r\n", proto, status)
+	if err := resp.Header.Write(&b); err != nil {
+		return nil, err
+	}
+	b.WriteString("\r\n")
+	if body {
+		dumpBody(&b, data, isChunked(resp.TransferEncoding), resp.Trailer)
+	}
+	return b.Bytes(), nil
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && strings.EqualFold(te[len(te)-1], "chunked")
+}
+
+// dumpBody 输出报文主体，chunked为true时把data作为一个chunk输出，之后是trailer
+func dumpBody(w io.Writer, data []byte, chunked bool, trailer Header) {
+	if !chunked {
+		w.Write(data)
+		return
+	}
+	if len(data) > 0 {
+		fmt.Fprintf(w, "%x\r\n", len(data))
+		w.Write(data)
+		io.WriteString(w, "\r\n")
+	}
+	io.WriteString(w, "0\r\n")
+	trailer.Write(w)
+	io.WriteString(w, "\r\n")
+}
@@ -0,0 +1,226 @@
+package httpd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filecache.go为FileHandler提供可选的内存缓存：css、js这类体积小、访问频繁的文件，
+// 每次请求都要open、stat、read一遍并不划算，缓存之后直接从内存发送，可以压缩的文件同时缓存gzip压缩后的版本。
+// 缓存的文件在CheckInterval内不会再访问文件系统，超过之后stat一次，修改时间或者大小变化了就重新读取。
+
+const (
+	// DefaultFileCacheSize FileCache默认最多占用的内存
+	DefaultFileCacheSize = 64 << 20
+	// DefaultFileCacheMaxFileSize 默认只缓存不超过1MB的文件
+	DefaultFileCacheMaxFileSize = 1 << 20
+	// DefaultFileCacheCheckInterval 默认每秒最多检查一次文件是否被修改
+	DefaultFileCacheCheckInterval = time.Second
+
+	// 小于这个大小的文件压缩后节省不了多少流量，不再缓存gzip版本
+	minGzipCacheSize = 256
+)
+
+// FileCache 是FileHandler使用的LRU缓存，零值即可使用。
+// 缓存以文件路径为键，一个FileCache只能用于一个FileHandler
+type FileCache struct {
+	// MaxBytes 缓存的文件内容(包括gzip版本)最多占用的内存，不大于0时使用DefaultFileCacheSize
+	MaxBytes int64
+	// MaxFileSize 大于它的文件不缓存，不大于0时使用DefaultFileCacheMaxFileSize
+	MaxFileSize int64
+	// CheckInterval 缓存的文件在这段时间内直接使用，不检查文件是否被修改，不大于0时使用DefaultFileCacheCheckInterval
+	CheckInterval time.Duration
+
+	mu    sync.Mutex
+	lru   *list.List // 最近使用的排在前面，元素为*fileCacheEntry
+	items map[string]*list.Element
+	size  int64
+}
+
+// NewFileCache 创建一个最多占用maxBytes内存的FileCache
+func NewFileCache(maxBytes int64) *FileCache {
+	return &FileCache{MaxBytes: maxBytes}
+}
+
+type fileCacheEntry struct {
+	key     string      // 请求的路径
+	name    string      // 实际的文件，请求目录时为其中的index.html
+	dir     bool        // 请求的路径是否为目录
+	info    os.FileInfo // 用于FileHandler.CacheControl
+	modtime time.Time
+	etag    string
+	ctype   string
+	data    []byte
+	gz      []byte // gzip压缩后的内容，文件不适合压缩时为nil
+	checked time.Time
+}
+
+func (e *fileCacheEntry) memSize() int64 {
+	return int64(len(e.data) + len(e.gz))
+}
+
+func (c *FileCache) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return DefaultFileCacheSize
+}
+
+func (c *FileCache) maxFileSize() int64 {
+	if c.MaxFileSize > 0 {
+		return c.MaxFileSize
+	}
+	return DefaultFileCacheMaxFileSize
+}
+
+func (c *FileCache) checkInterval() time.Duration {
+	if c.CheckInterval > 0 {
+		return c.CheckInterval
+	}
+	return DefaultFileCacheCheckInterval
+}
+
+// get 返回key对应的缓存，超过了CheckInterval的缓存通过stat确认文件没有变化后才返回，变化了的缓存被删除
+func (c *FileCache) get(fs FileSystem, key string) *fileCacheEntry {
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*fileCacheEntry)
+	fresh := time.Since(e.checked) < c.checkInterval()
+	c.mu.Unlock()
+	if fresh {
+		return e
+	}
+
+	// 检查文件时不持有锁，避免一次慢的stat阻塞其他请求
+	if !fileUnchanged(fs, e) {
+		c.remove(e)
+		return nil
+	}
+	c.mu.Lock()
+	e.checked = time.Now()
+	c.mu.Unlock()
+	return e
+}
+
+func fileUnchanged(fs FileSystem, e *fileCacheEntry) bool {
+	f, err := fs.Open(e.name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	return err == nil && !d.IsDir() && d.ModTime().Equal(e.modtime) && d.Size() == int64(len(e.data))
+}
+
+func (c *FileCache) remove(e *fileCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok && el.Value == e {
+		c.lru.Remove(el)
+		delete(c.items, e.key)
+		c.size -= e.memSize()
+	}
+}
+
+// load 读取文件f并放入缓存，文件太大或者读取失败时返回nil
+func (c *FileCache) load(key, name string, dir bool, d os.FileInfo, f io.Reader) *fileCacheEntry {
+	if !d.Mode().IsRegular() || d.Size() > c.maxFileSize() {
+		return nil
+	}
+	data := make([]byte, d.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil
+	}
+	e := &fileCacheEntry{
+		key:     key,
+		name:    name,
+		dir:     dir,
+		info:    d,
+		modtime: d.ModTime(),
+		etag:    fmt.Sprintf(`"%x-%x"`, d.ModTime().UnixNano(), d.Size()),
+		data:    data,
+		checked: time.Now(),
+	}
+	e.ctype = TypeByExtension(filepath.Ext(name))
+	if e.ctype == "" {
+		e.ctype = DetectContentType(data)
+	}
+	if len(data) >= minGzipCacheSize && !isCompressedContentType(e.ctype) {
+		var buf bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		gw.Write(data)
+		gw.Close()
+		// 压缩效果不明显时不值得占用内存
+		if buf.Len() < len(data)*9/10 {
+			e.gz = buf.Bytes()
+		}
+	}
+	if e.memSize() > c.maxBytes() {
+		return e
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+	if el, ok := c.items[key]; ok {
+		old := el.Value.(*fileCacheEntry)
+		c.size -= old.memSize()
+		el.Value = e
+		c.lru.MoveToFront(el)
+	} else {
+		c.items[key] = c.lru.PushFront(e)
+	}
+	c.size += e.memSize()
+	for c.size > c.maxBytes() {
+		el := c.lru.Back()
+		old := el.Value.(*fileCacheEntry)
+		c.lru.Remove(el)
+		delete(c.items, old.key)
+		c.size -= old.memSize()
+	}
+	return e
+}
+
+// serveCached 从内存发送缓存的文件，客户端接受gzip并且没有请求范围时发送压缩后的版本
+func (fh *FileHandler) serveCached(w ResponseWriter, r *Request, e *fileCacheEntry) {
+	h := w.Header()
+	etag := h.Get("ETag")
+	if etag == "" {
+		etag = e.etag
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", e.ctype)
+	}
+	fh.setCacheControl(w, e.name, e.info)
+	if e.gz != nil {
+		addVary(h, "Accept-Encoding")
+		if acceptsGzip(r) && r.Header.Get("Range") == "" {
+			// 压缩后的内容是另一种表示，需要不同的ETag
+			if strings.HasSuffix(etag, `"`) {
+				etag = etag[:len(etag)-1] + `-gzip"`
+			}
+			h.Set("ETag", etag)
+			h.Set("Content-Encoding", "gzip")
+			serveContent(w, r, e.name, e.modtime, int64(len(e.gz)), bytes.NewReader(e.gz))
+			return
+		}
+	}
+	h.Set("ETag", etag)
+	serveContent(w, r, e.name, e.modtime, int64(len(e.data)), bytes.NewReader(e.data))
+}
@@ -0,0 +1,92 @@
+package httpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+)
+
+// urlencoded表单的报文主体会被一次性读入内存，需要限制其大小，防止恶意客户端耗尽内存
+const maxFormSize = 10 << 20 // 10MB
+
+// application/x-www-form-urlencoded是最常见的表单编码方式，报文主体形如：
+// name=gu&token=1234&msg=hello%20world
+// 与queryString的格式一致，只是位于报文主体中，并且需要进行百分号解码
+
+// ParseForm 解析queryString以及urlencoded编码的报文主体，将结果分别存入Form以及PostForm。
+// 多次调用ParseForm是安全的，只有第一次调用会进行解析。
+func (r *Request) ParseForm() (err error) {
+	if r.PostForm == nil {
+		if ct, _ := r.parseContentType(); ct == "application/x-www-form-urlencoded" {
+			r.PostForm, err = parsePostForm(r.Body)
+		}
+		if r.PostForm == nil {
+			r.PostForm = make(url.Values)
+		}
+	}
+
+	if r.Form == nil {
+		r.Form = make(url.Values)
+		// 报文主体中的值排在queryString的值之前
+		copyValues(r.Form, r.PostForm)
+		query, e := url.ParseQuery(r.URL.RawQuery)
+		if err == nil {
+			err = e
+		}
+		copyValues(r.Form, query)
+	}
+	return
+}
+
+func parsePostForm(body io.Reader) (url.Values, error) {
+	// 多读一个字节，用于判断报文主体是否超过了限制
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxFormSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxFormSize {
+		return nil, errors.New("httpd: POST form too large")
+	}
+	return url.ParseQuery(string(buf))
+}
+
+func copyValues(dst, src url.Values) {
+	for k, vs := range src {
+		dst[k] = append(dst[k], vs...)
+	}
+}
+
+// FormValue 返回表单中name对应的第一个值，报文主体中的值优先于queryString中的值。
+// 如果表单还未解析，FormValue会根据Content-Type自动选择解析方式。
+func (r *Request) FormValue(name string) string {
+	if r.Form == nil {
+		r.parseFormLazily()
+	}
+	if vs := r.Form[name]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// PostFormValue 与FormValue类似，但只查询报文主体中的表单数据，忽略queryString
+func (r *Request) PostFormValue(name string) string {
+	if r.PostForm == nil {
+		r.parseFormLazily()
+	}
+	if vs := r.PostForm[name]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// 懒加载：直到用户第一次查询表单时才去解析报文主体，解析出错时忽略错误，查询结果为空即可。
+// 根据Content-Type选择解析方式，ParseMultipartForm内部也会调用ParseForm解析queryString。
+func (r *Request) parseFormLazily() {
+	if ct, _ := r.parseContentType(); ct == "multipart/form-data" {
+		r.ParseMultipartForm(defaultMaxMemory)
+	}
+	if r.Form == nil {
+		r.ParseForm()
+	}
+}
@@ -0,0 +1,156 @@
+package httpd
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// forwardproxy.go实现了正向代理，客户端把代理地址配置为HTTP代理后，所有请求都发往这里：
+//   - https等加密流量使用CONNECT方法建立隧道：CONNECT example.com:443 HTTP/1.1，
+//     代理连接上目标后回复200，此后客户端与目标之间的数据原样双向转发，代理看不到其中的内容；
+//   - 明文的http请求使用绝对形式的uri：GET http://example.com/index HTTP/1.1，由ReverseProxy转发。
+
+// ForwardProxy 是一个正向代理Handler，零值即可直接使用，此时不做任何认证
+type ForwardProxy struct {
+	// Authenticate 校验请求中的Proxy-Authorization，返回false时回复407，要求客户端提供凭证。
+	// 为nil时不需要认证，可以使用ProxyBasicAuth解析Basic认证的用户名与密码
+	Authenticate func(r *Request) bool
+	// Realm 回复407时Proxy-Authenticate首部中的realm
+	Realm string
+
+	// Authorize 判断是否允许访问target(host:port形式)，返回false时回复403。为nil时允许访问任意目标
+	Authorize func(r *Request, target string) bool
+
+	// DialContext 连接CONNECT的目标，为nil时使用超时为30秒的net.Dialer
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Transport 转发明文http请求，为nil时使用DefaultTransport
+	Transport RoundTripper
+
+	// ErrorLog 记录代理过程中的错误，为nil时使用log包
+	ErrorLog Logger
+}
+
+// ProxyBasicAuth 解析Proxy-Authorization首部中的Basic认证，格式错误或者不是Basic认证时ok为false
+func ProxyBasicAuth(r *Request) (username, password string, ok bool) {
+	return parseBasicAuth(r.Header.Get("Proxy-Authorization"))
+}
+
+// parseBasicAuth 解析 Basic base64(username:password)
+func parseBasicAuth(auth string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return cutString(string(b), ":")
+}
+
+func (p *ForwardProxy) logf(format string, v ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (p *ForwardProxy) ServeHTTP(w ResponseWriter, r *Request) {
+	if r.Method != "CONNECT" && !r.URL.IsAbs() {
+		w.WriteHeader(StatusBadRequest)
+		io.WriteString(w, "not a proxy request")
+		return
+	}
+	if p.Authenticate != nil && !p.Authenticate(r) {
+		realm := p.Realm
+		if realm == "" {
+			realm = "proxy"
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+		w.WriteHeader(StatusProxyAuthRequired)
+		return
+	}
+
+	target := r.URL.Host
+	if r.Method != "CONNECT" {
+		target = canonicalAddr(r.URL)
+	}
+	if p.Authorize != nil && !p.Authorize(r, target) {
+		w.WriteHeader(StatusForbidden)
+		return
+	}
+
+	if r.Method == "CONNECT" {
+		p.tunnel(w, r, target)
+		return
+	}
+	rp := &ReverseProxy{
+		Director:  func(*Request) {},
+		Transport: p.Transport,
+		ErrorLog:  p.ErrorLog,
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// tunnel 连接目标后接管客户端的连接，在两者之间双向转发数据
+func (p *ForwardProxy) tunnel(w ResponseWriter, r *Request, target string) {
+	hj, ok := w.(Hijacker)
+	if !ok {
+		w.WriteHeader(StatusInternalServerError)
+		return
+	}
+	dial := p.DialContext
+	if dial == nil {
+		d := net.Dialer{Timeout: 30 * time.Second}
+		dial = d.DialContext
+	}
+	upstream, err := dial(r.Context(), "tcp", target)
+	if err != nil {
+		p.logf("httpd: proxy dial %s: %v", target, err)
+		w.WriteHeader(StatusBadGateway)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		p.logf("httpd: proxy hijack: %v", err)
+		return
+	}
+	defer conn.Close()
+	defer upstream.Close()
+
+	if _, err = rw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		return
+	}
+
+	// 客户端可能在收到200之前就发来了数据(如tls的ClientHello)，它们已经缓存在rw.Reader中，
+	// 所以客户端到目标的方向从rw.Reader读取。一个方向结束后只关闭对端的写，另一个方向仍然可以继续传输
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, rw.Reader)
+		closeWrite(upstream)
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite 关闭连接的写方向，告知对端数据已经发送完毕；不支持半关闭的连接直接关闭
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
@@ -0,0 +1,621 @@
+package httpd
+
+// fs.go 实现静态文件服务
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileSystem 是对一组文件的抽象，FileServer通过它来访问文件。
+// Open的参数是以/分隔的路径，并且已经经过了path.Clean的处理。
+type FileSystem interface {
+	Open(name string) (FileSystemFile, error)
+}
+
+// FileSystemFile 是FileSystem打开后的文件，*os.File天然实现了这个接口
+type FileSystemFile interface {
+	io.Closer
+	io.Reader
+	io.Seeker
+	Readdir(count int) ([]os.FileInfo, error)
+	Stat() (os.FileInfo, error)
+}
+
+// Dir 使用本地文件系统中以Dir为根的目录树实现FileSystem，
+// 例如 httpd.Dir("/var/www") 中的 /index.html 对应磁盘上的 /var/www/index.html。
+type Dir string
+
+func (d Dir) Open(name string) (FileSystemFile, error) {
+	// 在windows下，\也是路径分隔符，不允许出现在路径中，否则可能借此逃逸出根目录
+	if filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator) {
+		return nil, errors.New("httpd: invalid character in file path")
+	}
+	dir := string(d)
+	if dir == "" {
+		dir = "."
+	}
+	// 先在/下进行Clean，..最多只能回退到/，从而保证最终的路径不会跑到dir之外
+	fullName := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	f, err := os.Open(fullName)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// FileHandler 是提供静态文件服务的Handler，需要开启目录列表时可以直接构造：
+//
+//	h := &httpd.FileHandler{Root: httpd.Dir("./public"), ListDirectories: true}
+type FileHandler struct {
+	Root FileSystem
+	// ListDirectories 为true时，没有index.html的目录返回一个列出目录内容的html页面，
+	// 可以按照名称、大小、修改时间排序；为false时回复404，不暴露目录的结构
+	ListDirectories bool
+	// Cache 不为nil时，小文件的内容缓存在内存中，见FileCache
+	Cache *FileCache
+	// CacheControl 返回文件对应的Cache-Control首部，返回空字符串时不设置。name为以/开头的文件路径，
+	// 请求目录时为其中的index.html，目录列表的name以/结尾。handler事先设置了Cache-Control时不会调用。
+	// 一般使用CacheControlRules按照路径模式配置
+	CacheControl func(name string, info os.FileInfo) string
+}
+
+// CacheRule 是CacheControlRules中的一条规则，Pattern为path.Match格式的模式，
+// 含有/时与完整的路径匹配(如"/assets/*.js")，否则只与文件名匹配(如"*.html")
+type CacheRule struct {
+	Pattern      string
+	CacheControl string
+}
+
+// CacheControlRules 返回一个按照rules设置Cache-Control的函数，用于FileHandler.CacheControl，排在前面的规则优先。
+// 例如文件名带有内容指纹的资源可以长期缓存，html则需要每次验证：
+//
+//	CacheControlRules(
+//		CacheRule{"/assets/*", "public, max-age=31536000, immutable"},
+//		CacheRule{"*.html", "no-cache"},
+//	)
+//
+// 模式格式错误时panic
+func CacheControlRules(rules ...CacheRule) func(name string, info os.FileInfo) string {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			panic("httpd: invalid cache rule pattern " + rule.Pattern)
+		}
+	}
+	rules = append([]CacheRule(nil), rules...)
+	return func(name string, info os.FileInfo) string {
+		for _, rule := range rules {
+			target := name
+			if !strings.Contains(rule.Pattern, "/") {
+				target = path.Base(name)
+			}
+			if ok, _ := path.Match(rule.Pattern, target); ok {
+				return rule.CacheControl
+			}
+		}
+		return ""
+	}
+}
+
+// FileServer 返回一个以root为根目录提供静态文件服务的Handler。
+// 请求路径为目录时，返回目录下的index.html，没有index.html时回复404。
+func FileServer(root FileSystem) Handler {
+	return &FileHandler{Root: root}
+}
+
+func (f *FileHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+		r.URL.Path = upath
+	}
+	f.serveFile(w, r, path.Clean(upath), true)
+}
+
+const indexPage = "/index.html"
+
+// serveFile 将name对应的文件发送给客户端，redirect代表是否对不规范的url进行重定向：
+// 目录的url需要以/结尾，文件的url则不能以/结尾，这样浏览器解析页面中的相对路径时才不会出错。
+func (fh *FileHandler) serveFile(w ResponseWriter, r *Request, name string, redirect bool) {
+	// 访问/index.html时重定向到./，避免同一个页面存在两个url
+	if strings.HasSuffix(r.URL.Path, indexPage) {
+		localRedirect(w, r, "./")
+		return
+	}
+	// 缓存中的文件只在url是否以/结尾与它是否为目录相符时使用，否则交给下面重定向
+	if fh.Cache != nil {
+		if e := fh.Cache.get(fh.Root, name); e != nil && (!redirect || e.dir == strings.HasSuffix(r.URL.Path, "/")) {
+			fh.serveCached(w, r, e)
+			return
+		}
+	}
+
+	f, err := fh.Root.Open(name)
+	if err != nil {
+		serveFileError(w, err)
+		return
+	}
+	defer f.Close()
+
+	d, err := f.Stat()
+	if err != nil {
+		serveFileError(w, err)
+		return
+	}
+
+	if redirect {
+		url := r.URL.Path
+		if d.IsDir() {
+			if url[len(url)-1] != '/' {
+				localRedirect(w, r, path.Base(url)+"/")
+				return
+			}
+		} else if url[len(url)-1] == '/' {
+			localRedirect(w, r, "../"+path.Base(url))
+			return
+		}
+	}
+
+	key, isDir := name, d.IsDir()
+	if isDir {
+		index := strings.TrimSuffix(name, "/") + indexPage
+		ff, err := fh.Root.Open(index)
+		if err != nil {
+			if fh.ListDirectories {
+				fh.setCacheControl(w, strings.TrimSuffix(name, "/")+"/", d)
+				dirList(w, r, f, d.ModTime())
+				return
+			}
+			NotFound(w, r)
+			return
+		}
+		defer ff.Close()
+		dd, err := ff.Stat()
+		if err != nil || dd.IsDir() {
+			NotFound(w, r)
+			return
+		}
+		name, d, f = index, dd, ff
+	}
+
+	if fh.Cache != nil {
+		if e := fh.Cache.load(key, name, isDir, d, f); e != nil {
+			fh.serveCached(w, r, e)
+			return
+		}
+		// 可能已经读取了部分内容
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			Error(w, "seeker can't seek", StatusInternalServerError)
+			return
+		}
+	}
+
+	// 根据修改时间以及文件大小生成ETag，文件内容改变时ETag也会随之改变
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, d.ModTime().UnixNano(), d.Size()))
+	}
+	fh.setCacheControl(w, name, d)
+	serveContent(w, r, name, d.ModTime(), d.Size(), f)
+}
+
+// setCacheControl 在发送内容之前设置Cache-Control，304响应同样需要携带它
+func (fh *FileHandler) setCacheControl(w ResponseWriter, name string, info os.FileInfo) {
+	if fh.CacheControl == nil {
+		return
+	}
+	h := w.Header()
+	if _, ok := h["Cache-Control"]; ok {
+		return
+	}
+	if v := fh.CacheControl(name, info); v != "" {
+		h.Set("Cache-Control", v)
+	}
+}
+
+// ServeContent 将content的内容发送给客户端，支持Range请求以及条件请求。
+// name用于根据扩展名推断Content-Type，无法推断时嗅探content的前512字节，modtime不为零值时用于设置Last-Modified。
+// 如果调用方事先在响应首部中设置了ETag，则会用它来处理If-None-Match以及If-Range。
+// content的大小通过Seek到末尾得到，发送时会Seek到对应的位置。
+func ServeContent(w ResponseWriter, r *Request, name string, modtime time.Time, content io.ReadSeeker) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		Error(w, "seeker can't seek", StatusInternalServerError)
+		return
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		Error(w, "seeker can't seek", StatusInternalServerError)
+		return
+	}
+	serveContent(w, r, name, modtime, size, content)
+}
+
+func serveContent(w ResponseWriter, r *Request, name string, modtime time.Time, size int64, content io.ReadSeeker) {
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		ctype := TypeByExtension(filepath.Ext(name))
+		if ctype == "" {
+			// 扩展名无法判断时读取文件开头的内容嗅探
+			var buf [sniffLen]byte
+			n, _ := io.ReadFull(content, buf[:])
+			ctype = DetectContentType(buf[:n])
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				Error(w, "seeker can't seek", StatusInternalServerError)
+				return
+			}
+		}
+		header.Set("Content-Type", ctype)
+	}
+	if !isZeroTime(modtime) {
+		header.Set("Last-Modified", modtime.UTC().Format(TimeFormat))
+	}
+
+	done, rangeReq := checkPreconditions(w, r, modtime)
+	if done {
+		return
+	}
+	header.Set("Accept-Ranges", "bytes")
+
+	code := StatusOK
+	sendSize := size
+	// 无法满足或者格式错误的Range直接忽略，返回完整的内容
+	ranges, ok := parseRanges(rangeReq, size)
+	switch {
+	case !ok:
+	case len(ranges) == 1:
+		ra := ranges[0]
+		if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+			Error(w, "seeker can't seek", StatusInternalServerError)
+			return
+		}
+		code = StatusPartialContent
+		sendSize = ra.length
+		header.Set("Content-Range", ra.contentRange(size))
+	case len(ranges) <= maxRanges && sumRangesSize(ranges) <= size:
+		// 多个范围时返回multipart/byteranges。范围过多或者互相重叠导致总量超过文件本身时，
+		// 返回完整的内容更划算，也避免被用来放大流量
+		serveMultiRange(w, r, ranges, size, content)
+		return
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(sendSize, 10))
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		io.CopyN(w, content, sendSize)
+	}
+}
+
+// dirList 返回目录的html列表，通过queryString中的sort(name、size、mtime)以及order(asc、desc)排序
+func dirList(w ResponseWriter, r *Request, f FileSystemFile, modtime time.Time) {
+	// 目录内容变化时它的修改时间也会改变，可以用于条件请求
+	if !isZeroTime(modtime) {
+		w.Header().Set("Last-Modified", modtime.UTC().Format(TimeFormat))
+		if done, _ := checkPreconditions(w, r, modtime); done {
+			return
+		}
+	}
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		Error(w, "500 Error reading directory", StatusInternalServerError)
+		return
+	}
+	key, desc := r.Query("sort"), r.Query("order") == "desc"
+	if key != "size" && key != "mtime" {
+		key = "name"
+	}
+	less := func(a, b os.FileInfo) bool {
+		switch key {
+		case "size":
+			return a.Size() < b.Size()
+		case "mtime":
+			return a.ModTime().Before(b.ModTime())
+		}
+		return a.Name() < b.Name()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	title := html.EscapeString(r.URL.Path)
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Index of " + title + "</title>\n</head>\n<body>\n")
+	buf.WriteString("<h1>Index of " + title + "</h1>\n<table>\n<tr>")
+	for _, col := range []struct{ key, text string }{{"name", "Name"}, {"size", "Size"}, {"mtime", "Modified"}} {
+		// 再次点击当前排序的列时反转顺序
+		order := "asc"
+		if col.key == key && !desc {
+			order = "desc"
+		}
+		buf.WriteString("<th><a href=\"?sort=" + col.key + "&amp;order=" + order + "\">" + col.text + "</a></th>")
+	}
+	buf.WriteString("</tr>\n")
+	if r.URL.Path != "/" {
+		buf.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, e := range entries {
+		name, size := e.Name(), strconv.FormatInt(e.Size(), 10)
+		if e.IsDir() {
+			name, size = name+"/", "-"
+		}
+		// 文件名中可能含有?、#等字符，需要作为路径转义，./防止含有:的文件名被当作scheme
+		href := (&url.URL{Path: "./" + name}).String()
+		fmt.Fprintf(&buf, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, e.ModTime().UTC().Format(TimeFormat))
+	}
+	buf.WriteString("</table>\n</body>\n</html>\n")
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
+
+func isZeroTime(t time.Time) bool {
+	return t.IsZero() || t.Unix() == 0
+}
+
+// 条件请求让客户端只在资源发生变化时才重新获取资源：
+// 客户端缓存了资源后，在下一次请求时带上If-None-Match(上一次响应中的ETag)或者If-Modified-Since(上一次响应中的Last-Modified)，
+// 如果资源没有变化，服务端回复304 Not Modified而不携带报文主体，客户端直接使用缓存即可。
+// If-Range则用于断点续传：只有资源没有变化时，Range才会生效，否则返回完整的资源。
+
+// checkPreconditions 处理条件请求，done为true说明已经回复了304或412，调用方不需要再发送内容。
+// rangeReq为经过If-Range判断后仍然有效的Range首部。
+func checkPreconditions(w ResponseWriter, r *Request, modtime time.Time) (done bool, rangeReq string) {
+	etag := w.Header().Get("ETag")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagWeakListMatch(inm, etag) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				writeNotModified(w)
+			} else {
+				w.WriteHeader(StatusPreconditionFailed)
+			}
+			return true, ""
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && (r.Method == "GET" || r.Method == "HEAD") && !isZeroTime(modtime) {
+		// If-None-Match优先于If-Modified-Since，同时存在时忽略后者
+		if t, err := time.Parse(TimeFormat, ims); err == nil {
+			// http首部中的时间只精确到秒
+			if !modtime.Truncate(time.Second).After(t) {
+				writeNotModified(w)
+				return true, ""
+			}
+		}
+	}
+
+	rangeReq = r.Header.Get("Range")
+	if ir := r.Header.Get("If-Range"); ir != "" && rangeReq != "" {
+		if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+			// If-Range中的ETag必须使用强比较
+			if !etagStrongMatch(ir, etag) {
+				rangeReq = ""
+			}
+		} else if t, err := time.Parse(TimeFormat, ir); err != nil || isZeroTime(modtime) || !modtime.Truncate(time.Second).Equal(t) {
+			rangeReq = ""
+		}
+	}
+	return false, rangeReq
+}
+
+// 304响应不携带报文主体，与报文主体相关的首部也需要删除
+func writeNotModified(w ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	if h.Get("ETag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(StatusNotModified)
+}
+
+// etagWeakListMatch 判断以逗号分隔的ETag列表中是否有与etag匹配的，*匹配任意ETag。
+// If-None-Match使用弱比较，即忽略W/前缀。
+func etagWeakListMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 强比较要求两个ETag都不是弱ETag，并且完全相同
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && !strings.HasPrefix(a, "W/")
+}
+
+// httpRange 代表Range首部中的一个范围，对应内容中[start, start+length)的字节
+type httpRange struct {
+	start, length int64
+}
+
+func (ra httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size)
+}
+
+// maxRanges 一个请求最多允许的范围数，超过时返回完整的内容
+const maxRanges = 64
+
+// parseRanges 解析Range首部，返回其中可以满足的范围，首部格式错误或者没有可以满足的范围时返回false。
+// Range首部中可以有多个以逗号分隔的范围，每个范围有三种形式：
+// bytes=0-499  第0到第499个字节
+// bytes=500-   第500个字节到末尾
+// bytes=-500   最后500个字节
+func parseRanges(s string, size int64) ([]httpRange, bool) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, false
+	}
+	var ranges []httpRange
+	for _, spec := range strings.Split(s[len(b):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		ra, satisfiable, ok := parseRange(spec, size)
+		if !ok {
+			return nil, false
+		}
+		if satisfiable {
+			ranges = append(ranges, ra)
+		}
+	}
+	return ranges, len(ranges) > 0
+}
+
+// parseRange 解析一个范围，ok为false代表格式错误，satisfiable为false代表范围超出了内容的大小
+func parseRange(spec string, size int64) (ra httpRange, satisfiable, ok bool) {
+	index := strings.IndexByte(spec, '-')
+	if index == -1 {
+		return httpRange{}, false, false
+	}
+	start, end := strings.TrimSpace(spec[:index]), strings.TrimSpace(spec[index+1:])
+
+	if start == "" {
+		// 后缀形式，取最后n个字节
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return httpRange{}, false, false
+		}
+		if n == 0 || size == 0 {
+			return httpRange{}, false, true
+		}
+		if n > size {
+			n = size
+		}
+		ra.start, ra.length = size-n, n
+		return ra, true, true
+	}
+
+	i, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || i < 0 {
+		return httpRange{}, false, false
+	}
+	ra.start = i
+	var j int64
+	if end == "" {
+		j = size - 1
+	} else if j, err = strconv.ParseInt(end, 10, 64); err != nil || j < i {
+		return httpRange{}, false, false
+	}
+	if i >= size {
+		return httpRange{}, false, true
+	}
+	if j >= size {
+		j = size - 1
+	}
+	ra.length = j - i + 1
+	return ra, true, true
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
+
+// serveMultiRange 以multipart/byteranges回复多个范围，每个部分带有自己的Content-Type以及Content-Range：
+//
+//	--BOUNDARY
+//	Content-Type: text/plain
+//	Content-Range: bytes 0-49/1000
+//
+//	...第0到第49个字节...
+//	--BOUNDARY
+//	...
+//	--BOUNDARY--
+func serveMultiRange(w ResponseWriter, r *Request, ranges []httpRange, size int64, content io.ReadSeeker) {
+	header := w.Header()
+	boundary := randomBoundary()
+	ctype := header.Get("Content-Type")
+	// 事先生成每个部分的首部，以便计算出Content-Length
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, ra := range ranges {
+		h := "\r\n--" + boundary + "\r\n"
+		if ctype != "" {
+			h += "Content-Type: " + ctype + "\r\n"
+		}
+		h += "Content-Range: " + ra.contentRange(size) + "\r\n\r\n"
+		partHeaders[i] = h
+		length += int64(len(h)) + ra.length
+	}
+	closing := "\r\n--" + boundary + "--\r\n"
+	length += int64(len(closing))
+
+	header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(StatusPartialContent)
+	if r.Method == "HEAD" {
+		return
+	}
+	for i, ra := range ranges {
+		if _, err := content.Seek(ra.start, io.SeekStart); err != nil {
+			// 首部已经发送，只能中断响应
+			return
+		}
+		io.WriteString(w, partHeaders[i])
+		if _, err := io.CopyN(w, content, ra.length); err != nil {
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+// randomBoundary 生成multipart的分隔符，随机的分隔符几乎不可能与内容冲突
+func randomBoundary() string {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// localRedirect 发送一个相对路径的重定向，保留原请求中的queryString
+func localRedirect(w ResponseWriter, r *Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(StatusMovedPermanently)
+}
+
+// 将打开文件时的错误转换为合适的状态码，不把具体的错误信息暴露给客户端
+func serveFileError(w ResponseWriter, err error) {
+	if os.IsNotExist(err) {
+		Error(w, "404 page not found", StatusNotFound)
+		return
+	}
+	if os.IsPermission(err) {
+		Error(w, "403 Forbidden", StatusForbidden)
+		return
+	}
+	Error(w, "500 Internal Server Error", StatusInternalServerError)
+}
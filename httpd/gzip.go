@@ -0,0 +1,241 @@
+package httpd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 客户端通过Accept-Encoding告知服务端自己支持的压缩方式，如Accept-Encoding: gzip, deflate, br。
+// 服务端压缩了报文主体后，需要通过Content-Encoding: gzip告知客户端，
+// 同时设置Vary: Accept-Encoding，提醒中间的缓存服务器这个响应会随着Accept-Encoding的不同而不同。
+
+// GzipHandler 返回一个包装了h的Handler，当客户端支持gzip时对响应的报文主体进行压缩。
+// 已经压缩过的内容(图片、视频、压缩包等)以及已经设置了Content-Encoding的响应不会被再次压缩。
+func GzipHandler(h Handler) Handler {
+	return &gzipHandler{h: h}
+}
+
+type gzipHandler struct {
+	h Handler
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+func (g *gzipHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	if !acceptsGzip(r) {
+		g.h.ServeHTTP(w, r)
+		return
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w, req: r}
+	defer gw.close()
+	g.h.ServeHTTP(gw, r)
+}
+
+// acceptsGzip 判断客户端是否接受gzip编码，q=0代表明确拒绝
+func acceptsGzip(r *Request) bool {
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			coding, q := parseQValue(part)
+			if (coding == "gzip" || coding == "*") && q > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseQValue 解析形如 gzip;q=0.8 的值，没有q参数时权重为1
+func parseQValue(s string) (value string, q float64) {
+	q = 1
+	params := strings.Split(s, ";")
+	value = strings.ToLower(strings.TrimSpace(params[0]))
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "q=") {
+			continue
+		}
+		if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+			q = f
+		}
+	}
+	return
+}
+
+type gzipResponseWriter struct {
+	ResponseWriter
+	req *Request
+
+	wroteHeader bool
+	gz          *gzip.Writer // 为nil说明此响应不进行压缩
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	addVary(h, "Accept-Encoding")
+	if w.shouldCompress(code) {
+		h.Set("Content-Encoding", "gzip")
+		// 压缩后的长度无法预知，交给框架使用chunk编码
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// 压缩后的内容与原内容不再逐字节相同，强ETag需要降级为弱ETag
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzipWriterPool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) shouldCompress(code int) bool {
+	h := w.Header()
+	if !bodyAllowedForStatus(code) || code == StatusPartialContent || w.req.Method == "HEAD" {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	return !isCompressedContentType(h.Get("Content-Type"))
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// 设置了Content-Encoding之后框架不会再嗅探，所以要在压缩之前根据原始数据补充Content-Type，
+		// 嗅探出的类型同时决定了是否需要压缩
+		sniffContentType(w.Header(), b)
+		w.WriteHeader(StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// close 在handler结束后调用，写入gzip的尾部
+func (w *gzipResponseWriter) close() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Close()
+	gzipWriterPool.Put(w.gz)
+	w.gz = nil
+}
+
+// Flush 先把gzip中还没有输出的压缩数据写出，再交给底层的Flusher发送
+func (w *gzipResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(Hijacker)
+	if !ok {
+		return nil, nil, ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+// 这些类型的内容本身就是压缩过的，再用gzip压缩只会浪费cpu
+func isCompressedContentType(ct string) bool {
+	if i := strings.IndexByte(ct, ';'); i != -1 {
+		ct = ct[:i]
+	}
+	ct = strings.ToLower(strings.TrimSpace(ct))
+	switch {
+	case strings.HasPrefix(ct, "image/") && ct != "image/svg+xml":
+		return true
+	case strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"):
+		return true
+	}
+	switch ct {
+	case "application/zip", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+		"application/x-rar-compressed", "application/zstd", "font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
+
+// addVary 往Vary首部中追加一个值，已经存在时不重复添加
+func addVary(h Header, value string) {
+	for _, v := range h["Vary"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// 客户端也可以压缩请求的报文主体，并通过Content-Encoding告知服务端。
+
+// decompressReader 在第一次读取时才创建解压器，因为创建gzip.Reader时就需要读取gzip的头部，
+// 提前读取会导致handler还没决定是否接收报文主体时就发送了100 Continue。
+// 很小的压缩数据就能解压出极大的内容(zip炸弹)，解压后的数据超过max字节时返回ErrBodyTooLarge
+type decompressReader struct {
+	r        io.Reader // 原始的报文主体
+	encoding string
+	max      int64
+	zr       io.Reader
+	err      error
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.zr == nil {
+		switch d.encoding {
+		case "gzip", "x-gzip":
+			d.zr, d.err = gzip.NewReader(d.r)
+		case "deflate":
+			d.zr, d.err = zlib.NewReader(d.r)
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.zr = &maxBytesReader{r: d.zr, n: d.max}
+	}
+	n, err := d.zr.Read(p)
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func (r *Request) fixDecompressReader() {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "gzip", "x-gzip", "deflate":
+	default:
+		return
+	}
+	r.Body = &decompressReader{r: r.Body, encoding: encoding, max: r.conn.svr.maxDecompressedBytes()}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+}
@@ -0,0 +1,133 @@
+package httpd
+
+import (
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// handlers.go提供了一些常用的Handler以及构造Handler的辅助函数。
+
+// Error 回复一个纯文本的错误响应，msg为响应的内容。
+// 同时设置X-Content-Type-Options: nosniff，防止浏览器把其中由用户输入构成的内容当作html执行。
+// 调用之后handler不应该再写入w
+func Error(w ResponseWriter, msg string, code int) {
+	h := w.Header()
+	// handler可能已经为正常的响应设置了这些首部，它们对错误信息不再适用
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	io.WriteString(w, msg+"\n")
+}
+
+// NotFound 回复404
+func NotFound(w ResponseWriter, r *Request) {
+	Error(w, "404 page not found", StatusNotFound)
+}
+
+// NotFoundHandler 返回一个对所有请求都回复404的Handler
+func NotFoundHandler() Handler {
+	return notFoundHandler{}
+}
+
+type notFoundHandler struct{}
+
+func (notFoundHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	NotFound(w, r)
+}
+
+// StripPrefix 返回一个Handler，它去掉请求路径中的prefix后交给h处理，URL.Path、URL.RawPath以及RequestURI同时修改。
+// 路径不以prefix开头时回复404。常用于把FileServer挂载在子路径下：
+//
+//	StripPrefix("/static", FileServer(Dir("./public")))
+func StripPrefix(prefix string, h Handler) Handler {
+	if prefix == "" {
+		return h
+	}
+	return &stripPrefixHandler{prefix: prefix, h: h}
+}
+
+type stripPrefixHandler struct {
+	prefix string
+	h      Handler
+}
+
+func (s *stripPrefixHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	p := strings.TrimPrefix(r.URL.Path, s.prefix)
+	rp := strings.TrimPrefix(r.URL.RawPath, s.prefix)
+	// RawPath不为空时，两者都要以prefix开头，否则转义前后的路径会不一致
+	if len(p) == len(r.URL.Path) || r.URL.RawPath != "" && len(rp) == len(r.URL.RawPath) {
+		NotFound(w, r)
+		return
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = rp
+	r2.RequestURI = r2.URL.RequestURI()
+	s.h.ServeHTTP(w, r2)
+}
+
+// Redirect 回复一个重定向到target的响应，code应当是3xx状态码。
+// target可以是绝对地址，也可以是相对于当前请求路径的相对地址(如 "../list"、"detail?id=1")，后者会被转换为以/开头的路径。
+// GET、HEAD请求的响应中附带一个指向target的html链接，方便不会自动跳转的客户端
+func Redirect(w ResponseWriter, r *Request, target string, code int) {
+	if u, err := url.Parse(target); err == nil && u.Scheme == "" && u.Host == "" {
+		target = resolveRedirectPath(r.URL.Path, target)
+	}
+	h := w.Header()
+	h.Set("Location", target)
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if _, ok := h["Content-Type"]; !ok {
+			h.Set("Content-Type", "text/html; charset=utf-8")
+		}
+	}
+	w.WriteHeader(code)
+	if r.Method == "GET" {
+		io.WriteString(w, "<a href=\""+html.EscapeString(target)+"\">"+StatusText(code)+"</a>.\n")
+	}
+}
+
+// resolveRedirectPath 把相对地址转换为以/开头的路径，并清理其中的.与..，原地址以/结尾的保留结尾的/
+func resolveRedirectPath(current, target string) string {
+	p, query := target, ""
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p, query = p[:i], p[i:]
+	}
+	if p == "" {
+		return current + query
+	}
+	if p[0] != '/' {
+		dir, _ := path.Split(current)
+		if dir == "" {
+			dir = "/"
+		}
+		p = dir + p
+	}
+	trailing := strings.HasSuffix(p, "/")
+	p = path.Clean(p)
+	if trailing && p != "/" {
+		p += "/"
+	}
+	return p + query
+}
+
+// RedirectHandler 返回一个把所有请求都重定向到target的Handler
+func RedirectHandler(target string, code int) Handler {
+	return &redirectHandler{target: target, code: code}
+}
+
+type redirectHandler struct {
+	target string
+	code   int
+}
+
+func (rh *redirectHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	Redirect(w, r, rh.target, rh.code)
+}
@@ -1,22 +1,145 @@
 package httpd
 
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// Header 存储首部字段，http首部的字段名是大小写不敏感的，
+// 因此我们统一将字段名转换成规范形式(canonical)再作为map的key，如content-type会被转换成Content-Type。
+// 直接操作map时也需要使用规范形式的字段名。
 type Header map[string][]string
 
-func (h Header) Add(key,val string) {
-	h[key] = append(h[key],val)
+func (h Header) Add(key, val string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], val)
 }
 
-func (h Header) Set(key,val string) {
-	h[key] = []string{val}
+func (h Header) Set(key, val string) {
+	h[CanonicalHeaderKey(key)] = []string{val}
 }
 
 func (h Header) Get(key string) string {
-	if val,ok := h[key];ok && len(val) > 0 {
+	if val, ok := h[CanonicalHeaderKey(key)]; ok && len(val) > 0 {
 		return val[0]
 	}
 	return ""
 }
 
-func(h Header) Del(key string) {
-	delete(h, key)
-}
\ No newline at end of file
+func (h Header) Del(key string) {
+	delete(h, CanonicalHeaderKey(key))
+}
+
+// Values 返回key对应的所有值，返回的切片与Header共享底层数组
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// Clone 深拷贝一份Header，h为nil时返回nil
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	// 所有的值共用一个切片，减少内存分配
+	n := 0
+	for _, vs := range h {
+		n += len(vs)
+	}
+	all := make([]string, n)
+	h2 := make(Header, len(h))
+	for k, vs := range h {
+		n = copy(all, vs)
+		h2[k] = all[:n:n]
+		all = all[n:]
+	}
+	return h2
+}
+
+// Write 将首部以 key: value\r\n 的格式写入w，不包含结束首部的空行
+func (h Header) Write(w io.Writer) error {
+	return h.WriteSubset(w, nil)
+}
+
+// WriteSubset 与Write相同，但会跳过exclude中为true的字段，exclude中的key需要是规范形式。
+// 字段按照字典序写入，值中的换行符会被替换成空格，防止伪造首部。
+func (h Header) WriteSubset(w io.Writer, exclude map[string]bool) error {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		if !exclude[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	sw, ok := w.(io.StringWriter)
+	if !ok {
+		sw = stringWriter{w}
+	}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			v = strings.TrimSpace(headerValueReplacer.Replace(v))
+			for _, s := range []string{k, ": ", v, "\r\n"} {
+				if _, err := sw.WriteString(s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var headerValueReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+type stringWriter struct {
+	w io.Writer
+}
+
+func (w stringWriter) WriteString(s string) (int, error) {
+	return w.w.Write([]byte(s))
+}
+
+// CanonicalHeaderKey 返回字段名的规范形式：首字母以及每个-之后的字母大写，其余字母小写，
+// 如 accept-encoding 转换为 Accept-Encoding。
+// 如果字段名中包含空格等不合法的字符，则原样返回，与textproto的语义保持一致。
+func CanonicalHeaderKey(s string) string {
+	// 大多数时候字段名已经是规范形式了，先检查一遍，避免不必要的内存分配
+	upper := true
+	canonical := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isTokenChar(c) {
+			return s
+		}
+		if upper && 'a' <= c && c <= 'z' || !upper && 'A' <= c && c <= 'Z' {
+			canonical = false
+		}
+		upper = c == '-'
+	}
+	if canonical {
+		return s
+	}
+	return canonicalHeaderKey([]byte(s))
+}
+
+// token中不能包含控制字符、空白字符以及分隔符
+func isTokenChar(b byte) bool {
+	if b <= ' ' || b >= 0x7f {
+		return false
+	}
+	return !strings.ContainsRune(`()<>@,;:\"/[]?={}`, rune(b))
+}
+
+func canonicalHeaderKey(b []byte) string {
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b[i] = c
+		upper = c == '-'
+	}
+	return string(b)
+}
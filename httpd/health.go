@@ -0,0 +1,165 @@
+package httpd
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health.go提供供负载均衡器以及容器编排系统探测的健康检查接口：
+//
+//	health := httpd.NewHealthHandler(srv)
+//	health.AddCheck("db", func(ctx context.Context) error { return db.PingContext(ctx) })
+//	mux.Handle("GET /healthz", health)
+//
+// 所有检查都通过时回复200，否则回复503，报文主体是每一项检查的结果：
+//
+//	{"status":"unavailable","checks":{"db":{"status":"error","error":"connection refused","duration_ms":3.2}}}
+//
+// 服务器开始Shutdown后直接回复503，status为draining，配合Server.DrainDelay，
+// 负载均衡器在监听器关闭之前就能发现并停止转发新的请求。
+
+// DefaultHealthCheckTimeout HealthHandler默认的单项检查超时时间
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// HealthCheck 检查一项依赖是否可用，应当在ctx结束时尽快返回
+type HealthCheck func(ctx context.Context) error
+
+// HealthHandler 汇总多项检查的结果，检查在每次请求时并发执行
+type HealthHandler struct {
+	// Timeout 每一项检查的超时时间，不大于0时使用DefaultHealthCheckTimeout。
+	// 超时的检查视为失败，即使检查函数没有理会ctx，请求也不会等待它返回
+	Timeout time.Duration
+
+	mu       sync.RWMutex
+	names    []string
+	checks   map[string]HealthCheck
+	draining int32
+}
+
+// NewHealthHandler 创建一个HealthHandler，srv不为nil时在srv开始Shutdown时自动调用Drain
+func NewHealthHandler(srv *Server) *HealthHandler {
+	h := &HealthHandler{}
+	if srv != nil {
+		srv.RegisterOnShutdown(h.Drain)
+	}
+	return h
+}
+
+// AddCheck 添加一项名为name的检查，同名的检查会被替换
+func (h *HealthHandler) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checks == nil {
+		h.checks = make(map[string]HealthCheck)
+	}
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+		sort.Strings(h.names)
+	}
+	h.checks[name] = check
+}
+
+// Drain 使之后的请求都回复503，表示服务器正在下线，不可撤销
+func (h *HealthHandler) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Draining 是否已经调用过Drain
+func (h *HealthHandler) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// HealthResult 一项检查的结果
+type HealthResult struct {
+	Status   string  `json:"status"` // ok、error或者timeout
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// HealthReport HealthHandler回复的报文主体
+type HealthReport struct {
+	Status string                  `json:"status"` // ok、unavailable或者draining
+	Checks map[string]HealthResult `json:"checks,omitempty"`
+}
+
+func (h *HealthHandler) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return DefaultHealthCheckTimeout
+}
+
+// Check 执行所有的检查并返回汇总的结果
+func (h *HealthHandler) Check(ctx context.Context) HealthReport {
+	if h.Draining() {
+		return HealthReport{Status: "draining"}
+	}
+	h.mu.RLock()
+	names := h.names
+	checks := make([]HealthCheck, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.RUnlock()
+
+	results := make([]HealthResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			results[i] = runHealthCheck(ctx, check, h.timeout())
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: "ok"}
+	if len(names) > 0 {
+		report.Checks = make(map[string]HealthResult, len(names))
+	}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func runHealthCheck(ctx context.Context, check HealthCheck, timeout time.Duration) HealthResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	// 检查函数可能不理会ctx，在单独的goroutine中运行，超时后不再等待它
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	var res HealthResult
+	select {
+	case err := <-done:
+		res.Status = "ok"
+		if err != nil {
+			res.Status, res.Error = "error", err.Error()
+		}
+	case <-ctx.Done():
+		res.Status, res.Error = "timeout", ctx.Err().Error()
+	}
+	res.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	return res
+}
+
+// ServeHTTP 所有检查都通过时回复200，否则回复503，报文主体为json格式的HealthReport
+func (h *HealthHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	report := h.Check(r.Context())
+	code := StatusOK
+	if report.Status != "ok" {
+		code = StatusServiceUnavailable
+	}
+	// 健康状态随时可能变化，不能被缓存
+	w.Header().Set("Cache-Control", "no-store")
+	JSON(w, code, report)
+}
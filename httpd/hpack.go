@@ -0,0 +1,374 @@
+package httpd
+
+import (
+	"errors"
+	"strings"
+)
+
+// hpack.go实现了http/2的首部压缩(RFC 7541)。
+// 首部字段可以引用静态表(61个常见字段)或者动态表(连接上最近出现过的字段)中的条目，
+// 也可以是字面量，字面量的字符串可以使用huffman编码。
+// 解码端必须完整地维护动态表，否则之后的首部块都会解析错误，所以即使某个请求被拒绝，它的首部块也要照常解码。
+// 编码端只使用静态表以及不带索引的字面量，不往动态表中添加条目，这样对端的动态表始终为空，
+// 也就不需要关心对端设置的SETTINGS_HEADER_TABLE_SIZE。
+
+type hpackField struct {
+	name, value string
+}
+
+// size 条目在动态表中占用的大小，额外的32字节是RFC规定的估算开销
+func (f hpackField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+var hpackStaticTable = [...]hpackField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// 编码时查找静态表用，下标从1开始
+var (
+	hpackStaticByName  = make(map[string]int)
+	hpackStaticByField = make(map[hpackField]int)
+)
+
+func init() {
+	for i := len(hpackStaticTable) - 1; i >= 0; i-- {
+		f := hpackStaticTable[i]
+		hpackStaticByName[f.name] = i + 1
+		if f.value != "" {
+			hpackStaticByField[f] = i + 1
+		}
+	}
+	buildHuffmanTree()
+}
+
+var (
+	errHpackIndex   = errors.New("hpack: invalid index")
+	errHpackInteger = errors.New("hpack: integer overflow")
+	errHpackString  = errors.New("hpack: string too long")
+	errHpackTrunc   = errors.New("hpack: truncated header block")
+	errHpackSize    = errors.New("hpack: invalid dynamic table size update")
+	errHuffman      = errors.New("hpack: invalid huffman-encoded data")
+)
+
+// hpackDecoder 维护一个连接上的解码动态表
+type hpackDecoder struct {
+	dyn      []hpackField // 越靠后的越新
+	size     int          // 动态表当前占用的大小
+	capacity int          // 对端通过动态表大小更新设置的上限
+	maxSize  int          // 我们在SETTINGS_HEADER_TABLE_SIZE中允许的上限
+	// maxStringLen 单个字符串的最大长度，防止对端用一个巨大的字面量耗尽内存
+	maxStringLen int
+}
+
+func newHpackDecoder(maxSize, maxStringLen int) *hpackDecoder {
+	return &hpackDecoder{capacity: maxSize, maxSize: maxSize, maxStringLen: maxStringLen}
+}
+
+// decode 解码一个完整的首部块，每得到一个字段就调用emit
+func (d *hpackDecoder) decode(block []byte, emit func(hpackField)) error {
+	first := true
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		switch {
+		case b&0x80 != 0: // 1xxxxxxx 索引字段
+			var idx uint64
+			if idx, block, err = hpackReadInt(block, 7); err != nil {
+				return err
+			}
+			f, ok := d.at(idx)
+			if !ok {
+				return errHpackIndex
+			}
+			emit(f)
+		case b&0xc0 == 0x40: // 01xxxxxx 带索引的字面量，解码后加入动态表
+			var f hpackField
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return err
+			}
+			d.add(f)
+			emit(f)
+		case b&0xe0 == 0x20: // 001xxxxx 动态表大小更新，只能出现在首部块的开头
+			var size uint64
+			if size, block, err = hpackReadInt(block, 5); err != nil {
+				return err
+			}
+			if !first || size > uint64(d.maxSize) {
+				return errHpackSize
+			}
+			d.capacity = int(size)
+			d.evict()
+			continue
+		default: // 0000xxxx 不带索引的字面量，0001xxxx 永不索引的字面量
+			var f hpackField
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return err
+			}
+			emit(f)
+		}
+		first = false
+	}
+	return nil
+}
+
+// at 按照索引取出字段，1~61为静态表，之后是动态表，最新的条目索引最小
+func (d *hpackDecoder) at(idx uint64) (hpackField, bool) {
+	if idx == 0 {
+		return hpackField{}, false
+	}
+	if idx <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[idx-1], true
+	}
+	idx -= uint64(len(hpackStaticTable))
+	if idx > uint64(len(d.dyn)) {
+		return hpackField{}, false
+	}
+	return d.dyn[len(d.dyn)-int(idx)], true
+}
+
+func (d *hpackDecoder) readLiteral(p []byte, prefix uint8) (f hpackField, rest []byte, err error) {
+	idx, p, err := hpackReadInt(p, prefix)
+	if err != nil {
+		return f, nil, err
+	}
+	if idx > 0 {
+		nf, ok := d.at(idx)
+		if !ok {
+			return f, nil, errHpackIndex
+		}
+		f.name = nf.name
+	} else if f.name, p, err = d.readString(p); err != nil {
+		return f, nil, err
+	}
+	if f.value, p, err = d.readString(p); err != nil {
+		return f, nil, err
+	}
+	return f, p, nil
+}
+
+func (d *hpackDecoder) readString(p []byte) (s string, rest []byte, err error) {
+	if len(p) == 0 {
+		return "", nil, errHpackTrunc
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := hpackReadInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, errHpackTrunc
+	}
+	if d.maxStringLen > 0 && n > uint64(d.maxStringLen) {
+		return "", nil, errHpackString
+	}
+	if !huffman {
+		return string(p[:n]), p[n:], nil
+	}
+	s, err = huffmanDecode(p[:n], d.maxStringLen)
+	return s, p[n:], err
+}
+
+// add 把字段加入动态表，超过容量时淘汰最旧的条目，比整个容量还大的字段会清空动态表
+func (d *hpackDecoder) add(f hpackField) {
+	if f.size() > d.capacity {
+		d.dyn = d.dyn[:0]
+		d.size = 0
+		return
+	}
+	d.dyn = append(d.dyn, f)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *hpackDecoder) evict() {
+	n := 0
+	for d.size > d.capacity {
+		d.size -= d.dyn[n].size()
+		n++
+	}
+	if n > 0 {
+		copy(d.dyn, d.dyn[n:])
+		for i := len(d.dyn) - n; i < len(d.dyn); i++ {
+			d.dyn[i] = hpackField{}
+		}
+		d.dyn = d.dyn[:len(d.dyn)-n]
+	}
+}
+
+// hpackReadInt 读取一个前缀为prefix比特的整数：前缀没有全部置1时就是整数的值，
+// 否则之后每个字节的低7位依次作为更高的位，最高位为0的字节是最后一个
+func hpackReadInt(p []byte, prefix uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, errHpackTrunc
+	}
+	max := uint64(1)<<prefix - 1
+	v := uint64(p[0]) & max
+	p = p[1:]
+	if v < max {
+		return v, p, nil
+	}
+	var m uint
+	for len(p) > 0 {
+		b := p[0]
+		p = p[1:]
+		v += uint64(b&0x7f) << m
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+		if m += 7; m >= 63 {
+			return 0, nil, errHpackInteger
+		}
+	}
+	return 0, nil, errHpackTrunc
+}
+
+func hpackAppendInt(dst []byte, first byte, prefix uint8, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(max))
+	v -= max
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func hpackAppendString(dst []byte, s string) []byte {
+	dst = hpackAppendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// hpackAppendField 编码一个字段：静态表中有完全相同的字段时使用索引，
+// 否则使用不带索引的字面量，名称尽量引用静态表
+func hpackAppendField(dst []byte, name, value string) []byte {
+	if i, ok := hpackStaticByField[hpackField{name, value}]; ok {
+		return hpackAppendInt(dst, 0x80, 7, uint64(i))
+	}
+	if i, ok := hpackStaticByName[name]; ok {
+		dst = hpackAppendInt(dst, 0, 4, uint64(i))
+	} else {
+		dst = append(dst, 0)
+		dst = hpackAppendString(dst, name)
+	}
+	return hpackAppendString(dst, value)
+}
+
+// huffmanNode 是huffman解码树的节点，叶子节点的children为nil
+type huffmanNode struct {
+	children *[2]*huffmanNode
+	sym      byte
+	bits     uint8 // 叶子节点对应编码的长度
+}
+
+var huffmanRoot = &huffmanNode{children: new([2]*huffmanNode)}
+
+func buildHuffmanTree() {
+	for sym, code := range huffmanCodes {
+		n := huffmanRoot
+		length := huffmanCodeLen[sym]
+		for i := int(length) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				if i == 0 {
+					n.children[bit] = &huffmanNode{sym: byte(sym), bits: length}
+				} else {
+					n.children[bit] = &huffmanNode{children: new([2]*huffmanNode)}
+				}
+			}
+			n = n.children[bit]
+		}
+	}
+}
+
+// huffmanDecode 逐比特地走解码树。结尾不足一个字节的部分是填充，必须全为1且少于8位
+func huffmanDecode(p []byte, maxLen int) (string, error) {
+	var sb strings.Builder
+	n := huffmanRoot
+	depth, ones := 0, true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", errHuffman
+			}
+			depth++
+			ones = ones && bit == 1
+			if n.children == nil {
+				if maxLen > 0 && sb.Len() >= maxLen {
+					return "", errHpackString
+				}
+				sb.WriteByte(n.sym)
+				n, depth, ones = huffmanRoot, 0, true
+			}
+		}
+	}
+	if depth > 7 || !ones {
+		return "", errHuffman
+	}
+	return sb.String(), nil
+}
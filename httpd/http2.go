@@ -0,0 +1,1301 @@
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http2.go实现了服务端的http/2协议。
+// http/1.1的一个连接同一时间只能处理一个请求，浏览器只好同时建立多个连接；
+// http/2把每个请求-响应拆成一个流(stream)，多个流的帧在同一个连接上交错传输，互不阻塞。
+// 连接的建立有三种方式：
+//   - tls连接通过ALPN协商出h2；
+//   - 明文连接(h2c)的客户端直接发送连接前言(prior knowledge)；
+//   - 明文连接的客户端先发送带有Upgrade: h2c的http/1.1请求，服务端回复101后切换协议，这个请求作为流1继续处理。
+//
+// serve所在的goroutine负责读取并处理所有的帧，每个流的handler运行在单独的goroutine中，
+// handler写入的数据按照流量控制窗口切分为DATA帧，写帧时持有wmu保证帧的完整。
+// handler看到的仍然是同样的Request与ResponseWriter，不需要为http/2做任何修改。
+
+// DefaultMaxConcurrentStreams 每个http/2连接上默认的最大并发流数
+const DefaultMaxConcurrentStreams = 250
+
+const (
+	// 我们的接收窗口，客户端最多可以发送这么多还没有被handler读取的报文主体
+	h2StreamRecvWindow = 256 << 10
+	h2ConnRecvWindow   = 1 << 20
+	// h2HeaderTableSize 解码动态表的大小，使用协议的默认值，不需要在SETTINGS中声明
+	h2HeaderTableSize = 4096
+)
+
+var (
+	errH2StreamClosed = errors.New("http2: stream closed")
+	errH2ConnClosed   = errors.New("http2: connection closed")
+	errH2BodyClosed   = errors.New("http2: request body closed")
+)
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams > 0 {
+		return s.MaxConcurrentStreams
+	}
+	return DefaultMaxConcurrentStreams
+}
+
+// h2Conn 是一个http/2连接
+type h2Conn struct {
+	c   *conn
+	svr *Server
+	fr  h2Framer
+	dec *hpackDecoder
+
+	// wmu 保证每个帧完整地写入，HEADERS与CONTINUATION之间也不能插入其他帧
+	wmu     sync.Mutex
+	wclosed bool // 连接已经结束，bufw可能已经归还给了池
+
+	mu                sync.Mutex
+	cond              *sync.Cond // 发送窗口变大、流被重置或者连接关闭时广播
+	streams           map[uint32]*h2Stream
+	sendWindow        int64 // 连接级别的发送窗口
+	initialSendWindow int64 // 对端的SETTINGS_INITIAL_WINDOW_SIZE，新建流的发送窗口
+	maxSendFrame      int   // 对端的SETTINGS_MAX_FRAME_SIZE
+	recvWindow        int64 // 连接级别的接收窗口
+	recvUnacked       int64 // 已经被消费、还没有通过WINDOW_UPDATE归还的字节数
+	closed            bool
+	goingAway         bool // 已经因为Shutdown发送了GOAWAY，最后一个流结束后关闭连接
+	// handlers 正在运行的handler数。被RST_STREAM重置的流会立即从streams中删除，但handler可能还在运行，
+	// 并发数以它为准，否则客户端不断地新建并重置流就能启动任意多的handler
+	handlers uint32
+
+	// 以下字段只由读取帧的goroutine访问
+	maxStreamID  uint32 // 客户端使用过的最大流id，更小的id不能再用来新建流
+	sawSettings  bool
+	headerBlock  []byte // HEADERS之后跟着CONTINUATION时，首部块在这里累积
+	headerStream uint32 // 正在接收首部块的流，为0时代表没有
+	headerEnd    bool   // 首部块所在的HEADERS帧带有END_STREAM
+
+	done chan struct{} // serve结束时关闭
+}
+
+// h2Stream 是一个流，对应一个请求与它的响应
+type h2Stream struct {
+	sc     *h2Conn
+	id     uint32
+	req    *Request
+	body   *h2Pipe // 请求没有报文主体时为nil
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// 以下字段由sc.mu保护
+	sendWindow   int64
+	recvWindow   int64
+	recvUnacked  int64
+	remoteClosed bool // 收到了END_STREAM，客户端不会再发送数据
+	reset        bool // 流被RST_STREAM关闭了
+
+	// 以下字段只由读取帧的goroutine访问
+	declLength int64 // content-length声明的长度，-1代表未声明
+	received   int64
+}
+
+// handshake 在连接上读取第一个请求之前调用，返回连接要使用的协议，为空时代表http/1.x。
+// tls连接在这里完成握手，返回ALPN协商的结果；开启了H2C时，检查客户端是否直接发送了http/2的连接前言
+func (c *conn) handshake() (proto string, err error) {
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		if d := c.svr.ReadHeaderTimeout; d > 0 {
+			tc.SetDeadline(time.Now().Add(d))
+		}
+		if err = tc.Handshake(); err != nil {
+			return "", err
+		}
+		tc.SetDeadline(time.Time{})
+		cs := tc.ConnectionState()
+		c.tlsState = &cs
+		// tls-alpn-01验证只需要完成握手，CA不会在这个连接上发送请求
+		if cs.NegotiatedProtocol == acmeALPNProto {
+			return "", io.EOF
+		}
+		return cs.NegotiatedProtocol, nil
+	}
+	if !c.svr.H2C {
+		return "", nil
+	}
+	if d := c.svr.ReadHeaderTimeout; d > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+		defer c.rwc.SetReadDeadline(time.Time{})
+	}
+	// 前言以PRI开头，合法的http/1请求不会使用这个方法
+	p, err := c.bufr.Peek(3)
+	if err != nil {
+		return "", err
+	}
+	if string(p) == h2ClientPreface[:3] {
+		return "h2", nil
+	}
+	return "", nil
+}
+
+// isH2CUpgrade 判断请求是否要求升级到h2c：Upgrade: h2c、恰好一个HTTP2-Settings，
+// 并且Connection中列出了这两个首部。带有报文主体的请求不升级，按照http/1.1正常处理
+func isH2CUpgrade(r *Request) bool {
+	if r.Proto != "HTTP/1.1" || len(r.Header["Http2-Settings"]) != 1 {
+		return false
+	}
+	if _, ok := r.Body.(*eofReader); !ok {
+		return false
+	}
+	return headerHasToken(r.Header, "Upgrade", "h2c") &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		headerHasToken(r.Header, "Connection", "http2-settings")
+}
+
+// headerHasToken 判断以逗号分隔的首部中是否包含token，不区分大小写
+func headerHasToken(h Header, key, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveH2CUpgrade 回复101后把连接切换为http/2，升级请求作为流1处理
+func (c *conn) serveH2CUpgrade(req *Request) {
+	v := strings.TrimRight(req.Header.Get("Http2-Settings"), "=")
+	payload, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		c.writeErrorResponse(StatusBadRequest)
+		return
+	}
+	settings, err := parseH2Settings(payload)
+	if err != nil {
+		c.writeErrorResponse(StatusBadRequest)
+		return
+	}
+	c.bufw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err = c.bufw.Flush(); err != nil {
+		return
+	}
+	for _, key := range []string{"Connection", "Upgrade", "Http2-Settings"} {
+		req.Header.Del(key)
+	}
+	req.Proto = "HTTP/2.0"
+	req.Close = false
+	c.serveHTTP2(req, settings)
+}
+
+// serveHTTP2 在连接上运行http/2协议，直到连接关闭或者发生连接级别的错误。
+// upgrade不为nil时是h2c升级的请求，settings为它携带的HTTP2-Settings
+func (c *conn) serveHTTP2(upgrade *Request, settings []h2Setting) {
+	c.lr.N = 1<<63 - 1 // 帧的大小由framer限制
+	c.setState(StateActive)
+	sc := &h2Conn{
+		c:                 c,
+		svr:               c.svr,
+		fr:                h2Framer{r: c.bufr, maxFrameSize: h2DefaultMaxFrameSize},
+		dec:               newHpackDecoder(h2HeaderTableSize, int(c.svr.maxHeaderBytes())),
+		streams:           make(map[uint32]*h2Stream),
+		sendWindow:        h2DefaultWindowSize,
+		initialSendWindow: h2DefaultWindowSize,
+		maxSendFrame:      h2DefaultMaxFrameSize,
+		recvWindow:        h2DefaultWindowSize,
+		done:              make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	defer sc.shutdown()
+
+	// 服务器关闭时告知客户端不要再发起新的请求，然后关闭连接；
+	// Shutdown时同样发送GOAWAY，但要等正在处理的流结束后再关闭
+	go func() {
+		select {
+		case <-c.svr.baseContext().Done():
+			sc.writeGoAway(h2ErrNo)
+			c.rwc.Close()
+			return
+		case <-c.svr.shutdownChan():
+			sc.startGoAway()
+		case <-sc.done:
+			return
+		}
+		select {
+		case <-c.svr.baseContext().Done():
+			c.rwc.Close()
+		case <-sc.done:
+		}
+	}()
+
+	if settings != nil {
+		if err := sc.applySettings(settings); err != nil {
+			c.logError("serving http2", err)
+			return
+		}
+	}
+	// 服务端的连接前言就是一个SETTINGS帧，不需要等待客户端的前言就可以发送
+	if err := sc.writeInitialSettings(); err != nil {
+		return
+	}
+	preface := make([]byte, len(h2ClientPreface))
+	if _, err := io.ReadFull(c.bufr, preface); err != nil || string(preface) != h2ClientPreface {
+		if err == nil {
+			c.svr.logf("httpd: bogus http2 client preface from %s", c.remoteAddr)
+		}
+		return
+	}
+	if upgrade != nil {
+		sc.maxStreamID = 1
+		st := sc.newStream(1, upgrade)
+		st.remoteClosed = true
+		go sc.runHandler(st)
+	}
+
+	for {
+		fh, payload, err := sc.fr.readFrame()
+		if err == nil {
+			err = sc.processFrame(fh, payload)
+		}
+		if err == nil {
+			continue
+		}
+		if se, ok := err.(h2StreamError); ok {
+			sc.resetStream(se)
+			continue
+		}
+		if ce, ok := err.(h2ConnError); ok {
+			sc.writeGoAway(ce.code)
+		}
+		if err != io.ErrUnexpectedEOF {
+			c.logError("serving http2", err)
+		}
+		return
+	}
+}
+
+func (sc *h2Conn) writeInitialSettings() error {
+	var p []byte
+	for _, s := range []h2Setting{
+		{h2SettingMaxConcurrentStreams, sc.svr.maxConcurrentStreams()},
+		{h2SettingInitialWindowSize, h2StreamRecvWindow},
+		{h2SettingMaxHeaderListSize, uint32(sc.svr.maxHeaderBytes())},
+	} {
+		p = append(p, byte(s.id>>8), byte(s.id))
+		p = append(p, byte(s.val>>24), byte(s.val>>16), byte(s.val>>8), byte(s.val))
+	}
+	if err := sc.writeFrame(h2FrameSettings, 0, 0, p); err != nil {
+		return err
+	}
+	// 连接级别的接收窗口只能通过WINDOW_UPDATE调大
+	sc.mu.Lock()
+	sc.recvWindow = h2ConnRecvWindow
+	sc.mu.Unlock()
+	return sc.writeWindowUpdate(0, h2ConnRecvWindow-h2DefaultWindowSize)
+}
+
+// shutdown 在serve结束时调用，唤醒所有等待中的handler，之后所有的写入都会失败
+func (sc *h2Conn) shutdown() {
+	close(sc.done)
+	sc.mu.Lock()
+	sc.closed = true
+	streams := sc.streams
+	sc.streams = nil
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	for _, st := range streams {
+		st.cancel()
+		if st.body != nil {
+			st.body.closeWithError(io.ErrUnexpectedEOF)
+		}
+	}
+	sc.wmu.Lock()
+	sc.wclosed = true
+	sc.wmu.Unlock()
+}
+
+func (sc *h2Conn) processFrame(fh h2FrameHeader, p []byte) error {
+	if !sc.sawSettings {
+		if fh.typ != h2FrameSettings || fh.has(h2FlagAck) {
+			return h2ConnError{h2ErrProtocol, "expected SETTINGS frame"}
+		}
+		sc.sawSettings = true
+	}
+	// 首部块必须连续，中间不能插入其他帧
+	if sc.headerStream != 0 && (fh.typ != h2FrameContinuation || fh.streamID != sc.headerStream) {
+		return h2ConnError{h2ErrProtocol, "expected CONTINUATION frame"}
+	}
+	switch fh.typ {
+	case h2FrameData:
+		return sc.processData(fh, p)
+	case h2FrameHeaders:
+		return sc.processHeaders(fh, p)
+	case h2FramePriority:
+		// 不支持优先级，只检查格式
+		if fh.streamID == 0 {
+			return h2ConnError{h2ErrProtocol, "PRIORITY on stream 0"}
+		}
+		if len(p) != 5 {
+			return h2StreamError{fh.streamID, h2ErrFrameSize}
+		}
+		return nil
+	case h2FrameRSTStream:
+		return sc.processReset(fh, p)
+	case h2FrameSettings:
+		return sc.processSettings(fh, p)
+	case h2FramePushPromise:
+		return h2ConnError{h2ErrProtocol, "PUSH_PROMISE from client"}
+	case h2FramePing:
+		return sc.processPing(fh, p)
+	case h2FrameGoAway:
+		// 客户端不会再发起新的请求，已有的流照常处理，等待客户端关闭连接
+		if fh.streamID != 0 {
+			return h2ConnError{h2ErrProtocol, "GOAWAY on non-zero stream"}
+		}
+		return nil
+	case h2FrameWindowUpdate:
+		return sc.processWindowUpdate(fh, p)
+	case h2FrameContinuation:
+		return sc.processContinuation(fh, p)
+	}
+	// 未知类型的帧必须忽略
+	return nil
+}
+
+func (sc *h2Conn) processHeaders(fh h2FrameHeader, p []byte) error {
+	if fh.streamID == 0 || fh.streamID%2 == 0 {
+		return h2ConnError{h2ErrProtocol, "invalid stream id for HEADERS"}
+	}
+	p, err := h2StripPadding(fh, p)
+	if err != nil {
+		return err
+	}
+	if fh.has(h2FlagPriority) {
+		if len(p) < 5 {
+			return h2ConnError{h2ErrFrameSize, "HEADERS too short for priority"}
+		}
+		p = p[5:]
+	}
+	sc.headerBlock = append(sc.headerBlock[:0], p...)
+	sc.headerStream = fh.streamID
+	sc.headerEnd = fh.has(h2FlagEndStream)
+	if !fh.has(h2FlagEndHeaders) {
+		return nil
+	}
+	return sc.endHeaders()
+}
+
+func (sc *h2Conn) processContinuation(fh h2FrameHeader, p []byte) error {
+	if sc.headerStream == 0 {
+		return h2ConnError{h2ErrProtocol, "unexpected CONTINUATION frame"}
+	}
+	// 压缩后的首部块不会比解压后大太多，远超MaxHeaderBytes的只可能是恶意的
+	if len(sc.headerBlock)+len(p) > 4*int(sc.svr.maxHeaderBytes()) {
+		return h2ConnError{h2ErrEnhanceYourCalm, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, p...)
+	if !fh.has(h2FlagEndHeaders) {
+		return nil
+	}
+	return sc.endHeaders()
+}
+
+// endHeaders 解码一个完整的首部块，新建流或者作为已有流的trailer
+func (sc *h2Conn) endHeaders() error {
+	id, endStream := sc.headerStream, sc.headerEnd
+	sc.headerStream = 0
+
+	var fields []hpackField
+	size, max := 0, int(sc.svr.maxHeaderBytes())
+	err := sc.dec.decode(sc.headerBlock, func(f hpackField) {
+		// 超过上限后仍然要解码完整个首部块，动态表才能与客户端保持一致
+		if size += f.size(); size <= max {
+			fields = append(fields, f)
+		}
+	})
+	if err != nil {
+		return h2ConnError{h2ErrCompression, err.Error()}
+	}
+
+	if id <= sc.maxStreamID {
+		sc.mu.Lock()
+		st := sc.streams[id]
+		sc.mu.Unlock()
+		if st == nil {
+			return nil // 我们已经关闭了这个流，客户端还没有意识到
+		}
+		if st.remoteClosed || !endStream {
+			return h2StreamError{id, h2ErrProtocol}
+		}
+		return sc.processTrailers(st, fields)
+	}
+	sc.maxStreamID = id
+
+	if size > max {
+		return sc.writeSimpleResponse(id, StatusRequestHeaderFieldsTooLarge)
+	}
+	sc.mu.Lock()
+	active, goingAway := sc.handlers, sc.goingAway
+	sc.mu.Unlock()
+	// 发送GOAWAY之后客户端新建的流不会被处理，客户端可以在新的连接上重试
+	if active >= sc.svr.maxConcurrentStreams() || goingAway {
+		return h2StreamError{id, h2ErrRefusedStream}
+	}
+	req, err := sc.newRequest(fields, endStream)
+	if err != nil {
+		return h2StreamError{id, h2ErrProtocol}
+	}
+	st := sc.newStream(id, req)
+	if !endStream {
+		st.body = &h2Pipe{onRead: func(n int) { sc.consumed(st, n) }}
+		st.body.cond.L = &st.body.mu
+		req.Body = st.body
+		if cl := req.Header.Get("Content-Length"); cl != "" {
+			st.declLength = req.ContentLength
+		}
+		if sc.svr.DecompressRequestBody {
+			req.fixDecompressReader()
+		}
+	}
+	st.remoteClosed = endStream
+	go sc.runHandler(st)
+	return nil
+}
+
+func (sc *h2Conn) newStream(id uint32, req *Request) *h2Stream {
+	st := &h2Stream{
+		sc:         sc,
+		id:         id,
+		req:        req,
+		recvWindow: h2StreamRecvWindow,
+		declLength: -1,
+	}
+	st.ctx, st.cancel = context.WithCancel(sc.svr.baseContext())
+	req.ctx = st.ctx
+	sc.mu.Lock()
+	st.sendWindow = sc.initialSendWindow
+	sc.streams[id] = st
+	sc.handlers++
+	sc.mu.Unlock()
+	return st
+}
+
+// newRequest 由伪首部以及普通首部构造请求，格式错误时返回error，调用方以PROTOCOL_ERROR重置这个流
+func (sc *h2Conn) newRequest(fields []hpackField, endStream bool) (*Request, error) {
+	var method, scheme, authority, path string
+	h := make(Header)
+	regular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			// 伪首部必须在普通首部之前，且每个只能出现一次
+			if regular {
+				return nil, errors.New("pseudo header after regular header")
+			}
+			var dst *string
+			switch f.name {
+			case ":method":
+				dst = &method
+			case ":scheme":
+				dst = &scheme
+			case ":authority":
+				dst = &authority
+			case ":path":
+				dst = &path
+			default:
+				return nil, errors.New("invalid pseudo header " + f.name)
+			}
+			if *dst != "" {
+				return nil, errors.New("duplicate pseudo header " + f.name)
+			}
+			*dst = f.value
+			continue
+		}
+		regular = true
+		if !validH2FieldName(f.name) {
+			return nil, errors.New("invalid header field name " + strconv.Quote(f.name))
+		}
+		switch f.name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			// http/2中没有逐跳首部，出现了就是格式错误
+			return nil, errors.New("connection-specific header " + f.name)
+		case "te":
+			if f.value != "trailers" {
+				return nil, errors.New("invalid te header")
+			}
+		}
+		h.Add(CanonicalHeaderKey(f.name), f.value)
+	}
+	// http/2允许把cookie拆成多个字段发送以提高压缩率，交给handler之前合并回一个
+	if cookies := h["Cookie"]; len(cookies) > 1 {
+		h["Cookie"] = []string{strings.Join(cookies, "; ")}
+	}
+
+	r := &Request{
+		Method:     method,
+		Proto:      "HTTP/2.0",
+		Header:     h,
+		RequestURI: path,
+		RemoteAddr: sc.c.remoteAddr.String(),
+		TLS:        sc.c.tlsState,
+		conn:       sc.c,
+		tmpForms:   new(multipartForms),
+	}
+	if method == "CONNECT" {
+		if authority == "" || scheme != "" || path != "" {
+			return nil, errors.New("malformed CONNECT request")
+		}
+		r.URL = &url.URL{Host: authority}
+		r.RequestURI = authority
+	} else {
+		if method == "" || scheme == "" || path == "" {
+			return nil, errors.New("missing pseudo header")
+		}
+		var err error
+		if r.URL, err = url.ParseRequestURI(path); err != nil {
+			return nil, err
+		}
+	}
+	r.Host = authority
+	if r.Host == "" {
+		r.Host = h.Get("Host")
+	}
+
+	if endStream {
+		r.Body = new(eofReader)
+	} else {
+		cl, err := parseContentLength(h)
+		if err != nil {
+			return nil, err
+		}
+		r.ContentLength = -1
+		if cl != "" {
+			r.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
+		}
+		r.Trailer = declaredTrailer(h)
+	}
+	return r, nil
+}
+
+// validH2FieldName 首部名称必须是小写的token
+func validH2FieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !isTokenChar(c) || 'A' <= c && c <= 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// processTrailers 只填充客户端在Trailer首部中声明过的字段，handler读到io.EOF之后才能访问它们
+func (sc *h2Conn) processTrailers(st *h2Stream, fields []hpackField) error {
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			return h2StreamError{st.id, h2ErrProtocol}
+		}
+		key := CanonicalHeaderKey(f.name)
+		if _, ok := st.req.Trailer[key]; ok {
+			st.req.Trailer[key] = append(st.req.Trailer[key], f.value)
+		}
+	}
+	return sc.endRemote(st)
+}
+
+func (sc *h2Conn) processData(fh h2FrameHeader, p []byte) error {
+	if fh.streamID == 0 {
+		return h2ConnError{h2ErrProtocol, "DATA on stream 0"}
+	}
+	// 填充也要计入流量控制窗口
+	n := int64(len(p))
+	sc.mu.Lock()
+	if n > sc.recvWindow {
+		sc.mu.Unlock()
+		return h2ConnError{h2ErrFlowControl, "connection flow control window exceeded"}
+	}
+	sc.recvWindow -= n
+	st := sc.streams[fh.streamID]
+	if st == nil || st.remoteClosed {
+		sc.mu.Unlock()
+		if fh.streamID > sc.maxStreamID {
+			return h2ConnError{h2ErrProtocol, "DATA on idle stream"}
+		}
+		// 流已经关闭了，数据直接丢弃，连接的窗口要归还
+		sc.consumed(nil, int(n))
+		if st != nil {
+			return h2StreamError{fh.streamID, h2ErrStreamClosed}
+		}
+		return nil
+	}
+	if n > st.recvWindow {
+		sc.mu.Unlock()
+		sc.consumed(nil, int(n))
+		return h2StreamError{fh.streamID, h2ErrFlowControl}
+	}
+	st.recvWindow -= n
+	sc.mu.Unlock()
+
+	data, err := h2StripPadding(fh, p)
+	if err != nil {
+		return err
+	}
+	if pad := len(p) - len(data); pad > 0 {
+		sc.consumed(st, pad)
+	}
+	if len(data) > 0 {
+		st.received += int64(len(data))
+		if st.declLength >= 0 && st.received > st.declLength {
+			sc.consumed(nil, len(data))
+			return h2StreamError{fh.streamID, h2ErrProtocol}
+		}
+		if !st.body.write(data) {
+			// handler已经不再读取报文主体了
+			sc.consumed(nil, len(data))
+		}
+	}
+	if fh.has(h2FlagEndStream) {
+		return sc.endRemote(st)
+	}
+	return nil
+}
+
+// endRemote 客户端发送完了报文主体
+func (sc *h2Conn) endRemote(st *h2Stream) error {
+	if st.declLength >= 0 && st.received != st.declLength {
+		return h2StreamError{st.id, h2ErrProtocol}
+	}
+	sc.mu.Lock()
+	st.remoteClosed = true
+	sc.mu.Unlock()
+	if st.body != nil {
+		st.body.closeWithError(io.EOF)
+	}
+	return nil
+}
+
+// consumed 归还n字节的接收窗口，累积到窗口的一半时才发送WINDOW_UPDATE，避免发送大量的小帧。
+// st为nil时只归还连接的窗口
+func (sc *h2Conn) consumed(st *h2Stream, n int) {
+	if n <= 0 {
+		return
+	}
+	var connInc, streamInc int64
+	sc.mu.Lock()
+	sc.recvUnacked += int64(n)
+	if sc.recvUnacked >= h2ConnRecvWindow/2 {
+		connInc, sc.recvUnacked = sc.recvUnacked, 0
+		sc.recvWindow += connInc
+	}
+	if st != nil && !st.remoteClosed && !st.reset {
+		st.recvUnacked += int64(n)
+		if st.recvUnacked >= h2StreamRecvWindow/2 {
+			streamInc, st.recvUnacked = st.recvUnacked, 0
+			st.recvWindow += streamInc
+		}
+	}
+	sc.mu.Unlock()
+	if connInc > 0 {
+		sc.writeWindowUpdate(0, uint32(connInc))
+	}
+	if streamInc > 0 {
+		sc.writeWindowUpdate(st.id, uint32(streamInc))
+	}
+}
+
+func (sc *h2Conn) processReset(fh h2FrameHeader, p []byte) error {
+	if len(p) != 4 {
+		return h2ConnError{h2ErrFrameSize, "invalid RST_STREAM length"}
+	}
+	if fh.streamID == 0 || fh.streamID > sc.maxStreamID {
+		return h2ConnError{h2ErrProtocol, "RST_STREAM on idle stream"}
+	}
+	sc.mu.Lock()
+	st := sc.streams[fh.streamID]
+	sc.mu.Unlock()
+	if st != nil {
+		sc.abortStream(st)
+	}
+	return nil
+}
+
+// resetStream 发送RST_STREAM并关闭流
+func (sc *h2Conn) resetStream(se h2StreamError) {
+	sc.writeReset(se.streamID, se.code)
+	sc.mu.Lock()
+	st := sc.streams[se.streamID]
+	sc.mu.Unlock()
+	if st != nil {
+		sc.abortStream(st)
+	}
+}
+
+// abortStream 流被重置，取消handler的Context，唤醒阻塞在读取报文主体或者等待发送窗口上的handler
+func (sc *h2Conn) abortStream(st *h2Stream) {
+	sc.mu.Lock()
+	st.reset = true
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	st.cancel()
+	if st.body != nil {
+		sc.consumed(nil, st.body.closeWithError(errH2StreamClosed))
+	}
+}
+
+func (sc *h2Conn) processSettings(fh h2FrameHeader, p []byte) error {
+	if fh.streamID != 0 {
+		return h2ConnError{h2ErrProtocol, "SETTINGS on non-zero stream"}
+	}
+	if fh.has(h2FlagAck) {
+		if len(p) != 0 {
+			return h2ConnError{h2ErrFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseH2Settings(p)
+	if err != nil {
+		return err
+	}
+	if err = sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(h2FrameSettings, h2FlagAck, 0, nil)
+}
+
+func (sc *h2Conn) applySettings(settings []h2Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case h2SettingEnablePush:
+			if s.val > 1 {
+				return h2ConnError{h2ErrProtocol, "invalid SETTINGS_ENABLE_PUSH"}
+			}
+		case h2SettingInitialWindowSize:
+			if s.val > h2MaxWindowSize {
+				return h2ConnError{h2ErrFlowControl, "invalid SETTINGS_INITIAL_WINDOW_SIZE"}
+			}
+			// 新的初始窗口对所有已有的流生效，窗口可能因此变为负数
+			delta := int64(s.val) - sc.initialSendWindow
+			for _, st := range sc.streams {
+				if st.sendWindow += delta; st.sendWindow > h2MaxWindowSize {
+					return h2ConnError{h2ErrFlowControl, "stream window overflow"}
+				}
+			}
+			sc.initialSendWindow = int64(s.val)
+			sc.cond.Broadcast()
+		case h2SettingMaxFrameSize:
+			if s.val < h2DefaultMaxFrameSize || s.val > h2MaxFrameSizeLimit {
+				return h2ConnError{h2ErrProtocol, "invalid SETTINGS_MAX_FRAME_SIZE"}
+			}
+			sc.maxSendFrame = int(s.val)
+		}
+		// 我们不使用动态表编码、不推送，其余的参数都不需要处理
+	}
+	return nil
+}
+
+func (sc *h2Conn) processPing(fh h2FrameHeader, p []byte) error {
+	if fh.streamID != 0 {
+		return h2ConnError{h2ErrProtocol, "PING on non-zero stream"}
+	}
+	if len(p) != 8 {
+		return h2ConnError{h2ErrFrameSize, "invalid PING length"}
+	}
+	if fh.has(h2FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(h2FramePing, h2FlagAck, 0, p)
+}
+
+func (sc *h2Conn) processWindowUpdate(fh h2FrameHeader, p []byte) error {
+	if len(p) != 4 {
+		return h2ConnError{h2ErrFrameSize, "invalid WINDOW_UPDATE length"}
+	}
+	inc := int64(binary.BigEndian.Uint32(p) & (1<<31 - 1))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if fh.streamID == 0 {
+		if inc == 0 {
+			return h2ConnError{h2ErrProtocol, "zero WINDOW_UPDATE increment"}
+		}
+		if sc.sendWindow += inc; sc.sendWindow > h2MaxWindowSize {
+			return h2ConnError{h2ErrFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[fh.streamID]
+	if st == nil {
+		if fh.streamID > sc.maxStreamID {
+			return h2ConnError{h2ErrProtocol, "WINDOW_UPDATE on idle stream"}
+		}
+		return nil
+	}
+	if inc == 0 {
+		return h2StreamError{fh.streamID, h2ErrProtocol}
+	}
+	if st.sendWindow += inc; st.sendWindow > h2MaxWindowSize {
+		return h2StreamError{fh.streamID, h2ErrFlowControl}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+// runHandler 在单独的goroutine中处理一个流
+func (sc *h2Conn) runHandler(st *h2Stream) {
+	w := &h2Response{st: st, req: st.req, header: make(Header)}
+	start := time.Now()
+	var handlerTime time.Duration
+	defer func() {
+		err := recover()
+		if err != nil {
+			handlerTime = time.Since(start)
+			if err != ErrAbortHandler {
+				var trace [4096]byte
+				n := runtime.Stack(trace[:], false)
+				if sc.svr.PanicHandler != nil {
+					sc.svr.PanicHandler(st.req, err, trace[:n])
+				} else {
+					sc.svr.logf("httpd: panic serving %s%s: %v\n%s", sc.c.remoteAddr, st.req.logID(), err, trace[:n])
+				}
+			}
+			// 响应已经发送了一部分时，只能重置流让客户端感知到错误
+			if w.sentHeader {
+				sc.writeReset(st.id, h2ErrInternal)
+			} else {
+				w.status = StatusInternalServerError
+				w.written = 0
+				sc.writeSimpleResponse(st.id, StatusInternalServerError)
+			}
+		}
+		sc.svr.endRequest(st.req, RequestInfo{
+			Start:           start,
+			HandlerDuration: handlerTime,
+			Status:          w.status,
+			Written:         w.written,
+			Panic:           err,
+		})
+		st.req.removeMultipartFiles()
+		sc.closeStream(st)
+	}()
+	sc.svr.startRequest(st.req)
+	sc.c.serveHandler(w, st.req)
+	handlerTime = time.Since(start)
+	w.finish()
+}
+
+// closeStream handler结束后调用。客户端还在发送报文主体的话，用NO_ERROR重置流告知它不必再发送
+func (sc *h2Conn) closeStream(st *h2Stream) {
+	sc.mu.Lock()
+	_, active := sc.streams[st.id]
+	delete(sc.streams, st.id)
+	sc.handlers--
+	remoteClosed, reset := st.remoteClosed, st.reset
+	st.reset = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	st.cancel()
+	if active && !remoteClosed && !reset {
+		sc.writeReset(st.id, h2ErrNo)
+	}
+	if st.body != nil {
+		// 没有被读取的报文主体占用着连接的窗口
+		sc.consumed(nil, st.body.closeWithError(errH2BodyClosed))
+	}
+	sc.mu.Lock()
+	idle := sc.goingAway && len(sc.streams) == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.c.rwc.Close()
+	}
+}
+
+// startGoAway 在Shutdown时调用，发送GOAWAY后不再接受新的流，没有正在处理的流时直接关闭连接
+func (sc *h2Conn) startGoAway() {
+	sc.mu.Lock()
+	sc.goingAway = true
+	idle := len(sc.streams) == 0
+	sc.mu.Unlock()
+	sc.writeGoAway(h2ErrNo)
+	if idle {
+		sc.c.rwc.Close()
+	}
+}
+
+// reserveWindow 等待流以及连接都有可用的发送窗口，返回这次最多可以发送的字节数
+func (sc *h2Conn) reserveWindow(st *h2Stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if sc.closed {
+			return 0, errH2ConnClosed
+		}
+		if st.reset {
+			return 0, errH2StreamClosed
+		}
+		if want == 0 {
+			return 0, nil
+		}
+		if st.sendWindow > 0 && sc.sendWindow > 0 {
+			break
+		}
+		sc.cond.Wait()
+	}
+	n := want
+	if n > sc.maxSendFrame {
+		n = sc.maxSendFrame
+	}
+	if int64(n) > st.sendWindow {
+		n = int(st.sendWindow)
+	}
+	if int64(n) > sc.sendWindow {
+		n = int(sc.sendWindow)
+	}
+	st.sendWindow -= int64(n)
+	sc.sendWindow -= int64(n)
+	return n, nil
+}
+
+// writeData 把p切分为DATA帧发送，end为true时最后一帧带有END_STREAM
+func (sc *h2Conn) writeData(st *h2Stream, p []byte, end bool) error {
+	for {
+		n, err := sc.reserveWindow(st, len(p))
+		if err != nil {
+			return err
+		}
+		chunk := p[:n]
+		p = p[n:]
+		var flags uint8
+		if end && len(p) == 0 {
+			flags = h2FlagEndStream
+		}
+		if err = sc.writeFrame(h2FrameData, flags, st.id, chunk); err != nil {
+			return err
+		}
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+func (sc *h2Conn) writeFrame(typ h2FrameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if sc.wclosed {
+		return errH2ConnClosed
+	}
+	var hdr [h2FrameHeaderLen]byte
+	sc.c.bufw.Write(appendH2FrameHeader(hdr[:0], len(payload), typ, flags, streamID))
+	sc.c.bufw.Write(payload)
+	return sc.c.bufw.Flush()
+}
+
+// writeHeaders 发送首部块，超过对端允许的帧大小时拆分为HEADERS以及若干CONTINUATION，中间不能插入其他帧
+func (sc *h2Conn) writeHeaders(streamID uint32, endStream bool, block []byte) error {
+	sc.mu.Lock()
+	max := sc.maxSendFrame
+	sc.mu.Unlock()
+
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if sc.wclosed {
+		return errH2ConnClosed
+	}
+	typ := h2FrameHeaders
+	var hdr [h2FrameHeaderLen]byte
+	for first := true; first || len(block) > 0; first = false {
+		chunk := block
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		block = block[len(chunk):]
+		var flags uint8
+		if first && endStream {
+			flags |= h2FlagEndStream
+		}
+		if len(block) == 0 {
+			flags |= h2FlagEndHeaders
+		}
+		sc.c.bufw.Write(appendH2FrameHeader(hdr[:0], len(chunk), typ, flags, streamID))
+		sc.c.bufw.Write(chunk)
+		typ = h2FrameContinuation
+	}
+	return sc.c.bufw.Flush()
+}
+
+// writeSimpleResponse 发送一个只有状态码、没有报文主体的响应
+func (sc *h2Conn) writeSimpleResponse(streamID uint32, code int) error {
+	block := hpackAppendField(nil, ":status", strconv.Itoa(code))
+	block = hpackAppendField(block, "content-length", "0")
+	return sc.writeHeaders(streamID, true, block)
+}
+
+func (sc *h2Conn) writeReset(streamID uint32, code h2ErrCode) error {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], uint32(code))
+	return sc.writeFrame(h2FrameRSTStream, 0, streamID, p[:])
+}
+
+func (sc *h2Conn) writeWindowUpdate(streamID, inc uint32) error {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], inc)
+	return sc.writeFrame(h2FrameWindowUpdate, 0, streamID, p[:])
+}
+
+// writeGoAway 告知客户端最后处理的流，之后的流不会被处理，客户端可以在新的连接上重试
+func (sc *h2Conn) writeGoAway(code h2ErrCode) error {
+	sc.mu.Lock()
+	last := sc.maxStreamID
+	sc.mu.Unlock()
+	var p [8]byte
+	binary.BigEndian.PutUint32(p[:], last)
+	binary.BigEndian.PutUint32(p[4:], uint32(code))
+	return sc.writeFrame(h2FrameGoAway, 0, 0, p[:])
+}
+
+// h2Pipe 是请求的报文主体，读取帧的goroutine写入，handler读取
+type h2Pipe struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    bytes.Buffer
+	err    error     // 数据读完之后Read返回的错误
+	onRead func(int) // handler每读取一部分数据就归还相应的接收窗口
+}
+
+func (p *h2Pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for p.buf.Len() == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 {
+		err := p.err
+		p.mu.Unlock()
+		return 0, err
+	}
+	n, _ := p.buf.Read(b)
+	p.mu.Unlock()
+	p.onRead(n)
+	return n, nil
+}
+
+// write 写入收到的数据，pipe已经关闭时返回false
+func (p *h2Pipe) write(b []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return false
+	}
+	p.buf.Write(b)
+	p.cond.Signal()
+	return true
+}
+
+// closeWithError 关闭pipe，缓存的数据读完后Read返回err；err不是io.EOF时丢弃缓存的数据，返回丢弃的字节数
+func (p *h2Pipe) closeWithError(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil || p.err == io.EOF {
+		p.err = err
+	}
+	n := 0
+	if err != io.EOF {
+		n = p.buf.Len()
+		p.buf.Reset()
+	}
+	p.cond.Broadcast()
+	return n
+}
+
+// h2Response 是http/2中的ResponseWriter，与http/1.1的response一样先把报文主体缓存起来，
+// handler结束时还没有写满缓存的话，就可以设置Content-Length
+type h2Response struct {
+	st  *h2Stream
+	req *Request
+
+	header      Header
+	status      int
+	wroteHeader bool // handler是否调用过WriteHeader
+	sentHeader  bool // HEADERS帧是否已经发送
+	handlerDone bool
+	trailers    []string // handler通过Trailer首部声明的trailer字段
+
+	buf         []byte
+	written     int64
+	headBodyLen int64
+}
+
+func (w *h2Response) Header() Header {
+	return w.header
+}
+
+func (w *h2Response) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+}
+
+func (w *h2Response) Write(p []byte) (int, error) {
+	if w.handlerDone {
+		return 0, ErrHandlerDone
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if !bodyAllowedForStatus(w.status) {
+		return len(p), nil
+	}
+	if w.req.Method == "HEAD" {
+		w.headBodyLen += int64(len(p))
+		return len(p), nil
+	}
+	if w.buf == nil {
+		w.buf = make([]byte, 0, w.st.sc.svr.writeBufferSize())
+	}
+	w.written += int64(len(p))
+	if len(w.buf)+len(p) <= cap(w.buf) {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.send(w.buf, false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:0]
+	}
+	if err := w.send(p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *h2Response) Flush() {
+	if w.handlerDone {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if w.send(w.buf, false) == nil {
+		w.buf = w.buf[:0]
+	}
+}
+
+// send 发送报文主体，首部还没有发送的话先发送首部
+func (w *h2Response) send(p []byte, end bool) error {
+	if !w.sentHeader {
+		if err := w.writeHeader(p, end && len(p) == 0); err != nil {
+			return err
+		}
+		if end && len(p) == 0 {
+			return nil
+		}
+	}
+	if len(p) == 0 && !end {
+		return nil
+	}
+	return w.st.sc.writeData(w.st, p, end)
+}
+
+// finish 在handler返回后调用，发送剩余的报文主体以及trailer
+func (w *h2Response) finish() {
+	w.handlerDone = true
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	w.parseTrailers()
+	if !w.sentHeader && bodyAllowedForStatus(w.status) && len(w.trailers) == 0 && w.header.Get("Content-Length") == "" {
+		// 报文主体已经全部在缓存中了
+		if w.req.Method == "HEAD" {
+			if w.headBodyLen > 0 {
+				w.header.Set("Content-Length", strconv.FormatInt(w.headBodyLen, 10))
+			}
+		} else {
+			w.header.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		}
+	}
+	if len(w.trailers) == 0 {
+		w.send(w.buf, true)
+		return
+	}
+	if w.send(w.buf, false) != nil {
+		return
+	}
+	var block []byte
+	for _, key := range w.trailers {
+		for _, v := range w.header[key] {
+			block = hpackAppendField(block, strings.ToLower(key), headerValueReplacer.Replace(v))
+		}
+	}
+	w.st.sc.writeHeaders(w.st.id, true, block)
+}
+
+// parseTrailers 解析handler在Trailer首部中声明的字段，首部发送之后再声明的无效
+func (w *h2Response) parseTrailers() {
+	if w.sentHeader || w.trailers != nil {
+		return
+	}
+	for _, v := range w.header["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				w.trailers = append(w.trailers, CanonicalHeaderKey(key))
+			}
+		}
+	}
+}
+
+// writeHeader 编码并发送响应首部，p为第一块报文主体，用于嗅探Content-Type。
+// http/1.1中的逐跳首部在http/2中是非法的，需要去掉
+func (w *h2Response) writeHeader(p []byte, endStream bool) error {
+	w.parseTrailers()
+	w.sentHeader = true
+	h := w.header
+	if !bodyAllowedForStatus(w.status) {
+		h.Del("Content-Length")
+	} else {
+		sniffContentType(h, p)
+	}
+	if _, ok := h["Date"]; !ok {
+		h.Set("Date", httpDate(time.Now()))
+	}
+	if _, ok := h["Server"]; !ok {
+		h.Set("Server", w.st.sc.svr.serverHeader())
+	}
+
+	block := hpackAppendField(nil, ":status", strconv.Itoa(w.status))
+	for k, vs := range h {
+		switch k {
+		case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade":
+			continue
+		}
+		if w.isTrailer(k) {
+			continue
+		}
+		k = strings.ToLower(k)
+		for _, v := range vs {
+			block = hpackAppendField(block, k, strings.TrimSpace(headerValueReplacer.Replace(v)))
+		}
+	}
+	return w.st.sc.writeHeaders(w.st.id, endStream, block)
+}
+
+func (w *h2Response) isTrailer(key string) bool {
+	for _, t := range w.trailers {
+		if t == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package httpd
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+// http2_frame.go定义了http/2的帧格式。http/2把请求与响应拆分为一个个帧在同一个连接上交错发送，
+// 每个帧都以9字节的帧头开始：
+//
+//	+-----------------------------------------------+
+//	|                 Length (24)                   |
+//	+---------------+---------------+---------------+
+//	|   Type (8)    |   Flags (8)   |
+//	+-+-------------+---------------+-------------------------------+
+//	|R|                 Stream Identifier (31)                      |
+//	+=+=============================================================+
+//	|                   Frame Payload (0...)                      ...
+//	+---------------------------------------------------------------+
+
+type h2FrameType uint8
+
+const (
+	h2FrameData         h2FrameType = 0x0
+	h2FrameHeaders      h2FrameType = 0x1
+	h2FramePriority     h2FrameType = 0x2
+	h2FrameRSTStream    h2FrameType = 0x3
+	h2FrameSettings     h2FrameType = 0x4
+	h2FramePushPromise  h2FrameType = 0x5
+	h2FramePing         h2FrameType = 0x6
+	h2FrameGoAway       h2FrameType = 0x7
+	h2FrameWindowUpdate h2FrameType = 0x8
+	h2FrameContinuation h2FrameType = 0x9
+)
+
+// 帧头中的标志位，同一个值在不同类型的帧中含义不同
+const (
+	h2FlagEndStream  = 0x1 // DATA、HEADERS
+	h2FlagAck        = 0x1 // SETTINGS、PING
+	h2FlagEndHeaders = 0x4 // HEADERS、CONTINUATION
+	h2FlagPadded     = 0x8 // DATA、HEADERS
+	h2FlagPriority   = 0x20
+)
+
+// h2ErrCode 是RST_STREAM以及GOAWAY中携带的错误码
+type h2ErrCode uint32
+
+const (
+	h2ErrNo                 h2ErrCode = 0x0
+	h2ErrProtocol           h2ErrCode = 0x1
+	h2ErrInternal           h2ErrCode = 0x2
+	h2ErrFlowControl        h2ErrCode = 0x3
+	h2ErrSettingsTimeout    h2ErrCode = 0x4
+	h2ErrStreamClosed       h2ErrCode = 0x5
+	h2ErrFrameSize          h2ErrCode = 0x6
+	h2ErrRefusedStream      h2ErrCode = 0x7
+	h2ErrCancel             h2ErrCode = 0x8
+	h2ErrCompression        h2ErrCode = 0x9
+	h2ErrConnect            h2ErrCode = 0xa
+	h2ErrEnhanceYourCalm    h2ErrCode = 0xb
+	h2ErrInadequateSecurity h2ErrCode = 0xc
+	h2ErrHTTP11Required     h2ErrCode = 0xd
+)
+
+var h2ErrCodeName = map[h2ErrCode]string{
+	h2ErrNo:                 "NO_ERROR",
+	h2ErrProtocol:           "PROTOCOL_ERROR",
+	h2ErrInternal:           "INTERNAL_ERROR",
+	h2ErrFlowControl:        "FLOW_CONTROL_ERROR",
+	h2ErrSettingsTimeout:    "SETTINGS_TIMEOUT",
+	h2ErrStreamClosed:       "STREAM_CLOSED",
+	h2ErrFrameSize:          "FRAME_SIZE_ERROR",
+	h2ErrRefusedStream:      "REFUSED_STREAM",
+	h2ErrCancel:             "CANCEL",
+	h2ErrCompression:        "COMPRESSION_ERROR",
+	h2ErrConnect:            "CONNECT_ERROR",
+	h2ErrEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	h2ErrInadequateSecurity: "INADEQUATE_SECURITY",
+	h2ErrHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (e h2ErrCode) String() string {
+	if s, ok := h2ErrCodeName[e]; ok {
+		return s
+	}
+	return "unknown error code 0x" + strconv.FormatUint(uint64(e), 16)
+}
+
+// h2ConnError 连接级别的错误，发送GOAWAY后关闭整个连接
+type h2ConnError struct {
+	code   h2ErrCode
+	reason string
+}
+
+func (e h2ConnError) Error() string {
+	return "http2: connection error: " + e.code.String() + ": " + e.reason
+}
+
+// h2StreamError 流级别的错误，发送RST_STREAM关闭这个流，连接上的其他流不受影响
+type h2StreamError struct {
+	streamID uint32
+	code     h2ErrCode
+}
+
+func (e h2StreamError) Error() string {
+	return "http2: stream " + strconv.FormatUint(uint64(e.streamID), 10) + " error: " + e.code.String()
+}
+
+// SETTINGS帧中的参数
+const (
+	h2SettingHeaderTableSize      = 0x1
+	h2SettingEnablePush           = 0x2
+	h2SettingMaxConcurrentStreams = 0x3
+	h2SettingInitialWindowSize    = 0x4
+	h2SettingMaxFrameSize         = 0x5
+	h2SettingMaxHeaderListSize    = 0x6
+)
+
+const (
+	// h2ClientPreface 客户端在连接建立后首先发送的24字节，之后紧跟一个SETTINGS帧
+	h2ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	h2FrameHeaderLen = 9
+	// h2DefaultMaxFrameSize 协议规定的帧负载默认上限，对端通过SETTINGS_MAX_FRAME_SIZE可以调大，最多16MB-1
+	h2DefaultMaxFrameSize = 16 << 10
+	h2MaxFrameSizeLimit   = 1<<24 - 1
+	// h2DefaultWindowSize 流量控制窗口的初始大小
+	h2DefaultWindowSize = 65535
+	h2MaxWindowSize     = 1<<31 - 1
+)
+
+type h2FrameHeader struct {
+	length   uint32
+	typ      h2FrameType
+	flags    uint8
+	streamID uint32
+}
+
+func (h h2FrameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+// h2Framer 从连接上读取帧，返回的负载在下一次readFrame之前有效
+type h2Framer struct {
+	r            io.Reader
+	hdr          [h2FrameHeaderLen]byte
+	buf          []byte
+	maxFrameSize uint32 // 我们允许对端发送的最大负载
+}
+
+func (fr *h2Framer) readFrame() (h2FrameHeader, []byte, error) {
+	if _, err := io.ReadFull(fr.r, fr.hdr[:]); err != nil {
+		return h2FrameHeader{}, nil, err
+	}
+	fh := h2FrameHeader{
+		length:   uint32(fr.hdr[0])<<16 | uint32(fr.hdr[1])<<8 | uint32(fr.hdr[2]),
+		typ:      h2FrameType(fr.hdr[3]),
+		flags:    fr.hdr[4],
+		streamID: binary.BigEndian.Uint32(fr.hdr[5:]) & (1<<31 - 1),
+	}
+	if fh.length > fr.maxFrameSize {
+		return fh, nil, h2ConnError{h2ErrFrameSize, "frame too large"}
+	}
+	if cap(fr.buf) < int(fh.length) {
+		fr.buf = make([]byte, fh.length)
+	}
+	payload := fr.buf[:fh.length]
+	if _, err := io.ReadFull(fr.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fh, nil, err
+	}
+	return fh, payload, nil
+}
+
+func appendH2FrameHeader(dst []byte, length int, typ h2FrameType, flags uint8, streamID uint32) []byte {
+	return append(dst,
+		byte(length>>16), byte(length>>8), byte(length),
+		byte(typ), flags,
+		byte(streamID>>24), byte(streamID>>16), byte(streamID>>8), byte(streamID))
+}
+
+// h2StripPadding 去掉DATA或HEADERS帧的填充，返回实际的负载
+func h2StripPadding(fh h2FrameHeader, p []byte) ([]byte, error) {
+	if !fh.has(h2FlagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, h2ConnError{h2ErrProtocol, "invalid padding"}
+	}
+	return p[1 : len(p)-int(p[0])], nil
+}
+
+type h2Setting struct {
+	id  uint16
+	val uint32
+}
+
+func parseH2Settings(p []byte) ([]h2Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, h2ConnError{h2ErrFrameSize, "invalid SETTINGS length"}
+	}
+	settings := make([]h2Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, h2Setting{binary.BigEndian.Uint16(p), binary.BigEndian.Uint32(p[2:])})
+	}
+	return settings, nil
+}
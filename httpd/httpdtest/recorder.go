@@ -0,0 +1,181 @@
+// httpdtest 提供测试httpd的handler所需的工具，handler可以直接在内存中调用，不需要监听端口：
+//
+//	r := httpdtest.NewRequest("POST", "/users?verbose=1", strings.NewReader(`{"name":"gu"}`))
+//	r.Header.Set("Content-Type", "application/json")
+//	w := httpdtest.NewRecorder()
+//	handler.ServeHTTP(w, r)
+//	if w.Code != httpd.StatusCreated { ... }
+package httpdtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"httpd/httpd"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// DefaultRemoteAddr NewRequest创建的请求的RemoteAddr，取自RFC 5737中保留给文档使用的地址
+const DefaultRemoteAddr = "192.0.2.1:1234"
+
+// NewRequest 创建一个交给handler处理的服务端请求，与从连接上读到的请求一样经过ReadRequest解析，
+// Query、Cookie、ParseForm等方法都可以正常使用。
+//
+// target可以是路径(如/users?id=1)，此时Host为example.com；也可以是完整的url，此时Host取自url，
+// https的url还会设置TLS字段。body不为nil时会被全部读入内存并设置Content-Length。
+// method为空时使用GET。参数不合法时panic，这在测试中比返回错误更方便
+func NewRequest(method, target string, body io.Reader) *httpd.Request {
+	if method == "" {
+		method = "GET"
+	}
+	host, uri, secure := "example.com", target, false
+	if i := strings.Index(target, "://"); i >= 0 && !strings.HasPrefix(target, "/") {
+		secure = strings.EqualFold(target[:i], "https")
+		rest := target[i+3:]
+		j := strings.IndexAny(rest, "/?")
+		if j < 0 {
+			host, uri = rest, "/"
+		} else {
+			host, uri = rest[:j], rest[j:]
+			if uri[0] == '?' {
+				uri = "/" + uri
+			}
+		}
+	}
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(body); err != nil {
+			panic("httpdtest: reading request body: " + err.Error())
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, uri, host)
+	if body != nil {
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(data)) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(data)
+
+	r, err := httpd.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		panic("httpdtest: invalid NewRequest arguments: " + err.Error())
+	}
+	r.RemoteAddr = DefaultRemoteAddr
+	if secure {
+		r.TLS = &tls.ConnectionState{
+			Version:           tls.VersionTLS12,
+			HandshakeComplete: true,
+			ServerName:        r.Host,
+		}
+	}
+	return r
+}
+
+// ResponseRecorder 是记录handler写出的响应的ResponseWriter，同时实现了Flusher
+type ResponseRecorder struct {
+	// Code WriteHeader设置的状态码，handler没有调用WriteHeader而直接Write时为200
+	Code int
+	// HeaderMap handler通过Header设置的首部，响应发出之后仍然可能被修改，检查发出的首部应当使用Result
+	HeaderMap httpd.Header
+	// Body 写出的报文主体，为nil时丢弃
+	Body *bytes.Buffer
+	// Flushed handler是否调用过Flush
+	Flushed bool
+
+	wroteHeader bool
+	snapHeader  httpd.Header // WriteHeader时首部的快照
+}
+
+// NewRecorder 返回一个初始化了的ResponseRecorder
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{
+		Code:      httpd.StatusOK,
+		HeaderMap: make(httpd.Header),
+		Body:      new(bytes.Buffer),
+	}
+}
+
+func (rw *ResponseRecorder) Header() httpd.Header {
+	if rw.HeaderMap == nil {
+		rw.HeaderMap = make(httpd.Header)
+	}
+	return rw.HeaderMap
+}
+
+// writeHeader 与response一样，handler没有设置Content-Type时根据第一块报文主体补充
+func (rw *ResponseRecorder) writeHeader(p []byte) {
+	if rw.wroteHeader {
+		return
+	}
+	h := rw.Header()
+	_, hasType := h["Content-Type"]
+	_, hasEncoding := h["Content-Encoding"]
+	if len(p) > 0 && !hasType && !hasEncoding {
+		h.Set("Content-Type", httpd.DetectContentType(p))
+	}
+	rw.WriteHeader(httpd.StatusOK)
+}
+
+func (rw *ResponseRecorder) Write(p []byte) (int, error) {
+	rw.writeHeader(p)
+	if rw.Body != nil {
+		rw.Body.Write(p)
+	}
+	return len(p), nil
+}
+
+func (rw *ResponseRecorder) WriteString(s string) (int, error) {
+	return rw.Write([]byte(s))
+}
+
+// WriteHeader 记录状态码以及此时首部的快照，只有第一次调用生效
+func (rw *ResponseRecorder) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("httpdtest: invalid WriteHeader code %v", code))
+	}
+	rw.wroteHeader = true
+	rw.Code = code
+	rw.snapHeader = rw.Header().Clone()
+}
+
+func (rw *ResponseRecorder) Flush() {
+	rw.writeHeader(nil)
+	rw.Flushed = true
+}
+
+// Result 返回handler写出的响应，Header为WriteHeader时首部的快照，Body读取的是此时已经写出的报文主体。
+// 应当在handler返回之后调用
+func (rw *ResponseRecorder) Result() *httpd.Response {
+	header := rw.snapHeader
+	if header == nil {
+		header = rw.Header().Clone()
+	}
+	res := &httpd.Response{
+		Status:        strconv.Itoa(rw.Code) + " " + httpd.StatusText(rw.Code),
+		StatusCode:    rw.Code,
+		Proto:         "HTTP/1.1",
+		Header:        header,
+		ContentLength: -1,
+	}
+	var body []byte
+	if rw.Body != nil {
+		body = rw.Body.Bytes()
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if v := header.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			res.ContentLength = n
+		}
+	}
+	return res
+}
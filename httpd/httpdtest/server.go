@@ -0,0 +1,191 @@
+package httpdtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"httpd/httpd"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server 是一个监听在本机回环地址上的真实服务器，请求经过与线上完全相同的连接处理以及报文解析，
+// 用于端到端的测试：
+//
+//	ts := httpdtest.NewServer(handler)
+//	defer ts.Close()
+//	res, err := ts.Client().Get(ts.URL + "/users")
+type Server struct {
+	// URL 服务器的根地址，如 http://127.0.0.1:53412，末尾没有/
+	URL string
+	// Listener 服务器使用的监听器
+	Listener net.Listener
+	// Config 实际运行的服务器，可以在Start或者StartTLS之前修改其中的配置
+	Config *httpd.Server
+	// TLS StartTLS使用的tls配置，可以在StartTLS之前修改；没有配置证书时使用自签名的证书
+	TLS *tls.Config
+	// Certificate StartTLS之后为服务器使用的证书，Client返回的客户端信任这个证书
+	Certificate *x509.Certificate
+
+	started bool
+	wg      sync.WaitGroup // 等待Serve返回
+
+	mu     sync.Mutex
+	client *httpd.Client
+	closed bool
+}
+
+// NewServer 创建并启动一个使用handler处理请求的明文http服务器，调用方在使用完毕后应当调用Close
+func NewServer(handler httpd.Handler) *Server {
+	ts := NewUnstartedServer(handler)
+	ts.Start()
+	return ts
+}
+
+// NewTLSServer 创建并启动一个使用自签名证书的https服务器，应当通过Client返回的客户端访问
+func NewTLSServer(handler httpd.Handler) *Server {
+	ts := NewUnstartedServer(handler)
+	ts.StartTLS()
+	return ts
+}
+
+// NewUnstartedServer 创建一个监听在127.0.0.1的随机端口上、但还没有开始接受连接的服务器，
+// 调用方可以先修改Config再调用Start或者StartTLS
+func NewUnstartedServer(handler httpd.Handler) *Server {
+	return &Server{
+		Listener: newLocalListener(),
+		Config:   &httpd.Server{Handler: handler},
+	}
+}
+
+func newLocalListener() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		// 没有ipv4回环地址的环境
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("httpdtest: failed to listen on a port: " + err.Error())
+		}
+	}
+	return l
+}
+
+// Start 以明文http开始接受连接
+func (ts *Server) Start() {
+	if ts.started {
+		panic("httpdtest: Server already started")
+	}
+	ts.started = true
+	ts.URL = "http://" + ts.Listener.Addr().String()
+	ts.goServe(func() error { return ts.Config.Serve(ts.Listener) })
+}
+
+// StartTLS 以https开始接受连接，ALPN协商出h2时使用http/2
+func (ts *Server) StartTLS() {
+	if ts.started {
+		panic("httpdtest: Server already started")
+	}
+	ts.started = true
+	if ts.TLS == nil {
+		ts.TLS = new(tls.Config)
+	}
+	if len(ts.TLS.Certificates) == 0 && ts.TLS.GetCertificate == nil {
+		cert, err := selfSignedCert()
+		if err != nil {
+			panic("httpdtest: generating certificate: " + err.Error())
+		}
+		ts.TLS.Certificates = []tls.Certificate{cert}
+	}
+	if len(ts.TLS.Certificates) > 0 {
+		leaf, err := x509.ParseCertificate(ts.TLS.Certificates[0].Certificate[0])
+		if err != nil {
+			panic("httpdtest: parsing certificate: " + err.Error())
+		}
+		ts.Certificate = leaf
+	}
+	ts.Config.TLSConfig = ts.TLS
+	ts.URL = "https://" + ts.Listener.Addr().String()
+	ts.goServe(func() error { return ts.Config.ServeTLS(ts.Listener, "", "") })
+}
+
+func (ts *Server) goServe(serve func() error) {
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+		serve()
+	}()
+}
+
+// Client 返回一个访问这个服务器的客户端，StartTLS之后它信任服务器的证书。
+// Close时会关闭它的空闲连接
+func (ts *Server) Client() *httpd.Client {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.client == nil {
+		transport := &httpd.Transport{}
+		if ts.Certificate != nil {
+			pool := x509.NewCertPool()
+			pool.AddCert(ts.Certificate)
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+		ts.client = &httpd.Client{Transport: transport}
+	}
+	return ts.client
+}
+
+// Close 关闭服务器，取消所有正在处理的请求的Context，并等待接受连接的goroutine退出。可以多次调用
+func (ts *Server) Close() {
+	ts.mu.Lock()
+	if ts.closed {
+		ts.mu.Unlock()
+		return
+	}
+	ts.closed = true
+	client := ts.client
+	ts.mu.Unlock()
+
+	if !ts.started {
+		ts.Listener.Close()
+	}
+	ts.Config.Close()
+	ts.wg.Wait()
+	if client != nil {
+		if t, ok := client.Transport.(*httpd.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+// selfSignedCert 生成127.0.0.1、::1、localhost以及example.com可用的自签名证书
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"httpdtest"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost", "example.com"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,71 @@
+package httpd
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// iofs.go把标准库的fs.FS适配为FileSystem，使go:embed嵌入的静态资源可以直接交给FileServer：
+//
+//	//go:embed static
+//	var static embed.FS
+//
+//	sub, _ := fs.Sub(static, "static")
+//	mux.Handle("/", httpd.FileServer(httpd.FS(sub)))
+
+// FS 把fsys转换为FileSystem。fsys中的文件需要实现io.Seeker才能用于ServeContent，embed.FS中的文件都满足这一点
+func FS(fsys fs.FS) FileSystem {
+	return ioFS{fsys}
+}
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+func (f ioFS) Open(name string) (FileSystemFile, error) {
+	// fs.FS的路径不以/开头，根目录为.
+	name = path.Clean("/" + name)
+	if name == "/" {
+		name = "."
+	} else {
+		name = name[1:]
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioFile{file}, nil
+}
+
+// ioFile 为fs.File补充FileSystemFile需要的Seek以及Readdir
+type ioFile struct {
+	fs.File
+}
+
+func (f ioFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, errors.New("httpd: file does not implement io.Seeker")
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f ioFile) Readdir(count int) ([]fs.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, errors.New("httpd: file is not a directory")
+	}
+	entries, err := d.ReadDir(count)
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, ierr := e.Info()
+		if ierr != nil {
+			// 读取目录之后文件被删除了，跳过即可
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
@@ -0,0 +1,236 @@
+package httpd
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jar.go实现了客户端的cookie存储。Client设置了Jar后，响应中的Set-Cookie会被保存下来，
+// 之后发往匹配的域名与路径的请求会自动带上这些cookie，就像浏览器一样。
+// 匹配规则参照RFC 6265：
+//   - Domain：没有Domain属性的cookie只发往设置它的主机；有Domain属性的还会发往其子域名，
+//     但Domain必须是请求主机本身或者它的上级域名，否则拒绝保存。
+//   - Path：没有Path属性时取请求路径中最后一个/之前的部分，请求路径等于Path或者以Path/开头时才发送。
+//   - 过期时间：Max-Age优先于Expires，已经过期的cookie会删除同名的旧cookie；两者都没有的是会话cookie，一直保留到Jar被丢弃。
+//   - Secure：只通过https发送。
+// 没有内置公共后缀列表，只拒绝不含.的顶级域名(如Domain=com)，因此不适合用来访问互不信任的站点。
+
+// CookieJar 负责保存以及取出客户端的cookie，多个goroutine可能并发调用它的方法
+type CookieJar interface {
+	// SetCookies 处理从u收到的响应中的cookie，是否保存由实现决定
+	SetCookies(u *url.URL, cookies []*Cookie)
+	// Cookies 返回发往u的请求应该携带的cookie
+	Cookies(u *url.URL) []*Cookie
+}
+
+// Jar 是保存在内存中的CookieJar，零值即可直接使用
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*jarEntry // 域名 -> name;domain;path -> cookie
+	seq     uint64                          // 创建顺序，路径长度相同时先创建的cookie排在前面
+}
+
+type jarEntry struct {
+	name, value string
+	domain      string // 小写，没有开头的.
+	path        string
+	hostOnly    bool // 没有Domain属性，只发往domain本身
+	secure      bool
+	expires     time.Time // 零值代表会话cookie
+	seq         uint64
+}
+
+func (e *jarEntry) key() string {
+	return e.name + ";" + e.domain + ";" + e.path
+}
+
+func (e *jarEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !e.expires.After(now)
+}
+
+// shouldSend 判断cookie是否应该随发往host、path的请求一起发送
+func (e *jarEntry) shouldSend(https bool, host, path string) bool {
+	if e.secure && !https {
+		return false
+	}
+	if e.hostOnly {
+		if host != e.domain {
+			return false
+		}
+	} else if !domainMatch(host, e.domain) {
+		return false
+	}
+	return pathMatch(path, e.path)
+}
+
+// SetCookies 实现CookieJar，只接受http以及https地址的cookie
+func (j *Jar) SetCookies(u *url.URL, cookies []*Cookie) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+	host := jarHost(u)
+	if host == "" {
+		return
+	}
+	defPath := defaultCookiePath(u.Path)
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		e, ok := j.newEntry(c, host, defPath, now)
+		if !ok {
+			continue
+		}
+		submap := j.entries[e.domain]
+		if e.expired(now) {
+			delete(submap, e.key())
+			continue
+		}
+		if submap == nil {
+			if j.entries == nil {
+				j.entries = make(map[string]map[string]*jarEntry)
+			}
+			submap = make(map[string]*jarEntry)
+			j.entries[e.domain] = submap
+		}
+		// 覆盖旧的cookie时保留其创建顺序
+		if old := submap[e.key()]; old != nil {
+			e.seq = old.seq
+		} else {
+			j.seq++
+			e.seq = j.seq
+		}
+		submap[e.key()] = e
+	}
+}
+
+// newEntry 按照请求的主机与路径校验cookie的Domain、Path属性，计算过期时间
+func (j *Jar) newEntry(c *Cookie, host, defPath string, now time.Time) (*jarEntry, bool) {
+	if !isCookieNameValid(c.Name) {
+		return nil, false
+	}
+	e := &jarEntry{
+		name:   c.Name,
+		value:  sanitizeCookieValue(c.Value),
+		path:   c.Path,
+		secure: c.Secure,
+	}
+
+	domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	switch {
+	case domain == "" || domain == host:
+		e.domain, e.hostOnly = host, c.Domain == ""
+	case net.ParseIP(host) != nil:
+		// ip地址没有子域名，Domain只能等于它本身
+		return nil, false
+	case !strings.Contains(domain, ".") || !domainMatch(host, domain):
+		return nil, false
+	default:
+		e.domain = domain
+	}
+
+	if e.path == "" || e.path[0] != '/' {
+		e.path = defPath
+	}
+
+	switch {
+	case c.MaxAge < 0:
+		e.expires = time.Unix(1, 0)
+	case c.MaxAge > 0:
+		e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	case !c.Expires.IsZero():
+		e.expires = c.Expires
+		if !e.expires.After(now) {
+			e.expires = time.Unix(1, 0)
+		}
+	}
+	return e, true
+}
+
+// Cookies 实现CookieJar，路径越长的cookie越靠前，路径长度相同时先创建的靠前
+func (j *Jar) Cookies(u *url.URL) []*Cookie {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	host := jarHost(u)
+	if host == "" {
+		return nil
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	https := u.Scheme == "https"
+	now := time.Now()
+
+	j.mu.Lock()
+	var selected []*jarEntry
+	// cookie可能保存在host以及它的任意一级上级域名下
+	for d := host; ; {
+		for key, e := range j.entries[d] {
+			if e.expired(now) {
+				delete(j.entries[d], key)
+				continue
+			}
+			if e.shouldSend(https, host, path) {
+				selected = append(selected, e)
+			}
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 || net.ParseIP(host) != nil {
+			break
+		}
+		d = d[i+1:]
+	}
+	j.mu.Unlock()
+
+	sort.Slice(selected, func(a, b int) bool {
+		if len(selected[a].path) != len(selected[b].path) {
+			return len(selected[a].path) > len(selected[b].path)
+		}
+		return selected[a].seq < selected[b].seq
+	})
+	cookies := make([]*Cookie, len(selected))
+	for i, e := range selected {
+		cookies[i] = &Cookie{Name: e.name, Value: e.value}
+	}
+	return cookies
+}
+
+// jarHost 返回小写的、不带端口的主机名，cookie不区分端口
+func jarHost(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// domainMatch host等于domain，或者是domain的子域名
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, domain) && host[len(host)-len(domain)-1] == '.' && net.ParseIP(host) == nil
+}
+
+// pathMatch 请求路径等于cookie的路径，或者以cookie的路径加上/开头
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return cookiePath[len(cookiePath)-1] == '/' || reqPath[len(cookiePath)] == '/'
+}
+
+// defaultCookiePath 没有Path属性时，取请求路径中最后一个/之前的部分
+func defaultCookiePath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -0,0 +1,123 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// json.go提供了api服务中最常用的两个操作：把对象编码为json写入响应，以及把请求的报文主体解码到对象中。
+
+// DefaultMaxDecodeBytes DecodeJSON默认允许的报文主体大小
+const DefaultMaxDecodeBytes = 10 << 20 // 10MB
+
+// ErrUnsupportedMediaType 报文主体的Content-Type与期望的格式不符，handler一般回复415。
+// 报文主体超过大小限制时返回ErrBodyTooLarge，handler一般回复413
+var ErrUnsupportedMediaType = errors.New("httpd: unsupported media type")
+
+// DecodeOptions 控制报文主体的解码
+type DecodeOptions struct {
+	// MaxBytes 报文主体的大小上限，不大于0时使用DefaultMaxDecodeBytes
+	MaxBytes int64
+	// DisallowUnknownFields 为true时，json中出现目标结构体没有的字段会返回错误
+	DisallowUnknownFields bool
+}
+
+func (o DecodeOptions) maxBytes() int64 {
+	if o.MaxBytes > 0 {
+		return o.MaxBytes
+	}
+	return DefaultMaxDecodeBytes
+}
+
+// JSON 把v编码为json后以状态码code回复，同时设置Content-Type以及Content-Length。
+// 编码失败时回复500并返回错误，此时响应中不会包含部分的json
+func JSON(w ResponseWriter, code int, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		Error(w, "500 internal server error", StatusInternalServerError)
+		return err
+	}
+	buf = append(buf, '\n')
+	h := w.Header()
+	if _, ok := h["Content-Type"]; !ok {
+		h.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(code)
+	_, err = w.Write(buf)
+	return err
+}
+
+// DecodeJSON 把json格式的报文主体解码到v中，报文主体最多DefaultMaxDecodeBytes字节。
+// Content-Type不是json时返回ErrUnsupportedMediaType，超过大小限制时返回ErrBodyTooLarge，
+// 报文主体中除了一个json值之外还有其他内容时同样返回错误
+func (r *Request) DecodeJSON(v interface{}) error {
+	return r.DecodeJSONWith(v, DecodeOptions{})
+}
+
+// DecodeJSONWith 与DecodeJSON相同，只是由opts指定大小限制以及是否允许未知的字段
+func (r *Request) DecodeJSONWith(v interface{}, opts DecodeOptions) error {
+	if ct, _ := r.parseContentType(); ct != "" && !isJSONContentType(ct) {
+		return ErrUnsupportedMediaType
+	}
+	if r.Body == nil {
+		return errors.New("httpd: empty request body")
+	}
+	dec := json.NewDecoder(&maxBytesReader{r: r.Body, n: opts.maxBytes()})
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("httpd: empty request body")
+		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == ErrBodyTooLarge {
+			return err
+		}
+		return errors.New("httpd: request body must contain a single JSON value")
+	}
+	return nil
+}
+
+// isJSONContentType application/json以及形如application/problem+json的类型都视为json
+func isJSONContentType(ct string) bool {
+	ct = strings.ToLower(ct)
+	return ct == "application/json" || strings.HasPrefix(ct, "application/") && strings.HasSuffix(ct, "+json")
+}
+
+// maxBytesReader 最多允许读取n字节，超过之后返回ErrBodyTooLarge而不是截断，
+// 避免把截断后恰好合法的内容当作完整的报文主体
+type maxBytesReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// 多读一个字节，用于判断是否超过了限制
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+	n = int(l.n)
+	l.n = 0
+	l.err = ErrBodyTooLarge
+	return n, l.err
+}
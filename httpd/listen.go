@@ -0,0 +1,104 @@
+package httpd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listen.go负责根据Server的配置创建监听器
+
+// unixAddrPrefix Addr以此为前缀时在unix domain socket上监听，如 unix:/var/run/app.sock
+const unixAddrPrefix = "unix:"
+
+// listen 经过Listen的登记，重启时监听器可以传给新进程，新进程中优先使用继承来的监听器
+func (s *Server) listen() (net.Listener, error) {
+	if strings.HasPrefix(s.Addr, unixAddrPrefix) {
+		path := strings.TrimPrefix(s.Addr, unixAddrPrefix)
+		return listenInherited("unix:"+path, func() (net.Listener, error) {
+			return s.listenUnix(path)
+		})
+	}
+	return Listen("tcp", s.Addr)
+}
+
+// listenUnix 在path上监听unix domain socket。
+// 上一次进程异常退出时会留下socket文件，导致bind失败，所以监听前需要先把它删掉，
+// 但如果它还在被别的进程使用(能连接上)，说明地址确实被占用了，不能删除。
+// 监听器关闭时socket文件会被自动删除。
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if s.UnixSocketMode != 0 {
+		if err = os.Chmod(path, s.UnixSocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// FileListener 用一个已经打开的监听socket文件创建监听器，如从父进程继承来的文件描述符。
+// f会被复制一份，调用方可以在返回后关闭f。
+func FileListener(f *os.File) (net.Listener, error) {
+	return net.FileListener(f)
+}
+
+// systemd的socket activation约定：由systemd创建并绑定好socket，再启动服务进程，
+// 通过环境变量LISTEN_PID告知接收者的pid，LISTEN_FDS告知传递的socket数量，
+// 这些socket的文件描述符从3开始依次排列，LISTEN_FDNAMES中是以冒号分隔的名称。
+const listenFdsStart = 3
+
+// SystemdListeners 返回systemd通过socket activation传递给当前进程的所有监听器，顺序与unit文件中的声明一致。
+// 不是由systemd启动时返回空切片。为了不让子进程误认为这些socket也是传给它的，相关的环境变量会被清除。
+//
+//	l, err := httpd.SystemdListeners()
+//	if err != nil || len(l) == 0 { ... }
+//	svr.Serve(l[0])
+func SystemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("httpd: inherited fd %d (%s): %v", listenFdsStart+i, name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,201 @@
+package httpd
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics.go在Server内部统计运行指标：正在处理的请求数、按方法与状态码分类的请求总数、请求耗时的分布、
+// 打开以及空闲的连接数、连接上读写的字节数。MetricsHandler以Prometheus的文本格式输出这些指标：
+//
+//	mux.Handle("GET /metrics", srv.MetricsHandler())
+//
+// 字节数统计的是连接上的明文数据(tls连接为解密后的数据)，包括首部以及http/2的帧，连接被接管后直接读写rwc的部分不再统计。
+
+// durationBuckets 请求耗时直方图的上界(秒)，与Prometheus客户端库的默认值相同
+var durationBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricMethods 单独统计的请求方法，其他的方法归为OTHER，防止客户端用任意的方法名撑大指标
+var metricMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"PATCH": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+type serverMetrics struct {
+	// 以下字段通过atomic访问，放在结构体开头保证32位平台上的对齐
+	inFlight    int64
+	connsOpen   int64
+	connsIdle   int64
+	connsTotal  int64
+	bytesIn     int64
+	bytesOut    int64
+	durationSum int64 // 纳秒
+	buckets     [len(durationBuckets) + 1]int64
+
+	mu       sync.Mutex
+	requests map[requestKey]int64
+}
+
+type requestKey struct {
+	method string
+	code   int
+}
+
+func (s *Server) serverMetrics() *serverMetrics {
+	s.metricsOnce.Do(func() {
+		s.metrics = &serverMetrics{requests: make(map[requestKey]int64)}
+	})
+	return s.metrics
+}
+
+// observe 记录一个处理完毕的请求，连接被接管的请求状态码记为0
+func (m *serverMetrics) observe(method string, code int, d time.Duration) {
+	if !metricMethods[method] {
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	m.requests[requestKey{method, code}]++
+	m.mu.Unlock()
+
+	i := sort.SearchFloat64s(durationBuckets[:], d.Seconds())
+	atomic.AddInt64(&m.buckets[i], 1)
+	atomic.AddInt64(&m.durationSum, int64(d))
+}
+
+// connStateChanged 根据连接状态的变化更新连接数
+func (m *serverMetrics) connStateChanged(from, to ConnState) {
+	if from == StateClosed || from == StateHijacked {
+		return
+	}
+	if from == StateIdle && to != StateIdle {
+		atomic.AddInt64(&m.connsIdle, -1)
+	}
+	switch to {
+	case StateNew:
+		atomic.AddInt64(&m.connsOpen, 1)
+		atomic.AddInt64(&m.connsTotal, 1)
+	case StateIdle:
+		if from != StateIdle {
+			atomic.AddInt64(&m.connsIdle, 1)
+		}
+	case StateClosed, StateHijacked:
+		atomic.AddInt64(&m.connsOpen, -1)
+	}
+}
+
+// countingReader、countingWriter 把经过的字节数累加到n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// MetricsHandler 返回以Prometheus文本格式(text/plain; version=0.0.4)输出s的运行指标的Handler
+func (s *Server) MetricsHandler() Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(s.serverMetrics().appendText(nil))
+	})
+}
+
+func (m *serverMetrics) appendText(buf []byte) []byte {
+	// 没有标签的指标
+	single := func(name, help, typ string, v int64) {
+		buf = appendMetricHeader(buf, name, help, typ)
+		buf = append(buf, name...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, v, 10)
+		buf = append(buf, '\n')
+	}
+
+	single("httpd_requests_in_flight", "Number of requests currently being served.", "gauge", atomic.LoadInt64(&m.inFlight))
+
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	counts := make([]int64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for i, k := range keys {
+		counts[i] = m.requests[k]
+	}
+	m.mu.Unlock()
+	buf = appendMetricHeader(buf, "httpd_requests_total", "Total number of requests served, by method and status code.", "counter")
+	for i, k := range keys {
+		buf = append(buf, `httpd_requests_total{method="`...)
+		buf = append(buf, k.method...)
+		buf = append(buf, `",code="`...)
+		buf = strconv.AppendInt(buf, int64(k.code), 10)
+		buf = append(buf, `"} `...)
+		buf = strconv.AppendInt(buf, counts[i], 10)
+		buf = append(buf, '\n')
+	}
+
+	// 各个桶分别计数，输出时累加，与Prometheus的le语义一致
+	const hist = "httpd_request_duration_seconds"
+	buf = appendMetricHeader(buf, hist, "Time from reading the request header to finishing the response.", "histogram")
+	var total int64
+	for i := range m.buckets {
+		total += atomic.LoadInt64(&m.buckets[i])
+		buf = append(buf, hist+`_bucket{le="`...)
+		if i < len(durationBuckets) {
+			buf = strconv.AppendFloat(buf, durationBuckets[i], 'g', -1, 64)
+		} else {
+			buf = append(buf, "+Inf"...)
+		}
+		buf = append(buf, `"} `...)
+		buf = strconv.AppendInt(buf, total, 10)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, hist+"_sum "...)
+	buf = strconv.AppendFloat(buf, time.Duration(atomic.LoadInt64(&m.durationSum)).Seconds(), 'g', -1, 64)
+	buf = append(buf, '\n')
+	buf = append(buf, hist+"_count "...)
+	buf = strconv.AppendInt(buf, total, 10)
+	buf = append(buf, '\n')
+
+	single("httpd_connections_open", "Number of open client connections.", "gauge", atomic.LoadInt64(&m.connsOpen))
+	single("httpd_connections_idle", "Number of idle keep-alive connections.", "gauge", atomic.LoadInt64(&m.connsIdle))
+	single("httpd_connections_total", "Total number of accepted connections.", "counter", atomic.LoadInt64(&m.connsTotal))
+	single("httpd_read_bytes_total", "Total number of bytes read from client connections.", "counter", atomic.LoadInt64(&m.bytesIn))
+	single("httpd_written_bytes_total", "Total number of bytes written to client connections.", "counter", atomic.LoadInt64(&m.bytesOut))
+	return buf
+}
+
+func appendMetricHeader(buf []byte, name, help, typ string) []byte {
+	buf = append(buf, "# HELP "...)
+	buf = append(buf, name...)
+	buf = append(buf, ' ')
+	buf = append(buf, help...)
+	buf = append(buf, "\n# TYPE "...)
+	buf = append(buf, name...)
+	buf = append(buf, ' ')
+	buf = append(buf, typ...)
+	return append(buf, '\n')
+}
@@ -0,0 +1,91 @@
+package httpd
+
+import (
+	"errors"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// mimetype.go维护扩展名到MIME类型的映射，FileServer与ServeContent根据它设置Content-Type。
+// 内置一份常用类型的表，不依赖运行环境中的/etc/mime.types，保证不同机器上的结果一致；
+// 表中没有的扩展名再查询标准库mime包(它会读取系统的mime表)。应用可以通过AddExtensionType注册自己的类型。
+
+var mimeTypes = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: map[string]string{
+	".avif":        "image/avif",
+	".bmp":         "image/bmp",
+	".css":         "text/css; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".gif":         "image/gif",
+	".gz":          "application/gzip",
+	".htm":         "text/html; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".md":          "text/markdown; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".oga":         "audio/ogg",
+	".ogg":         "audio/ogg",
+	".ogv":         "video/ogg",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".svg":         "image/svg+xml",
+	".tar":         "application/x-tar",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".wav":         "audio/wav",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "text/xml; charset=utf-8",
+	".zip":         "application/zip",
+}}
+
+// TypeByExtension 返回扩展名ext(包含开头的.，如".html")对应的MIME类型，不区分大小写，未知的扩展名返回空字符串。
+// 先查询AddExtensionType注册的以及内置的类型，再查询标准库mime包
+func TypeByExtension(ext string) string {
+	if ext == "" {
+		return ""
+	}
+	lower := strings.ToLower(ext)
+	mimeTypes.RLock()
+	typ, ok := mimeTypes.m[lower]
+	mimeTypes.RUnlock()
+	if ok {
+		return typ
+	}
+	return mime.TypeByExtension(lower)
+}
+
+// AddExtensionType 把扩展名ext对应的MIME类型设置为typ，覆盖内置的类型。
+// ext必须以.开头；text/类型没有指定charset时补充charset=utf-8
+func AddExtensionType(ext, typ string) error {
+	if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+		return errors.New("httpd: extension " + ext + " missing leading dot")
+	}
+	mediaType, params, err := mime.ParseMediaType(typ)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mediaType, "text/") && params["charset"] == "" {
+		params["charset"] = "utf-8"
+		typ = mime.FormatMediaType(mediaType, params)
+	}
+	mimeTypes.Lock()
+	mimeTypes.m[strings.ToLower(ext)] = typ
+	mimeTypes.Unlock()
+	return nil
+}
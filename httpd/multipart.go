@@ -3,15 +3,48 @@ package httpd
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/quotedprintable"
+	"os"
 	"strings"
 )
 
+// bufSize 解析表单时默认的缓存大小
 const bufSize = 4096
 
+// 解析multipart表单时默认的限制，防止恶意的表单用大量很小的part或者超长的part首部长时间占用连接以及cpu
+const (
+	DefaultMaxMultipartParts  = 1000
+	DefaultMaxPartHeaderBytes = 16 << 10 // 16KB
+)
+
+// MultipartLimitError 表单超出了MultipartReader的某项限制。
+// errors.Is(err, ErrBodyTooLarge)为true，handler一般回复413
+type MultipartLimitError struct {
+	Limit string // 超出的限制：parts、part header或者form size
+	Max   int64
+}
+
+func (e *MultipartLimitError) Error() string {
+	return fmt.Sprintf("httpd: multipart %s exceeds limit %d", e.Limit, e.Max)
+}
+
+func (e *MultipartLimitError) Is(target error) bool {
+	return target == ErrBodyTooLarge
+}
+
 type MultipartReader struct {
+	// MaxParts part的最大数量，不大于0时使用DefaultMaxMultipartParts
+	MaxParts int
+	// MaxPartHeaderBytes 每个part首部的最大字节数，不大于0时使用DefaultMaxPartHeaderBytes
+	MaxPartHeaderBytes int
+	// MaxFormBytes 整个表单(包括分隔符以及各个part的首部)的最大字节数，不大于0时不限制
+	MaxFormBytes int64
+
 	// bufr是对Body的封装，方便我们预查看Body上的数据，从而确定part之间边界
 	// 每个part共享这个bufr，但只有Body的读取指针指向哪个part的报文，
 	// 哪个part才能在bufr上读取数据，此时其他part是无效的
@@ -25,6 +58,7 @@ type MultipartReader struct {
 	dashBoundaryDash     []byte  //--boundary--
 	curPart              *Part   //当前解析到了哪个part
 	crlf                 [2]byte //用于消费掉\r\n
+	parts                int     // 已经读取的part数
 }
 
 type Part struct {
@@ -38,23 +72,61 @@ type Part struct {
 	// substituteReader不为nil的时机，就是已经能够确定这个part还剩下多少数据可读了。
 	substituteReader io.Reader // 替补Reader
 	parsed           bool      // 是否已经解析过formName以及fileName
+	// decoder 按照Content-Transfer-Encoding解码报文主体的Reader，为nil时报文主体未经编码
+	decoder io.Reader
 }
 
 func (p *Part) Close() (err error) {
 	if p.closed {
 		return nil
 	}
-	_, err = io.Copy(ioutil.Discard, p)
+	// 直接消费掉原始的数据，编码错误不影响下一个part的解析
+	_, err = io.Copy(ioutil.Discard, rawPartReader{p})
 	p.closed = true
 	return err
 }
+
+// rawPartReader 读取part中未经解码的原始数据
+type rawPartReader struct {
+	p *Part
+}
+
+func (r rawPartReader) Read(buf []byte) (int, error) {
+	return r.p.readRaw(buf)
+}
+
+// setupDecoder 一些旧的客户端以及从邮件转换而来的表单会对part的报文主体使用base64或者quoted-printable编码，
+// Read返回解码后的数据。解码之后Content-Transfer-Encoding首部不再有意义，将其删除，避免使用者重复解码
+func (p *Part) setupDecoder() {
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		// base64的解码器会忽略其中的换行
+		p.decoder = base64.NewDecoder(base64.StdEncoding, rawPartReader{p})
+	case "quoted-printable":
+		p.decoder = quotedprintable.NewReader(rawPartReader{p})
+	default:
+		return
+	}
+	p.Header.Del("Content-Transfer-Encoding")
+}
 func (p *Part) readHeader() (err error) {
-	p.Header, err = readHeader(p.mr.bufr)
+	p.Header, err = p.mr.readPartHeader()
 	return
 }
 
+// Read 读取part的报文主体，使用了base64或者quoted-printable编码时返回的是解码后的数据
 func (p *Part) Read(buf []byte) (n int, err error) {
 	// part已经关闭后，直接返回io.EOF错误
+	if p.closed {
+		return 0, io.EOF
+	}
+	if p.decoder != nil {
+		return p.decoder.Read(buf)
+	}
+	return p.readRaw(buf)
+}
+
+func (p *Part) readRaw(buf []byte) (n int, err error) {
 	if p.closed {
 		return 0, io.EOF
 	}
@@ -70,12 +142,12 @@ func (p *Part) Read(buf []byte) (n int, err error) {
 	if p.mr.occurEofErr {
 		peek, _ = bufr.Peek(bufr.Buffered()) // 将最后缓存数据取出
 	} else {
-		//bufSize即bufr的缓存大小，强制触发Body的io，填满bufr缓存
-		peek, err = bufr.Peek(bufSize)
+		//Peek整个bufr的缓存大小，强制触发Body的io，填满bufr缓存
+		peek, err = bufr.Peek(bufr.Size())
 		// //出现EOF错误，代表Body数据读完了，我们利用递归跳转到另一个if分支
 		if err == io.EOF {
 			p.mr.occurEofErr = true
-			return p.Read(buf)
+			return p.readRaw(buf)
 		}
 		if err != nil {
 			return 0, err
@@ -96,8 +168,8 @@ func (p *Part) Read(buf []byte) (n int, err error) {
 	}
 
 	// //以下则是在peek出的数据中没有找到分隔符的情况，说明peek出的数据属于当前的part
-	//  不能一次把所有的bufSize都当作消息主体读出，还需要减去分隔符的最长子串的长度。
-	maxRead := bufSize - len(p.mr.crlfDashBoundary) + 1
+	//  不能一次把缓存中的数据都当作消息主体读出，还需要减去分隔符的最长子串的长度。
+	maxRead := bufr.Size() - len(p.mr.crlfDashBoundary) + 1
 	if maxRead > len(buf) {
 		maxRead = len(buf)
 	}
@@ -120,41 +192,94 @@ func (p *Part) FileName() string {
 	return p.fileName
 }
 
+// parseFormData 从Content-Disposition中取出name以及filename，支持quoted-string以及filename*等扩展参数
 func (p *Part) parseFormData() {
 	p.parsed = true
-	cd := p.Header.Get("Content-Disposition")
-	ss := strings.Split(cd, ";")
-	if len(ss) == 1 || strings.ToLower(ss[0]) != "form-data" {
+	disposition, params := ParseContentDisposition(p.Header.Get("Content-Disposition"))
+	if disposition != "form-data" {
 		return
 	}
-	for _, s := range ss {
-		key, value := getKV(s)
-		switch key {
-		case "name":
-			p.formName = value
-		case "filename":
-			p.fileName = value
-		}
-	}
+	p.formName = params["name"]
+	p.fileName = params["filename"]
 }
 
-func getKV(s string) (key string, value string) {
-	ss := strings.Split(s, "=")
-	if len(ss) != 2 {
-		return
-	}
-	return strings.TrimSpace(ss[0]), strings.Trim(ss[1], `"`)
+func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+	return newMultipartReaderSize(r, boundary, bufSize)
 }
 
-func NewMultipartReader(r io.Reader, boundary string) *MultipartReader {
+// newMultipartReaderSize 使用大小为size的缓存解析表单，缓存至少要能同时容纳两个分隔符
+func newMultipartReaderSize(r io.Reader, boundary string, size int) *MultipartReader {
 	b := []byte("\r\n--" + boundary + "--")
-	return &MultipartReader{
-		bufr:                 bufio.NewReaderSize(r, bufSize), //将io.Reader封装成bufio.Reader
+	if size < 2*len(b) {
+		size = 2 * len(b)
+	}
+	mr := &MultipartReader{
 		crlfDashBoundaryDash: b,
 		crlfDashBoundary:     b[:len(b)-2],
 		dashBoundary:         b[2 : len(b)-2],
 		dashBoundaryDash:     b[2:],
 	}
+	mr.bufr = bufio.NewReaderSize(&formSizeReader{r: r, mr: mr}, size) //将io.Reader封装成bufio.Reader
+	return mr
+}
+
+// formSizeReader 统计从Body中读取的字节数，超过MaxFormBytes后返回MultipartLimitError。
+// MaxFormBytes可能在创建MultipartReader之后才设置，所以每次读取时都重新检查
+type formSizeReader struct {
+	r  io.Reader
+	mr *MultipartReader
+	n  int64
+}
+
+func (fr *formSizeReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	fr.n += int64(n)
+	if max := fr.mr.MaxFormBytes; max > 0 && fr.n > max {
+		return 0, &MultipartLimitError{Limit: "form size", Max: max}
+	}
+	return n, err
+}
+
+func (mr *MultipartReader) maxParts() int {
+	if mr.MaxParts > 0 {
+		return mr.MaxParts
+	}
+	return DefaultMaxMultipartParts
+}
+
+func (mr *MultipartReader) maxPartHeaderBytes() int {
+	if mr.MaxPartHeaderBytes > 0 {
+		return mr.MaxPartHeaderBytes
+	}
+	return DefaultMaxPartHeaderBytes
+}
+
+// readPartHeader 读取part的首部，超过maxPartHeaderBytes时不再继续读取。
+// 先把原始的首部读出来，再交给readHeader解析
+func (mr *MultipartReader) readPartHeader() (Header, error) {
+	max := mr.maxPartHeaderBytes()
+	var raw []byte
+	lineStart := 0
+	for {
+		// 行的长度超过缓存时返回ErrBufferFull，继续读取这一行剩下的部分
+		line, err := mr.bufr.ReadSlice('\n')
+		raw = append(raw, line...)
+		if len(raw) > max {
+			return nil, &MultipartLimitError{Limit: "part header", Max: int64(max)}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 空行代表首部的结束
+		if len(bytes.TrimRight(raw[lineStart:], "\r\n")) == 0 {
+			break
+		}
+		lineStart = len(raw)
+	}
+	return readHeader(bufio.NewReader(bytes.NewReader(raw)))
 }
 
 func (mr *MultipartReader) NextPart() (p *Part, err error) {
@@ -183,6 +308,10 @@ func (mr *MultipartReader) NextPart() (p *Part, err error) {
 		return
 	}
 
+	if mr.parts++; mr.parts > mr.maxParts() {
+		return nil, &MultipartLimitError{Limit: "parts", Max: int64(mr.maxParts())}
+	}
+
 	// 这时Body已经指向了下一个part的报文
 	p = new(Part)
 	p.mr = mr
@@ -191,6 +320,7 @@ func (mr *MultipartReader) NextPart() (p *Part, err error) {
 	if err = p.readHeader(); err != nil {
 		return
 	}
+	p.setupDecoder()
 	mr.curPart = p
 	return
 }
@@ -209,3 +339,195 @@ func (mr *MultipartReader) discardCRLF() (err error) {
 func (mr *MultipartReader) readLine() ([]byte, error) {
 	return readLine(mr.bufr)
 }
+
+// MultipartForm 是整个multipart表单解析后的结果
+type MultipartForm struct {
+	Value map[string][]string      // 普通的表单字段
+	File  map[string][]*FileHeader // 上传的文件
+}
+
+// FileHeader 描述表单中的一个文件，较小的文件直接保存在内存中，较大的文件则保存在临时文件中
+type FileHeader struct {
+	Filename string
+	Header   Header
+	Size     int64
+
+	content []byte // 保存在内存中的文件内容
+	tmpfile string // 临时文件的路径，为空说明文件内容在content中
+}
+
+// File 是对上传文件的抽象，文件内容可能在内存中，也可能在临时文件中
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// 内存中的文件，Close什么也不用做
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// Open 打开FileHeader对应的文件
+func (fh *FileHeader) Open() (File, error) {
+	if fh.tmpfile == "" {
+		return memFile{bytes.NewReader(fh.content)}, nil
+	}
+	return os.Open(fh.tmpfile)
+}
+
+// RemoveAll 删除表单解析过程中产生的所有临时文件。服务端的请求处理完毕后框架会自动调用，
+// 已经删除的文件再次调用不会返回错误
+func (f *MultipartForm) RemoveAll() error {
+	var err error
+	for _, fhs := range f.File {
+		for _, fh := range fhs {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if e := os.Remove(fh.tmpfile); e != nil && !os.IsNotExist(e) && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// 普通表单字段没有计入maxMemory，但也不能不加限制地读入内存，额外允许10MB
+const maxFormValueBytes = 10 << 20
+
+// ReadForm 一次性消费掉所有的part，并将结果保存到MultipartForm中。
+// 表单字段以及文件总共最多占用maxMemory+10MB的内存，超出maxMemory的文件会被写入到临时文件中。
+func (mr *MultipartReader) ReadForm(maxMemory int64) (form *MultipartForm, err error) {
+	form = &MultipartForm{
+		Value: make(map[string][]string),
+		File:  make(map[string][]*FileHeader),
+	}
+	defer func() {
+		// 解析失败时要把已经产生的临时文件清理掉
+		if err != nil {
+			form.RemoveAll()
+			form = nil
+		}
+	}()
+
+	maxValueBytes := int64(maxFormValueBytes)
+	for {
+		var p *Part
+		p, err = mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			return
+		}
+
+		name := p.FormName()
+		if name == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		var n int64
+		fileName := p.FileName()
+		if fileName == "" {
+			// 普通的表单字段，直接读入内存
+			n, err = io.CopyN(&buf, p, maxValueBytes+1)
+			if err != nil && err != io.EOF {
+				return
+			}
+			if maxValueBytes -= n; maxValueBytes < 0 {
+				return nil, ErrBodyTooLarge
+			}
+			form.Value[name] = append(form.Value[name], buf.String())
+			continue
+		}
+
+		fh := &FileHeader{
+			Filename: fileName,
+			Header:   p.Header,
+		}
+		// 多读一个字节，超过maxMemory就说明这个文件需要写入到临时文件中
+		n, err = io.CopyN(&buf, p, maxMemory+1)
+		if err != nil && err != io.EOF {
+			return
+		}
+		if n > maxMemory {
+			var file *os.File
+			if file, err = ioutil.TempFile("", "httpd-multipart-"); err != nil {
+				return
+			}
+			fh.tmpfile = file.Name()
+			fh.Size, err = io.Copy(file, io.MultiReader(&buf, p))
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(fh.tmpfile)
+				return
+			}
+		} else {
+			fh.content = buf.Bytes()
+			fh.Size = n
+			maxMemory -= n
+		}
+		form.File[name] = append(form.File[name], fh)
+	}
+}
+
+// 用户没有指定maxMemory时，默认使用32MB内存
+const defaultMaxMemory = 32 << 20
+
+// ParseMultipartForm 解析multipart/form-data编码的报文主体，结果存入MultipartForm，
+// 其中的普通表单字段同时也会合并到Form以及PostForm中。
+func (r *Request) ParseMultipartForm(maxMemory int64) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if r.Form == nil {
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	form, err := mr.ReadForm(maxMemory)
+	if err != nil {
+		return err
+	}
+	r.MultipartForm = form
+	if r.tmpForms != nil {
+		r.tmpForms.add(form)
+	}
+
+	for k, vs := range form.Value {
+		r.Form[k] = append(r.Form[k], vs...)
+		r.PostForm[k] = append(r.PostForm[k], vs...)
+	}
+	return nil
+}
+
+// ErrMissingFile 表单中不存在用户查询的文件
+var ErrMissingFile = errors.New("httpd: no such file")
+
+// FormFile 返回表单中name对应的第一个文件，如果表单还未解析，则先调用ParseMultipartForm
+func (r *Request) FormFile(name string) (File, *FileHeader, error) {
+	if r.MultipartForm == nil {
+		if err := r.ParseMultipartForm(defaultMaxMemory); err != nil {
+			return nil, nil, err
+		}
+	}
+	if fhs := r.MultipartForm.File[name]; len(fhs) > 0 {
+		f, err := fhs[0].Open()
+		return f, fhs[0], err
+	}
+	return nil, nil, ErrMissingFile
+}
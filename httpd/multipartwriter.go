@@ -0,0 +1,179 @@
+package httpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MultipartWriter 生成multipart/form-data格式的报文主体，是MultipartReader的逆过程，
+// 供Client上传文件以及测试构造表单使用：
+//
+//	var body bytes.Buffer
+//	mw := httpd.NewMultipartWriter(&body)
+//	mw.WriteField("title", "report")
+//	fw, _ := mw.CreateFormFile("file", "report.pdf")
+//	io.Copy(fw, f)
+//	mw.Close()
+//	httpd.Post(url, mw.FormDataContentType(), &body)
+type MultipartWriter struct {
+	w        io.Writer
+	boundary string
+	lastPart *multipartPart
+	started  bool // 是否已经写出过part，之后的分隔符之前需要\r\n
+}
+
+// NewMultipartWriter 返回一个写入w的MultipartWriter，分隔符随机生成
+func NewMultipartWriter(w io.Writer) *MultipartWriter {
+	return &MultipartWriter{
+		w:        w,
+		boundary: randomBoundary(),
+	}
+}
+
+// Boundary 返回使用的分隔符
+func (mw *MultipartWriter) Boundary() string {
+	return mw.boundary
+}
+
+// SetBoundary 替换随机生成的分隔符，必须在创建第一个part之前调用。
+// 分隔符由1到70个RFC 2046中允许的字符组成，且不能以空格结尾
+func (mw *MultipartWriter) SetBoundary(boundary string) error {
+	if mw.started {
+		return errors.New("httpd: SetBoundary called after write")
+	}
+	if len(boundary) < 1 || len(boundary) > 70 || boundary[len(boundary)-1] == ' ' {
+		return errors.New("httpd: invalid boundary length")
+	}
+	for i := 0; i < len(boundary); i++ {
+		c := boundary[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("'()+_,-./:=? ", c) >= 0 {
+			continue
+		}
+		return errors.New("httpd: invalid boundary character")
+	}
+	mw.boundary = boundary
+	return nil
+}
+
+// FormDataContentType 返回报文主体对应的Content-Type首部的值
+func (mw *MultipartWriter) FormDataContentType() string {
+	b := mw.boundary
+	// 分隔符中可以出现的部分字符在Content-Type的参数中需要放在引号里
+	if strings.ContainsAny(b, `()<>@,;:\"/[]?= `) {
+		b = `"` + b + `"`
+	}
+	return "multipart/form-data; boundary=" + b
+}
+
+// CreatePart 以header为首部创建一个新的part，返回写入其报文主体的Writer。
+// 之前的part随之结束，不能再写入
+func (mw *MultipartWriter) CreatePart(header Header) (io.Writer, error) {
+	if mw.lastPart != nil {
+		mw.lastPart.closed = true
+	}
+	var b bytes.Buffer
+	if mw.started {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + mw.boundary + "\r\n")
+	header.Write(&b)
+	b.WriteString("\r\n")
+	if _, err := io.Copy(mw.w, &b); err != nil {
+		return nil, err
+	}
+	mw.started = true
+	p := &multipartPart{mw: mw}
+	mw.lastPart = p
+	return p, nil
+}
+
+// CreateFormField 创建一个名为name的普通表单字段
+func (mw *MultipartWriter) CreateFormField(name string) (io.Writer, error) {
+	h := make(Header)
+	h.Set("Content-Disposition", formDataDisposition(name, ""))
+	return mw.CreatePart(h)
+}
+
+// CreateFormFile 创建一个名为fieldname的文件字段，Content-Type为application/octet-stream。
+// filename中含有非ASCII字符时同时写入RFC 5987的filename*参数
+func (mw *MultipartWriter) CreateFormFile(fieldname, filename string) (io.Writer, error) {
+	h := make(Header)
+	h.Set("Content-Disposition", formDataDisposition(fieldname, filename))
+	h.Set("Content-Type", "application/octet-stream")
+	return mw.CreatePart(h)
+}
+
+// WriteField 写入一个普通表单字段
+func (mw *MultipartWriter) WriteField(name, value string) error {
+	w, err := mw.CreateFormField(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, value)
+	return err
+}
+
+// Close 结束最后一个part并写入结尾的分隔符
+func (mw *MultipartWriter) Close() error {
+	if mw.lastPart != nil {
+		mw.lastPart.closed = true
+		mw.lastPart = nil
+	}
+	end := "--" + mw.boundary + "--\r\n"
+	if mw.started {
+		end = "\r\n" + end
+	}
+	_, err := io.WriteString(mw.w, end)
+	return err
+}
+
+// multipartPart 写入一个part的报文主体，下一个part创建之后就不能再写入了
+type multipartPart struct {
+	mw     *MultipartWriter
+	closed bool
+}
+
+func (p *multipartPart) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, errors.New("httpd: write to closed multipart part")
+	}
+	return p.mw.w.Write(b)
+}
+
+// quoteEscaper 转义quoted-string中的\以及"，换行会被Header.Write替换为空格
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// formDataDisposition 生成part的Content-Disposition，ParseContentDisposition能够原样解析出name以及filename
+func formDataDisposition(name, filename string) string {
+	v := `form-data; name="` + quoteEscaper.Replace(name) + `"`
+	if filename == "" {
+		return v
+	}
+	v += `; filename="` + quoteEscaper.Replace(filename) + `"`
+	for i := 0; i < len(filename); i++ {
+		if filename[i] >= 0x80 {
+			v += "; filename*=UTF-8''" + encodeExtValue(filename)
+			break
+		}
+	}
+	return v
+}
+
+// encodeExtValue 按照RFC 5987对s进行百分号编码，attr-char之外的字节都需要编码
+func encodeExtValue(s string) string {
+	const upperHex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperHex[c>>4])
+		b.WriteByte(upperHex[c&0xf])
+	}
+	return b.String()
+}
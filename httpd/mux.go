@@ -0,0 +1,480 @@
+package httpd
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// mux.go实现了请求路由：按照请求的路径以及方法把请求分发给注册的Handler。
+// 路由按照路径的分段(以/分隔)组织成一棵树，匹配时逐段向下查找，不需要遍历所有的模式。
+//
+// 模式的格式为 [METHOD ]PATH，如 "GET /users"、"/static/"：
+//   - 不带方法的模式匹配所有方法；
+//   - 以/结尾的模式匹配以它为前缀的整棵子树，如 "/static/" 匹配 "/static/css/a.css"，有多个模式匹配时最长的优先；
+//     其余的模式只匹配完全相同的路径；
+//   - 以:开头或者写作{name}的一段是命名参数，匹配任意非空的一段，handler通过Request.PathValue读取，
+//     如 "/users/:id" 与 "/users/{id}" 都匹配 "/users/42"；
+//   - 写作{name:regexp}的参数只匹配满足正则表达式的段，如 "/orders/{id:[0-9]+}" 不匹配 "/orders/abc"；
+//   - 最后一段写作*name或者{name...}时是通配参数，与以/结尾的模式一样匹配整棵子树，参数的值为剩余的路径(可能为空)，
+//     如 "/files/*path" 匹配 "/files/css/a.css" 时path为"css/a.css"。
+//
+// 同一位置上固定的段优先于带正则的参数，带正则的参数优先于不带正则的参数，
+// 如 "/users/new" 与 "/users/:id" 可以同时注册，前者只匹配 "/users/new"。
+// 同一位置上不带正则的参数、正则相同的参数以及通配参数必须同名，否则在注册时panic。
+//
+// 路径匹配而方法不匹配时回复405，并在Allow首部中列出允许的方法；没有注册OPTIONS的路径自动回应OPTIONS请求。
+//
+// 路径中含有.、..或者连续的/时，重定向到清理之后的路径，handler看到的路径总是规范的，无法借助../访问到上层目录。
+
+// ServeMux 是一个请求路由器，零值即可直接使用，注册与处理请求可以并发进行
+type ServeMux struct {
+	// RedirectTrailingSlash 为true时，路径没有匹配任何模式而去掉或者加上结尾的/之后能够匹配，
+	// 就重定向到后者，如只注册了 "/foo" 时 "/foo/" 重定向到 "/foo"
+	RedirectTrailingSlash bool
+
+	mu   sync.RWMutex
+	root muxNode
+}
+
+// NewServeMux 创建一个ServeMux
+func NewServeMux() *ServeMux {
+	return new(ServeMux)
+}
+
+// muxNode 是路由树中的一个节点，对应路径中的一段
+type muxNode struct {
+	static map[string]*muxNode
+	// 以这个节点为终点的模式，键为方法，空字符串代表不限方法
+	handlers map[string]Handler
+	// params 这一段是命名参数时的子节点，带正则的排在前面
+	params []*muxParam
+	// subtree 以/结尾的模式以及通配参数注册在这里，匹配这个节点之下的所有路径，subtreeName为通配参数名
+	subtree     *muxNode
+	subtreeName string
+}
+
+// muxParam 是一个命名参数，re为nil时匹配任意非空的段
+type muxParam struct {
+	name string
+	expr string
+	re   *regexp.Regexp
+	node *muxNode
+}
+
+// Handle 注册pattern对应的Handler，pattern重复注册时panic
+func (mux *ServeMux) Handle(pattern string, h Handler) {
+	if h == nil {
+		panic("httpd: nil handler")
+	}
+	method, path := parsePattern(pattern)
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	n := &mux.root
+	segs := splitPath(path)
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		if last && seg == "" {
+			// 以/结尾：注册为子树模式
+			n = n.subtreeChild("", pattern)
+			break
+		}
+		name, expr, wildcard, ok := parseParam(seg)
+		switch {
+		case !ok:
+			n = n.child(seg)
+		case wildcard:
+			if !last {
+				panic("httpd: wildcard " + seg + " must be the last segment in " + pattern)
+			}
+			n = n.subtreeChild(name, pattern)
+		default:
+			n = n.paramChild(name, expr, pattern)
+		}
+	}
+	if n.handlers == nil {
+		n.handlers = make(map[string]Handler)
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic("httpd: multiple registrations for " + pattern)
+	}
+	n.handlers[method] = h
+}
+
+// HandleFunc 注册pattern对应的处理函数
+func (mux *ServeMux) HandleFunc(pattern string, f func(ResponseWriter, *Request)) {
+	mux.Handle(pattern, HandlerFunc(f))
+}
+
+// handleMethod 为方法注册path，path中不能再带方法
+func (mux *ServeMux) handleMethod(method, path string, h Handler) {
+	if method2, _ := parsePattern(path); method2 != "" {
+		panic("httpd: pattern " + path + " already contains a method")
+	}
+	mux.Handle(method+" "+path, h)
+}
+
+// 以下按方法注册的函数与Handle一样接受任意Handler，如FileServer或者经过中间件包装的handler，普通函数需要转换为HandlerFunc
+
+// GET 注册只处理GET的路由，同一路径上的HEAD请求同样交给它处理
+func (mux *ServeMux) GET(path string, h Handler) { mux.handleMethod("GET", path, h) }
+
+// POST 注册只处理POST的路由
+func (mux *ServeMux) POST(path string, h Handler) { mux.handleMethod("POST", path, h) }
+
+// PUT 注册只处理PUT的路由
+func (mux *ServeMux) PUT(path string, h Handler) { mux.handleMethod("PUT", path, h) }
+
+// DELETE 注册只处理DELETE的路由
+func (mux *ServeMux) DELETE(path string, h Handler) { mux.handleMethod("DELETE", path, h) }
+
+// PATCH 注册只处理PATCH的路由
+func (mux *ServeMux) PATCH(path string, h Handler) { mux.handleMethod("PATCH", path, h) }
+
+// HEAD 注册只处理HEAD的路由，它优先于同一路径上的GET
+func (mux *ServeMux) HEAD(path string, h Handler) { mux.handleMethod("HEAD", path, h) }
+
+func (n *muxNode) child(seg string) *muxNode {
+	if n.static == nil {
+		n.static = make(map[string]*muxNode)
+	}
+	c, ok := n.static[seg]
+	if !ok {
+		c = new(muxNode)
+		n.static[seg] = c
+	}
+	return c
+}
+
+func (n *muxNode) paramChild(name, expr, pattern string) *muxNode {
+	for _, p := range n.params {
+		if p.expr != expr {
+			continue
+		}
+		if p.name != name {
+			panic("httpd: parameter " + name + " in " + pattern + " conflicts with existing parameter " + p.name)
+		}
+		return p.node
+	}
+	p := &muxParam{name: name, expr: expr, node: new(muxNode)}
+	if expr == "" {
+		n.params = append(n.params, p)
+		return p.node
+	}
+	// 正则只需要匹配这一段的全部，而不是其中的一部分
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		panic("httpd: invalid regexp for parameter " + name + " in " + pattern + ": " + err.Error())
+	}
+	p.re = re
+	// 带正则的参数插在不带正则的参数之前
+	i := len(n.params)
+	if i > 0 && n.params[i-1].re == nil {
+		i--
+	}
+	n.params = append(n.params, nil)
+	copy(n.params[i+1:], n.params[i:])
+	n.params[i] = p
+	return p.node
+}
+
+func (n *muxNode) subtreeChild(name, pattern string) *muxNode {
+	if n.subtree == nil {
+		n.subtree = new(muxNode)
+		n.subtreeName = name
+	} else if n.subtreeName != name {
+		panic("httpd: wildcard in " + pattern + " conflicts with an existing subtree pattern")
+	}
+	return n.subtree
+}
+
+// parseParam 判断一段是否为参数，返回参数名、正则表达式以及是否为通配参数
+func parseParam(seg string) (name, expr string, wildcard, ok bool) {
+	switch {
+	case strings.HasPrefix(seg, ":"):
+		name = seg[1:]
+	case strings.HasPrefix(seg, "*"):
+		name, wildcard = seg[1:], true
+	case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+		name = seg[1 : len(seg)-1]
+		if strings.HasSuffix(name, "...") {
+			name, wildcard = strings.TrimSuffix(name, "..."), true
+		} else if i := strings.IndexByte(name, ':'); i >= 0 {
+			name, expr = name[:i], name[i+1:]
+		}
+	default:
+		return "", "", false, false
+	}
+	if name == "" {
+		panic("httpd: empty parameter name in segment " + seg)
+	}
+	return name, expr, wildcard, true
+}
+
+// parsePattern 分离模式中的方法与路径
+func parsePattern(pattern string) (method, path string) {
+	path = pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		method, path = pattern[:i], strings.TrimLeft(pattern[i+1:], " ")
+	}
+	if path == "" || path[0] != '/' {
+		panic("httpd: invalid pattern " + pattern)
+	}
+	return method, path
+}
+
+// splitPath 把路径按/分段，首个/之前的空段被去掉，以/结尾的路径最后一段为空字符串
+func splitPath(path string) []string {
+	return strings.Split(path[1:], "/")
+}
+
+// match 查找路径对应的节点，没有模式以它为终点时返回nil。
+// 匹配过程中得到的参数追加到params中，某个分支匹配失败时回退
+func (n *muxNode) match(segs []string, params *[]pathValue) *muxNode {
+	if len(segs) == 0 {
+		if len(n.handlers) > 0 {
+			return n
+		}
+		return nil
+	}
+	if c := n.static[segs[0]]; c != nil {
+		if m := c.match(segs[1:], params); m != nil {
+			return m
+		}
+	}
+	if segs[0] != "" {
+		for _, p := range n.params {
+			if p.re != nil && !p.re.MatchString(segs[0]) {
+				continue
+			}
+			*params = append(*params, pathValue{p.name, segs[0]})
+			if m := p.node.match(segs[1:], params); m != nil {
+				return m
+			}
+			*params = (*params)[:len(*params)-1]
+		}
+	}
+	// 更深的子树模式在递归中已经尝试过了，这里的是更短的前缀
+	if n.subtree != nil {
+		if n.subtreeName != "" {
+			*params = append(*params, pathValue{n.subtreeName, strings.Join(segs, "/")})
+		}
+		return n.subtree
+	}
+	return nil
+}
+
+// handler 返回处理r的Handler，路径不匹配时返回nil；路径匹配而方法不匹配时allow为允许的方法
+func (mux *ServeMux) handler(r *Request) (h Handler, allow []string) {
+	if r.URL == nil || !strings.HasPrefix(r.URL.Path, "/") {
+		return nil, nil
+	}
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	var params []pathValue
+	n := mux.root.match(splitPath(r.URL.Path), &params)
+	if n == nil {
+		return nil, nil
+	}
+	r.pathValues = params
+	if h = n.handlers[r.Method]; h != nil {
+		return h, nil
+	}
+	// 注册了GET的路径同样可以处理HEAD，response会丢弃报文主体
+	if r.Method == "HEAD" {
+		if h = n.handlers["GET"]; h != nil {
+			return h, nil
+		}
+	}
+	if h = n.handlers[""]; h != nil {
+		return h, nil
+	}
+	return nil, n.allowed()
+}
+
+// allowed 节点上注册的方法，GET隐含着HEAD，OPTIONS总是允许的
+func (n *muxNode) allowed() []string {
+	allow := []string{"OPTIONS"}
+	for m := range n.handlers {
+		if m != "OPTIONS" {
+			allow = append(allow, m)
+		}
+		if m == "GET" && n.handlers["HEAD"] == nil {
+			allow = append(allow, "HEAD")
+		}
+	}
+	sort.Strings(allow)
+	return allow
+}
+
+// cleanPath 去掉路径中的.、..以及连续的/，保留结尾的/
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// trailingSlashTarget 加上或者去掉p结尾的/，能够匹配某个模式时返回新的路径
+func (mux *ServeMux) trailingSlashTarget(p string) (string, bool) {
+	if p == "/" {
+		return "", false
+	}
+	if strings.HasSuffix(p, "/") {
+		p = p[:len(p)-1]
+	} else {
+		p += "/"
+	}
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	var params []pathValue
+	return p, mux.root.match(splitPath(p), &params) != nil
+}
+
+// redirectPath 重定向到同一个主机上的路径p，queryString保持不变。
+// GET、HEAD回复301，其他方法回复308，要求客户端保持原来的方法以及报文主体
+func redirectPath(w ResponseWriter, r *Request, p string) {
+	u := &url.URL{Path: p, RawQuery: r.URL.RawQuery}
+	code := StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		code = StatusMovedPermanently
+	}
+	Redirect(w, r, u.String(), code)
+}
+
+func (mux *ServeMux) ServeHTTP(w ResponseWriter, r *Request) {
+	// OPTIONS * 询问的是服务器整体的能力，不针对任何路径，不能当作路径清理后重定向；
+	// 其他方法不允许使用*作为请求目标
+	if r.RequestURI == "*" {
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(StatusOK)
+			return
+		}
+		Error(w, "400 bad request", StatusBadRequest)
+		return
+	}
+	// CONNECT的请求目标是host:port而不是路径
+	if r.Method != "CONNECT" && r.URL != nil {
+		if p := cleanPath(r.URL.Path); p != r.URL.Path {
+			redirectPath(w, r, p)
+			return
+		}
+	}
+	h, allow := mux.handler(r)
+	if h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if allow == nil {
+		if mux.RedirectTrailingSlash && r.URL != nil && strings.HasPrefix(r.URL.Path, "/") {
+			if p, ok := mux.trailingSlashTarget(r.URL.Path); ok {
+				redirectPath(w, r, p)
+				return
+			}
+		}
+		NotFound(w, r)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(StatusNoContent)
+		return
+	}
+	Error(w, "405 method not allowed", StatusMethodNotAllowed)
+}
+
+// Middleware 包装一个Handler，在它之前或者之后做一些处理，如GzipHandler
+type Middleware func(Handler) Handler
+
+// RouteGroup 是一组共享路径前缀以及中间件的路由，由ServeMux.Group创建：
+//
+//	api := mux.Group("/api/v1", authMiddleware)
+//	api.HandleFunc("GET /users/{id}", getUser) // 注册为 "GET /api/v1/users/{id}"，先经过authMiddleware
+//
+// 组内还可以再分组，子分组继承父分组的前缀以及中间件
+type RouteGroup struct {
+	mux        *ServeMux
+	prefix     string
+	middleware []Middleware
+}
+
+// Group 创建一个路由分组，prefix以/开头，结尾的/被忽略；middleware按顺序由外向内包装组内的Handler
+func (mux *ServeMux) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	g := &RouteGroup{mux: mux}
+	return g.Group(prefix, middleware...)
+}
+
+// Group 在g之下创建子分组
+func (g *RouteGroup) Group(prefix string, middleware ...Middleware) *RouteGroup {
+	if prefix != "" && prefix[0] != '/' {
+		panic("httpd: invalid group prefix " + prefix)
+	}
+	mw := make([]Middleware, 0, len(g.middleware)+len(middleware))
+	mw = append(mw, g.middleware...)
+	return &RouteGroup{
+		mux:        g.mux,
+		prefix:     g.prefix + strings.TrimRight(prefix, "/"),
+		middleware: append(mw, middleware...),
+	}
+}
+
+// Use 向g追加中间件，只对之后注册的路由生效
+func (g *RouteGroup) Use(middleware ...Middleware) {
+	g.middleware = append(g.middleware, middleware...)
+}
+
+// Handle 在g的前缀下注册pattern，h依次经过g的中间件包装
+func (g *RouteGroup) Handle(pattern string, h Handler) {
+	if h == nil {
+		panic("httpd: nil handler")
+	}
+	method, path := parsePattern(pattern)
+	if method != "" {
+		method += " "
+	}
+	for i := len(g.middleware) - 1; i >= 0; i-- {
+		h = g.middleware[i](h)
+	}
+	g.mux.Handle(method+g.prefix+path, h)
+}
+
+// HandleFunc 在g的前缀下注册处理函数
+func (g *RouteGroup) HandleFunc(pattern string, f func(ResponseWriter, *Request)) {
+	g.Handle(pattern, HandlerFunc(f))
+}
+
+func (g *RouteGroup) handleMethod(method, path string, h Handler) {
+	if method2, _ := parsePattern(path); method2 != "" {
+		panic("httpd: pattern " + path + " already contains a method")
+	}
+	g.Handle(method+" "+path, h)
+}
+
+// GET 在g的前缀下注册只处理GET(以及HEAD)的路由
+func (g *RouteGroup) GET(path string, h Handler) { g.handleMethod("GET", path, h) }
+
+// POST 在g的前缀下注册只处理POST的路由
+func (g *RouteGroup) POST(path string, h Handler) { g.handleMethod("POST", path, h) }
+
+// PUT 在g的前缀下注册只处理PUT的路由
+func (g *RouteGroup) PUT(path string, h Handler) { g.handleMethod("PUT", path, h) }
+
+// DELETE 在g的前缀下注册只处理DELETE的路由
+func (g *RouteGroup) DELETE(path string, h Handler) { g.handleMethod("DELETE", path, h) }
+
+// PATCH 在g的前缀下注册只处理PATCH的路由
+func (g *RouteGroup) PATCH(path string, h Handler) { g.handleMethod("PATCH", path, h) }
+
+// HEAD 在g的前缀下注册只处理HEAD的路由
+func (g *RouteGroup) HEAD(path string, h Handler) { g.handleMethod("HEAD", path, h) }
@@ -0,0 +1,110 @@
+package httpd
+
+import (
+	"sort"
+	"strings"
+)
+
+// negotiate.go实现内容协商：客户端在Accept、Accept-Charset、Accept-Encoding中列出可以接受的取值及其权重(q值)，
+// 服务器从自己能够提供的取值中选出客户端最偏好的一个，如：
+//
+//	switch r.Negotiate("application/json", "text/html") {
+//	case "application/json": ...
+//	case "text/html": ...
+//	default: Error(w, "406 not acceptable", StatusNotAcceptable)
+//	}
+
+// AcceptSpec 是Accept类首部中的一项，Value已经转换为小写并去掉了q以外的参数
+type AcceptSpec struct {
+	Value string
+	Q     float64
+}
+
+// ParseAccept 解析首部key(如"Accept")的所有值，按q值从高到低排序，q值相同的保持原来的顺序
+func ParseAccept(h Header, key string) []AcceptSpec {
+	var specs []AcceptSpec
+	for _, v := range h.Values(key) {
+		for _, part := range strings.Split(v, ",") {
+			value, q := parseQValue(part)
+			if value == "" {
+				continue
+			}
+			specs = append(specs, AcceptSpec{Value: value, Q: q})
+		}
+	}
+	sort.SliceStable(specs, func(i, j int) bool { return specs[i].Q > specs[j].Q })
+	return specs
+}
+
+// Negotiate 根据Accept首部从offers中选出客户端最偏好的媒体类型，offers中的类型不应该带有参数。
+// 客户端没有发送Accept时返回offers[0]，没有可以接受的类型时返回空字符串。
+// 每个offer取与它匹配的最具体的一项(text/html优先于text/*，text/*优先于*/*)的q值，q值相同时offers中靠前的优先
+func (r *Request) Negotiate(offers ...string) string {
+	return negotiate(r.Header, "Accept", offers, mediaTypeMatch, "")
+}
+
+// NegotiateCharset 根据Accept-Charset首部从offers中选出客户端最偏好的字符集，规则同Negotiate
+func (r *Request) NegotiateCharset(offers ...string) string {
+	return negotiate(r.Header, "Accept-Charset", offers, wildcardMatch, "")
+}
+
+// NegotiateEncoding 根据Accept-Encoding首部从offers(如"br"、"gzip"、"identity")中选出客户端最偏好的编码，规则同Negotiate。
+// 除非客户端通过identity;q=0或者*;q=0明确拒绝，identity总是可以接受的
+func (r *Request) NegotiateEncoding(offers ...string) string {
+	return negotiate(r.Header, "Accept-Encoding", offers, wildcardMatch, "identity")
+}
+
+// negotiate 的match返回spec是否匹配offer以及匹配的具体程度，越大越具体。
+// implicit是客户端没有提到时默认可以接受的取值
+func negotiate(h Header, key string, offers []string, match func(spec, offer string) (bool, int), implicit string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if len(h.Values(key)) == 0 {
+		return offers[0]
+	}
+	specs := ParseAccept(h, key)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		o := strings.ToLower(offer)
+		q, specificity := -1.0, -1
+		for _, spec := range specs {
+			if ok, s := match(spec.Value, o); ok && s > specificity {
+				q, specificity = spec.Q, s
+			}
+		}
+		if q < 0 {
+			if o != implicit {
+				continue
+			}
+			q = 1
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// mediaTypeMatch 匹配type/subtype形式的媒体类型，*/*与type/*为通配符
+func mediaTypeMatch(spec, offer string) (bool, int) {
+	if spec == offer {
+		return true, 2
+	}
+	if spec == "*/*" || spec == "*" {
+		return true, 0
+	}
+	if strings.HasSuffix(spec, "/*") {
+		typ := spec[:len(spec)-1]
+		return strings.HasPrefix(offer, typ), 1
+	}
+	return false, 0
+}
+
+// wildcardMatch 匹配字符集或者编码，只有*一种通配符
+func wildcardMatch(spec, offer string) (bool, int) {
+	if spec == offer {
+		return true, 1
+	}
+	return spec == "*", 0
+}
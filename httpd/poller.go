@@ -0,0 +1,182 @@
+package httpd
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// poller.go负责Server.IdlePoller模式下空闲长连接的托管。
+// 默认每个连接都有一个goroutine阻塞在读取下一个请求上，连同读写缓存，一个空闲连接要占用十几KB的内存，
+// 连接数达到十万级别时这部分开销就很可观了。开启IdlePoller后，一个请求处理完毕、缓存中也没有剩余数据的连接，
+// 会把它的文件描述符交给epoll(linux)或kqueue(bsd/macOS)监视，然后归还缓存、结束goroutine；
+// 等连接可读(新请求到达或者客户端关闭了连接)时，再从池中取出缓存、开启新的goroutine继续处理。
+// 所有托管的连接共用一个阻塞在epoll_wait/kevent上的goroutine。
+//
+// WebSocket等被handler接管的长连接大部分时间也在等待对端的数据，接管方可以通过ReadNotifier把连接交给poller，
+// 连接可读时poller在新的goroutine中调用它注册的回调，等待期间同样不占用goroutine。缓存归接管方所有，poller不会动它们。
+
+// poller 由平台相关的文件实现newPoller、add、del、wait以及closePollFd
+type poller struct {
+	fd int // epoll或kqueue的文件描述符
+
+	// 往wakeW中写入数据可以唤醒阻塞在wait上的goroutine，用于关闭poller
+	wakeR, wakeW *os.File
+
+	mu       sync.Mutex
+	conns    map[int]*conn  // 文件描述符 -> 托管中的连接
+	hijacked map[int]func() // 文件描述符 -> 被接管的连接可读时的回调
+	closed   bool
+}
+
+func (s *Server) idlePoller() *poller {
+	if !s.IdlePoller {
+		return nil
+	}
+	s.pollerOnce.Do(func() {
+		p, err := newPoller()
+		if err != nil {
+			s.logf("httpd: idle poller disabled: %v", err)
+			return
+		}
+		s.mu.Lock()
+		s.poller = p
+		s.mu.Unlock()
+		go p.run()
+	})
+	return s.poller
+}
+
+// connFd 取出连接底层的文件描述符，tls等不是直接基于socket的连接无法托管
+func connFd(c *conn) (int, bool) {
+	sc, ok := c.rwc.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	fd := -1
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil || fd < 0 {
+		return 0, false
+	}
+	return fd, true
+}
+
+// park 托管一个空闲的连接，成功后调用方的goroutine应当直接退出，连接由poller负责唤醒或关闭。
+// 调用方需要保证bufr中没有缓存的数据，bufw已经全部发送。
+func (p *poller) park(c *conn) bool {
+	fd, ok := connFd(c)
+	if !ok {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	// 连接可能在注册之后立即变为可读，poller会在另一个goroutine中唤醒它，所以要先归还缓存再注册
+	putBufioReader(c.bufr)
+	putBufioWriter(c.bufw)
+	c.bufr, c.bufw = nil, nil
+	if err := p.add(fd); err != nil {
+		c.bufr = newBufioReaderSize(c.lr, c.svr.readBufferSize())
+		c.bufw = newBufioWriterSize(c.w, c.svr.writeBufferSize())
+		return false
+	}
+	p.conns[fd] = c
+	return true
+}
+
+// watch 托管一个被接管的连接，连接可读时在新的goroutine中调用fn，只调用一次
+func (p *poller) watch(c *conn, fn func()) error {
+	fd, ok := connFd(c)
+	if !ok {
+		return ErrNotSupported
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrServerClosed
+	}
+	if err := p.add(fd); err != nil {
+		return err
+	}
+	if p.hijacked == nil {
+		p.hijacked = make(map[int]func())
+	}
+	p.hijacked[fd] = fn
+	return nil
+}
+
+// run 等待托管的连接变为可读，为它们开启新的goroutine
+func (p *poller) run() {
+	defer p.release()
+	wakeFd := int(p.wakeR.Fd())
+	var fds []int
+	for {
+		var err error
+		fds, err = p.wait(fds[:0])
+		if err != nil {
+			p.close()
+			return
+		}
+		for _, fd := range fds {
+			if fd == wakeFd {
+				return
+			}
+			p.mu.Lock()
+			c := p.conns[fd]
+			delete(p.conns, fd)
+			fn := p.hijacked[fd]
+			delete(p.hijacked, fd)
+			if c != nil || fn != nil {
+				p.del(fd)
+			}
+			p.mu.Unlock()
+			if c != nil {
+				go c.resume()
+			}
+			if fn != nil {
+				go fn()
+			}
+		}
+	}
+}
+
+// close 关闭poller以及所有托管中的空闲连接，之后park以及watch总是失败。
+// 被接管的连接不归框架关闭，直接调用它们的回调，由接管方在自己的goroutine中处理
+func (p *poller) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	conns, hijacked := p.conns, p.hijacked
+	p.conns, p.hijacked = nil, nil
+	p.mu.Unlock()
+
+	p.wakeW.Write([]byte{0})
+	for _, c := range conns {
+		c.close()
+	}
+	for _, fn := range hijacked {
+		go fn()
+	}
+}
+
+// release 释放poller自身占用的文件描述符
+func (p *poller) release() {
+	closePollFd(p.fd)
+	p.wakeR.Close()
+	p.wakeW.Close()
+}
+
+// resume 为被唤醒的连接重新分配缓存，继续serve循环
+func (c *conn) resume() {
+	c.bufr = newBufioReaderSize(c.lr, c.svr.readBufferSize())
+	c.bufw = newBufioWriterSize(c.w, c.svr.writeBufferSize())
+	c.serve()
+}
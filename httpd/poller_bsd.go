@@ -0,0 +1,64 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package httpd
+
+import (
+	"os"
+	"syscall"
+)
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+	syscall.CloseOnExec(fd)
+	r, w, err := os.Pipe()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	p := &poller{fd: fd, wakeR: r, wakeW: w, conns: make(map[int]*conn)}
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, int(r.Fd()), syscall.EVFILT_READ, syscall.EV_ADD)
+	if _, err = syscall.Kevent(fd, []syscall.Kevent_t{ev}, nil, nil); err != nil {
+		p.release()
+		return nil, os.NewSyscallError("kevent", err)
+	}
+	return p, nil
+}
+
+// add 监视fd上的可读事件，对端关闭连接时同样会唤醒，事件只触发一次(EV_ONESHOT)
+func (p *poller) add(fd int) error {
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, syscall.EVFILT_READ, syscall.EV_ADD|syscall.EV_ONESHOT)
+	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{ev}, nil, nil)
+	return os.NewSyscallError("kevent", err)
+}
+
+func closePollFd(fd int) {
+	syscall.Close(fd)
+}
+
+// del 触发过的EV_ONESHOT事件已经被内核删除了，这里的错误可以忽略
+func (p *poller) del(fd int) {
+	var ev syscall.Kevent_t
+	syscall.SetKevent(&ev, fd, syscall.EVFILT_READ, syscall.EV_DELETE)
+	syscall.Kevent(p.fd, []syscall.Kevent_t{ev}, nil, nil)
+}
+
+// wait 阻塞直到有文件描述符可读，将它们追加到fds中返回
+func (p *poller) wait(fds []int) ([]int, error) {
+	var events [128]syscall.Kevent_t
+	n, err := syscall.Kevent(p.fd, nil, events[:], nil)
+	if err == syscall.EINTR {
+		return fds, nil
+	}
+	if err != nil {
+		return fds, os.NewSyscallError("kevent", err)
+	}
+	for i := 0; i < n; i++ {
+		fds = append(fds, int(events[i].Ident))
+	}
+	return fds, nil
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package httpd
+
+import (
+	"os"
+	"syscall"
+)
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	p := &poller{fd: fd, wakeR: r, wakeW: w, conns: make(map[int]*conn)}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(r.Fd())}
+	if err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, int(r.Fd()), &ev); err != nil {
+		p.release()
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+	return p, nil
+}
+
+// add 监视fd上的可读事件，对端关闭连接(EPOLLRDHUP)同样会唤醒，事件只触发一次(EPOLLONESHOT)
+func (p *poller) add(fd int) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(fd)}
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &ev))
+}
+
+func closePollFd(fd int) {
+	syscall.Close(fd)
+}
+
+func (p *poller) del(fd int) {
+	syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+// wait 阻塞直到有文件描述符可读，将它们追加到fds中返回
+func (p *poller) wait(fds []int) ([]int, error) {
+	var events [128]syscall.EpollEvent
+	n, err := syscall.EpollWait(p.fd, events[:], -1)
+	if err == syscall.EINTR {
+		return fds, nil
+	}
+	if err != nil {
+		return fds, os.NewSyscallError("epoll_wait", err)
+	}
+	for i := 0; i < n; i++ {
+		fds = append(fds, int(events[i].Fd))
+	}
+	return fds, nil
+}
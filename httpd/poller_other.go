@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package httpd
+
+import "errors"
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("httpd: IdlePoller is not supported on this platform")
+}
+
+func (p *poller) add(fd int) error {
+	return ErrNotSupported
+}
+
+func (p *poller) del(fd int) {}
+
+func closePollFd(fd int) {}
+
+func (p *poller) wait(fds []int) ([]int, error) {
+	return fds, ErrNotSupported
+}
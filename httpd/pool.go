@@ -0,0 +1,62 @@
+package httpd
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// pool.go负责复用连接以及响应使用的bufio.Reader、bufio.Writer。
+// 每个连接都要分配读写两个4KB的缓存，每个请求还要分配一个2KB的缓存，
+// 在短连接、高QPS的场景下这些分配会带来很大的GC压力，用sync.Pool复用它们可以大幅减少分配。
+// 放回池中之前必须Reset，断开与原来的连接的关联，避免下一个使用者读到残留的数据或者写入旧的连接。
+// 被handler接管的连接的缓存交给了调用方，不能再放回池中。
+//
+// conn、Request以及response结构体本身不放入池中：handler可以把r或者w交给自己启动的goroutine，
+// 在handler返回之后继续持有它们，它们被复用的话，这些goroutine会读到下一个请求的数据，甚至写入别的客户端的响应。
+// 缓存则只由框架持有，handler返回后response上的写入一律返回ErrHandlerDone，不会再碰到已经归还的缓存。
+// 两者分配的大头是缓存，结构体本身只有几百字节，见pool_test.go中的基准测试。
+
+// 不同大小的缓存不能混用，按照大小分别建立池
+var (
+	bufioReaderPools sync.Map // map[int]*sync.Pool
+	bufioWriterPools sync.Map // map[int]*sync.Pool
+)
+
+func poolOfSize(pools *sync.Map, size int) *sync.Pool {
+	if p, ok := pools.Load(size); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := pools.LoadOrStore(size, new(sync.Pool))
+	return p.(*sync.Pool)
+}
+
+func newBufioReaderSize(r io.Reader, size int) *bufio.Reader {
+	if v := poolOfSize(&bufioReaderPools, size).Get(); v != nil {
+		br := v.(*bufio.Reader)
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+func putBufioReader(br *bufio.Reader) {
+	size := br.Size()
+	br.Reset(nil)
+	poolOfSize(&bufioReaderPools, size).Put(br)
+}
+
+func newBufioWriterSize(w io.Writer, size int) *bufio.Writer {
+	if v := poolOfSize(&bufioWriterPools, size).Get(); v != nil {
+		bw := v.(*bufio.Writer)
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	size := bw.Size()
+	bw.Reset(nil)
+	poolOfSize(&bufioWriterPools, size).Put(bw)
+}
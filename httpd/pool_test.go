@@ -0,0 +1,98 @@
+package httpd
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// 对比从池中取缓存与每次新分配缓存的开销，对应每个连接以及每个请求都要进行的分配
+
+func BenchmarkBufioWriterPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bw := newBufioWriterSize(ioutil.Discard, DefaultBufferSize)
+		bw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bw.Flush()
+		putBufioWriter(bw)
+	}
+}
+
+func BenchmarkBufioWriterNew(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bw := bufio.NewWriterSize(ioutil.Discard, DefaultBufferSize)
+		bw.WriteString("HTTP/1.1 200 OK\r\n\r\n")
+		bw.Flush()
+	}
+}
+
+func BenchmarkBufioReaderPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br := newBufioReaderSize(&eofReader{}, DefaultBufferSize)
+		br.Peek(1)
+		putBufioReader(br)
+	}
+}
+
+func BenchmarkBufioReaderNew(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br := bufio.NewReaderSize(&eofReader{}, DefaultBufferSize)
+		br.Peek(1)
+	}
+}
+
+func startBenchServer(b *testing.B) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	svr := &Server{Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+	})}
+	go svr.Serve(l)
+	return l.Addr().String(), func() { svr.Close() }
+}
+
+// BenchmarkServeConnPerRequest 每个请求一个短连接，连接以及请求的缓存都要重新获取
+func BenchmarkServeConnPerRequest(b *testing.B) {
+	addr, stop := startBenchServer(b)
+	defer stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	}
+}
+
+// BenchmarkServeKeepAlive 同一个长连接上依次发送请求，只有请求级别的缓存需要获取
+func BenchmarkServeKeepAlive(b *testing.B) {
+	addr, stop := startBenchServer(b)
+	defer stop()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+		resp, err := ReadResponse(br, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+}
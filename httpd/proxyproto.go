@@ -0,0 +1,223 @@
+package httpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyproto.go负责解析haproxy定义的PROXY protocol。
+// 服务器部署在以tcp模式工作的负载均衡(如AWS NLB、haproxy)之后时，连接的对端是负载均衡而不是客户端，
+// 负载均衡会在每个连接的最开始发送一个PROXY首部，告知原始客户端的地址，之后才是正常的http报文。
+// 协议有两个版本，v1为一行文本：
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+//
+// v2为二进制格式：12字节的签名，1字节的版本与命令，1字节的地址族与传输协议，2字节的地址部分长度，之后是地址部分。
+
+// ErrProxyHeader 开启了Server.ProxyProtocol，但连接开头不是合法的PROXY首部
+var ErrProxyHeader = errors.New("httpd: invalid PROXY protocol header")
+
+// proxyV2Sig v2首部的签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen v1首部的最大长度，包括结尾的\r\n
+const proxyV1MaxLen = 107
+
+// readProxyHeader 从连接的开头读取PROXY首部，将其中的源地址作为客户端地址。
+// 首部中的命令为LOCAL(v2)或者协议为UNKNOWN(v1)时，说明是负载均衡自己发起的连接(如健康检查)，保留连接的对端地址。
+func (c *conn) readProxyHeader() error {
+	// PROXY首部的读取同样受MaxHeaderBytes限制
+	c.lr.N = c.svr.maxHeaderBytes()
+	if d := c.svr.ReadHeaderTimeout; d > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+		defer c.rwc.SetReadDeadline(time.Time{})
+	}
+	addr, err := parseProxyHeader(c.bufr)
+	if err != nil {
+		return err
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+	return nil
+}
+
+// parseProxyHeader 根据签名判断首部的版本并解析，返回的地址为nil时代表保留连接的对端地址
+func parseProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil && len(sig) == 0 {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	return readProxyV1(br)
+}
+
+// tls连接中，PROXY首部是负载均衡在tls握手之前以明文发送的，不能从tls.Conn中读取，
+// 需要在tls.NewListener之前用proxyListener包装原始的监听器，握手第一次读取连接时先解析掉PROXY首部，
+// 剩下的数据(ClientHello)再交给tls
+
+// proxyListener 接受的连接都包装为proxyConn
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn 第一次读取时解析PROXY首部。解析不能放在Accept中进行，否则一个迟迟不发送首部的连接会阻塞整个accept循环
+type proxyConn struct {
+	net.Conn
+	once sync.Once
+	br   *bufio.Reader // 解析首部时读多了的数据，读完之后直接读取Conn
+
+	mu     sync.Mutex
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(p)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(p)
+}
+
+// readHeader 读取的超时由调用方(tls握手)设置的deadline控制
+func (c *proxyConn) readHeader() {
+	br := bufio.NewReaderSize(c.Conn, proxyV1MaxLen)
+	addr, err := parseProxyHeader(br)
+	c.mu.Lock()
+	c.br, c.remote, c.err = br, addr, err
+	c.mu.Unlock()
+}
+
+// RemoteAddr 读取PROXY首部之后返回其中的源地址
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// tlsListener 用config包装l，开启了ProxyProtocol时先解析PROXY首部
+func (s *Server) tlsListener(l net.Listener, config *tls.Config) net.Listener {
+	if s.ProxyProtocol {
+		l = proxyListener{l}
+	}
+	return tls.NewListener(l, config)
+}
+
+func readProxyV1(r io.ByteReader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, ErrProxyHeader
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, ErrProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil // 其余部分应当被忽略
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	cmd := hdr[12] & 0x0f
+	family := hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+	// 高4位为地址族，低4位为传输协议，地址部分之后可能还有TLV扩展，这里不关心
+	switch family {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), payload[0:4]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrProxyHeader
+		}
+		ip := net.IP(append([]byte(nil), payload[0:16]...))
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	case 0x31, 0x32: // unix stream/datagram
+		if len(payload) < 216 {
+			return nil, ErrProxyHeader
+		}
+		name := payload[0:108]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		return &net.UnixAddr{Name: string(name), Net: "unix"}, nil
+	default: // UNSPEC
+		return nil, nil
+	}
+}
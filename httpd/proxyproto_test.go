@@ -0,0 +1,75 @@
+package httpd
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// PROXY首部在tls握手之前以明文发送，必须先于握手解析
+func TestProxyProtocolTLS(t *testing.T) {
+	cert := testCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrc := make(chan string, 1)
+	svr := &Server{
+		ProxyProtocol: true,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: HandlerFunc(func(w ResponseWriter, r *Request) {
+			addrc <- r.RemoteAddr
+			io.WriteString(w, "ok")
+		}),
+	}
+	go svr.ServeTLS(l, "", "")
+	defer svr.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 443\r\n")
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	io.WriteString(tc, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := <-addrc; got != "1.2.3.4:1111" {
+		t.Errorf("RemoteAddr = %q, want 1.2.3.4:1111", got)
+	}
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -3,13 +3,19 @@ package httpd
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Request结构体就代表了客户端提交的http请求，我们使用readRequest函数从http连接上解析出这个对象
@@ -35,9 +41,18 @@ type Request struct {
 	// 首部字段由一个个键值对组成，我们的头部信息就存放在此处。Header存储
 	Header Header
 
+	// Trailer 存放chunk编码的报文主体之后携带的trailer。
+	// 客户端在Trailer首部中声明的字段会预先以nil值存在，只有Body读取到io.EOF之后，其中的值才是完整的。
+	Trailer Header
+
 	// 报文主体部分，相较于前面两个更为复杂，可能具有不同的编码方式，长度也可能特别大。平时前端提交的form表单就放置在报文主体部分。仅只有POST和PUT请求允许携带报文主体。
 	Body io.Reader // 用于读取报文主体
 
+	// GetBody 返回一个新的Body副本。Client跟随307、308重定向、Transport在复用的连接失效后重试时需要重新发送报文主体，
+	// 为nil时带有报文主体的请求不会跟随这两种重定向，也不会重试。NewRequest会为已知长度的body自动设置；
+	// 服务端的请求默认为nil，调用BufferBody之后才可用，ReverseProxy转发时会沿用它
+	GetBody func() (io.Reader, error)
+
 	// 像cookie以及queryString(如上面的URL中的?name=gufeijun)，是日常开发经常使用到的部分，为了方便用户的获取，我们分别用cookies以及queryString这两个map去保存解析后的字段
 	// Request结构中的cookie以及queryString字段都是私有属性，
 	// 因为只希望用户具有查询的权限，而不能够进行删除或者修改。为了让用户去查询这个私有字段，需要绑定相应的公共方法，这就是封装的思想。
@@ -47,142 +62,369 @@ type Request struct {
 	//所以gin采用了比较高明的方式，在用户使用Set方法时，Set方法会先检测keys这个map是否为nil，如果为nil，这时我们才为其初始化。这样懒加载就能减少一些不必要的开销。
 
 	cookies     map[string]string // 存储cookie
-	queryString map[string]string // 存querySting
+	queryString Values            // 存querySting，第一次调用Query时才解析
+	pathValues  []pathValue       // ServeMux从路径中解析出的参数
+	requestID   string            // RequestIDHandler分配的请求ID，记录在访问日志以及错误日志中
+
+	// Form 存储queryString以及urlencoded报文主体中解析出的全部表单数据，PostForm只存报文主体中的表单数据。
+	// 两者都只有在调用ParseForm后才有效
+	Form     url.Values
+	PostForm url.Values
+
+	// MultipartForm 存储multipart/form-data表单解析后的结果，只有在调用ParseMultipartForm后才有效。
+	// 其中的临时文件在请求处理完毕后被自动删除，handler返回之后不能再打开
+	MultipartForm *MultipartForm
+
+	// Host 为请求的目标主机，优先取自绝对形式的请求uri(如 GET http://example.com/ HTTP/1.1)，其次取自Host首部
+	Host string
+
+	// ContentLength 为报文主体的长度，-1代表长度未知(如chunk编码或者解压之后)，0代表没有报文主体
+	ContentLength int64
+	// TransferEncoding 为报文主体使用的传输编码，目前只可能是nil或者[chunked]
+	TransferEncoding []string
+	// Close 代表本次请求结束后是否需要关闭连接，由协议版本以及Connection首部共同决定
+	Close bool
 
 	RemoteAddr string // 客户端地址
 	RequestURI string // 字符串形式的url
-	conn       *conn  // 产生此request 的http连接
+	// TLS 为tls连接握手后的状态，明文连接上为nil。开启了客户端证书验证时，
+	// 客户端的证书在TLS.PeerCertificates中，handler可以根据其中的Subject或者DNSNames识别客户端
+	TLS  *tls.ConnectionState
+	conn *conn // 产生此request 的http连接
+
+	// 客户端断开连接或者服务器关闭时，ctx会被取消
+	ctx context.Context
+	// 客户端携带了Expect: 100-continue时，指向包装Body的expectContinueReader
+	expectBody *expectContinueReader
+	// chunk编码的报文主体的chunkReader，用于在handler返回后检查是否出错或者超出了限制
+	chunks *chunkReader
+	// 服务端的请求解析出的所有MultipartForm，WithContext等产生的浅拷贝共享同一个指针，
+	// 中间件之后的handler解析的表单同样会被登记，请求结束后统一删除其中的临时文件
+	tmpForms *multipartForms
+}
+
+// multipartForms 一个请求上解析出的MultipartForm
+type multipartForms struct {
+	mu    sync.Mutex
+	forms []*MultipartForm
+}
+
+func (m *multipartForms) add(f *MultipartForm) {
+	m.mu.Lock()
+	m.forms = append(m.forms, f)
+	m.mu.Unlock()
+}
+
+func (m *multipartForms) removeAll() {
+	m.mu.Lock()
+	forms := m.forms
+	m.forms = nil
+	m.mu.Unlock()
+	for _, f := range forms {
+		f.RemoveAll()
+	}
+}
+
+// 解析请求报文时可能出现的错误，handleError根据错误的种类决定回复给客户端的状态码
+var (
+	ErrHeaderTooLarge   = errors.New("httpd: request header too large")
+	ErrBodyTooLarge     = errors.New("httpd: request body too large")
+	ErrUnsupportedProto = errors.New("httpd: unsupported http version")
+)
+
+// badRequestError 代表请求报文的格式错误，对应400状态码
+type badRequestError string
 
-	contentType string //
-	boundary    string //
+func (e badRequestError) Error() string {
+	return "httpd: bad request: " + string(e)
 }
 
 func readRequest(c *conn) (r *Request, err error) {
-	r = new(Request)
+	// 上一个请求读取Body时解除了限制，每个新请求都要重新设置首部的读取上限，
+	// 否则长连接上只有第一个请求受到限制
+	c.lr.N = c.svr.maxHeaderBytes()
+	// 首部必须在ReadHeaderTimeout内读完，防止客户端一个字节一个字节地发送首部(slowloris攻击)，
+	// 长连接上每个请求都重新计时，等待下一个请求的空闲时间同样计算在内
+	if d := c.svr.ReadHeaderTimeout; d > 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+	// 读到了请求的第一个字节后，连接才算进入活动状态，在此之前一直是空闲的
+	if _, err = c.bufr.Peek(1); err == nil {
+		c.setState(StateActive)
+	}
 
+	r, err = ReadRequest(c.bufr)
+	if err != nil {
+		return nil, c.fixHeaderErr(err)
+	}
+	if c.svr.ReadHeaderTimeout > 0 {
+		c.rwc.SetReadDeadline(time.Time{}) // 报文主体的读取不受首部超时的限制
+	}
 	r.conn = c
-	r.RemoteAddr = c.rwc.RemoteAddr().String()
+	r.RemoteAddr = c.remoteAddr.String()
+	r.TLS = c.tlsState
+	r.tmpForms = new(multipartForms)
+	if err = r.checkExpect(); err != nil {
+		return nil, err
+	}
+
+	const noLimit = (1 << 63) - 1
+	c.lr.N = noLimit // Body的读取无需进行读取字节数限制
+	if cr, ok := r.Body.(*chunkReader); ok {
+		cr.maxChunkSize, cr.maxBytes, cr.maxChunks = c.svr.MaxChunkSize, c.svr.MaxChunkedBodyBytes, c.svr.MaxChunks
+		cr.maxLineBytes = int(c.svr.maxHeaderBytes())
+		r.chunks = cr
+	}
+
+	// 以下与连接相关的包装只对携带了报文主体的请求生效
+	if _, ok := r.Body.(*eofReader); !ok {
+		// 为了防止资源的浪费，有些客户端在发送完http首部之后，发送body数据前，会先通过发送Expect: 100-continue查询服务端是否希望接受body数据，服务端只有回复了HTTP/1.1 100 Continue客户端才会再次发送body。因此我们也要处理这种情况
+		r.fixExpectContinueReader()
+		if c.svr.DecompressRequestBody {
+			r.fixDecompressReader()
+		}
+	}
+	return r, nil
+}
+
+// ReadRequest 从b中解析出一个http请求，Body直接从b中读取报文主体。
+// 它不依赖于服务端的连接，可以用于测试、代理以及请求的回放等场景，
+// 因此不会处理Expect: 100-continue，也不会限制首部的大小，返回的Request也没有RemoteAddr。
+func ReadRequest(b *bufio.Reader) (r *Request, err error) {
+	r = new(Request)
 
 	// 读取请求行
-	line, err := readLine(c.bufr)
+	line, err := readLine(b)
 	if err != nil {
-		return
+		return nil, err
 	}
 
 	// 按空格分割就得到了三个属性
 	_, err = fmt.Sscanf(string(line), "%s%s%s", &r.Method, &r.RequestURI, &r.Proto)
 	if err != nil {
-		return
+		return nil, badRequestError("malformed request line " + strconv.Quote(string(line)))
+	}
+
+	// 目前只支持http1.0以及http1.1
+	if r.Proto != "HTTP/1.1" && r.Proto != "HTTP/1.0" {
+		if !strings.HasPrefix(r.Proto, "HTTP/") {
+			return nil, badRequestError("malformed protocol " + strconv.Quote(r.Proto))
+		}
+		return nil, ErrUnsupportedProto
 	}
 
 	// 将字符串形式的uri 变成url.URL
-	r.URL, err = url.ParseRequestURI(r.RequestURI)
-	if err != nil {
-		return
+	// CONNECT请求的uri是authority形式，如 CONNECT example.com:443 HTTP/1.1，只有主机与端口
+	if r.Method == "CONNECT" && !strings.HasPrefix(r.RequestURI, "/") {
+		r.URL = &url.URL{Host: r.RequestURI}
+		if _, _, err = net.SplitHostPort(r.RequestURI); err != nil {
+			return nil, badRequestError("invalid CONNECT target " + strconv.Quote(r.RequestURI))
+		}
+	} else if r.URL, err = url.ParseRequestURI(r.RequestURI); err != nil {
+		return nil, badRequestError("invalid request uri " + strconv.Quote(r.RequestURI))
 	}
 
-	// 解析queryString
-	r.parseQuery()
 	// 读取header
-	r.Header, err = readHeader(c.bufr)
+	r.Header, err = readHeader(b)
 	if err != nil {
-		return
+		return nil, err
+	}
+	r.Host = r.URL.Host
+	if r.Host == "" {
+		r.Host = r.Header.Get("Host")
 	}
+	r.Close = r.wantsClose()
 
-	const noLimit = (1 << 63) - 1
-	r.conn.lr.N = noLimit // Body的读取无需进行读取字节数限制
-	r.setupBody()         // 设置Body
-	r.parseContentType()
-	return
+	if err = r.setupBody(b); err != nil { // 设置Body
+		return nil, err
+	}
+	return r, nil
 }
 
-func (r *Request) parseContentType() {
+// parseContentType 从Content-Type首部中取出媒体类型以及multipart的boundary。
+// 每次都从首部解析而不是在读取请求时缓存，handler或者中间件修改了Content-Type之后同样生效
+func (r *Request) parseContentType() (contentType, boundary string) {
 	ct := r.Header.Get("Content-Type")
 
 	index := strings.IndexByte(ct, ';')
 	if index == -1 {
-		r.contentType = ct
-		return
+		return ct, ""
 	}
 
+	contentType = strings.TrimSpace(ct[:index])
 	if index == len(ct)-1 {
-		return
+		return contentType, ""
 	}
 
 	ss := strings.Split(ct[index+1:], "=")
 	if len(ss) < 2 || strings.TrimSpace(ss[0]) != "boundary" {
-		return
+		return contentType, ""
 	}
-	r.contentType, r.boundary = ct[:index], strings.Trim(ss[1], `"`)
+	return contentType, strings.Trim(ss[1], `"`)
 }
 
 func (r *Request) MultipartReader() (*MultipartReader, error) {
-	if r.boundary == "" {
+	_, boundary := r.parseContentType()
+	if boundary == "" {
 		return nil,errors.New("no boundary detected")
 	}
-	return NewMultipartReader(r.Body, r.boundary),nil
+	size := bufSize
+	if r.conn != nil {
+		size = r.conn.svr.readBufferSize()
+	}
+	mr := newMultipartReaderSize(r.Body, boundary, size)
+	if r.conn != nil {
+		svr := r.conn.svr
+		mr.MaxParts, mr.MaxPartHeaderBytes, mr.MaxFormBytes = svr.MaxMultipartParts, svr.MaxMultipartHeaderBytes, svr.MaxMultipartBytes
+	}
+	return mr, nil
 }
 
 // bufio.Reader具有ReadLine方法，其存在三个返回参数line []byte, isPrefix bool, err error，line和err都很好理解，
 // 但为什么还多出了一个isPrefix参数呢？这是因为ReadLine会借助到bufio.Reader的缓存切片
 // 如果一行大小超过了缓存的大小，这也会无法达到读出一行的要求，这时isPrefix会设置成true，代表只读取了一部分。
 func readLine(bufr *bufio.Reader) ([]byte, error) {
+	return readLineLimit(bufr, 0)
+}
+
+// errLineTooLong 一行超过了readLineLimit的限制，由调用方换成对应的错误
+var errLineTooLong = errors.New("httpd: line too long")
+
+// readLineLimit 与readLine相同，但一行超过max字节时返回errLineTooLong，不会把整行读入内存，max不大于0时不限制
+func readLineLimit(bufr *bufio.Reader, max int) ([]byte, error) {
 	p, isPrefix, err := bufr.ReadLine()
 	if err != nil {
 		return p, err
 	}
 
+	if isPrefix {
+		// p指向bufr的缓存切片，继续读取会覆盖其中的内容，需要先复制出来
+		p = append([]byte(nil), p...)
+	}
 	var l []byte
 	for isPrefix {
+		if max > 0 && len(p) > max {
+			return nil, errLineTooLong
+		}
 		l, isPrefix, err = bufr.ReadLine()
 		if err != nil {
 			break
 		}
 		p = append(p, l...)
 	}
+	if max > 0 && len(p) > max {
+		return nil, errLineTooLong
+	}
 
 	return p, err
 }
 
+// Values 存储queryString解析后的键值对，同一个key可以出现多次，如 ?tag=a&tag=b
+type Values map[string][]string
+
+// Get 返回key对应的第一个值
+func (v Values) Get(key string) string {
+	if vs := v[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func (v Values) Set(key, value string) {
+	v[key] = []string{value}
+}
+
+func (v Values) Add(key, value string) {
+	v[key] = append(v[key], value)
+}
+
+func (v Values) Del(key string) {
+	delete(v, key)
+}
+
+func (v Values) Has(key string) bool {
+	_, ok := v[key]
+	return ok
+}
+
 func (r *Request) parseQuery() {
 	// name=gu&token=1234
 	r.queryString = parseQuery(r.URL.RawQuery)
 }
 
-func parseQuery(rawQuery string) map[string]string {
-	parts := strings.Split(rawQuery, "&")
-	queries := make(map[string]string, len(parts))
-	for _, v := range parts {
-		index := strings.IndexByte(v, '=')
-		if index == -1 || index == len(v)-1 {
+// parseQuery 按照application/x-www-form-urlencoded的规则解析queryString，
+// key和value都会进行百分号解码，+会被解码成空格。解码失败的键值对直接丢弃。
+func parseQuery(rawQuery string) Values {
+	queries := make(Values)
+	for _, v := range strings.Split(rawQuery, "&") {
+		if v == "" {
 			continue
 		}
-		queries[strings.TrimSpace(v[:index])] = strings.TrimSpace(v[index+1:])
+		key, value := v, ""
+		if index := strings.IndexByte(v, '='); index != -1 {
+			key, value = v[:index], v[index+1:]
+		}
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			continue
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		queries.Add(key, value)
 	}
 	return queries
 }
 
 func readHeader(bufr *bufio.Reader) (Header, error) {
+	return readHeaderLimit(bufr, 0)
+}
+
+// readHeaderLimit 与readHeader相同，但所有首部行(包括换行)总共超过max字节时返回errLineTooLong，max不大于0时不限制
+func readHeaderLimit(bufr *bufio.Reader, max int) (Header, error) {
 	header := make(Header)
 
+	remain := max
 	for {
-		line, err := readLine(bufr)
+		limit := 0
+		if max > 0 {
+			if remain <= 0 {
+				return nil, errLineTooLong
+			}
+			limit = remain
+		}
+		line, err := readLineLimit(bufr, limit)
 		if err != nil {
 			return nil, err
 		}
+		remain -= len(line) + 2
 
 		//如果读到/r/n/r/n，代表报文首部的结束
 		if len(line) == 0 {
 			break
 		}
 
+		// 以空格或者制表符开头的行是上一行的延续(obs-fold)，RFC 7230已经废弃了这种写法。
+		// 前后端对它的理解可能不一致，从而导致请求走私，因此直接拒绝
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, badRequestError("obsolete line folding in header")
+		}
+
 		lineStr := string(line)
 		index := strings.IndexByte(lineStr, ':')
-		if index == -1 || index == len(lineStr)-1 {
+		if index == -1 {
+			return nil, badRequestError("malformed header line " + strconv.Quote(lineStr))
+		}
+		// 字段名与冒号之间不允许出现空白，如 "Content-Length : 5"
+		if index == 0 || strings.ContainsAny(lineStr[:index], " \t") {
+			return nil, badRequestError("invalid header field name " + strconv.Quote(lineStr[:index]))
+		}
+		if index == len(lineStr)-1 {
 			continue
 		}
 		//header.Add(lineStr[:index],strings.TrimSpace(lineStr[index+1:]))
-		k, v := lineStr[:index], strings.TrimSpace(lineStr[index+1:])
+		k, v := CanonicalHeaderKey(lineStr[:index]), strings.TrimSpace(lineStr[index+1:])
 		header[k] = append(header[k], v)
 	}
 
@@ -212,28 +454,40 @@ func (e *eofReader) Read([]byte) (n int, err error) {
 // 如果单纯保证第一点，完全可以用上一文中conn结构体的bufr字段作为Body，因为我们已经将首部字段从bufr中读出，下一次对bufr的读取自然会从报文主体开始。
 //但这样做，第二点就无法满足。在go语言中，对一个io.Reader的读取，如果返回io.EOF错误代表我们将这个Reader中的所有数据读取完了。
 // ioutil.ReadAll就是利用了这个特点，如果不出现一些异常错误，它会不停的读取数据直至出现io.EOF。而一个网络连接net.Conn，只有在对端主动将连接关闭后，对net.Conn的Read才会返回io.EOF错误。
-func (r *Request) setupBody() {
+func (r *Request) setupBody(bufr *bufio.Reader) error {
+	// 前置的代理与我们对报文主体边界的理解一旦不一致，攻击者就可以把第二个请求藏在第一个请求的报文主体中(请求走私)，
+	// 因此对于有歧义的请求直接拒绝：同时携带Transfer-Encoding与Content-Length、存在多个不同的Content-Length、
+	// 以及不认识的Transfer-Encoding。
+	te, hasTE := r.Header["Transfer-Encoding"]
+	cl, err := r.contentLength()
+	if err != nil {
+		return err
+	}
+	if hasTE && cl != "" {
+		return badRequestError("both Transfer-Encoding and Content-Length present")
+	}
 
-	if r.Method != "POST" && r.Method != "PUT" { // POST 和 PUT外的方法不允许设置包文主体
-		r.Body = new(eofReader)
-	} else if r.chunked() {
-		r.Body = &chunkReader{
-			bufr: r.conn.bufr,
+	// 即使是GET这类不应该携带报文主体的方法，只要首部声明了报文主体，也必须按照声明读取，
+	// 否则报文主体会被当成下一个请求来解析
+	if hasTE {
+		if len(te) != 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return badRequestError("unsupported Transfer-Encoding " + strconv.Quote(strings.Join(te, ",")))
 		}
-		// 为了防止资源的浪费，有些客户端在发送完http首部之后，发送body数据前，会先通过发送Expect: 100-continue查询服务端是否希望接受body数据，服务端只有回复了HTTP/1.1 100 Continue客户端才会再次发送body。因此我们也要处理这种情况
-		r.fixExpectContinueReader()
-	} else if cl := r.Header.Get("Content-Length"); cl != "" {
-		contentLength, err := strconv.ParseInt(cl, 10, 64)
-		if err != nil {
-			r.Body = new(eofReader)
-			return
+		r.TransferEncoding = []string{"chunked"}
+		r.ContentLength = -1
+		r.fixTrailer()
+		r.Body = &chunkReader{
+			bufr:    bufr,
+			trailer: r.Trailer,
 		}
+	} else if cl != "" && cl != "0" {
+		r.ContentLength, _ = strconv.ParseInt(cl, 10, 64)
 		// 允许Body最多读取contentLength的数据
-		r.Body = io.LimitReader(r.conn.bufr, contentLength)
-		r.fixExpectContinueReader()
+		r.Body = io.LimitReader(bufr, r.ContentLength)
 	} else {
 		r.Body = new(eofReader)
 	}
+	return nil
 }
 
 /*我们给域名生成的cookie，一旦颁发给用户浏览器之后，浏览器在访问我们域名下的后端接口时都会在请求报文中将这个cookie带上，要是后端接口不关系客户端的cookie，而框架无脑全部提前解析，这就做了徒工。
@@ -242,8 +496,35 @@ func (r *Request) setupBody() {
 
 接下来为Request绑定两个公有方法Query以及Cookie，分别用于查询queryString以及cookie：*/
 
+// Query 返回queryString中name对应的第一个值
 func (r *Request) Query(name string) string {
-	fmt.Println(r)
+	if r.queryString == nil {
+		r.parseQuery()
+	}
+	return r.queryString.Get(name)
+}
+
+// PathValue 返回ServeMux匹配路径时得到的参数，如模式 /users/:id 匹配 /users/42 时，PathValue("id")返回"42"。
+// 没有这个参数时返回空字符串
+func (r *Request) PathValue(name string) string {
+	for _, pv := range r.pathValues {
+		if pv.name == name {
+			return pv.value
+		}
+	}
+	return ""
+}
+
+// pathValue 是路径中的一个命名参数
+type pathValue struct {
+	name, value string
+}
+
+// QueryValues 返回queryString中name对应的所有值，如 ?tag=a&tag=b 返回[a b]
+func (r *Request) QueryValues(name string) []string {
+	if r.queryString == nil {
+		r.parseQuery()
+	}
 	return r.queryString[name]
 }
 
@@ -283,21 +564,166 @@ func (r *Request) parseCookies() {
 	}
 }
 
-func (r *Request) chunked() bool {
-	te := r.Header.Get("Transfer-Encoding")
-	return te == "chunked"
+// Context 返回请求的Context，当客户端断开连接、服务器关闭或者handler返回后，Context会被取消，
+// 耗时较长的handler可以借此及时停止工作
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext 返回r的浅拷贝，其Context被替换为ctx，主要供中间件向下游传递数据
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// Clone 返回r的深拷贝，其Context被替换为ctx。与WithContext不同，Header、Trailer、URL以及已经解析出的表单、
+// cookie、queryString等都是副本，中间件修改它们(如反向代理改写路径)不会影响到r。
+// Body不会被复制，两者读取的是同一个报文主体
+func (r *Request) Clone(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	if r.URL != nil {
+		u := *r.URL
+		r2.URL = &u
+	}
+	r2.Header = r.Header.Clone()
+	r2.Trailer = r.Trailer.Clone()
+	if r.TransferEncoding != nil {
+		r2.TransferEncoding = append([]string(nil), r.TransferEncoding...)
+	}
+	r2.Form = cloneURLValues(r.Form)
+	r2.PostForm = cloneURLValues(r.PostForm)
+	if r.MultipartForm != nil {
+		r2.MultipartForm = &MultipartForm{
+			Value: cloneURLValues(r.MultipartForm.Value),
+			File:  make(map[string][]*FileHeader, len(r.MultipartForm.File)),
+		}
+		for k, fhs := range r.MultipartForm.File {
+			r2.MultipartForm.File[k] = append([]*FileHeader(nil), fhs...)
+		}
+	}
+	if r.cookies != nil {
+		r2.cookies = make(map[string]string, len(r.cookies))
+		for k, v := range r.cookies {
+			r2.cookies[k] = v
+		}
+	}
+	r2.queryString = Values(cloneURLValues(url.Values(r.queryString)))
+	if r.pathValues != nil {
+		r2.pathValues = append([]pathValue(nil), r.pathValues...)
+	}
+	return r2
+}
+
+func cloneURLValues(v url.Values) url.Values {
+	if v == nil {
+		return nil
+	}
+	// 与Header.Clone相同，所有的值共用一个切片
+	return url.Values(Header(v).Clone())
+}
+
+// bodyErr chunk编码的报文主体格式错误或者超出了Server配置的限制时返回对应的错误。
+// 此时连接上剩余的数据无法再正确地划分出下一个请求，连接不能复用
+func (r *Request) bodyErr() error {
+	if r.chunks == nil {
+		return nil
+	}
+	return r.chunks.err
+}
+
+// removeMultipartFiles 请求处理完毕后删除ParseMultipartForm产生的临时文件，handler不需要自己调用RemoveAll。
+// 包括中间件传下去的副本上解析出的表单
+func (r *Request) removeMultipartFiles() {
+	if r.MultipartForm != nil {
+		r.MultipartForm.RemoveAll()
+	}
+	if r.tmpForms != nil {
+		r.tmpForms.removeAll()
+	}
+}
+
+// wantsClose 判断客户端是否希望在本次请求结束后关闭连接：
+// http1.1默认使用长连接，除非首部中包含Connection: close；
+// http1.0默认使用短连接，除非首部中包含Connection: keep-alive。
+func (r *Request) wantsClose() bool {
+	conn := strings.ToLower(r.Header.Get("Connection"))
+	if r.Proto == "HTTP/1.0" {
+		return conn != "keep-alive"
+	}
+	return conn == "close"
+}
+
+// contentLength 校验并返回Content-Length首部的值
+func (r *Request) contentLength() (string, error) {
+	cl, err := parseContentLength(r.Header)
+	if err != nil {
+		return "", badRequestError(err.Error())
+	}
+	return cl, nil
+}
+
+// parseContentLength 校验并返回h中Content-Length的值，多个值相同的Content-Length(包括 5, 5 这种写法)视为一个。
+// 请求与响应共用这个校验
+func parseContentLength(h Header) (string, error) {
+	var cl string
+	for _, v := range h["Content-Length"] {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 || s[0] == '+' {
+				return "", errors.New("invalid Content-Length " + strconv.Quote(v))
+			}
+			if cl != "" && cl != s {
+				return "", errors.New("conflicting Content-Length values")
+			}
+			cl = s
+		}
+	}
+	return cl, nil
+}
+
+// fixTrailer 根据Trailer首部预先声明Trailer中的字段，如 Trailer: Checksum, Expires
+func (r *Request) fixTrailer() {
+	r.Trailer = declaredTrailer(r.Header)
+}
+
+// declaredTrailer 返回以h中Trailer首部声明的字段为key、值为nil的Header
+func declaredTrailer(h Header) Header {
+	trailer := make(Header)
+	for _, v := range h["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				trailer[CanonicalHeaderKey(key)] = nil
+			}
+		}
+	}
+	return trailer
 }
 
 type expectContinueReader struct {
 	wroteContinue bool // 是否已经发送过100 continue
 	r             io.Reader
 	w             *bufio.Writer
+	res           *response // 响应一旦开始发送，就不能再回复100 continue了
 }
 
 func (er *expectContinueReader) Read(p []byte) (n int, err error) {
 	//第一次读取前发送100 continue
 	// 一旦发现客户端的请求报文的首部中存在Expect: 100-continue，那么我们在第一次读取body时，也就意味希望接受报文主体，expectContinueReader会自动发送HTTP/1.1 100 Continue
-	if !er.wroteContinue {
+	if !er.wroteContinue && (er.res == nil || !er.res.cw.wroteHeader) {
 		er.w.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
 		er.w.Flush()
 		er.wroteContinue = true
@@ -305,24 +731,186 @@ func (er *expectContinueReader) Read(p []byte) (n int, err error) {
 	return er.r.Read(p)
 }
 
+// expectationFailedError 客户端在Expect首部中提出了服务端不认识的期望，对应417状态码
+type expectationFailedError string
+
+func (e expectationFailedError) Error() string {
+	return "httpd: unsupported expectation " + strconv.Quote(string(e))
+}
+
+// checkExpect 目前只认识100-continue这一种期望，其他的期望都要回复417
+func (r *Request) checkExpect() error {
+	expect := r.Header.Get("Expect")
+	if expect == "" || strings.EqualFold(expect, "100-continue") {
+		return nil
+	}
+	return expectationFailedError(expect)
+}
+
 func (r *Request) fixExpectContinueReader() {
-	if r.Header.Get("Expect") != "100-continue" {
+	// http1.0的客户端不认识100 continue
+	if !strings.EqualFold(r.Header.Get("Expect"), "100-continue") || r.Proto == "HTTP/1.0" {
 		return
 	}
-	r.Body = &expectContinueReader{
+	if r.conn.svr.ExpectContinue == ExpectContinueImmediate {
+		// 不等handler读取Body，立即通知客户端发送报文主体
+		r.conn.bufw.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+		r.conn.bufw.Flush()
+		return
+	}
+	r.expectBody = &expectContinueReader{
 		r: r.Body,
 		w: r.conn.bufw,
 	}
+	r.Body = r.expectBody
+}
+
+// waitingContinue 判断客户端是否还在等待100 continue，此时报文主体可能根本还没有发送
+func (r *Request) waitingContinue() bool {
+	return r.expectBody != nil && !r.expectBody.wroteContinue
 }
 
 // 如果用户在Handler的回调函数中没有去读取Body的数据，就意味着处理同一个socket连接上的下一个http报文时，
 // Body未消费的数据会干扰下一个http报文的解析。所以我们的框架还需要在Handler结束后，将当前http请求的数据给消费掉。给Request增加一个finishRequest方法，以后的一些善尾工作都将交给它
 
 func (r *Request) finishRequest() (err error) {
+	defer r.removeMultipartFiles()
 	//
 	if err = r.conn.bufw.Flush(); err != nil {
 		return
 	}
-	_, err = io.Copy(ioutil.Discard, r.Body)
+	// handler没有读取Body就返回了(如直接回复了错误)，客户端还在等待100 continue，
+	// 有的客户端等待超时后会直接发送报文主体，在ExpectContinueTimeout内等待并消费掉它，
+	// 否则不再读取，response已经设置了closeAfterReply，serve循环会关闭连接
+	if r.waitingContinue() {
+		timeout := r.conn.svr.ExpectContinueTimeout
+		if timeout <= 0 {
+			return nil
+		}
+		r.conn.rwc.SetReadDeadline(time.Now().Add(timeout))
+		defer r.conn.rwc.SetReadDeadline(time.Time{})
+	}
+
+	// 报文主体格式错误或者超出了限制，剩下的数据不再读取，finishResponse已经设置了closeAfterReply
+	if r.bodyErr() != nil {
+		return nil
+	}
+
+	// 经过解压的Body需要消费掉原始的报文主体，解压后的数据流可能在报文主体结束前就已经结束了
+	body := r.Body
+	if dr, ok := body.(*decompressReader); ok {
+		body = dr.r
+	}
+	_, err = io.Copy(ioutil.Discard, body)
+	return err
+}
+
+// Write 将请求序列化为http/1.1的报文格式写入w，会读取并消费掉Body。
+// 请求行中的uri以及Host首部取自URL与Host字段，而不是RequestURI以及Header中原有的值，
+// 方便代理在修改了目标地址之后转发请求。报文主体的长度未知(ContentLength为-1)时使用chunk编码。
+func (r *Request) Write(w io.Writer) error {
+	host := r.Host
+	if host == "" && r.URL != nil {
+		host = r.URL.Host
+	}
+	uri := "/"
+	if r.URL != nil {
+		uri = r.URL.RequestURI()
+	}
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method == "CONNECT" && r.URL != nil && r.URL.Path == "" {
+		uri = host
+	}
+
+	bw, ok := w.(*bufio.Writer)
+	if !ok {
+		bw = bufio.NewWriter(w)
+	}
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", method, uri)
+	if host != "" {
+		fmt.Fprintf(bw, "Host: %s\r\n", headerValueReplacer.Replace(host))
+	}
+
+	// 写出的总是http/1.1报文，http/1.0请求默认的短连接需要显式声明
+	if r.Close && r.Header.Get("Connection") == "" {
+		bw.WriteString("Connection: close\r\n")
+	}
+
+	hasBody := r.Body != nil && r.ContentLength != 0
+	if _, ok := r.Body.(*eofReader); ok {
+		hasBody = false
+	}
+	chunked := hasBody && r.ContentLength < 0
+	switch {
+	case chunked:
+		bw.WriteString("Transfer-Encoding: chunked\r\n")
+		if len(r.Trailer) > 0 {
+			keys := make([]string, 0, len(r.Trailer))
+			for k := range r.Trailer {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(bw, "Trailer: %s\r\n", strings.Join(keys, ", "))
+		}
+	case hasBody:
+		fmt.Fprintf(bw, "Content-Length: %d\r\n", r.ContentLength)
+	}
+	// 报文主体的边界由上面重新决定，Header中原有的相关字段不能再使用
+	err := r.Header.WriteSubset(bw, reqWriteExcludeHeader)
+	if err != nil {
+		return err
+	}
+	if _, err = bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	switch {
+	case chunked:
+		err = r.writeChunkedBody(bw)
+	case hasBody:
+		var n int64
+		n, err = io.Copy(bw, io.LimitReader(r.Body, r.ContentLength))
+		if err == nil && n != r.ContentLength {
+			err = fmt.Errorf("httpd: ContentLength=%d with Body length %d", r.ContentLength, n)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+var reqWriteExcludeHeader = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
+
+func (r *Request) writeChunkedBody(bw *bufio.Writer) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(bw, "%x\r\n", n)
+			bw.Write(buf[:n])
+			bw.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	bw.WriteString("0\r\n")
+	// trailer只有在Body读取完毕之后才是完整的
+	if err := r.Trailer.Write(bw); err != nil {
+		return err
+	}
+	_, err := bw.WriteString("\r\n")
 	return err
 }
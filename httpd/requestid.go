@@ -0,0 +1,76 @@
+package httpd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// requestid.go为每个请求分配一个唯一的ID，一个请求经过多个服务时，各个服务的日志可以通过它关联起来。
+// 上游(如网关)已经在X-Request-ID中带上了ID时沿用它，否则生成一个新的。
+// ID会写入请求首部，ReverseProxy转发请求时随之传递给下游服务，同时也会写入响应首部返回给客户端。
+
+// RequestIDHeader 携带请求ID的首部
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen 上游传来的ID超过这个长度时不予采用，防止日志被超长的首部撑大
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestIDHandler 返回为请求分配ID后交给h处理的Handler，h可以通过RequestIDFromContext取得ID。
+// 访问日志以及panic日志中会带上ID，为了让它们能够看到，RequestIDHandler应当位于最外层，直接作为Server.Handler
+func RequestIDHandler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		r.requestID = id
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFromContext 返回RequestIDHandler存入ctx的请求ID，没有时返回空字符串
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID 只接受长度有限的可见ascii字符，其他内容可能被用来伪造日志
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+var requestIDSeq uint64
+
+// newRequestID 生成128位的随机ID，随机数不可用时退化为时间戳加序号
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		seq := atomic.AddUint64(&requestIDSeq, 1)
+		return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(seq, 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// logID 用于错误日志，请求有ID时返回" (request id xxx)"
+func (r *Request) logID() string {
+	if r.requestID == "" {
+		return ""
+	}
+	return " (request id " + r.requestID + ")"
+}
@@ -1,21 +1,482 @@
 package httpd
 
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
 // response结构体就代表服务端的响应对象
 // 绑定些与客户端交互的方法，供用户使用
 type response struct {
-	c *conn
+	c   *conn
+	req *Request
+
+	header      Header // 用户设置的响应首部，在第一次真正发送数据时才会写入到连接中
+	status      int    // 响应状态码
+	wroteHeader bool   // 用户是否已经调用过WriteHeader
+	written     int64  // 实际发送的报文主体字节数(不包括chunk编码的额外开销)，用于访问日志
+
+	// 用户写入的报文主体先缓存在bufw中，缓存满了或者handler结束时才交给chunkWriter。
+	// 这样对于较小的响应，等到handler结束时我们就能知道报文主体的长度，从而设置Content-Length，
+	// 而对于较大的响应，则使用chunk编码边产生边发送。
+	bufw *bufio.Writer
+	cw   chunkWriter
+
+	handlerDone     bool // handler是否已经返回
+	closeAfterReply bool // 发送完响应后是否关闭连接
+
+	// HEAD请求的响应不能携带报文主体，handler写入的数据会被丢弃，只记录其长度，用于设置Content-Length
+	headBodyLen int64
 }
 
-// 
+// ResponseWriter 供用户的handler构造响应报文。
+// 用户在调用Write或WriteHeader之前可以通过Header设置响应首部，
+// 如果用户没有调用WriteHeader，第一次调用Write时会隐式使用200状态码。
 type ResponseWriter interface {
-	Write([]byte)(n int,err error)
+	Header() Header
+	Write([]byte) (n int, err error)
+	WriteHeader(statusCode int)
+}
+
+// Hijacker 由response实现，handler可以借此接管底层的tcp连接，在其上实现WebSocket、隧道或者自定义协议。
+// 调用Hijack后，框架不会再对这个连接进行读写，也不会关闭它，这些都由调用方负责。
+// 返回的bufio.ReadWriter中可能已经缓存了客户端发来的数据。
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
 }
 
-func setupResponse(c *conn) *response {
-	return &response{c:c}
+// ReadNotifier 由response实现，开启了Server.IdlePoller时，handler调用Hijack接管连接之后，
+// 可以通过NotifyReadable把连接交给poller监视：连接可读(对端发来数据或者关闭了连接)时，在新的goroutine中调用fn一次，
+// 等待期间不占用goroutine，适合大量连接长时间没有数据的WebSocket。fn处理完数据后可以再次调用NotifyReadable。
+// 调用前Hijack返回的bufio.Reader中不能有缓存的数据，否则它们不会触发可读事件；托管期间不能关闭连接。
+// 服务器关闭时所有托管中的fn都会被调用。没有开启IdlePoller或者连接不支持托管(如tls连接)时返回ErrNotSupported，
+// 调用方应当退回到在自己的goroutine中阻塞读取
+type ReadNotifier interface {
+	NotifyReadable(fn func()) error
+}
+
+// Flusher 由response实现，handler可以借此把缓存中的数据立即发送给客户端，
+// 用于server-sent events、长轮询或者代理流式的响应。首部还没有发送的话会先发送首部
+type Flusher interface {
+	Flush()
+}
+
+var (
+	// ErrHijacked 连接被接管后，再调用response的方法返回此错误
+	ErrHijacked = errors.New("httpd: connection has been hijacked")
+	// ErrHandlerDone handler返回之后(如在另外启动的goroutine中)再写入响应返回此错误，响应已经结束了
+	ErrHandlerDone = errors.New("httpd: write after handler returned")
+	// ErrNotSupported 包装后的ResponseWriter不支持某项功能时返回此错误
+	ErrNotSupported = errors.New("httpd: feature not supported")
+	// ErrAbortHandler handler可以用它作为panic的值来中断响应，框架会直接关闭连接，不记录错误日志。
+	// 响应已经发送了一部分、后续数据又无法产生时(如代理的上游中途断开)，这是让客户端感知到错误的唯一办法
+	ErrAbortHandler = errors.New("httpd: abort Handler")
+)
+
+const bufferBeforeChunkingSize = 2048
+
+func setupResponse(c *conn, req *Request) *response {
+	res := &response{
+		c:      c,
+		req:    req,
+		header: make(Header),
+	}
+	res.cw.res = res
+	res.bufw = newBufioWriterSize(&res.cw, bufferBeforeChunkingSize)
+	if req.expectBody != nil {
+		req.expectBody.res = res
+	}
+	return res
+}
+
+func (w *response) Header() Header {
+	return w.header
+}
+
+func (w *response) WriteHeader(statusCode int) {
+	if w.wroteHeader || w.c.hijacked {
+		return
+	}
+	w.wroteHeader = true
+	w.status = statusCode
 }
 
 func (w *response) Write(b []byte) (n int, err error) {
-	return w.c.bufw.Write(b)
+	if w.c.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.handlerDone {
+		return 0, ErrHandlerDone
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	if !bodyAllowedForStatus(w.status) {
+		return len(b), nil
+	}
+	if w.req.Method == "HEAD" {
+		w.headBodyLen += int64(len(b))
+		return len(b), nil
+	}
+	n, err = w.bufw.Write(b)
+	w.written += int64(n)
+	return
+}
+
+// ReadFrom 使response实现io.ReaderFrom，handler调用io.Copy(w, f)发送文件时会走到这里。
+// 如果src是文件，响应已经确定了Content-Length并且不需要chunk编码，底层又是tcp连接，
+// 就把首部发送出去之后直接调用tcp连接的ReadFrom，由内核通过sendfile把文件内容发送到socket，
+// 文件内容不需要再经过用户态的缓存拷贝。其他情况退化为普通的Write。
+func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
+	if w.c.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.handlerDone {
+		return 0, ErrHandlerDone
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	rf, ok := w.c.rwc.(io.ReaderFrom)
+	if !ok || !isFileReader(src) || w.req.Method == "HEAD" || !bodyAllowedForStatus(w.status) {
+		return io.Copy(writerOnly{w}, src)
+	}
+	// 已经写入的报文主体要先发送，没有写入过的话这里会发送首部
+	if err = w.bufw.Flush(); err != nil {
+		return 0, err
+	}
+	if !w.cw.wroteHeader {
+		if w.header.Get("Content-Length") == "" {
+			// 长度未知时需要chunk编码，无法直接把文件交给内核
+			return io.Copy(writerOnly{w}, src)
+		}
+		w.cw.writeHeader(nil)
+	}
+	if w.cw.chunking {
+		return io.Copy(writerOnly{w}, src)
+	}
+	if err = w.c.bufw.Flush(); err != nil {
+		return 0, err
+	}
+	n, err = rf.ReadFrom(src)
+	w.written += n
+	atomic.AddInt64(w.c.w.n, n)
+	return n, err
+}
+
+// isFileReader 判断r是不是文件或者io.CopyN等对文件的长度限制，tcp连接只对这两种情况使用sendfile
+func isFileReader(r io.Reader) bool {
+	if lr, ok := r.(*io.LimitedReader); ok {
+		r = lr.R
+	}
+	_, ok := r.(*os.File)
+	return ok
+}
+
+// writerOnly 隐藏response的ReadFrom方法，防止io.Copy递归调用回ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+// finishResponse 在handler结束后调用，将缓存中的数据全部交给连接的bufw
+func (w *response) finishResponse() error {
+	// 报文主体格式错误或者超出了限制，剩下的部分无法可靠地划分出下一个请求，连接不能再复用；
+	// handler没有回复时(如直接忽略了读取的错误)替它回复413、431或者400
+	if bodyErr := w.req.bodyErr(); bodyErr != nil {
+		w.closeAfterReply = true
+		if !w.wroteHeader {
+			code := StatusBadRequest
+			switch bodyErr {
+			case ErrBodyTooLarge:
+				code = StatusRequestEntityTooLarge
+			case ErrHeaderTooLarge:
+				code = StatusRequestHeaderFieldsTooLarge
+			}
+			Error(w, strconv.Itoa(code)+" "+StatusText(code), code)
+		}
+	}
+	w.handlerDone = true
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	err := w.bufw.Flush()
+	// handler已经返回，之后的写入都会返回ErrHandlerDone，缓存可以交给下一个请求使用
+	putBufioWriter(w.bufw)
+	w.bufw = nil
+	if err != nil {
+		return err
+	}
+	return w.cw.close()
+}
+
+func (w *response) Flush() {
+	if w.c.hijacked || w.handlerDone {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK)
+	}
+	w.bufw.Flush()
+	// 还没有写入过报文主体的话，chunkWriter还没有发送首部
+	if !w.cw.wroteHeader {
+		w.cw.writeHeader(nil)
+	}
+	w.c.bufw.Flush()
 }
 
+// NotifyReadable 只访问连接本身，handler返回之后仍然可以调用
+func (w *response) NotifyReadable(fn func()) error {
+	c := w.c
+	if !c.hijacked {
+		return errors.New("httpd: NotifyReadable called before Hijack")
+	}
+	p := c.svr.idlePoller()
+	if p == nil {
+		return ErrNotSupported
+	}
+	return p.watch(c, fn)
+}
+
+func (w *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c := w.c
+	if c.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.handlerDone {
+		return nil, nil, ErrHandlerDone
+	}
+	// 后台预读会和调用方争抢连接上的数据，需要先停掉
+	c.abortBackgroundRead()
+	// 用户已经写入的响应数据需要先交给连接的bufw
+	if w.cw.wroteHeader {
+		if err := w.bufw.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.hijacked = true
+	c.setState(StateHijacked)
+	return c.rwc, bufio.NewReadWriter(c.bufr, c.bufw), nil
+}
+
+// 1xx、204以及304的响应报文不允许携带报文主体
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == StatusNoContent:
+		return false
+	case status == StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// chunkWriter 负责在第一次写入时发送状态行以及首部，并在需要时对报文主体进行chunk编码
+type chunkWriter struct {
+	res         *response
+	wroteHeader bool     // 状态行以及首部是否已经发送
+	chunking    bool     // 是否使用chunk编码
+	trailers    []string // handler通过Trailer首部声明的trailer字段
+	header      []byte   // 序列化后的状态行以及首部
+}
+
+func (cw *chunkWriter) Write(p []byte) (n int, err error) {
+	bufw := cw.res.c.bufw
+	if !cw.wroteHeader {
+		cw.buildHeader(p)
+		// 首部加上报文主体放不进bufw时，bufw会先把首部单独发送出去，再直接发送报文主体，
+		// 这里改用writev，一次系统调用就把它们一起交给内核，尽量放进同一个tcp报文段中
+		if len(p) > 0 && bufw.Buffered() == 0 && len(cw.header)+len(p) > bufw.Available() {
+			return cw.writeVectored(p)
+		}
+		bufw.Write(cw.header)
+		cw.header = nil
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cw.chunking {
+		if _, err = fmt.Fprintf(bufw, "%x\r\n", len(p)); err != nil {
+			return
+		}
+	}
+	if n, err = bufw.Write(p); err != nil {
+		return
+	}
+	if cw.chunking {
+		_, err = bufw.WriteString("\r\n")
+	}
+	return
+}
+
+func (cw *chunkWriter) close() error {
+	if !cw.wroteHeader {
+		cw.writeHeader(nil)
+	}
+	if cw.chunking {
+		// 通过0\r\n\r\n标记报文主体的结束，trailer位于最后一个chunk与结尾的\r\n之间
+		bufw := cw.res.c.bufw
+		bufw.WriteString("0\r\n")
+		trailer := make(Header, len(cw.trailers))
+		for _, key := range cw.trailers {
+			if vs, ok := cw.res.header[key]; ok {
+				trailer[key] = vs
+			}
+		}
+		trailer.Write(bufw)
+		_, err := bufw.WriteString("\r\n")
+		return err
+	}
+	return nil
+}
+
+// writeVectored 用一次writev发送首部以及第一块报文主体
+func (cw *chunkWriter) writeVectored(p []byte) (n int, err error) {
+	bufs := net.Buffers{cw.header}
+	if cw.chunking {
+		bufs = append(bufs, []byte(strconv.FormatInt(int64(len(p)), 16)+"\r\n"), p, []byte("\r\n"))
+	} else {
+		bufs = append(bufs, p)
+	}
+	cw.header = nil
+	written, err := bufs.WriteTo(cw.res.c.rwc)
+	atomic.AddInt64(cw.res.c.w.n, written)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeHeader 决定报文主体的传输方式，并将状态行以及首部写入到连接的bufw中
+func (cw *chunkWriter) writeHeader(p []byte) {
+	cw.buildHeader(p)
+	cw.res.c.bufw.Write(cw.header)
+	cw.header = nil
+}
+
+// buildHeader 决定报文主体的传输方式，并将状态行以及首部序列化到cw.header中。
+// p为第一次写入的数据，如果此时handler已经结束，p就是完整的报文主体。
+func (cw *chunkWriter) buildHeader(p []byte) {
+	cw.wroteHeader = true
+	res := cw.res
+	req := res.req
+	header := res.header
+
+	if req.Close {
+		res.closeAfterReply = true
+	}
+	// 服务器正在Shutdown，告知客户端这次响应之后连接就会关闭
+	if atomic.LoadInt32(&res.c.svr.inShutdown) == 1 {
+		res.closeAfterReply = true
+	}
+	// 客户端还在等待100 continue，报文主体的去向不明，只能在响应后关闭连接
+	if req.waitingContinue() && res.c.svr.ExpectContinueTimeout <= 0 {
+		res.closeAfterReply = true
+	}
+
+	// handler可以在写入报文主体之前通过Trailer首部声明trailer，如 Trailer: X-Checksum，
+	// 等报文主体写完后再设置X-Checksum的值。trailer只能在chunk编码中发送。
+	for _, v := range header["Trailer"] {
+		for _, key := range strings.Split(v, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				cw.trailers = append(cw.trailers, CanonicalHeaderKey(key))
+			}
+		}
+	}
+	wantsTrailer := len(cw.trailers) > 0 && req.Proto == "HTTP/1.1"
+
+	if bodyAllowedForStatus(res.status) {
+		if cl := header.Get("Content-Length"); cl != "" {
+			if _, err := strconv.ParseInt(cl, 10, 64); err != nil {
+				header.Del("Content-Length")
+			}
+		}
+		sniffContentType(header, p)
+		switch {
+		case header.Get("Content-Length") != "":
+			// 用户自己设置了Content-Length
+		case req.Method == "HEAD":
+			// HEAD请求的报文主体全部被丢弃了，handler结束时才会走到这里，
+			// 此时Content-Length与同样的GET请求保持一致
+			if res.headBodyLen > 0 {
+				header.Set("Content-Length", strconv.FormatInt(res.headBodyLen, 10))
+			}
+		case res.handlerDone && !wantsTrailer:
+			// handler已经结束，报文主体已经全部在p中了
+			header.Set("Content-Length", strconv.Itoa(len(p)))
+		case req.Proto == "HTTP/1.1":
+			// 不知道报文主体的长度，http1.1可以使用chunk编码
+			cw.chunking = true
+			header.Set("Transfer-Encoding", "chunked")
+		default:
+			// http1.0不支持chunk编码，只能通过关闭连接来标记报文主体的结束
+			res.closeAfterReply = true
+		}
+	} else {
+		header.Del("Content-Length")
+		header.Del("Transfer-Encoding")
+	}
+
+	if res.closeAfterReply {
+		header.Set("Connection", "close")
+	} else if req.Proto == "HTTP/1.0" {
+		header.Set("Connection", "keep-alive")
+	}
+	if !cw.chunking {
+		header.Del("Trailer")
+		cw.trailers = nil
+	}
+	// Date以及Server首部由框架自动添加，handler自己设置了的话以handler为准
+	if _, ok := header["Date"]; !ok {
+		header.Set("Date", httpDate(time.Now()))
+	}
+	if _, ok := header["Server"]; !ok {
+		header.Set("Server", res.c.svr.serverHeader())
+	}
+
+	var buf bytes.Buffer
+	text := StatusText(res.status)
+	if text == "" {
+		text = "status code " + strconv.Itoa(res.status)
+	}
+	fmt.Fprintf(&buf, "HTTP/1.1 %03d %s\r\n", res.status, text)
+	// trailer在报文主体之后发送
+	var exclude map[string]bool
+	if len(cw.trailers) > 0 {
+		exclude = make(map[string]bool, len(cw.trailers))
+		for _, key := range cw.trailers {
+			exclude[key] = true
+		}
+	}
+	header.WriteSubset(&buf, exclude)
+	buf.WriteString("\r\n")
+	cw.header = buf.Bytes()
+}
+
+// Date首部只精确到秒，每个请求都格式化一次时间没有必要，
+// 因此缓存当前这一秒格式化后的结果，同一秒内的请求直接复用
+type cachedDate struct {
+	sec   int64
+	value string
+}
+
+var dateCache atomic.Value // 存放cachedDate
+
+func httpDate(now time.Time) string {
+	sec := now.Unix()
+	if d, ok := dateCache.Load().(cachedDate); ok && d.sec == sec {
+		return d.value
+	}
+	value := now.UTC().Format(TimeFormat)
+	dateCache.Store(cachedDate{sec: sec, value: value})
+	return value
+}
@@ -0,0 +1,345 @@
+package httpd
+
+import (
+	"bytes"
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responsecache.go实现了一个共享缓存：把handler对GET请求的完整响应保存在内存中，
+// 在响应的有效期内，同样的请求直接从缓存回复而不再调用handler，适合计算量大、读多写少的接口。
+//
+// 只有明确声明了有效期(Cache-Control中的s-maxage、max-age或者Expires)的响应才会被缓存，
+// 带有no-store、private、no-cache或者Set-Cookie的响应不会被缓存。
+// 缓存以主机名以及RequestURI为键，响应中有Vary首部时，Vary列出的请求首部的值也是键的一部分。
+
+const (
+	// DefaultResponseCacheSize ResponseCache默认最多占用的内存
+	DefaultResponseCacheSize = 32 << 20
+	// DefaultResponseCacheMaxEntrySize 报文主体超过这个大小的响应默认不缓存
+	DefaultResponseCacheMaxEntrySize = 1 << 20
+)
+
+// ResponseCache 是缓存响应的中间件，零值即可使用，通过Handler方法包装需要缓存的handler：
+//
+//	cache := httpd.NewResponseCache(64 << 20)
+//	mux.Handle("GET /reports/", cache.Handler(reportHandler))
+type ResponseCache struct {
+	// MaxBytes 缓存的报文主体最多占用的内存，不大于0时使用DefaultResponseCacheSize
+	MaxBytes int64
+	// MaxEntrySize 报文主体超过它的响应不缓存，不大于0时使用DefaultResponseCacheMaxEntrySize
+	MaxEntrySize int64
+
+	mu    sync.Mutex
+	lru   *list.List // 最近使用的排在前面，元素为*cachedResponse
+	items map[string]*list.Element
+	vary  map[string]*cacheVary
+	size  int64
+}
+
+// cacheVary 主键(主机以及uri)对应的响应的Vary首部，以及主键下缓存的响应数，最后一个响应被删除时随之删除
+type cacheVary struct {
+	headers []string
+	entries int
+}
+
+// NewResponseCache 创建一个最多占用maxBytes内存的ResponseCache
+func NewResponseCache(maxBytes int64) *ResponseCache {
+	return &ResponseCache{MaxBytes: maxBytes}
+}
+
+type cachedResponse struct {
+	key     string
+	primary string
+	status  int
+	header  Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (c *ResponseCache) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return DefaultResponseCacheSize
+}
+
+func (c *ResponseCache) maxEntrySize() int64 {
+	if c.MaxEntrySize > 0 {
+		return c.MaxEntrySize
+	}
+	return DefaultResponseCacheMaxEntrySize
+}
+
+// Handler 返回使用c缓存h的响应的Handler，c.Handler可以作为Middleware使用
+func (c *ResponseCache) Handler(h Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		reqCC := parseCacheControl(r.Header)
+		// 带有Authorization的请求的响应可能因人而异，共享缓存默认不能使用
+		if r.Header.Get("Authorization") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		primary := r.Host + " " + r.URL.RequestURI()
+		if _, noCache := reqCC["no-cache"]; !noCache {
+			if e := c.get(primary, r); e != nil {
+				e.serve(w, r)
+				return
+			}
+		}
+		_, noStore := reqCC["no-store"]
+		if r.Method == "HEAD" || noStore {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &cacheWriter{ResponseWriter: w, limit: c.maxEntrySize()}
+		h.ServeHTTP(cw, r)
+		cw.store(c, primary, r)
+	})
+}
+
+// varyKey 由Vary列出的请求首部的值组成二级键
+func varyKey(primary string, vary []string, r *Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c *ResponseCache) get(primary string, r *Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.vary[primary]
+	if !ok {
+		return nil
+	}
+	el, ok := c.items[varyKey(primary, v.headers, r)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cachedResponse)
+	if !time.Now().Before(e.expires) {
+		c.removeElement(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+func (c *ResponseCache) add(primary string, vary []string, e *cachedResponse) {
+	size := int64(len(e.body))
+	if size > c.maxBytes() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]*list.Element)
+		c.vary = make(map[string]*cacheVary)
+		c.lru = list.New()
+	}
+	if el, ok := c.items[e.key]; ok {
+		c.removeElement(el)
+	}
+	v := c.vary[primary]
+	if v == nil {
+		v = new(cacheVary)
+		c.vary[primary] = v
+	}
+	v.headers = vary
+	v.entries++
+	e.primary = primary
+	c.items[e.key] = c.lru.PushFront(e)
+	c.size += size
+	for c.size > c.maxBytes() {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) removeElement(el *list.Element) {
+	e := el.Value.(*cachedResponse)
+	c.lru.Remove(el)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.body))
+	if v := c.vary[e.primary]; v != nil {
+		if v.entries--; v.entries == 0 {
+			delete(c.vary, e.primary)
+		}
+	}
+}
+
+// serve 从缓存回复，Age首部为响应在缓存中存放的秒数，客户端带有条件请求时可能回复304
+func (e *cachedResponse) serve(w ResponseWriter, r *Request) {
+	h := w.Header()
+	for k, vs := range e.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(time.Since(e.stored)/time.Second), 10))
+	if e.status == StatusOK {
+		modtime, _ := time.Parse(TimeFormat, e.header.Get("Last-Modified"))
+		if done, _ := checkPreconditions(w, r, modtime); done {
+			return
+		}
+	}
+	w.WriteHeader(e.status)
+	if r.Method != "HEAD" {
+		w.Write(e.body)
+	}
+}
+
+// cacheWriter 把响应写给客户端的同时保存一份副本，报文主体超过limit后放弃缓存
+type cacheWriter struct {
+	ResponseWriter
+	limit int64
+
+	wroteHeader bool
+	status      int
+	header      Header // WriteHeader时的首部快照
+	buf         bytes.Buffer
+	overflow    bool
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	cw.header = cw.ResponseWriter.Header().Clone()
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(StatusOK)
+	}
+	if !cw.overflow {
+		if int64(cw.buf.Len()+len(p)) > cw.limit {
+			cw.overflow = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(StatusOK)
+	}
+	if f, ok := cw.ResponseWriter.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// store 在handler结束后判断响应能否缓存，能的话放入c
+func (cw *cacheWriter) store(c *ResponseCache, primary string, r *Request) {
+	if !cw.wroteHeader || cw.overflow {
+		return
+	}
+	switch cw.status {
+	case StatusOK, StatusNoContent, StatusMovedPermanently, StatusNotFound, StatusGone:
+	default:
+		return
+	}
+	h := cw.header
+	if _, ok := h["Set-Cookie"]; ok {
+		return
+	}
+	ttl, ok := responseTTL(h)
+	if !ok || ttl <= 0 {
+		return
+	}
+	var vary []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary = append(vary, CanonicalHeaderKey(name))
+			}
+		}
+	}
+	// 这些首部只对这一次响应有意义
+	h.Del("Date")
+	h.Del("Age")
+	h.Del("Connection")
+	h.Del("Transfer-Encoding")
+	now := time.Now()
+	c.add(primary, vary, &cachedResponse{
+		key:     varyKey(primary, vary, r),
+		status:  cw.status,
+		header:  h,
+		body:    append([]byte(nil), cw.buf.Bytes()...),
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+}
+
+// responseTTL 根据Cache-Control以及Expires计算响应在共享缓存中的有效期，响应不能缓存时返回false
+func responseTTL(h Header) (time.Duration, bool) {
+	cc := parseCacheControl(h)
+	for _, d := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := cc[d]; ok {
+			return 0, false
+		}
+	}
+	// s-maxage专门针对共享缓存，优先于max-age
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if exp := h.Get("Expires"); exp != "" {
+		t, err := time.Parse(TimeFormat, exp)
+		if err != nil {
+			// 无法解析的Expires代表已经过期
+			return 0, false
+		}
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+// parseCacheControl 解析Cache-Control首部，指令名转换为小写，没有值的指令值为空字符串
+func parseCacheControl(h Header) map[string]string {
+	var cc map[string]string
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if cc == nil {
+				cc = make(map[string]string)
+			}
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
@@ -0,0 +1,253 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// restart.go实现不中断服务的重启(如部署新版本)：旧进程启动新的可执行文件，把监听socket的文件描述符传给它，
+// 新进程直接在这些socket上accept，不需要重新bind，内核accept队列中的连接也不会丢失；
+// 新进程就绪后旧进程通过Shutdown处理完手头的请求再退出。一般由SIGUSR2触发：
+//
+//	l, err := httpd.Listen("tcp", ":8080") // 新进程中得到的是从旧进程继承的监听器
+//	go srv.Serve(l)
+//	httpd.RestartReady() // 通知旧进程可以退出了，不是由Restart启动时什么都不做
+//
+//	ch := make(chan os.Signal, 1)
+//	signal.Notify(ch, syscall.SIGUSR2)
+//	for range ch {
+//		if _, err := httpd.Restart(ctx); err != nil {
+//			log.Println("restart failed:", err) // 旧进程继续服务
+//			continue
+//		}
+//		srv.Shutdown(ctx)
+//		return
+//	}
+//
+// 只有通过Listen创建的监听器(ListenAndServe以及ListenAndServeTLS内部同样使用它)才会被传递。
+// 文件描述符的传递依赖于unix的fork/exec，在windows上Restart会返回错误。
+
+// 新进程通过这些环境变量得知继承了哪些文件描述符，它们从3开始依次排列，就绪通知用的管道排在最后
+const (
+	envRestartFds   = "HTTPD_RESTART_FDS"
+	envRestartNames = "HTTPD_RESTART_NAMES"
+)
+
+var restart struct {
+	mu        sync.Mutex
+	parsed    bool
+	inherited []inheritedListener // 从旧进程继承、还没有被Listen取走的监听器
+	active    []inheritedListener // 当前进程正在使用的监听器，Restart时传给新进程
+	ready     *os.File            // 向旧进程发送就绪通知的管道
+}
+
+type inheritedListener struct {
+	name string // 网络类型与地址，如tcp::8080
+	l    net.Listener
+}
+
+// Listen 与net.Listen相同，只是当前进程由Restart启动时，优先使用从旧进程继承来的同一个地址上的监听器。
+// 返回的监听器在之后调用Restart时会被传给新进程
+func Listen(network, address string) (net.Listener, error) {
+	return listenInherited(network+":"+address, func() (net.Listener, error) {
+		return net.Listen(network, address)
+	})
+}
+
+// listenInherited 优先返回名为name的继承来的监听器，没有的话调用create创建
+func listenInherited(name string, create func() (net.Listener, error)) (net.Listener, error) {
+	restart.mu.Lock()
+	defer restart.mu.Unlock()
+	if err := parseInherited(); err != nil {
+		return nil, err
+	}
+	for i, il := range restart.inherited {
+		if il.name == name {
+			restart.inherited = append(restart.inherited[:i], restart.inherited[i+1:]...)
+			restart.active = append(restart.active, il)
+			return il.l, nil
+		}
+	}
+	l, err := create()
+	if err != nil {
+		return nil, err
+	}
+	restart.active = append(restart.active, inheritedListener{name, l})
+	return l, nil
+}
+
+// parseInherited 解析旧进程传来的文件描述符，只在第一次调用时生效。调用方需要持有restart.mu
+func parseInherited() error {
+	if restart.parsed {
+		return nil
+	}
+	restart.parsed = true
+	v := os.Getenv(envRestartFds)
+	if v == "" {
+		return nil
+	}
+	var names []string
+	if s := os.Getenv(envRestartNames); s != "" {
+		names = strings.Split(s, "\n")
+	}
+	// 新进程再启动的子进程不应该认为这些文件描述符也是传给它的
+	os.Unsetenv(envRestartFds)
+	os.Unsetenv(envRestartNames)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || len(names) != n {
+		return fmt.Errorf("httpd: malformed %s", envRestartFds)
+	}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), names[i])
+		l, err := FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("httpd: inherited fd %d (%s): %v", fd, names[i], err)
+		}
+		restart.inherited = append(restart.inherited, inheritedListener{names[i], l})
+	}
+	restart.ready = os.NewFile(uintptr(listenFdsStart+n), "restart-ready")
+	return nil
+}
+
+// RestartReady 由Restart启动的新进程在开始Serve之后调用，通知旧进程可以开始Shutdown了，
+// 同时关闭继承来的、新版本不再使用的监听器。当前进程不是由Restart启动时什么都不做
+func RestartReady() error {
+	restart.mu.Lock()
+	defer restart.mu.Unlock()
+	if err := parseInherited(); err != nil {
+		return err
+	}
+	for _, il := range restart.inherited {
+		il.l.Close()
+	}
+	restart.inherited = nil
+	if restart.ready == nil {
+		return nil
+	}
+	_, err := restart.ready.Write([]byte{1})
+	restart.ready.Close()
+	restart.ready = nil
+	return err
+}
+
+// IsRestarted 当前进程是否由Restart启动
+func IsRestarted() bool {
+	restart.mu.Lock()
+	defer restart.mu.Unlock()
+	parseInherited()
+	return restart.ready != nil
+}
+
+// filer 是可以取得底层文件的监听器，*net.TCPListener以及*net.UnixListener都实现了它
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Restart 以当前进程的可执行文件、命令行参数、环境变量以及工作目录启动一个新进程，
+// 把通过Listen创建的监听器传给它，等到新进程调用RestartReady后返回。
+// 新进程在就绪之前退出或者ctx先结束时返回错误，此时新进程会被杀掉，当前进程的监听器不受影响，可以继续服务。
+// 成功返回后两个进程同时在这些监听器上accept，调用方应当随即Shutdown当前进程的服务器
+func Restart(ctx context.Context) (*os.Process, error) {
+	restart.mu.Lock()
+	defer restart.mu.Unlock()
+	if err := parseInherited(); err != nil {
+		return nil, err
+	}
+
+	var (
+		files []*os.File
+		names []string
+		unix  []*net.UnixListener
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, il := range restart.active {
+		fl, ok := il.l.(filer)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			continue // 已经关闭了的监听器
+		}
+		if ul, ok := il.l.(*net.UnixListener); ok {
+			unix = append(unix, ul)
+		}
+		files = append(files, f)
+		names = append(names, il.name)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envRestartFds+"=") && !strings.HasPrefix(kv, envRestartNames+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, envRestartFds+"="+strconv.Itoa(len(files)), envRestartNames+"="+strings.Join(names, "\n"))
+	attrFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	attrFiles = append(attrFiles, readyW)
+	// 旧进程关闭unix监听器时默认会删除socket文件，新进程还在使用它，重启失败时再恢复
+	for _, ul := range unix {
+		ul.SetUnlinkOnClose(false)
+	}
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Dir: dir, Env: env, Files: attrFiles})
+	// 管道的写端只留给新进程，它退出时读端才能读到EOF
+	readyW.Close()
+	if err != nil {
+		restoreUnlink(unix)
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if n, _ := readyR.Read(b[:]); n == 1 {
+			result <- nil
+		} else {
+			result <- errors.New("httpd: restarted process exited before it was ready")
+		}
+	}()
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		p.Kill()
+		p.Wait()
+		restoreUnlink(unix)
+		return nil, err
+	}
+	return p, nil
+}
+
+func restoreUnlink(listeners []*net.UnixListener) {
+	for _, ul := range listeners {
+		ul.SetUnlinkOnClose(true)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package httpd
+
+// 标准库syscall在linux/amd64等平台上没有导出SO_REUSEPORT，这些平台上它的值都是15
+const soReusePort = 0xf
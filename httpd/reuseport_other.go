@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && (!linux || mips || mipsle || mips64 || mips64le)
+
+package httpd
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, errors.New("httpd: SO_REUSEPORT is not supported on this platform")
+}
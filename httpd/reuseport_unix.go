@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !mips && !mipsle && !mips64 && !mips64le)
+
+package httpd
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// listenReusePort 创建一个设置了SO_REUSEPORT的tcp监听器，
+// 多个这样的监听器可以绑定在同一个地址上，由内核将新连接分散到它们各自的accept队列中
+func listenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
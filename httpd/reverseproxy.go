@@ -0,0 +1,328 @@
+package httpd
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reverseproxy.go实现了反向代理：把收到的请求转发给上游服务器，再把上游的响应原样返回给客户端。
+// 请求与响应的报文主体都是边读边转发的，不会整个缓存在内存中。
+// Connection、Keep-Alive等逐跳(hop-by-hop)首部只对相邻的两个节点有效，转发前需要删除，
+// 客户端与代理之间、代理与上游之间的连接各自独立管理。
+
+// ReverseProxy 是一个把请求转发给上游服务器的Handler
+type ReverseProxy struct {
+	// Director 在转发之前修改请求，至少需要设置URL的Scheme以及Host。
+	// 传入的是原请求的副本，修改它不会影响原请求
+	Director func(*Request)
+
+	// Transport 用于发送转发的请求，为nil时使用DefaultTransport
+	Transport RoundTripper
+
+	// FlushInterval 把响应的报文主体发送给客户端的最大延迟，为0时只在缓存满了之后发送，为负数时每次读取到数据都立即发送。
+	// Content-Type为text/event-stream的响应总是立即发送
+	FlushInterval time.Duration
+
+	// ModifyResponse 在把上游的响应返回给客户端之前调用，返回错误时交给ErrorHandler处理
+	ModifyResponse func(*Response) error
+
+	// ErrorHandler 处理连接上游失败或者ModifyResponse返回的错误，为nil时记录日志并回复502
+	ErrorHandler func(ResponseWriter, *Request, error)
+
+	// ErrorLog 记录代理过程中的错误，为nil时使用log包
+	ErrorLog Logger
+}
+
+// NewSingleHostReverseProxy 返回一个把所有请求转发给target的ReverseProxy。
+// 请求的路径会拼接在target的路径之后，target中的queryString与请求的queryString合并。
+// Host首部保持客户端请求的原值，上游需要的话可以在Director中改为target.Host
+func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
+	director := func(req *Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		req.URL.RawPath = ""
+		if target.RawQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		}
+	}
+	return &ReverseProxy{Director: director}
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// hopHeaders 逐跳首部，不能转发给下一个节点
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // 非标准，但一些老旧的客户端会发送
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders 删除标准的逐跳首部，以及Connection首部中列出的字段
+func removeHopHeaders(h Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+}
+
+func (p *ReverseProxy) transport() RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return DefaultTransport
+}
+
+func (p *ReverseProxy) logf(format string, v ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (p *ReverseProxy) defaultErrorHandler(w ResponseWriter, req *Request, err error) {
+	p.logf("httpd: proxy error: %v", err)
+	w.WriteHeader(StatusBadGateway)
+}
+
+func (p *ReverseProxy) handleError(w ResponseWriter, req *Request, err error) {
+	if p.ErrorHandler != nil {
+		p.ErrorHandler(w, req, err)
+		return
+	}
+	p.defaultErrorHandler(w, req, err)
+}
+
+func (p *ReverseProxy) ServeHTTP(w ResponseWriter, req *Request) {
+	outreq := p.outRequest(req)
+	p.Director(outreq)
+	outreq.Close = false
+	outreq.RequestURI = ""
+	removeHopHeaders(outreq.Header)
+	// 客户端声明了能接收trailer的话需要告知上游，它决定了上游能否使用trailer
+	if acceptsTrailers(req.Header) {
+		outreq.Header.Set("Te", "trailers")
+	}
+	p.setForwardedHeaders(req, outreq)
+
+	resp, err := p.transport().RoundTrip(outreq)
+	if err != nil {
+		p.handleError(w, req, err)
+		return
+	}
+	if p.ModifyResponse != nil {
+		if err = p.ModifyResponse(resp); err != nil {
+			resp.Body.Close()
+			p.handleError(w, req, err)
+			return
+		}
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = append(h[k], vs...)
+	}
+	// 上游的trailer要等报文主体转发完才知道值，这里先声明
+	if len(resp.Trailer) > 0 {
+		keys := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		h.Set("Trailer", strings.Join(keys, ", "))
+		// 长度已知的响应不会使用chunk编码，也就无法携带trailer
+		h.Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if err = p.copyResponse(w, resp.Body, p.flushInterval(resp)); err != nil {
+		// 首部已经发送，无法再回复错误，只能中断连接让客户端知道响应不完整
+		if req.Context().Err() == nil {
+			p.logf("httpd: proxy error copying response body: %v", err)
+		}
+		panic(ErrAbortHandler)
+	}
+	for k, vs := range resp.Trailer {
+		h[k] = vs
+	}
+}
+
+// outRequest 复制一份要转发的请求，首部以及URL都是深拷贝，Director可以随意修改
+func (p *ReverseProxy) outRequest(req *Request) *Request {
+	outreq := &Request{
+		Method:        req.Method,
+		Proto:         "HTTP/1.1",
+		Header:        req.Header.Clone(),
+		Host:          req.Host,
+		ContentLength: req.ContentLength,
+		Trailer:       req.Trailer,
+		ctx:           req.ctx,
+	}
+	if outreq.Header == nil {
+		outreq.Header = make(Header)
+	}
+	if req.URL != nil {
+		u := *req.URL
+		outreq.URL = &u
+	} else {
+		outreq.URL = new(url.URL)
+	}
+	// 没有报文主体时Body为nil，Transport就可以在复用的连接失效时安全地重试；
+	// 报文主体经过BufferBody缓存之后同样可以通过GetBody重试
+	if req.ContentLength != 0 {
+		outreq.Body = req.Body
+		outreq.GetBody = req.GetBody
+	}
+	return outreq
+}
+
+// setForwardedHeaders 把客户端的地址、请求的Host以及协议告知上游。
+// 只有X-Forwarded-For是逐跳追加的，Host与协议总是以本代理看到的为准，不能沿用客户端发来的值，否则客户端可以随意伪造
+func (p *ReverseProxy) setForwardedHeaders(req, outreq *Request) {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		// 沿用前面的代理添加的值，把自己看到的对端地址追加到末尾
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+	outreq.Header.Set("X-Forwarded-Host", req.Host)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	outreq.Header.Set("X-Forwarded-Proto", proto)
+}
+
+func acceptsTrailers(h Header) bool {
+	for _, v := range h["Te"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *ReverseProxy) flushInterval(resp *Response) time.Duration {
+	ct, _, _ := cutString(resp.Header.Get("Content-Type"), ";")
+	if strings.EqualFold(strings.TrimSpace(ct), "text/event-stream") {
+		return -1
+	}
+	return p.FlushInterval
+}
+
+// copyResponse 把上游的报文主体转发给客户端，返回读取上游时遇到的错误；
+// 客户端断开导致的写入错误直接结束转发，不需要额外处理
+func (p *ReverseProxy) copyResponse(w ResponseWriter, src io.Reader, flushInterval time.Duration) error {
+	var dst io.Writer = w
+	if flushInterval != 0 {
+		if f, ok := w.(Flusher); ok {
+			mlw := &maxLatencyWriter{dst: w, flush: f.Flush, latency: flushInterval}
+			defer mlw.stop()
+			dst = mlw
+		}
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return nil
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// maxLatencyWriter 保证写入的数据最多延迟latency就会被发送，latency为负数时每次写入后立即发送。
+// 定时器在另一个goroutine中执行flush，所以写入与flush需要加锁
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flush   func()
+	latency time.Duration
+
+	mu           sync.Mutex
+	t            *time.Timer
+	flushPending bool
+	stopped      bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err = m.dst.Write(p)
+	if m.latency < 0 {
+		m.flush()
+		return
+	}
+	if m.flushPending {
+		return
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// stop之后handler可能已经返回，response不能再被使用
+	if !m.flushPending || m.stopped {
+		return
+	}
+	m.flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
@@ -0,0 +1,117 @@
+package httpd
+
+import (
+	"strconv"
+	"time"
+)
+
+// secure.go提供设置安全相关响应首部的中间件，默认配置适合大多数网站：
+//
+//	mux := httpd.NewServeMux()
+//	srv.Handler = httpd.SecureHeaders(httpd.SecurityPolicy{
+//		ContentSecurityPolicy: "default-src 'self'",
+//	})(mux)
+//
+// 单独的路由可以再包一层SecureHeaders覆盖其中的部分首部，如允许某个页面被同源的页面嵌入：
+//
+//	mux.Handle("/embed", httpd.SecureHeaders(httpd.SecurityPolicy{FrameOptions: "SAMEORIGIN"})(embedHandler))
+//
+// 内层只覆盖明确指定了的首部，handler自己设置的首部优先于所有的中间件。
+
+// DefaultHSTSMaxAge SecurityPolicy默认的HSTS有效期
+const DefaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// SecurityPolicy 描述需要添加的安全首部。字符串字段为空时使用默认值，为"-"时删除对应的首部
+type SecurityPolicy struct {
+	// HSTSMaxAge Strict-Transport-Security的max-age，只在https请求的响应中设置。
+	// 为0时使用DefaultHSTSMaxAge，小于0时删除
+	HSTSMaxAge time.Duration
+	// HSTSIncludeSubdomains、HSTSPreload 对应Strict-Transport-Security中的includeSubDomains以及preload
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	// FrameOptions X-Frame-Options，默认为DENY
+	FrameOptions string
+	// ReferrerPolicy Referrer-Policy，默认为strict-origin-when-cross-origin
+	ReferrerPolicy string
+	// ContentSecurityPolicy Content-Security-Policy，默认不设置，需要根据网站引用的资源配置
+	ContentSecurityPolicy string
+	// DisableNosniff 为true时删除X-Content-Type-Options，默认设置为nosniff
+	DisableNosniff bool
+}
+
+// secHeader 是一个首部的操作：value为空时删除，explicit为false的默认值只在首部不存在时设置
+type secHeader struct {
+	key, value string
+	explicit   bool
+}
+
+// SecureHeaders 返回按照p添加安全首部的中间件
+func SecureHeaders(p SecurityPolicy) Middleware {
+	var headers []secHeader
+	add := func(key, value, def string) {
+		switch value {
+		case "":
+			if def != "" {
+				headers = append(headers, secHeader{key, def, false})
+			}
+		case "-":
+			headers = append(headers, secHeader{key, "", true})
+		default:
+			headers = append(headers, secHeader{key, value, true})
+		}
+	}
+	if p.DisableNosniff {
+		add("X-Content-Type-Options", "-", "")
+	} else {
+		add("X-Content-Type-Options", "", "nosniff")
+	}
+	add("X-Frame-Options", p.FrameOptions, "DENY")
+	add("Referrer-Policy", p.ReferrerPolicy, "strict-origin-when-cross-origin")
+	add("Content-Security-Policy", p.ContentSecurityPolicy, "")
+	hsts := p.hsts()
+
+	return func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			// 外层的中间件先执行，内层明确指定的值覆盖外层，handler随后可以再修改
+			dst := w.Header()
+			for _, sh := range headers {
+				sh.apply(dst)
+			}
+			if r.TLS != nil {
+				hsts.apply(dst)
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (sh secHeader) apply(h Header) {
+	if _, ok := h[sh.key]; ok && !sh.explicit {
+		return
+	}
+	if sh.value == "" {
+		h.Del(sh.key)
+		return
+	}
+	h.Set(sh.key, sh.value)
+}
+
+func (p SecurityPolicy) hsts() secHeader {
+	const key = "Strict-Transport-Security"
+	maxAge := p.HSTSMaxAge
+	if maxAge < 0 {
+		return secHeader{key, "", true}
+	}
+	explicit := maxAge > 0 || p.HSTSIncludeSubdomains || p.HSTSPreload
+	if maxAge == 0 {
+		maxAge = DefaultHSTSMaxAge
+	}
+	v := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if p.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if p.HSTSPreload {
+		v += "; preload"
+	}
+	return secHeader{key, v, explicit}
+}
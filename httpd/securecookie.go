@@ -0,0 +1,161 @@
+package httpd
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// securecookie.go用于把少量状态(如提示信息、轻量的会话)保存在客户端的cookie中而不被伪造：
+// cookie的值经过HMAC-SHA256签名，可选地再用AES-GCM加密使客户端无法读取其中的内容。
+// 值中带有签发时间，可以限制有效期；cookie名参与签名，一个cookie的值无法挪用到另一个cookie上。
+//
+// 更换密钥时把新密钥放在第一位，旧密钥放在后面，新的值总是使用第一个密钥，旧密钥签发的值在过期前仍然有效：
+//
+//	codec, _ := httpd.NewCookieCodec(true, newKey, oldKey)
+//	codec.SetCookie(w, &httpd.Cookie{Name: "flash", Value: "saved", Path: "/"})
+//	msg, err := codec.Cookie(r, "flash")
+
+// ErrInvalidCookie cookie不存在、被篡改、无法解密或者已经过期
+var ErrInvalidCookie = errors.New("httpd: invalid cookie value")
+
+// MinCookieKeyLen CookieCodec的密钥的最小长度
+const MinCookieKeyLen = 32
+
+// CookieCodec 对cookie的值进行签名以及加密，可以被多个goroutine同时使用
+type CookieCodec struct {
+	// MaxAge 大于0时，签发时间超过MaxAge的值被视为无效，与Cookie.MaxAge无关，浏览器不一定遵守后者
+	MaxAge time.Duration
+
+	keys    []cookieKey
+	encrypt bool
+}
+
+// cookieKey 由一个密钥派生出签名以及加密使用的两个子密钥，避免同一个密钥用于两种用途
+type cookieKey struct {
+	sign []byte
+	aead cipher.AEAD
+}
+
+// NewCookieCodec 创建一个CookieCodec，keys中的第一个用于签发，所有的都用于验证，每个密钥至少32字节。
+// encrypt为true时值还会被加密
+func NewCookieCodec(encrypt bool, keys ...[]byte) (*CookieCodec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("httpd: no cookie keys")
+	}
+	c := &CookieCodec{encrypt: encrypt}
+	for _, key := range keys {
+		if len(key) < MinCookieKeyLen {
+			return nil, errors.New("httpd: cookie key too short")
+		}
+		k := cookieKey{sign: deriveKey(key, "httpd cookie signing")}
+		if encrypt {
+			block, err := aes.NewCipher(deriveKey(key, "httpd cookie encryption"))
+			if err != nil {
+				return nil, err
+			}
+			if k.aead, err = cipher.NewGCM(block); err != nil {
+				return nil, err
+			}
+		}
+		c.keys = append(c.keys, k)
+	}
+	return c, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Encode 返回name对应的cookie值value签名(以及加密)后的结果，结果只包含base64url字符，可以直接用作cookie的值
+func (c *CookieCodec) Encode(name, value string) (string, error) {
+	k := c.keys[0]
+	// 格式为 签发时间(8字节) | 内容 | HMAC(32字节)，加密时内容为 nonce | 密文
+	buf := make([]byte, 8, 8+len(value)+64)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
+	if c.encrypt {
+		nonce := make([]byte, k.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return "", err
+		}
+		buf = append(buf, nonce...)
+		buf = k.aead.Seal(buf, nonce, []byte(value), cookieAAD(name, buf[:8]))
+	} else {
+		buf = append(buf, value...)
+	}
+	buf = append(buf, cookieMAC(k.sign, name, buf)...)
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Decode 验证Encode的结果并返回原来的值，签名或者密文不正确、已经过期时返回ErrInvalidCookie
+func (c *CookieCodec) Decode(name, encoded string) (string, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(buf) < 8+sha256.Size {
+		return "", ErrInvalidCookie
+	}
+	data, sum := buf[:len(buf)-sha256.Size], buf[len(buf)-sha256.Size:]
+	issued := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	if c.MaxAge > 0 && time.Since(issued) > c.MaxAge {
+		return "", ErrInvalidCookie
+	}
+	for _, k := range c.keys {
+		if !hmac.Equal(cookieMAC(k.sign, name, data), sum) {
+			continue
+		}
+		if !c.encrypt {
+			return string(data[8:]), nil
+		}
+		n := k.aead.NonceSize()
+		if len(data) < 8+n {
+			return "", ErrInvalidCookie
+		}
+		plain, err := k.aead.Open(nil, data[8:8+n], data[8+n:], cookieAAD(name, data[:8]))
+		if err != nil {
+			return "", ErrInvalidCookie
+		}
+		return string(plain), nil
+	}
+	return "", ErrInvalidCookie
+}
+
+func cookieMAC(key []byte, name string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func cookieAAD(name string, issued []byte) []byte {
+	return append(append([]byte(name), 0), issued...)
+}
+
+// SetCookie 把cookie.Value替换为Encode的结果后添加到响应中，cookie本身不会被修改
+func (c *CookieCodec) SetCookie(w ResponseWriter, cookie *Cookie) error {
+	v, err := c.Encode(cookie.Name, cookie.Value)
+	if err != nil {
+		return err
+	}
+	signed := *cookie
+	signed.Value = v
+	SetCookie(w, &signed)
+	return nil
+}
+
+// Cookie 读取请求中名为name的cookie并验证，返回原来的值；cookie不存在时同样返回ErrInvalidCookie
+func (c *CookieCodec) Cookie(r *Request, name string) (string, error) {
+	v := r.Cookie(name)
+	if v == "" {
+		return "", ErrInvalidCookie
+	}
+	return c.Decode(name, v)
+}
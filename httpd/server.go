@@ -2,34 +2,596 @@ package httpd
 
 // server.go只负责WEB服务器的启动逻辑
 
-import "net"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Handler interface {
 	ServeHTTP(w ResponseWriter, r *Request)
 }
 
+// HandlerFunc 把普通的函数适配为Handler
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeHTTP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
 // 启动一个服务器其必须项只有Addr以及Handler
 // Server结构体中还可以加入很多字段如读取或写入超时时间、能接受的最大报文大小等控制信息，但为了专注于一个框架最核心的实现，我们忽略这些细节内容。
 type Server struct {
-	Addr    string  // 监听地址
+	Addr    string  // 监听地址，以unix:开头时监听unix domain socket，如 unix:/var/run/app.sock
 	Handler Handler // 处理http请求的回调函数
+
+	// UnixSocketMode 监听unix domain socket时socket文件的权限，如0660，为0时由umask决定
+	UnixSocketMode os.FileMode
+
+	// ReusePort 大于1时，ListenAndServe会在Addr上打开ReusePort个设置了SO_REUSEPORT的tcp监听器，
+	// 每个监听器各自运行一个accept循环，由内核把新连接分散到各个监听器上，减少高建连速率下对同一个accept队列的争抢。
+	// 对unix domain socket以及不支持SO_REUSEPORT的平台无效(后者会返回错误)
+	ReusePort int
+
+	// ProxyProtocol 为true时，每个连接的开头都必须是PROXY protocol(v1或v2)首部，
+	// Request.RemoteAddr取自其中的源地址。只应在负载均衡(如AWS NLB、以tcp模式工作的haproxy)之后开启，
+	// 否则任何客户端都可以伪造自己的地址。
+	// 使用tls时，首部在握手之前解析，需要通过ListenAndServeTLS或ServeTLS启动，不能自行用tls.NewListener包装监听器
+	ProxyProtocol bool
+
+	// TrustedProxies 受信任的反向代理的地址，可以是CIDR(如10.0.0.0/8)或者单独的ip。
+	// 只有连接的对端属于其中时，Request.ClientIP才会采信X-Forwarded-For以及X-Real-IP首部
+	TrustedProxies []string
+
+	// MaxConns 同时处理的最大连接数，为0时不限制。被handler接管的连接在handler返回后不再计入
+	MaxConns int
+	// ConnLimit 连接数达到MaxConns之后对待新连接的方式，默认暂停接受新连接
+	ConnLimit ConnLimitPolicy
+	// AcceptQueue 只在ConnLimit为ConnLimitReject时有效，连接数达到上限后最多允许这么多连接排队等待，超出的连接回复503
+	AcceptQueue int
+
+	// 请求行以及首部字段的最大字节数，为0时使用DefaultMaxHeaderBytes。
+	// 这个限制对每个请求单独生效，长连接上的每个请求都会重新计算。
+	// chunk编码的报文主体中每个chunk大小所在的行以及最后的trailer也分别受它的限制，超出时回复400以及431
+	MaxHeaderBytes int
+
+	// ReadHeaderTimeout 读取请求行以及首部的超时时间，从开始等待请求算起，长连接上的每个请求都重新计时。
+	// 超时后直接关闭连接，用于抵御慢速发送首部的攻击，为0时不限制
+	ReadHeaderTimeout time.Duration
+
+	// MaxHandlerGoroutines 同时运行的handler的最大数量，为0时不限制。与MaxConns不同，它限制的是请求处理的并发度，
+	// 适合handler依赖数据库等连接数有限的资源的场景
+	MaxHandlerGoroutines int
+	// HandlerQueue handler数达到MaxHandlerGoroutines之后最多允许这么多请求排队等待，超出的请求回复503
+	HandlerQueue int
+
+	// IdlePoller 为true时，处理完请求的空闲长连接交给epoll(linux)或kqueue(bsd/macOS)监视，
+	// 不再占用goroutine以及读写缓存，有新数据到达时才重新分配，适合有大量空闲长连接的场景。
+	// 只对基于socket的连接有效，不支持的平台上会记录一条错误并退回默认的模式。
+	// 托管期间连接不受ReadHeaderTimeout的限制，被唤醒后才开始计时。
+	// 被handler接管的连接(如WebSocket)可以通过ReadNotifier交给同一个poller托管
+	IdlePoller bool
+
+	// MaxRequestsPerConn 一个长连接上最多处理的请求数，达到后在最后一个响应中设置Connection: close并关闭连接，
+	// 可以让负载均衡重新分配连接，也能限制单个连接上累积的状态，为0时不限制
+	MaxRequestsPerConn int
+
+	// H2C 为true时允许明文的http/2：客户端既可以直接发送http/2的连接前言(prior knowledge)，
+	// 也可以在http/1.1请求中通过Upgrade: h2c升级。基于tls的http/2不受它的影响，
+	// 只要tls.Config.NextProtos中包含"h2"，ALPN协商的结果就决定了连接使用的协议
+	H2C bool
+	// MaxConcurrentStreams 每个http/2连接上同时处理的最大流数，为0时使用DefaultMaxConcurrentStreams
+	MaxConcurrentStreams uint32
+
+	// ReadBufferSize 以及 WriteBufferSize 为每个连接读写缓存的大小，为0时使用DefaultBufferSize。
+	// 首部较大的请求可以调大读缓存以减少读取次数，流式发送大响应时调大写缓存可以减少系统调用，代价是每个连接占用更多内存。
+	// 解析multipart表单时也使用ReadBufferSize大小的缓存
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// 为true时，对于Content-Encoding为gzip或deflate的请求，Body读出的是解压后的数据，
+	// 同时请求首部中的Content-Encoding以及Content-Length会被删除
+	DecompressRequestBody bool
+	// MaxDecompressedBytes 解压后的报文主体的最大字节数，超出时Body的读取返回ErrBodyTooLarge，
+	// 不大于0时使用DefaultMaxDecodeBytes
+	MaxDecompressedBytes int64
+
+	// 解析multipart表单时的限制，对应MultipartReader的MaxParts、MaxPartHeaderBytes以及MaxFormBytes，
+	// 超出时ParseMultipartForm返回MultipartLimitError
+	MaxMultipartParts       int
+	MaxMultipartHeaderBytes int
+	MaxMultipartBytes       int64
+
+	// 读取chunk编码的请求报文主体时的限制：单个chunk的最大字节数、解码后报文主体的最大字节数以及最多的chunk数，为0时不限制。
+	// 超出时Body的读取返回错误，handler没有回复的话框架回复413(chunk数超出时为400)，并在响应之后关闭连接
+	MaxChunkSize        int
+	MaxChunkedBodyBytes int64
+	MaxChunks           int
+
+	// ExpectContinue 控制何时回复100 continue，默认在handler第一次读取Body时回复
+	ExpectContinue ExpectContinuePolicy
+	// ExpectContinueTimeout 客户端在等待100 continue时，handler没有读取Body就返回了，
+	// 框架最多等待这么长时间来消费客户端可能在超时后发送的报文主体，为0时直接关闭连接
+	ExpectContinueTimeout time.Duration
+
+	// ServerHeader 响应中Server首部的值，为空时使用DefaultServerHeader。
+	// handler也可以自己设置Server首部来覆盖它。
+	ServerHeader string
+
+	// TLSConfig ListenAndServeTLS以及ServeTLS使用的tls配置，为nil时使用默认配置。
+	// Certificates中可以放入多个域名的证书，握手时按照客户端在SNI中发送的域名选择，支持*.example.com形式的通配符证书；
+	// 设置了GetCertificate时优先调用它，它返回nil, nil时再按照SNI从Certificates中选择
+	TLSConfig *tls.Config
+	// ClientAuth 不为tls.NoClientCert时覆盖TLSConfig中的同名字段，决定是否要求以及验证客户端证书，
+	// 双向认证(mTLS)一般使用tls.RequireAndVerifyClientCert
+	ClientAuth tls.ClientAuthType
+	// ClientCAs 不为nil时覆盖TLSConfig中的同名字段，用于验证客户端证书的根证书，为nil时使用系统的根证书
+	ClientCAs *x509.CertPool
+
+	// TLSNextProto 以ALPN协议名为键，协商出其中的协议时，tls连接在握手之后交给对应的函数处理，不再进入http/1.1的处理流程，
+	// 函数返回后连接被关闭。这些协议名会被加入ALPN的候选列表(TLSConfig中没有指定NextProtos时)。
+	// 其中的"h2"会替换内置的http/2实现
+	TLSNextProto map[string]func(*Server, *tls.Conn, Handler)
+
+	// CertReloadInterval 大于0时，每隔这么长时间检查一次ListenAndServeTLS以及ServeTLS的证书文件，
+	// 文件被修改后重新加载，之后的握手使用新证书，见certreload.go
+	CertReloadInterval time.Duration
+
+	// AutoCert 不为nil时，ListenAndServeTLS以及ServeTLS通过ACME协议自动申请、续期证书，不再需要证书文件，
+	// 并且会回应tls-alpn-01验证。TLSConfig中已经设置了GetCertificate时优先使用它
+	AutoCert *CertManager
+
+	// AccessLog 不为nil时，每个请求处理完毕后都会往其中写入一行Combined Log Format格式的访问日志
+	AccessLog io.Writer
+
+	// ConnState 不为nil时，在连接的状态发生变化时调用，可用于统计空闲连接、实现自定义的超时以及优雅关闭等逻辑。
+	// 同一个连接上的调用是串行的，但不同连接上的调用可能并发进行。
+	ConnState func(net.Conn, ConnState)
+
+	// ErrorLog 记录服务器运行过程中的错误，如接受连接失败、请求解析失败、handler发生panic等，
+	// 为nil时使用标准库log包默认的Logger
+	ErrorLog Logger
+
+	// PanicHandler 在handler发生panic时调用，用于上报错误，为nil时记录到ErrorLog。
+	// req为出错的请求，err为recover得到的值，stack为发生panic的goroutine的调用栈。
+	// 无论是否设置了PanicHandler，只要响应还没有开始发送，客户端都会收到500 Internal Server Error。
+	PanicHandler func(req *Request, err interface{}, stack []byte)
+
+	// Tracer 不为nil时，在每个请求开始以及结束时调用，用于接入分布式追踪系统，见tracing.go
+	Tracer Tracer
+
+	// DrainDelay Shutdown在调用RegisterOnShutdown注册的函数之后、关闭监听器之前等待的时间。
+	// 这段时间内服务器照常处理新的请求，HealthHandler则已经回复503，负载均衡器有时间发现并把流量切走
+	DrainDelay time.Duration
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	closed     bool
+	conns      map[*conn]struct{} // 没有关闭也没有被接管的连接，Shutdown等待它们结束
+	onShutdown []func()
+	// shutdownCh 在Shutdown关闭监听器时关闭，通知http/2连接发送GOAWAY
+	shutdownCh chan struct{}
+	inShutdown int32        // 调用过Shutdown后为1，通过atomic访问，每个请求都会检查
+	certStores []*certStore // 从证书文件加载的证书，ReloadCertificates重新加载它们
+	// 所有请求的Context都派生自baseCtx，服务器关闭时调用cancel，通知所有正在运行的handler
+	baseCtx context.Context
+	cancel  context.CancelFunc
+
+	pollerOnce sync.Once
+	poller     *poller
+
+	handlerLimiterOnce sync.Once
+	handlerLimit       *connLimiter
+
+	limiterOnce sync.Once
+	connLimiter *connLimiter
+
+	trustedOnce sync.Once
+	trustedNets []*net.IPNet
+
+	accessLogOnce sync.Once
+	accessLog     *accessLogger
+
+	metricsOnce sync.Once
+	metrics     *serverMetrics
+}
+
+// ConnState 代表客户端连接所处的状态
+type ConnState int
+
+const (
+	// StateNew 连接刚刚被接受，还没有读到任何数据，之后一定会转换为StateActive或StateClosed
+	StateNew ConnState = iota
+	// StateActive 连接上读到了请求的数据，正在处理请求。
+	// handler运行期间连接一直处于此状态，处理完毕后转换为StateIdle、StateHijacked或StateClosed
+	StateActive
+	// StateIdle 一个请求处理完毕，长连接正在等待下一个请求，之后会转换为StateActive或StateClosed
+	StateIdle
+	// StateHijacked 连接被handler接管，这是终止状态，不会再转换为StateClosed
+	StateHijacked
+	// StateClosed 连接已经关闭，这是终止状态
+	StateClosed
+)
+
+var stateName = map[ConnState]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
+}
+
+// Logger 是Server记录错误时所需的最小接口，*log.Logger即实现了它，
+// 也可以很容易地适配到zap、logrus等日志库上
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// ExpectContinuePolicy 决定如何回应请求中的Expect: 100-continue
+type ExpectContinuePolicy int
+
+const (
+	// ExpectContinueOnRead 只有handler读取Body时才回复100 continue，handler不需要报文主体时可以节省带宽
+	ExpectContinueOnRead ExpectContinuePolicy = iota
+	// ExpectContinueImmediate 解析完首部后立即回复100 continue
+	ExpectContinueImmediate
+)
+
+// ErrServerClosed 服务器调用Close关闭后，ListenAndServe以及Serve返回此错误
+var ErrServerClosed = errors.New("httpd: Server closed")
+
+// DefaultMaxHeaderBytes 默认的首部最大字节数 1MB
+const DefaultMaxHeaderBytes = 1 << 20
+
+// DefaultBufferSize 连接默认的读写缓存大小 4KB
+const DefaultBufferSize = 4 << 10
+
+// DefaultServerHeader 默认的Server首部
+const DefaultServerHeader = "httpd"
+
+func (s *Server) serverHeader() string {
+	if s.ServerHeader != "" {
+		return s.ServerHeader
+	}
+	return DefaultServerHeader
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (s *Server) maxHeaderBytes() int64 {
+	if s.MaxHeaderBytes > 0 {
+		return int64(s.MaxHeaderBytes)
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (s *Server) maxDecompressedBytes() int64 {
+	if s.MaxDecompressedBytes > 0 {
+		return s.MaxDecompressedBytes
+	}
+	return DefaultMaxDecodeBytes
+}
+
+func (s *Server) readBufferSize() int {
+	if s.ReadBufferSize > 0 {
+		return s.ReadBufferSize
+	}
+	return DefaultBufferSize
+}
+
+func (s *Server) writeBufferSize() int {
+	if s.WriteBufferSize > 0 {
+		return s.WriteBufferSize
+	}
+	return DefaultBufferSize
 }
 
 // ListenAndServe方法中展现的是go语言socket编程的写法，
-// 大致意思是在Addr上监听TCP连接，将得到的TCP连接rwc(ReadWriteCloser)以及s进行封装得到conn结构体。
-// 接着调用conn.serve()方法，开启goroutine处理请求。
+// 大致意思是在Addr上监听TCP连接(或者unix domain socket)，再交给Serve处理。
 func (s *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.Addr)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	if s.ReusePort > 1 && !strings.HasPrefix(s.Addr, unixAddrPrefix) {
+		return s.listenAndServeReusePort(nil)
+	}
+	l, err := s.listen()
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// listenAndServeReusePort 为每个SO_REUSEPORT监听器运行一个Serve，
+// 其中任何一个返回时关闭其余的监听器，等所有的accept循环都退出后返回第一个错误。
+// config不为nil时在每个监听器上使用tls
+func (s *Server) listenAndServeReusePort(config *tls.Config) error {
+	listeners := make([]net.Listener, 0, s.ReusePort)
+	for i := 0; i < s.ReusePort; i++ {
+		l, err := listenInherited("tcp-reuseport:"+s.Addr, func() (net.Listener, error) {
+			return listenReusePort(s.Addr)
+		})
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if config != nil {
+			l = s.tlsListener(l, config)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- s.Serve(l)
+		}(l)
+	}
+	err := <-errc
+	for _, l := range listeners {
+		l.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errc
+	}
+	return err
+}
+
+// Serve 在l上接受连接，将得到的连接rwc(ReadWriteCloser)以及s进行封装得到conn结构体，
+// 接着调用conn.serve()方法，开启goroutine处理请求。
+// 调用方可以传入自己创建的监听器，如预先绑定好的socket、tls.Listener或者测试时使用的内存监听器。
+// Serve返回时l总是已经被关闭，服务器关闭后返回ErrServerClosed。
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	limiter := s.limiter()
+	var tempDelay time.Duration // 连续接受连接失败时的等待时间，避免在文件描述符耗尽等情况下空转并刷屏
 	for {
+		// 连接数达到上限时不再调用Accept，新连接留在内核的accept队列中
+		if limiter != nil && s.ConnLimit == ConnLimitWait && !limiter.acquire(s.baseContext().Done()) {
+			return ErrServerClosed
+		}
 		rwc, err := l.Accept()
 		if err != nil {
+			if limiter != nil && s.ConnLimit == ConnLimitWait {
+				limiter.release()
+			}
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			// 监听器已经被关闭了，再重试也没有意义
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else if tempDelay *= 2; tempDelay > time.Second {
+				tempDelay = time.Second
+			}
+			s.logf("httpd: accept error: %v; retrying in %v", err, tempDelay)
+			time.Sleep(tempDelay)
 			continue // 其他连接还要继续
 		}
+		tempDelay = 0
 		conn := newConn(rwc, s)
-		go conn.serve()
+		conn.setState(StateNew)
+		switch {
+		case limiter == nil:
+			go conn.serve()
+		case s.ConnLimit == ConnLimitWait:
+			go conn.serveLimited(limiter)
+		default:
+			s.serveLimited(limiter, conn)
+		}
 	}
+}
+
+// Close 关闭所有的监听器，并取消所有正在处理的请求的Context。
+// Close不会等待handler返回，但会关闭IdlePoller托管的空闲连接，handler应当通过Request.Context感知服务器的关闭。
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.initBaseContext()
+	s.cancel()
+
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.listeners, l)
+	}
+	p := s.poller
+	s.mu.Unlock()
+
+	// 托管中的空闲连接没有goroutine在处理，需要由这里关闭
+	if p != nil {
+		p.close()
+	}
+	return err
+}
 
+// RegisterOnShutdown 注册一个在Shutdown开始时调用的函数，函数在单独的goroutine中运行，
+// 可用于通知被接管的连接(如websocket)关闭，HealthHandler也通过它得知服务器正在下线
+func (s *Server) RegisterOnShutdown(f func()) {
+	s.mu.Lock()
+	s.onShutdown = append(s.onShutdown, f)
+	s.mu.Unlock()
+}
+
+// Shutdown 优雅地关闭服务器：调用RegisterOnShutdown注册的函数，等待DrainDelay后关闭所有的监听器，
+// 然后关闭空闲的连接，正在处理请求的http/1.x连接在响应结束后关闭，http/2连接发送GOAWAY并在所有的流结束后关闭。
+// 所有连接都关闭后返回nil；ctx先结束时返回ctx.Err()，之后可以调用Close取消还在运行的handler。
+// 被handler接管的连接不在等待之列，需要应用自己负责关闭
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	first := atomic.CompareAndSwapInt32(&s.inShutdown, 0, 1)
+	hooks := s.onShutdown
+	s.mu.Unlock()
+	if first {
+		for _, f := range hooks {
+			go f()
+		}
+		if s.DrainDelay > 0 {
+			t := time.NewTimer(s.DrainDelay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(s.listeners, l)
+	}
+	if s.shutdownCh == nil {
+		s.shutdownCh = make(chan struct{})
+	}
+	select {
+	case <-s.shutdownCh:
+	default:
+		close(s.shutdownCh)
+	}
+	p := s.poller
+	s.mu.Unlock()
+	if p != nil {
+		p.close()
+	}
+
+	// 轮询间隔从1ms开始加倍，最长500ms
+	interval := time.Millisecond
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if interval *= 2; interval > 500*time.Millisecond {
+				interval = 500 * time.Millisecond
+			}
+			t.Reset(interval)
+		}
+	}
+}
+
+// closeIdleConns 关闭所有空闲的连接，没有剩余的连接时返回true
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		// 连接的goroutine读取失败后自己调用close，那时才从conns中删除
+		if ConnState(atomic.LoadInt32(&c.state)) == StateIdle {
+			c.rwc.Close()
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// shutdownChan 返回Shutdown关闭监听器时关闭的channel
+func (s *Server) shutdownChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdownCh == nil {
+		s.shutdownCh = make(chan struct{})
+	}
+	return s.shutdownCh
+}
+
+// trackConn 记录或移除一个连接
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// 记录或移除一个监听器，服务器已经关闭时返回false
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.closed {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// 调用方需要持有mu
+func (s *Server) initBaseContext() {
+	if s.baseCtx == nil {
+		s.baseCtx, s.cancel = context.WithCancel(context.Background())
+	}
+}
+
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initBaseContext()
+	return s.baseCtx
+}
+
+func (s *Server) accessLogger() *accessLogger {
+	if s.AccessLog == nil {
+		return nil
+	}
+	s.accessLogOnce.Do(func() {
+		s.accessLog = &accessLogger{w: s.AccessLog}
+	})
+	return s.accessLog
 }
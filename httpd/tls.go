@@ -0,0 +1,232 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// tls.go负责https的启动：在监听器上套一层tls，ALPN优先协商h2，
+// 一个Server可以同时持有多个域名的证书，握手时按照客户端的SNI选择。
+
+// ListenAndServeTLS 与ListenAndServe相同，只是在连接上使用tls。
+// certFile与keyFile为PEM格式的证书以及私钥，证书由CA签发时certFile中应当依次放入服务器证书以及中间证书。
+// TLSConfig中已经配置了证书(Certificates或者GetCertificate)时两者可以为空
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if s.ReusePort > 1 && !strings.HasPrefix(s.Addr, unixAddrPrefix) {
+		return s.listenAndServeReusePort(config)
+	}
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(s.tlsListener(l, config))
+}
+
+// ServeTLS 在l上接受连接并使用tls，certFile与keyFile的含义同ListenAndServeTLS
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config, err := s.tlsConfig(certFile, keyFile)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	return s.Serve(s.tlsListener(l, config))
+}
+
+// tlsConfig 复制一份TLSConfig，补充证书、ALPN以及按SNI选择证书的逻辑，不修改用户传入的配置
+func (s *Server) tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if s.ClientAuth != tls.NoClientCert {
+		config.ClientAuth = s.ClientAuth
+	}
+	if s.ClientCAs != nil {
+		config.ClientCAs = s.ClientCAs
+	}
+	// 用户没有指定ALPN时优先使用http/2，其后是TLSNextProto中注册的协议
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+		var protos []string
+		for proto := range s.TLSNextProto {
+			if proto != "h2" && proto != "http/1.1" {
+				protos = append(protos, proto)
+			}
+		}
+		sort.Strings(protos)
+		config.NextProtos = append(config.NextProtos, protos...)
+	}
+	if s.AutoCert != nil {
+		if config.GetCertificate == nil {
+			config.GetCertificate = s.AutoCert.GetCertificate
+		}
+		config.NextProtos = append(config.NextProtos, acmeALPNProto)
+	}
+	if certFile != "" || keyFile != "" {
+		// 文件中的证书可以重新加载，握手时总是通过GetCertificate从certStore中选择
+		cs, err := newCertStore(certFile, keyFile, config.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.certStores = append(s.certStores, cs)
+		s.mu.Unlock()
+		if s.CertReloadInterval > 0 {
+			go s.watchCertificates(cs, s.CertReloadInterval)
+		}
+		config.Certificates = nil
+		userGet := config.GetCertificate
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if userGet != nil {
+				if cert, err := userGet(hello); cert != nil || err != nil {
+					return cert, err
+				}
+			}
+			return cs.getCertificate(hello)
+		}
+		return config, nil
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("httpd: no TLS certificate configured")
+	}
+	if len(config.Certificates) > 1 {
+		config.Certificates = append([]tls.Certificate(nil), config.Certificates...)
+		sni, err := newSNICertificates(config.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		userGet := config.GetCertificate
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if userGet != nil {
+				if cert, err := userGet(hello); cert != nil || err != nil {
+					return cert, err
+				}
+			}
+			return sni.get(hello), nil
+		}
+	}
+	return config, nil
+}
+
+// sniCertificates 以证书中的域名为键索引证书，通配符证书以*.example.com的形式存放
+type sniCertificates struct {
+	names map[string]*tls.Certificate
+}
+
+// newSNICertificates 读取每个证书的SubjectAltName(没有时使用CommonName)建立索引，
+// 多个证书包含同一个域名时，排在前面的优先
+func newSNICertificates(certs []tls.Certificate) (*sniCertificates, error) {
+	m := &sniCertificates{names: make(map[string]*tls.Certificate)}
+	for i := range certs {
+		cert := &certs[i]
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				return nil, errors.New("httpd: empty TLS certificate")
+			}
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, err
+			}
+			cert.Leaf = leaf // 握手时不必再解析
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := m.names[name]; !ok {
+				m.names[name] = cert
+			}
+		}
+	}
+	return m, nil
+}
+
+// get 先精确匹配域名，再匹配通配符(只匹配一级)，都没有时返回nil，由crypto/tls回退到Certificates中的第一个证书
+func (m *sniCertificates) get(hello *tls.ClientHelloInfo) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil
+	}
+	if cert, ok := m.names[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return m.names["*"+name[i:]]
+	}
+	return nil
+}
+
+// RedirectToHTTPSHandler 返回一个把请求重定向到https的Handler，主机名保持请求中的Host，路径与queryString不变。
+// httpsPort为https服务的端口，为空或者为443时重定向的地址中不带端口。
+// GET、HEAD请求回复301，其他方法回复308，要求客户端保持原来的方法以及报文主体
+func RedirectToHTTPSHandler(httpsPort string) Handler {
+	return &httpsRedirectHandler{port: httpsPort}
+}
+
+type httpsRedirectHandler struct {
+	port string
+}
+
+func (h *httpsRedirectHandler) ServeHTTP(w ResponseWriter, r *Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]") // 不带端口的ipv6地址
+	}
+	if host == "" {
+		Error(w, "400 Bad Request: missing Host", StatusBadRequest)
+		return
+	}
+	if h.port != "" && h.port != "443" {
+		host = net.JoinHostPort(host, h.port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	code := StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		code = StatusMovedPermanently
+	}
+	w.Header().Set("Location", "https://"+host+r.URL.RequestURI())
+	w.WriteHeader(code)
+}
+
+// RedirectHTTP 在addr(一般为":80")上监听http，把所有请求重定向到s提供的https服务，https的端口取自s.Addr。
+// 设置了AutoCert时同时回应http-01验证。s关闭时它随之关闭，返回ErrServerClosed
+func (s *Server) RedirectHTTP(addr string) error {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	var h Handler = RedirectToHTTPSHandler(port)
+	if s.AutoCert != nil {
+		h = s.AutoCert.HTTPHandler(h)
+	}
+	rs := &Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ErrorLog:          s.ErrorLog,
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.baseContext().Done():
+			rs.Close()
+		case <-done:
+		}
+	}()
+	return rs.ListenAndServe()
+}
@@ -0,0 +1,198 @@
+package httpd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// tracing.go为分布式追踪提供挂载点：设置了Server.Tracer后，每个请求(http/1.x以及http/2)在交给handler之前调用StartRequest，
+// 响应结束(包括handler发生panic、连接被接管)之后调用EndRequest，追踪系统可以在其中创建、结束span，不需要修改conn.serve。
+//
+// 上游传来的W3C Trace Context(traceparent以及tracestate首部)会先解析出来放入请求的Context，
+// StartRequest通过TraceContextFromContext取得父span，把新的span放入返回的Context中，handler发起下游请求时再通过Inject传递：
+//
+//	func (t *myTracer) StartRequest(ctx context.Context, r *httpd.Request) context.Context {
+//		parent, _ := httpd.TraceContextFromContext(ctx)
+//		return httpd.ContextWithTraceContext(ctx, parent.NewSpan())
+//	}
+
+// Tracer 接收请求开始以及结束的通知，方法可能被多个goroutine同时调用
+type Tracer interface {
+	// StartRequest 在handler运行之前调用，返回的Context替换请求的Context，handler通过r.Context()取得。
+	// 返回的Context必须派生自ctx，否则连接断开、服务器关闭时handler无法收到通知
+	StartRequest(ctx context.Context, r *Request) context.Context
+	// EndRequest 在响应结束之后调用，r.Context()为StartRequest返回的Context
+	EndRequest(r *Request, info RequestInfo)
+}
+
+// RequestInfo 描述一个请求的处理结果
+type RequestInfo struct {
+	// Start 开始处理请求的时间，即读取完请求首部的时间
+	Start time.Time
+	// HandlerDuration handler运行的时间
+	HandlerDuration time.Duration
+	// Duration 从Start到响应全部写出的时间
+	Duration time.Duration
+	// Status 响应的状态码，handler发生panic并且响应还没有发送时为500，连接被接管时为0
+	Status int
+	// Written 写出的报文主体的字节数
+	Written int64
+	// Hijacked 连接是否被handler接管
+	Hijacked bool
+	// Panic handler发生panic时recover得到的值，否则为nil
+	Panic interface{}
+}
+
+// startRequest 在handler运行之前调用，解析请求中的trace context并调用Tracer.StartRequest
+func (s *Server) startRequest(r *Request) {
+	atomic.AddInt64(&s.serverMetrics().inFlight, 1)
+	if s.Tracer == nil {
+		return
+	}
+	ctx := r.ctx
+	if tc, ok := ParseTraceparent(r.Header.Get("Traceparent")); ok {
+		tc.State = r.Header.Get("Tracestate")
+		ctx = ContextWithTraceContext(ctx, tc)
+	}
+	r.ctx = s.Tracer.StartRequest(ctx, r)
+}
+
+// endRequest 在请求处理完毕后记录访问日志、更新指标并通知Tracer
+func (s *Server) endRequest(r *Request, info RequestInfo) {
+	info.Duration = time.Since(info.Start)
+	m := s.serverMetrics()
+	atomic.AddInt64(&m.inFlight, -1)
+	m.observe(r.Method, info.Status, info.Duration)
+	if l := s.accessLogger(); l != nil {
+		l.log(r, info.Status, info.Written, info.Start)
+	}
+	if s.Tracer != nil {
+		s.Tracer.EndRequest(r, info)
+	}
+}
+
+// TraceContext 是W3C Trace Context中traceparent以及tracestate首部携带的内容
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	// Flags 目前只定义了最低位sampled，表示上游记录了这个span
+	Flags byte
+	// State tracestate首部的原始值，由各个追踪系统自行解释，本包只负责原样传递
+	State string
+}
+
+// ParseTraceparent 解析traceparent首部，格式为 version-traceid-spanid-flags，如
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01。格式错误或者id全为0时返回false
+func ParseTraceparent(s string) (TraceContext, bool) {
+	var tc TraceContext
+	// 版本00的长度固定为55，更高的版本可以在后面追加以-分隔的字段
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, false
+	}
+	var version [1]byte
+	if !decodeLowerHex(version[:], s[:2]) || version[0] == 0xff {
+		return tc, false
+	}
+	if version[0] == 0 && len(s) != 55 || len(s) > 55 && s[55] != '-' {
+		return tc, false
+	}
+	var flags [1]byte
+	if !decodeLowerHex(tc.TraceID[:], s[3:35]) || !decodeLowerHex(tc.SpanID[:], s[36:52]) || !decodeLowerHex(flags[:], s[53:55]) {
+		return tc, false
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// decodeLowerHex 把小写的十六进制字符串解码到dst，traceparent中不允许大写
+func decodeLowerHex(dst []byte, s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'F' {
+			return false
+		}
+	}
+	n, err := hex.Decode(dst, []byte(s))
+	return err == nil && n == len(dst)
+}
+
+// IsValid trace id以及span id都不全为0时返回true
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// Sampled 上游是否记录了这个span
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&1 != 0
+}
+
+// String 返回版本00的traceparent首部的值
+func (tc TraceContext) String() string {
+	buf := make([]byte, 0, 55)
+	buf = append(buf, "00-"...)
+	buf = appendHex(buf, tc.TraceID[:])
+	buf = append(buf, '-')
+	buf = appendHex(buf, tc.SpanID[:])
+	buf = append(buf, '-')
+	buf = appendHex(buf, []byte{tc.Flags})
+	return string(buf)
+}
+
+func appendHex(buf, p []byte) []byte {
+	for _, b := range p {
+		buf = append(buf, hexDigits[b>>4], hexDigits[b&0xf])
+	}
+	return buf
+}
+
+// NewSpan 返回同一个trace中的一个新span，span id随机生成；tc无效时同时生成新的trace id并标记为sampled
+func (tc TraceContext) NewSpan() TraceContext {
+	child := tc
+	if !tc.IsValid() {
+		child = TraceContext{Flags: 1}
+		randomID(child.TraceID[:])
+	}
+	randomID(child.SpanID[:])
+	return child
+}
+
+func randomID(p []byte) {
+	for {
+		if _, err := rand.Read(p); err != nil {
+			panic("httpd: reading random id: " + err.Error())
+		}
+		for _, b := range p {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
+
+// Inject 把tc写入h的traceparent以及tracestate首部，用于向下游传递
+func (tc TraceContext) Inject(h Header) {
+	h.Set("Traceparent", tc.String())
+	if tc.State != "" {
+		h.Set("Tracestate", tc.State)
+	} else {
+		h.Del("Tracestate")
+	}
+}
+
+type traceContextKey struct{}
+
+// ContextWithTraceContext 返回携带tc的Context
+func ContextWithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext 取出ctx中的TraceContext，不存在时返回false
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
@@ -0,0 +1,382 @@
+package httpd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// transport.go负责客户端连接的建立与复用。
+// 每个请求都新建tcp连接的话，除了三次握手的1个RTT，https还要再加上tls握手的开销，
+// 因此读取完一个响应之后，如果双方都没有要求关闭连接，就把连接放入空闲池，下一个发往同一主机的请求直接复用它。
+
+// RoundTripper 负责执行一次http事务：发送一个请求，得到对应的响应。Client通过它发送请求
+type RoundTripper interface {
+	RoundTrip(*Request) (*Response, error)
+}
+
+// DefaultMaxIdleConnsPerHost 每个主机默认保留的空闲连接数
+const DefaultMaxIdleConnsPerHost = 2
+
+// DefaultTransport Client没有设置Transport时使用，空闲连接在90秒后关闭
+var DefaultTransport RoundTripper = &Transport{
+	IdleConnTimeout: 90 * time.Second,
+}
+
+// Transport 实现了RoundTripper，缓存发往各个主机的空闲连接。多个goroutine可以并发使用同一个Transport
+type Transport struct {
+	// DialContext 建立tcp连接，为nil时使用net.Dialer
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig 访问https地址时使用的tls配置，为nil时使用默认配置
+	TLSClientConfig *tls.Config
+
+	// DisableKeepAlives 为true时每个请求都使用新的连接，并在响应后关闭
+	DisableKeepAlives bool
+	// MaxIdleConnsPerHost 每个主机最多保留的空闲连接数，为0时使用DefaultMaxIdleConnsPerHost
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout 空闲连接在池中最多停留的时间，为0时不限制
+	IdleConnTimeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]*persistConn // scheme://host:port -> 空闲连接，越靠后的越新
+}
+
+// persistConn 是一个可以复用的客户端连接
+type persistConn struct {
+	t    *Transport
+	key  string
+	conn net.Conn
+	bufr *bufio.Reader
+
+	idleTimer *time.Timer // 空闲超时后将连接移出空闲池并关闭
+}
+
+func (t *Transport) maxIdleConnsPerHost() int {
+	if t.MaxIdleConnsPerHost > 0 {
+		return t.MaxIdleConnsPerHost
+	}
+	return DefaultMaxIdleConnsPerHost
+}
+
+// RoundTrip 发送请求并读取响应的首部，1xx的临时响应会被跳过。
+// 复用的连接可能已经被服务端关闭了，这时对于没有报文主体或者设置了GetBody的请求会换一个新连接重试，
+// 幂等的请求在读到响应之前出错都会重试，其他请求只在发送请求本身失败时重试。
+func (t *Transport) RoundTrip(req *Request) (*Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("httpd: nil Request.URL")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, errors.New("httpd: unsupported protocol scheme " + strconv.Quote(req.URL.Scheme))
+	}
+	if req.URL.Host == "" {
+		return nil, errors.New("httpd: no Host in request URL")
+	}
+	addr := canonicalAddr(req.URL)
+	key := req.URL.Scheme + "://" + addr
+
+	for {
+		pc, reused := t.getIdleConn(key)
+		if pc == nil {
+			var err error
+			if pc, err = t.dialConn(req.Context(), req.URL.Scheme, req.URL.Hostname(), addr, key); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := pc.roundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		if !reused || !canRetry(req, err) {
+			return nil, err
+		}
+		// 之前的Body可能已经被读取了一部分，通过GetBody重新取得
+		if req.GetBody != nil && requestHasBody(req) {
+			body, e := req.GetBody()
+			if e != nil {
+				return nil, err
+			}
+			r2 := *req
+			r2.Body = body
+			req = &r2
+		}
+	}
+}
+
+// canRetry 复用的连接在读到任何响应数据之前出错，通常说明服务端在我们发送请求前就关闭了连接，
+// 只要Body不需要重新读取或者可以通过GetBody重新取得，就可以重试。
+// 但请求完整写出之后才出错时，服务端可能已经处理了请求，只有幂等的请求可以重试
+func canRetry(req *Request, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	e, ok := err.(nothingReadError)
+	if !ok {
+		return false
+	}
+	if e.written && !isIdempotent(req) {
+		return false
+	}
+	return !requestHasBody(req) || req.GetBody != nil
+}
+
+// isIdempotent 报告请求重复发送是否安全，非幂等的方法可以通过Idempotency-Key首部声明请求可以重试
+func isIdempotent(req *Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+// nothingReadError 代表在连接上还没有读到任何响应数据时发生的错误，written为true时请求已经完整写出
+type nothingReadError struct {
+	err     error
+	written bool
+}
+
+func (e nothingReadError) Error() string { return e.err.Error() }
+func (e nothingReadError) Unwrap() error { return e.err }
+
+// canonicalAddr 返回带有端口的主机地址
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func (t *Transport) dialConn(ctx context.Context, scheme, hostname, addr, key string) (*persistConn, error) {
+	dial := t.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "https" {
+		cfg := t.TLSClientConfig.Clone()
+		if cfg == nil {
+			cfg = new(tls.Config)
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = hostname
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return &persistConn{t: t, key: key, conn: conn, bufr: bufio.NewReader(conn)}, nil
+}
+
+// getIdleConn 取出最近放入的一个空闲连接
+func (t *Transport) getIdleConn(key string) (pc *persistConn, reused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		conns := t.idle[key]
+		if len(conns) == 0 {
+			return nil, false
+		}
+		pc = conns[len(conns)-1]
+		t.idle[key] = conns[:len(conns)-1]
+		if pc.idleTimer != nil {
+			pc.idleTimer.Stop()
+		}
+		// 空闲期间服务端发来了数据，这个连接的状态已经不可预测了
+		if pc.bufr.Buffered() > 0 {
+			pc.conn.Close()
+			continue
+		}
+		return pc, true
+	}
+}
+
+// putIdleConn 把连接放回空闲池，池已满或者禁用了长连接时关闭连接
+func (t *Transport) putIdleConn(pc *persistConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.DisableKeepAlives || len(t.idle[pc.key]) >= t.maxIdleConnsPerHost() {
+		pc.conn.Close()
+		return
+	}
+	if t.idle == nil {
+		t.idle = make(map[string][]*persistConn)
+	}
+	t.idle[pc.key] = append(t.idle[pc.key], pc)
+	if t.IdleConnTimeout > 0 {
+		if pc.idleTimer == nil {
+			pc.idleTimer = time.AfterFunc(t.IdleConnTimeout, pc.expire)
+		} else {
+			pc.idleTimer.Reset(t.IdleConnTimeout)
+		}
+	}
+}
+
+// expire 空闲超时，连接如果还在池中就将其移出并关闭
+func (pc *persistConn) expire() {
+	t := pc.t
+	t.mu.Lock()
+	conns := t.idle[pc.key]
+	for i, c := range conns {
+		if c == pc {
+			t.idle[pc.key] = append(conns[:i:i], conns[i+1:]...)
+			t.mu.Unlock()
+			pc.conn.Close()
+			return
+		}
+	}
+	t.mu.Unlock()
+}
+
+// CloseIdleConnections 关闭所有空闲的连接，正在使用的连接不受影响
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.mu.Unlock()
+	for _, conns := range idle {
+		for _, pc := range conns {
+			if pc.idleTimer != nil {
+				pc.idleTimer.Stop()
+			}
+			pc.conn.Close()
+		}
+	}
+}
+
+func (pc *persistConn) roundTrip(req *Request) (*Response, error) {
+	// Context被取消时关闭连接，阻塞中的读写会立即返回
+	ctx := req.Context()
+	stop := make(chan struct{})
+	closed := make(chan bool, 1) // 监视的goroutine退出时写入它是否关闭了连接
+	go func() {
+		select {
+		case <-ctx.Done():
+			pc.conn.Close()
+			closed <- true
+		case <-stop:
+			closed <- false
+		}
+	}()
+	// stopWatch 等待监视的goroutine退出，之后它不会再关闭连接，连接才能放回空闲池。
+	// 取消与请求正常结束同时发生时，它可能已经关闭了连接，返回true
+	stopWatch := func() bool {
+		close(stop)
+		return <-closed
+	}
+	fail := func(err error) (*Response, error) {
+		stopWatch()
+		pc.conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	r2 := *req
+	if pc.t.DisableKeepAlives {
+		r2.Close = true
+	}
+	if err := r2.Write(pc.conn); err != nil {
+		return fail(nothingReadError{err: err})
+	}
+
+	var resp *Response
+	for {
+		// 对端关闭了连接的话，Peek会立即返回错误，此时还没有读到任何响应数据
+		if _, err := pc.bufr.Peek(1); err != nil {
+			return fail(nothingReadError{err: err, written: true})
+		}
+		var err error
+		if resp, err = ReadResponse(pc.bufr, req); err != nil {
+			return fail(err)
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == StatusSwitchingProtocols {
+			break
+		}
+	}
+
+	reusable := !resp.Close && !r2.Close && resp.StatusCode != StatusSwitchingProtocols
+	resp.Body = &bodyEOFSignal{
+		body:   resp.Body,
+		noBody: !resp.bodyAllowed() || resp.ContentLength == 0,
+		fn: func(eof bool) {
+			if canceled := stopWatch(); eof && reusable && !canceled {
+				pc.t.putIdleConn(pc)
+			} else {
+				pc.conn.Close()
+			}
+		},
+	}
+	return resp, nil
+}
+
+// bodyEOFSignal 在报文主体读取完毕或者被关闭时调用fn，eof代表报文主体是否被完整地读取了。
+// 只有完整读取了报文主体的连接才能复用，否则剩余的数据会被当成下一个响应。
+// Close可以与Read并发调用，用于中断阻塞中的读取
+type bodyEOFSignal struct {
+	body   io.ReadCloser
+	noBody bool // 响应没有报文主体，不需要读取就可以复用连接
+	fn     func(eof bool)
+
+	mu     sync.Mutex
+	closed bool
+	done   bool
+}
+
+var errReadOnClosedBody = errors.New("httpd: read on closed response body")
+
+func (b *bodyEOFSignal) Read(p []byte) (n int, err error) {
+	b.mu.Lock()
+	closed, done := b.closed, b.done
+	b.mu.Unlock()
+	if closed {
+		return 0, errReadOnClosedBody
+	}
+	if done {
+		return 0, io.EOF
+	}
+	n, err = b.body.Read(p)
+	if err != nil {
+		b.finish(err == io.EOF)
+	}
+	return
+}
+
+func (b *bodyEOFSignal) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.finish(b.noBody)
+	return b.body.Close()
+}
+
+// finish 保证fn只被调用一次
+func (b *bodyEOFSignal) finish(eof bool) {
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return
+	}
+	b.done = true
+	b.mu.Unlock()
+	b.fn(eof)
+}
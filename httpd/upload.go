@@ -0,0 +1,90 @@
+package httpd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ParseMultipartForm会把整个表单读完，较大的文件先写入临时文件；需要处理很大的上传(如视频)时，
+// 可以直接通过MultipartReader逐个读取part，把文件流式地写到最终的位置，内存中始终只有一小块缓存：
+//
+//	mr, err := r.MultipartReader()
+//	for {
+//		p, err := mr.NextPart()
+//		if err == io.EOF {
+//			break
+//		}
+//		if p.FileName() == "" {
+//			continue
+//		}
+//		_, err = p.SaveTo(filepath.Join(dir, id), httpd.SaveOptions{MaxBytes: 1 << 30, Progress: report})
+//	}
+
+// SaveOptions 控制Part.CopyTo以及Part.SaveTo的行为
+type SaveOptions struct {
+	// MaxBytes 文件的最大字节数，超出时返回MultipartLimitError，不大于0时不限制
+	MaxBytes int64
+	// Progress 不为nil时，每写出一块数据后以目前为止写出的总字节数调用
+	Progress func(written int64)
+}
+
+// uploadBufSize 复制part时每次读取的大小
+const uploadBufSize = 32 << 10
+
+// CopyTo 把part的报文主体写入w，返回写出的字节数。超出opts.MaxBytes时已经写出的数据不会被撤回
+func (p *Part) CopyTo(w io.Writer, opts SaveOptions) (written int64, err error) {
+	buf := make([]byte, uploadBufSize)
+	for {
+		n, rerr := p.Read(buf)
+		if n > 0 {
+			if opts.MaxBytes > 0 && written+int64(n) > opts.MaxBytes {
+				return written, &MultipartLimitError{Limit: "file size", Max: opts.MaxBytes}
+			}
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+			if opts.Progress != nil {
+				opts.Progress(written)
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// SaveTo 把part的报文主体保存到path，文件的权限为0644。数据先写入同一目录下的临时文件，全部写完之后才重命名为path，
+// 出错(包括超出opts.MaxBytes)时删除临时文件，path上不会留下不完整的文件，原有的文件也不受影响
+func (p *Part) SaveTo(path string, opts SaveOptions) (written int64, err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".upload-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if written, err = p.CopyTo(f, opts); err != nil {
+		return written, err
+	}
+	if err = f.Close(); err != nil {
+		return written, err
+	}
+	// TempFile创建的文件只有所有者可以读写，改为一般文件的0644
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return written, err
+	}
+	return written, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,561 @@
+// websocket 在httpd的Hijacker之上实现了RFC 6455中规定的WebSocket协议。
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpd/httpd"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// WebSocket的握手借助http的Upgrade机制完成，客户端发送的请求报文如下：
+/*
+	GET /chat HTTP/1.1\r\n
+	Host: server.example.com\r\n
+	Upgrade: websocket\r\n
+	Connection: Upgrade\r\n
+	Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n
+	Sec-WebSocket-Version: 13\r\n
+	\r\n
+*/
+// 服务端同意升级时回复101状态码，其中Sec-WebSocket-Accept由Sec-WebSocket-Key拼接上一个固定的GUID后，
+// 计算sha1摘要再进行base64编码得到：
+/*
+	HTTP/1.1 101 Switching Protocols\r\n
+	Upgrade: websocket\r\n
+	Connection: Upgrade\r\n
+	Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n
+	\r\n
+*/
+// 此后这个tcp连接上传输的就不再是http报文，而是WebSocket的数据帧。
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 消息类型，与数据帧的opcode一致
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+
+	continuationFrame = 0
+)
+
+// 关闭帧中携带的状态码
+const (
+	CloseNormalClosure    = 1000
+	CloseGoingAway        = 1001
+	CloseProtocolError    = 1002
+	CloseUnsupportedData  = 1003
+	CloseNoStatusReceived = 1005
+	CloseInvalidPayload   = 1007
+	CloseMessageTooBig    = 1009
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrReadLimit    = errors.New("websocket: read limit exceeded")
+	ErrCloseSent    = errors.New("websocket: close sent")
+)
+
+// CloseError 对端发送了关闭帧时，ReadMessage返回此错误
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+// Upgrader 负责将一个http请求升级为WebSocket连接
+type Upgrader struct {
+	// CheckOrigin 用于校验请求的Origin，防止跨站的WebSocket劫持，为nil时要求Origin与Host一致
+	CheckOrigin func(r *httpd.Request) bool
+	// Subprotocols 服务端支持的子协议，按优先级排列
+	Subprotocols []string
+}
+
+// Upgrade 完成WebSocket握手并接管底层连接，握手失败时会回复对应的错误响应。
+// responseHeader中的首部会被加入到101响应中。
+func (u *Upgrader) Upgrade(w httpd.ResponseWriter, r *httpd.Request, responseHeader httpd.Header) (*Conn, error) {
+	if r.Method != "GET" {
+		return u.fail(w, httpd.StatusMethodNotAllowed, "request method is not GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return u.fail(w, httpd.StatusBadRequest, "'upgrade' token not found in 'Connection' header")
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return u.fail(w, httpd.StatusBadRequest, "'websocket' token not found in 'Upgrade' header")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return u.fail(w, httpd.StatusBadRequest, "unsupported version")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return u.fail(w, httpd.StatusForbidden, "origin not allowed")
+	}
+	key := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
+	if key == "" {
+		return u.fail(w, httpd.StatusBadRequest, "'Sec-WebSocket-Key' header is missing")
+	}
+
+	h, ok := w.(httpd.Hijacker)
+	if !ok {
+		return u.fail(w, httpd.StatusInternalServerError, "response does not implement httpd.Hijacker")
+	}
+	netConn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// 握手完成之前，客户端不应该发送任何数据帧
+	if brw.Reader.Buffered() > 0 {
+		netConn.Close()
+		return nil, ErrBadHandshake
+	}
+
+	subprotocol := u.selectSubprotocol(r)
+	bufw := brw.Writer
+	bufw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	bufw.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(key) + "\r\n")
+	if subprotocol != "" {
+		bufw.WriteString("Sec-WebSocket-Protocol: " + subprotocol + "\r\n")
+	}
+	for k, vs := range responseHeader {
+		if strings.EqualFold(k, "Sec-WebSocket-Extensions") {
+			continue // 不支持任何扩展
+		}
+		for _, v := range vs {
+			bufw.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	bufw.WriteString("\r\n")
+	if err = bufw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	c := newConn(netConn, brw.Reader, bufw, true, subprotocol)
+	c.notifier, _ = w.(httpd.ReadNotifier)
+	return c, nil
+}
+
+func (u *Upgrader) fail(w httpd.ResponseWriter, code int, reason string) (*Conn, error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, httpd.StatusText(code))
+	return nil, fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+func (u *Upgrader) selectSubprotocol(r *httpd.Request) string {
+	for _, want := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		want = strings.TrimSpace(want)
+		for _, p := range u.Subprotocols {
+			if p == want {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// IsWebSocketUpgrade 判断请求是否希望升级为WebSocket
+func IsWebSocketUpgrade(r *httpd.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(h httpd.Header, key, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameOrigin(r *httpd.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // 非浏览器客户端通常不携带Origin
+	}
+	if i := strings.Index(origin, "://"); i != -1 {
+		origin = origin[i+3:]
+	}
+	return strings.EqualFold(origin, r.Header.Get("Host"))
+}
+
+// 数据帧的格式：
+/*
+	 0                   1                   2                   3
+	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	+-+-+-+-+-------+-+-------------+-------------------------------+
+	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+	| |1|2|3|       |K|             |                               |
+	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+	|     Extended payload length continued, if payload len == 127  |
+	+ - - - - - - - - - - - - - - - +-------------------------------+
+	|                               |Masking-key, if MASK set to 1  |
+	+-------------------------------+-------------------------------+
+	| Masking-key (continued)       |          Payload Data         |
+	+-------------------------------- - - - - - - - - - - - - - - - +
+*/
+// 客户端发往服务端的帧必须经过掩码处理，服务端发往客户端的帧则不能使用掩码。
+
+const (
+	finBit  = 1 << 7
+	rsvBits = 0x70
+	maskBit = 1 << 7
+
+	maxControlPayload = 125
+	defaultReadLimit  = 32 << 20
+)
+
+// Conn 代表一个WebSocket连接。
+// ReadMessage只能在一个goroutine中调用，WriteMessage可以在多个goroutine中并发调用。
+type Conn struct {
+	conn     net.Conn
+	bufr     *bufio.Reader
+	isServer bool
+
+	subprotocol string
+	readLimit   int64
+
+	wmu       sync.Mutex // 保护bufw以及closeSent
+	bufw      *bufio.Writer
+	closeSent bool
+
+	pingHandler func(data string) error
+	pongHandler func(data string) error
+
+	notifier httpd.ReadNotifier // 服务端连接的ResponseWriter实现了它时不为nil，见WaitReadable
+}
+
+func newConn(conn net.Conn, bufr *bufio.Reader, bufw *bufio.Writer, isServer bool, subprotocol string) *Conn {
+	c := &Conn{
+		conn:        conn,
+		bufr:        bufr,
+		bufw:        bufw,
+		isServer:    isServer,
+		subprotocol: subprotocol,
+		readLimit:   defaultReadLimit,
+	}
+	c.pingHandler = func(data string) error {
+		err := c.WriteMessage(PongMessage, []byte(data))
+		if err == ErrCloseSent {
+			return nil
+		}
+		return err
+	}
+	c.pongHandler = func(string) error { return nil }
+	return c
+}
+
+// Subprotocol 返回握手时协商出的子协议
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// NetConn 返回底层的tcp连接，可用于设置超时
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// WaitReadable 对端发来数据时在新的goroutine中调用fn一次，等待期间连接由服务器的IdlePoller托管，不占用goroutine。
+// fn中通常调用一次ReadMessage，处理完之后再次调用WaitReadable。
+// 服务器没有开启IdlePoller或者连接不支持托管时返回httpd.ErrNotSupported，调用方应当退回到循环调用ReadMessage
+func (c *Conn) WaitReadable(fn func()) error {
+	if c.notifier == nil {
+		return httpd.ErrNotSupported
+	}
+	// 已经缓存的数据不会再触发可读事件
+	if c.bufr.Buffered() > 0 {
+		go fn()
+		return nil
+	}
+	return c.notifier.NotifyReadable(fn)
+}
+
+// SetReadLimit 设置单条消息的最大字节数，超过限制时ReadMessage返回ErrReadLimit并关闭连接
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetPingHandler 设置收到ping帧时的回调，默认回复一个携带相同数据的pong帧
+func (c *Conn) SetPingHandler(h func(data string) error) {
+	if h == nil {
+		h = func(data string) error { return c.WriteMessage(PongMessage, []byte(data)) }
+	}
+	c.pingHandler = h
+}
+
+// SetPongHandler 设置收到pong帧时的回调，默认什么也不做
+func (c *Conn) SetPongHandler(h func(data string) error) {
+	if h == nil {
+		h = func(string) error { return nil }
+	}
+	c.pongHandler = h
+}
+
+type frameHeader struct {
+	fin    bool
+	opcode int
+	length int64
+	masked bool
+	mask   [4]byte
+}
+
+func (c *Conn) readFrameHeader() (fh frameHeader, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(c.bufr, b[:2]); err != nil {
+		return
+	}
+	if b[0]&rsvBits != 0 {
+		return fh, c.protocolError("reserved bits set")
+	}
+	fh.fin = b[0]&finBit != 0
+	fh.opcode = int(b[0] & 0x0f)
+	fh.masked = b[1]&maskBit != 0
+	fh.length = int64(b[1] & 0x7f)
+
+	switch fh.length {
+	case 126:
+		if _, err = io.ReadFull(c.bufr, b[:2]); err != nil {
+			return
+		}
+		fh.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.bufr, b[:8]); err != nil {
+			return
+		}
+		fh.length = int64(binary.BigEndian.Uint64(b[:8]))
+		if fh.length < 0 {
+			return fh, c.protocolError("invalid payload length")
+		}
+	}
+
+	if fh.masked != c.isServer {
+		return fh, c.protocolError("incorrect mask flag")
+	}
+	if fh.masked {
+		if _, err = io.ReadFull(c.bufr, fh.mask[:]); err != nil {
+			return
+		}
+	}
+
+	switch fh.opcode {
+	case CloseMessage, PingMessage, PongMessage:
+		if fh.length > maxControlPayload {
+			return fh, c.protocolError("control frame length > 125")
+		}
+		if !fh.fin {
+			return fh, c.protocolError("control frame not final")
+		}
+	case continuationFrame, TextMessage, BinaryMessage:
+	default:
+		return fh, c.protocolError(fmt.Sprintf("unknown opcode %d", fh.opcode))
+	}
+	return
+}
+
+func (c *Conn) readPayload(fh frameHeader) ([]byte, error) {
+	p := make([]byte, fh.length)
+	if _, err := io.ReadFull(c.bufr, p); err != nil {
+		return nil, err
+	}
+	if fh.masked {
+		maskBytes(fh.mask, p)
+	}
+	return p, nil
+}
+
+// ReadMessage 读取下一条完整的消息，分片的消息会被拼接起来。
+// 期间收到的控制帧会被自动处理：ping帧交给pingHandler，pong帧交给pongHandler，
+// 收到关闭帧时回复关闭帧，并返回*CloseError。
+func (c *Conn) ReadMessage() (messageType int, p []byte, err error) {
+	var msg []byte
+	messageType = -1
+	for {
+		var fh frameHeader
+		if fh, err = c.readFrameHeader(); err != nil {
+			return -1, nil, err
+		}
+
+		if fh.opcode == continuationFrame || fh.opcode == TextMessage || fh.opcode == BinaryMessage {
+			if fh.opcode == continuationFrame && messageType == -1 {
+				return -1, nil, c.protocolError("continuation after final frame")
+			}
+			if fh.opcode != continuationFrame && messageType != -1 {
+				return -1, nil, c.protocolError("message start before final frame")
+			}
+			if int64(len(msg))+fh.length > c.readLimit {
+				c.writeClose(CloseMessageTooBig, "")
+				return -1, nil, ErrReadLimit
+			}
+		}
+
+		var payload []byte
+		if payload, err = c.readPayload(fh); err != nil {
+			return -1, nil, err
+		}
+
+		switch fh.opcode {
+		case PingMessage:
+			if err = c.pingHandler(string(payload)); err != nil {
+				return -1, nil, err
+			}
+			continue
+		case PongMessage:
+			if err = c.pongHandler(string(payload)); err != nil {
+				return -1, nil, err
+			}
+			continue
+		case CloseMessage:
+			return -1, nil, c.handleClose(payload)
+		case TextMessage, BinaryMessage:
+			messageType = fh.opcode
+		}
+
+		msg = append(msg, payload...)
+		if fh.fin {
+			if messageType == TextMessage && !utf8.Valid(msg) {
+				c.writeClose(CloseInvalidPayload, "")
+				return -1, nil, errors.New("websocket: invalid utf8 payload in text message")
+			}
+			return messageType, msg, nil
+		}
+	}
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	switch {
+	case len(payload) == 1:
+		return c.protocolError("invalid close frame")
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !utf8.ValidString(closeErr.Text) {
+			return c.protocolError("invalid utf8 payload in close frame")
+		}
+	}
+	// 回复一个关闭帧完成关闭握手
+	code := closeErr.Code
+	if code == CloseNoStatusReceived {
+		code = CloseNormalClosure
+	}
+	c.writeClose(code, "")
+	return closeErr
+}
+
+func (c *Conn) protocolError(msg string) error {
+	c.writeClose(CloseProtocolError, msg)
+	return errors.New("websocket: " + msg)
+}
+
+func (c *Conn) writeClose(code int, text string) error {
+	p := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	copy(p[2:], text)
+	return c.WriteMessage(CloseMessage, p)
+}
+
+// WriteMessage 发送一条消息，消息不会被分片
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage:
+	case CloseMessage, PingMessage, PongMessage:
+		if len(data) > maxControlPayload {
+			return errors.New("websocket: invalid control frame")
+		}
+	default:
+		return errors.New("websocket: unknown message type")
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+
+	var header [14]byte
+	header[0] = finBit | byte(messageType)
+	n := 2
+	length := len(data)
+	switch {
+	case length <= 125:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+		n += 8
+	}
+
+	payload := data
+	if !c.isServer {
+		// 客户端发送的帧需要使用随机掩码
+		var mask [4]byte
+		if _, err := io.ReadFull(randReader, mask[:]); err != nil {
+			return err
+		}
+		header[1] |= maskBit
+		copy(header[n:], mask[:])
+		n += 4
+		payload = make([]byte, length)
+		copy(payload, data)
+		maskBytes(mask, payload)
+	}
+
+	if _, err := c.bufw.Write(header[:n]); err != nil {
+		return err
+	}
+	if _, err := c.bufw.Write(payload); err != nil {
+		return err
+	}
+	return c.bufw.Flush()
+}
+
+// Close 发送关闭帧并关闭底层连接
+func (c *Conn) Close() error {
+	c.writeClose(CloseNormalClosure, "")
+	return c.conn.Close()
+}
+
+var randReader = rand.Reader
+
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i&3]
+	}
+}
@@ -0,0 +1,117 @@
+package httpd
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// xml.go是json.go的xml版本，用于对接仍然使用xml的系统。
+// encoding/xml只能处理utf-8，这里额外支持us-ascii以及iso-8859-1(latin1)编码的报文主体，其他编码返回错误。
+
+// XML 把v编码为xml后以状态码code回复，报文开头带有xml声明，Content-Type为application/xml; charset=utf-8。
+// 编码失败时回复500并返回错误
+func XML(w ResponseWriter, code int, v interface{}) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		Error(w, "500 internal server error", StatusInternalServerError)
+		return err
+	}
+	buf := make([]byte, 0, len(xml.Header)+len(body)+1)
+	buf = append(buf, xml.Header...)
+	buf = append(buf, body...)
+	buf = append(buf, '\n')
+	h := w.Header()
+	if _, ok := h["Content-Type"]; !ok {
+		h.Set("Content-Type", "application/xml; charset=utf-8")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(code)
+	_, err = w.Write(buf)
+	return err
+}
+
+// DecodeXML 把xml格式的报文主体解码到v中，报文主体最多DefaultMaxDecodeBytes字节。
+// 字符集优先取自Content-Type中的charset参数，其次是xml声明中的encoding。
+// Content-Type不是xml时返回ErrUnsupportedMediaType，超过大小限制时返回ErrBodyTooLarge
+func (r *Request) DecodeXML(v interface{}) error {
+	return r.DecodeXMLWith(v, DecodeOptions{})
+}
+
+// DecodeXMLWith 与DecodeXML相同，只是由opts指定大小限制，xml不支持DisallowUnknownFields，会被忽略
+func (r *Request) DecodeXMLWith(v interface{}, opts DecodeOptions) error {
+	if ct, _ := r.parseContentType(); ct != "" && !isXMLContentType(ct) {
+		return ErrUnsupportedMediaType
+	}
+	if r.Body == nil {
+		return errors.New("httpd: empty request body")
+	}
+	var body io.Reader = &maxBytesReader{r: r.Body, n: opts.maxBytes()}
+	charsetReader := xmlCharsetReader
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && params["charset"] != "" {
+		if body, err = xmlCharsetReader(params["charset"], body); err != nil {
+			return err
+		}
+		// 报文主体已经转换为utf-8，忽略xml声明中的encoding
+		charsetReader = func(_ string, input io.Reader) (io.Reader, error) { return input, nil }
+	}
+	dec := xml.NewDecoder(body)
+	dec.CharsetReader = charsetReader
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			return errors.New("httpd: empty request body")
+		}
+		return err
+	}
+	return nil
+}
+
+// isXMLContentType application/xml、text/xml以及形如application/soap+xml的类型都视为xml
+func isXMLContentType(ct string) bool {
+	ct = strings.ToLower(ct)
+	return ct == "application/xml" || ct == "text/xml" || strings.HasPrefix(ct, "application/") && strings.HasSuffix(ct, "+xml")
+}
+
+// xmlCharsetReader 把charset编码的input转换为utf-8
+func xmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		// ascii是utf-8的子集
+		return input, nil
+	case "iso-8859-1", "latin1", "iso_8859-1", "l1":
+		return &latin1Reader{r: bufio.NewReader(input)}, nil
+	}
+	return nil, errors.New("httpd: unsupported charset " + strconv.Quote(charset))
+}
+
+// latin1Reader 把iso-8859-1编码转换为utf-8，latin1的每个字节就是对应的unicode码点
+type latin1Reader struct {
+	r *bufio.Reader
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n+utf8.UTFMax <= len(p) {
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		n += utf8.EncodeRune(p[n:], rune(b))
+		if l.r.Buffered() == 0 {
+			// 不为了填满p而阻塞
+			break
+		}
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.ErrShortBuffer
+	}
+	return n, nil
+}
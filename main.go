@@ -27,10 +27,9 @@ func (*MyHandler) ServeHTTP(w httpd.ResponseWriter, r *httpd.Request) {
 	fmt.Fprintf(buff, "[Addr]Addr=%s\n", r.RemoteAddr)
 	fmt.Fprintf(buff, "[Request]%+v\n", r)
 
-	//手动发送响应报文
-	io.WriteString(w, "HTTP/1.1 200 OK\r\n")
-	io.WriteString(w, fmt.Sprintf("Content-Length: %d\r\n", buff.Len()))
-	io.WriteString(w, "\r\n")
+	// 状态行以及首部由框架负责发送
+	httpd.SetCookie(w, &httpd.Cookie{Name: "foo1", Value: "bar", HttpOnly: true})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	io.Copy(w, buff) //将buff缓存数据发送给客户端
 }
 
@@ -43,9 +42,6 @@ func (*EchoHandler) ServeHTTP(w httpd.ResponseWriter, r *httpd.Request) {
 	}
 
 	const prefix = "you message:"
-	io.WriteString(w, "HTTP/1.1 200 OK\r\n")
-	io.WriteString(w, fmt.Sprintf("Content-Length: %d\r\n", len(buf)+len(prefix)))
-	io.WriteString(w, "\r\n")
 	io.WriteString(w, prefix)
 	w.Write(buf)
 }
@@ -92,10 +88,7 @@ label:
 		fmt.Println(err)
 	}
 	// 发送响应报文
-	io.WriteString(w, "HTTP/1.1 200 OK\r\n")
-	io.WriteString(w, fmt.Sprintf("Content-Length: %d\r\n", 0))
-	io.WriteString(w, "\r\n")
-
+	w.WriteHeader(httpd.StatusOK)
 }
 
 func main() {